@@ -0,0 +1,660 @@
+package crawlspace
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+// handshakeTimeout limits TLS handshakes on listeners that authenticate
+// clients.
+const handshakeTimeout = 10 * time.Second
+
+// Config is a declarative configuration of a Crawlspace, so that operators
+// can manage its settings without code changes. It is usually read with
+// LoadConfig and applied with ServeConfig.
+//
+// A config looks like:
+//
+//	{
+//	  "banner": "production: be careful",
+//	  "startup": ["import \"os\""],
+//	  "limits": {"max_elements": 100, "slow_command": "1s", "safe_mode": 3},
+//	  "profiles": {
+//	    "viewer": {"read_only": true},
+//	    "admin": {"startup": ["db := app.DB()"]}
+//	  },
+//	  "auth": {"users": {"alice": {"profile": "admin"}, "bob": {}}},
+//	  "listeners": [
+//	    {"network": "unix", "address": "/run/app/crawlspace.sock", "profile": "admin"},
+//	    {"name": "ops", "address": "10.0.0.1:7070", "profile": "viewer",
+//	     "authenticate": true,
+//	     "tls": {"cert_file": "server.pem", "key_file": "server.key",
+//	             "client_ca_file": "ops-ca.pem"}}
+//	  ]
+//	}
+type Config struct {
+	// Banner is shown at the start of every session, after the versions.
+	Banner string `json:"banner,omitempty"`
+	// Startup are commands evaluated at the start of every session, after
+	// Crawlspace.Startup.
+	Startup []string `json:"startup,omitempty"`
+	// Limits are the Crawlspace's limits.
+	Limits LimitsConfig `json:"limits"`
+	// Profiles are the session policies that listeners and users refer to
+	// by name.
+	Profiles map[string]Profile `json:"profiles,omitempty"`
+	// Auth is who may connect to listeners that authenticate clients.
+	Auth AuthConfig `json:"auth"`
+	// Listeners are where sessions are served.
+	Listeners []ListenerConfig `json:"listeners"`
+}
+
+// LimitsConfig are the limits of a Config. Each field takes precedence over
+// the Crawlspace field of the same name, unless it is zero.
+type LimitsConfig struct {
+	MaxElements   int      `json:"max_elements,omitempty"`
+	SpillSize     int      `json:"spill_size,omitempty"`
+	OutputBuffer  int      `json:"output_buffer,omitempty"`
+	SlowCommand   Duration `json:"slow_command,omitempty"`
+	SafeMode      int      `json:"safe_mode,omitempty"`
+	FreezeTimeout Duration `json:"freeze_timeout,omitempty"`
+}
+
+// AuthConfig is who may connect to listeners that authenticate clients.
+type AuthConfig struct {
+	// Users are the users allowed to connect, by the common name of their
+	// client certificates. If empty, anyone with a certificate signed by a
+	// listener's client CA may connect.
+	Users map[string]UserConfig `json:"users,omitempty"`
+}
+
+// UserConfig is the policy for a user.
+type UserConfig struct {
+	// Profile, if set, names the profile of the user's sessions, instead of
+	// the listener's.
+	Profile string `json:"profile,omitempty"`
+}
+
+// ListenerConfig is a listener of a Config.
+type ListenerConfig struct {
+	// Name identifies the listener in logs. If empty, Address is used.
+	Name string `json:"name,omitempty"`
+	// Network is "tcp", "tcp4", "tcp6", or "unix". If empty, "tcp" is
+	// used.
+	Network string `json:"network,omitempty"`
+	// Address is where to listen, such as "127.0.0.1:7070", or a socket
+	// path for unix listeners.
+	Address string `json:"address"`
+	// Telnet enables telnet terminal handling, as with
+	// ListenerOptions.Telnet.
+	Telnet bool `json:"telnet,omitempty"`
+	// Profile, if set, names the profile of sessions from this listener.
+	Profile string `json:"profile,omitempty"`
+	// TLS, if set, serves the listener with TLS.
+	TLS *TLSConfig `json:"tls,omitempty"`
+	// Authenticate requires clients to present a certificate signed by
+	// TLS.ClientCAFile, for one of the users in Auth. The certificate's
+	// common name is the session's user.
+	Authenticate bool `json:"authenticate,omitempty"`
+}
+
+// TLSConfig is the TLS configuration of a listener, as paths to PEM files.
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ClientCAFile is the certificate authorities client certificates are
+	// verified with, for listeners that authenticate clients.
+	ClientCAFile string `json:"client_ca_file,omitempty"`
+}
+
+// Profile is a policy for sessions, such as for a class of users.
+type Profile struct {
+	// ReadOnly makes sessions read-only for good, as if they called
+	// readonly().
+	ReadOnly bool `json:"read_only,omitempty"`
+	// Startup are commands evaluated at the start of sessions, after the
+	// Crawlspace's.
+	Startup []string `json:"startup,omitempty"`
+	// Allow and Deny are patterns of the fields, methods, functions, and
+	// packages sessions may and may not access, such as "*.Shutdown" or
+	// "crypto", as described by reflectlang.Rules.
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	// Pure are patterns of the functions and methods that are free of side
+	// effects, such as "*.String", which read-only sessions may still call.
+	Pure []string `json:"pure,omitempty"`
+}
+
+// policy returns the profile's access policy, or nil if it has none.
+func (p Profile) policy() reflectlang.Policy {
+	if len(p.Allow) == 0 && len(p.Deny) == 0 {
+		return nil
+	}
+	return reflectlang.Rules{Allow: p.Allow, Deny: p.Deny}
+}
+
+// pure returns the policy of the functions the profile marks as pure, or
+// nil if it marks none.
+func (p Profile) pure() reflectlang.Policy {
+	if len(p.Pure) == 0 {
+		return nil
+	}
+	return reflectlang.Rules{Allow: p.Pure}
+}
+
+// Duration is a time.Duration that configs write as a string, such as
+// "1.5s".
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations are strings, such as \"1s\": %s", data)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadConfig reads a Config written as JSON from r and validates it.
+// Unknown fields are errors, so that typos don't go unnoticed.
+func LoadConfig(r io.Reader) (*Config, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var cfg Config
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("crawlspace: invalid config: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate returns an error describing everything wrong with cfg, if
+// anything is.
+func (cfg *Config) Validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	commands := func(where string, startup []string) {
+		for _, command := range startup {
+			if _, err := reflectlang.Parse(command); err != nil {
+				problem("%s: startup command %q: %v", where, command, err)
+			}
+		}
+	}
+	profile := func(where, name string) {
+		if _, ok := cfg.Profiles[name]; name != "" && !ok {
+			problem("%s: unknown profile %q", where, name)
+		}
+	}
+
+	commands("config", cfg.Startup)
+	limits := cfg.Limits
+	if limits.MaxElements < -1 || limits.SpillSize < 0 || limits.OutputBuffer < 0 ||
+		limits.SlowCommand < 0 || limits.SafeMode < 0 || limits.FreezeTimeout < 0 {
+		problem("limits: limits can't be negative, other than a max_elements of -1")
+	}
+	var profiles, users []string
+	for name := range cfg.Profiles {
+		profiles = append(profiles, name)
+	}
+	for name := range cfg.Auth.Users {
+		users = append(users, name)
+	}
+	sort.Strings(profiles)
+	sort.Strings(users)
+	for _, name := range profiles {
+		commands(fmt.Sprintf("profile %q", name), cfg.Profiles[name].Startup)
+	}
+	for _, name := range users {
+		profile(fmt.Sprintf("user %q", name), cfg.Auth.Users[name].Profile)
+	}
+
+	names := map[string]bool{}
+	for i, lc := range cfg.Listeners {
+		where := fmt.Sprintf("listener %d", i)
+		if lc.Address == "" {
+			problem("%s: missing address", where)
+		} else {
+			where = fmt.Sprintf("listener %q", lc.name())
+			if names[lc.name()] {
+				problem("%s: duplicate listener", where)
+			}
+			names[lc.name()] = true
+		}
+		switch lc.Network {
+		case "", "tcp", "tcp4", "tcp6", "unix":
+		default:
+			problem("%s: unsupported network %q", where, lc.Network)
+		}
+		profile(where, lc.Profile)
+		switch {
+		case lc.TLS != nil && (lc.TLS.CertFile == "" || lc.TLS.KeyFile == ""):
+			problem("%s: tls needs a cert_file and a key_file", where)
+		case lc.Authenticate && lc.TLS == nil:
+			problem("%s: authenticate needs tls", where)
+		case lc.Authenticate && lc.TLS.ClientCAFile == "":
+			problem("%s: authenticate needs a tls client_ca_file", where)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("crawlspace: invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (lc ListenerConfig) name() string {
+	if lc.Name != "" {
+		return lc.Name
+	}
+	return lc.Address
+}
+
+// ServeConfig applies cfg to the crawlspace and serves its listeners,
+// until they all stop, such as when Shutdown is called. Invalid configs,
+// and listeners that fail to start, such as for a port in use or a missing
+// certificate, are reported before any listener is served. Like ServeWith,
+// ServeConfig returns ErrClosed after Shutdown.
+//
+// The config's settings take precedence over the crawlspace's fields, where
+// set. Reload applies a new config while ServeConfig is running.
+func (m *Crawlspace) ServeConfig(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if len(cfg.Listeners) == 0 {
+		return errors.New("crawlspace: config has no listeners")
+	}
+	m.reloadMtx.Lock()
+	m.mtx.Lock()
+	if m.served != nil {
+		m.mtx.Unlock()
+		m.reloadMtx.Unlock()
+		return errors.New("crawlspace: already serving a config")
+	}
+	m.mtx.Unlock()
+
+	listeners := make([]net.Listener, 0, len(cfg.Listeners))
+	for _, lc := range cfg.Listeners {
+		l, err := lc.listen()
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			m.reloadMtx.Unlock()
+			return fmt.Errorf("crawlspace: listener %q: %w", lc.name(), err)
+		}
+		listeners = append(listeners, l)
+	}
+	m.mtx.Lock()
+	m.config = cfg
+	m.served = map[string]*servedListener{}
+	m.mtx.Unlock()
+	for i, l := range listeners {
+		m.serveConfigListener(cfg.Listeners[i], l)
+	}
+	m.reloadMtx.Unlock()
+
+	m.serving.Wait()
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	err := m.serveErr
+	m.served, m.serveErr = nil, nil
+	if err == nil {
+		err = ErrClosed
+	}
+	return err
+}
+
+// servedListener is a listener served by ServeConfig.
+type servedListener struct {
+	config   ListenerConfig
+	listener net.Listener
+}
+
+// serveConfigListener serves l, which lc describes, in the background for
+// ServeConfig. The first error, other than ErrClosed, is kept for
+// ServeConfig to return.
+func (m *Crawlspace) serveConfigListener(lc ListenerConfig, l net.Listener) {
+	m.mtx.Lock()
+	m.served[lc.name()] = &servedListener{config: lc, listener: l}
+	m.mtx.Unlock()
+	m.serving.Add(1)
+	go func() {
+		defer m.serving.Done()
+		err := m.ServeWith(l, m.listenerOptions(lc))
+		m.mtx.Lock()
+		defer m.mtx.Unlock()
+		if served := m.served[lc.name()]; served != nil && served.listener == l {
+			delete(m.served, lc.name())
+		}
+		if !errors.Is(err, ErrClosed) && m.serveErr == nil {
+			m.serveErr = err
+		}
+	}()
+}
+
+// Reload applies cfg to a crawlspace running ServeConfig, without dropping
+// sessions, unless their policy was revoked. New settings apply to commands
+// run from then on. Listeners are matched by name: new ones are started,
+// removed ones are stopped, and changed ones are restarted. Sessions from
+// stopped listeners continue. Sessions of users no longer in Auth.Users of
+// listeners that authenticate clients are ended, and sessions whose profile
+// became read-only are made read-only.
+//
+// If cfg is invalid, or a new listener fails to start, nothing is changed.
+// Errors restarting changed listeners are returned after everything else is
+// applied.
+func (m *Crawlspace) Reload(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	m.reloadMtx.Lock()
+	defer m.reloadMtx.Unlock()
+	m.mtx.Lock()
+	served := make(map[string]*servedListener, len(m.served))
+	for name, l := range m.served {
+		served[name] = l
+	}
+	running := m.served != nil
+	m.mtx.Unlock()
+	if !running {
+		return errors.New("crawlspace: Reload needs ServeConfig to be running")
+	}
+	// keep ServeConfig running while listeners are replaced.
+	m.serving.Add(1)
+	defer m.serving.Done()
+
+	var added []net.Listener
+	var addedConfigs, changed []ListenerConfig
+	wanted := map[string]bool{}
+	for _, lc := range cfg.Listeners {
+		wanted[lc.name()] = true
+		old, ok := served[lc.name()]
+		switch {
+		case !ok:
+			l, err := lc.listen()
+			if err != nil {
+				for _, l := range added {
+					_ = l.Close()
+				}
+				return fmt.Errorf("crawlspace: listener %q: %w", lc.name(), err)
+			}
+			added = append(added, l)
+			addedConfigs = append(addedConfigs, lc)
+		case !reflect.DeepEqual(old.config, lc):
+			changed = append(changed, lc)
+		}
+	}
+
+	m.mtx.Lock()
+	m.config = cfg
+	m.mtx.Unlock()
+	for i, l := range added {
+		m.serveConfigListener(addedConfigs[i], l)
+	}
+	for name, old := range served {
+		if !wanted[name] {
+			m.stopListener(old.listener)
+		}
+	}
+	var problems []string
+	for _, lc := range changed {
+		m.stopListener(served[lc.name()].listener)
+		l, err := lc.listen()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("listener %q: %v", lc.name(), err))
+			continue
+		}
+		m.serveConfigListener(lc, l)
+	}
+	m.applyPolicies(cfg)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("crawlspace: reloading: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// applyPolicies ends the sessions cfg revokes, and makes read-only the
+// sessions whose profile became read-only.
+func (m *Crawlspace) applyPolicies(cfg *Config) {
+	listeners := map[string]ListenerConfig{}
+	for _, lc := range cfg.Listeners {
+		listeners[lc.name()] = lc
+	}
+	m.mtx.Lock()
+	sessions := make([]*Session, 0, len(m.live))
+	for s := range m.live {
+		sessions = append(sessions, s)
+	}
+	m.mtx.Unlock()
+
+	for _, s := range sessions {
+		lc, ok := listeners[s.listener]
+		if !ok || s.listener == "" {
+			continue
+		}
+		if _, allowed := cfg.Auth.Users[s.user]; lc.Authenticate && len(cfg.Auth.Users) > 0 && !allowed {
+			s.revoke(m.messages().Revoked)
+			continue
+		}
+		profile := m.listenerOptions(lc).Profile(s.user)
+		s.mtx.Lock()
+		if profile.ReadOnly {
+			s.pinnedReadOnly = true
+			reflectlang.SetReadOnly(s.env, true)
+		}
+		reflectlang.SetPolicy(s.env, profile.policy())
+		reflectlang.SetPure(s.env, profile.pure())
+		s.mtx.Unlock()
+	}
+}
+
+// listen starts the listener lc describes.
+func (lc ListenerConfig) listen() (net.Listener, error) {
+	var tlsConfig *tls.Config
+	if lc.TLS != nil {
+		cert, err := tls.LoadX509KeyPair(lc.TLS.CertFile, lc.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		if lc.Authenticate {
+			pem, err := os.ReadFile(lc.TLS.ClientCAFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in %s", lc.TLS.ClientCAFile)
+			}
+			tlsConfig.ClientCAs = pool
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	network := lc.Network
+	if network == "" {
+		network = "tcp"
+	}
+	l, err := net.Listen(network, lc.Address)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	return l, nil
+}
+
+// listenerOptions returns how to serve lc. Users and profiles are looked up
+// in the crawlspace's config as each connection is accepted.
+func (m *Crawlspace) listenerOptions(lc ListenerConfig) ListenerOptions {
+	opts := ListenerOptions{
+		Name:     lc.name(),
+		Telnet:   lc.Telnet,
+		listener: lc.name(),
+		Profile: func(user string) Profile {
+			cfg := m.currentConfig()
+			name := lc.Profile
+			if u, ok := cfg.Auth.Users[user]; ok && user != "" && u.Profile != "" {
+				name = u.Profile
+			}
+			return cfg.Profiles[name]
+		},
+	}
+	if lc.Authenticate {
+		opts.Authenticate = func(conn net.Conn) error {
+			user, err := clientCertUser(conn)
+			if err != nil {
+				return err
+			}
+			if users := m.currentConfig().Auth.Users; len(users) > 0 {
+				if _, ok := users[user]; !ok {
+					return fmt.Errorf("unknown user %q", user)
+				}
+			}
+			return nil
+		}
+		opts.User = func(conn net.Conn) string {
+			user, _ := clientCertUser(conn)
+			return user
+		}
+	}
+	return opts
+}
+
+// clientCertUser completes the TLS handshake on conn, if needed, and returns
+// the common name of the client's certificate.
+func clientCertUser(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", errors.New("authentication needs a TLS connection")
+	}
+	if err := tlsConn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return "", err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	if err := tlsConn.SetDeadline(time.Time{}); err != nil {
+		return "", err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", errors.New("no client certificate")
+	}
+	return certs[0].Subject.CommonName, nil
+}
+
+// currentConfig returns the config the crawlspace was served with, or an
+// empty one.
+func (m *Crawlspace) currentConfig() *Config {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.config == nil {
+		return &Config{}
+	}
+	return m.config
+}
+
+// limits returns the crawlspace's limits: those of its config, where set,
+// and otherwise its own fields.
+func (m *Crawlspace) limits() LimitsConfig {
+	limits := m.currentConfig().Limits
+	for _, limit := range []struct {
+		value *int
+		field int
+	}{
+		{&limits.MaxElements, m.MaxElements},
+		{&limits.SpillSize, m.SpillSize},
+		{&limits.OutputBuffer, m.OutputBuffer},
+		{&limits.SafeMode, m.SafeMode},
+	} {
+		if *limit.value == 0 {
+			*limit.value = limit.field
+		}
+	}
+	if limits.SlowCommand == 0 {
+		limits.SlowCommand = Duration(m.SlowCommand)
+	}
+	if limits.FreezeTimeout == 0 {
+		limits.FreezeTimeout = Duration(m.FreezeTimeout)
+	}
+	return limits
+}
+
+// ReloadOnSIGHUP reloads the config at path with LoadConfig and Reload
+// whenever the process receives SIGHUP, until stop is called. Failures are
+// logged with Logf, and leave the running config in place.
+func (m *Crawlspace) ReloadOnSIGHUP(path string) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-signals:
+			}
+			err := m.reloadFile(path)
+			if m.Logf == nil {
+				continue
+			}
+			if err != nil {
+				m.Logf("crawlspace: reloading %s: %v", path, err)
+			} else {
+				m.Logf("crawlspace: reloaded %s", path)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			close(done)
+		})
+	}
+}
+
+func (m *Crawlspace) reloadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cfg, err := LoadConfig(f)
+	if err != nil {
+		return err
+	}
+	return m.Reload(cfg)
+}
@@ -25,12 +25,14 @@ package crawlspace
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jtolio/crawlspace/reflectlang"
@@ -38,40 +40,255 @@ import (
 
 // Crawlspace is a registry of Go values to expose via a remote shell.
 type Crawlspace struct {
-	env func(out io.Writer) reflectlang.Environment
+	// Logf, if not nil, is called with errors from accepting connections and
+	// from sessions. Repeated errors of the same kind are rate limited.
+	Logf func(format string, args ...interface{})
+
+	// OnAcceptError and OnSessionError, if not nil, are called with every
+	// accept and session error respectively, without rate limiting. They are
+	// intended for metrics.
+	OnAcceptError  func(err error)
+	OnSessionError func(err error)
+
+	// AcceptRetry controls how Serve retries after accept errors.
+	AcceptRetry RetryPolicy
+
+	// SlowCommand, if positive, causes commands that take at least this long
+	// to evaluate to have their elapsed time printed after their results and
+	// logged with Logf.
+	SlowCommand time.Duration
+
+	// MaxElements limits how many elements of a slice or array result are
+	// rendered. If zero, 1000 is used. If negative, there is no limit.
+	MaxElements int
+
+	// OutputBuffer, if positive, is the size in bytes of a per-session
+	// buffer that output is written through asynchronously, so that a slow
+	// or stalled client doesn't block evaluation. SlowClient controls what
+	// happens when the buffer fills up.
+	OutputBuffer int
+	SlowClient   SlowClientPolicy
+
+	// SpillSize, if positive, is how many bytes a rendered result may be
+	// before it is written to a file in SpillFS instead of the session. The
+	// session shows the start of the result and the file's name. This keeps
+	// careless dumps of huge values from flooding slow clients.
+	SpillSize int
+
+	// SpillFS is where results larger than SpillSize are written. If nil,
+	// they are written to a directory in os.TempDir() that only the current
+	// user can access, named after their uid.
+	SpillFS SpillFS
+
+	// NoSummary disables the summary line printed after multiple results or
+	// container results, describing their types and lengths.
+	NoSummary bool
+
+	// Conflicts controls what happens when the environment already binds a
+	// name that the session itself defines, such as quit or _.
+	Conflicts ConflictPolicy
+
+	// SafeMode, if positive, is how many consecutive commands may fail with a
+	// panic, type mismatch, or runtime error before the session becomes
+	// read-only (see reflectlang.SetReadOnly), as a guard rail against
+	// flailing in a fragile process. unlock() makes the session writable
+	// again.
+	SafeMode int
+
+	// Messages are the strings sessions show the operator, for localizing
+	// or rebranding them.
+	Messages Messages
+
+	// OnCommand, if not nil, is called after every command is evaluated with
+	// the command, how long it took, and its error, if any.
+	OnCommand func(command string, elapsed time.Duration, err error)
+
+	// Exec controls the exec(...) session builtin for running allowed host
+	// commands. It is disabled unless Exec.Allow is set.
+	Exec ExecPolicy
+
+	// FreezeTimeout is how long freeze(...) waits to engage pause points
+	// before giving up, and then how long it holds them before releasing
+	// them, even if f is still running. If zero, 5 seconds is used.
+	FreezeTimeout time.Duration
+
+	// NotebookFS is where session notebooks are saved, as Markdown and HTML
+	// files, by notebook.save() and when sessions end. If nil, they are saved
+	// where results are spilled by default.
+	NotebookFS SpillFS
+
+	// Startup are commands evaluated at the start of every session, before
+	// the first prompt, such as to import packages or define helpers. Their
+	// results aren't shown, but their errors are.
+	Startup []string
+
+	// Internals controls the crawlspace session builtin, a namespace of the
+	// crawlspace's own state. By default, it can be inspected but not
+	// modified.
+	Internals InternalsPolicy
+
+	env        func(s *Session) reflectlang.Environment
+	acceptLog  errorLimiter
+	sessionLog errorLimiter
+
+	mtx           sync.Mutex
+	closed        bool
+	lastSessionID uint64
+	live          map[*Session]struct{}
+	pausePoints   map[string]PausePoint
+	listeners     map[net.Listener]struct{}
+	conns         map[net.Conn]struct{}
+	sessions      sync.WaitGroup
+	counts        Metrics
+
+	// config is the config being served by ServeConfig, served are its
+	// listeners by name, serving counts them, and serveErr is the first
+	// error serving them. reloadMtx makes ServeConfig and Reload happen one
+	// at a time.
+	config    *Config
+	served    map[string]*servedListener
+	serving   sync.WaitGroup
+	serveErr  error
+	reloadMtx sync.Mutex
+
+	// freezeMtx makes freezes happen one at a time.
+	freezeMtx sync.Mutex
+}
+
+// ConflictPolicy controls how session builtins interact with environment
+// values of the same name. Regardless of policy, session builtins are always
+// available in the std namespace, e.g., std.quit().
+type ConflictPolicy int
+
+const (
+	// ShadowEnvironment binds session builtins over conflicting environment
+	// values and prints a warning at the start of the session.
+	ShadowEnvironment ConflictPolicy = iota
+	// KeepEnvironment leaves conflicting environment values in place, so the
+	// session builtin is only available in the std namespace.
+	KeepEnvironment
+	// RejectConflicts ends the session with an error if there is a conflict.
+	RejectConflicts
+)
+
+// sessionBuiltins are the names every session binds, subject to its
+// ConflictPolicy.
+var sessionBuiltins = []string{
+	// quit() ends the session.
+	"quit",
+	// raw(...) renders its arguments, or the previous results if called with
+	// no arguments, without escaping control characters or annotating errors
+	// and addresses. The whole command's output is then written unescaped.
+	"raw",
+	// _ is the previous command's results.
+	"_",
+	// tag(value, label) bookmarks a value for the rest of the session.
+	"tag",
+	// tags(label) retrieves a tagged value, and tags() returns them all by
+	// label.
+	"tags",
+	// onchange(obj, "Field", interval, "action") polls a field in the
+	// background until the session ends, printing changes and evaluating the
+	// optional action with old and new bound. The interval must be at least
+	// 10ms, and a session may run at most 100 watches.
+	"onchange",
+	// unlock() makes the session writable again after SafeMode trips.
+	"unlock",
+	// readonly() makes the session read-only for good, which unlock() can't
+	// undo.
+	"readonly",
+	// session is the Session.
+	"session",
+	// freeze(f, names...) engages the pause points registered with
+	// RegisterPausePoint, or just the named ones, while calling f or
+	// evaluating the expression f, releasing them after FreezeTimeout even if
+	// f hasn't returned. Read-only sessions can't freeze.
+	"freeze",
+	// notebook.keep() and notebook.note("text") add the previous command and
+	// its output, or a note, to the session's notebook, which is saved in
+	// NotebookFS when the session ends. notebook.markdown() and
+	// notebook.html() export it.
+	"notebook",
 }
 
 // New makes a new crawlspace using the environment constructor env.
 // If env is nil, reflectlang.Environment{} is used.
 // github.com/jtolio/crawlspace/tools.Env is perhaps a more useful choice.
 func New(env func(out io.Writer) reflectlang.Environment) *Crawlspace {
+	return &Crawlspace{env: sessionEnv(env)}
+}
+
+// NewWithSession is like New, but env is called with each new session, so
+// that the environment can depend on who the session is for.
+func NewWithSession(env func(s *Session) reflectlang.Environment) *Crawlspace {
 	if env == nil {
-		env = func(io.Writer) reflectlang.Environment { return reflectlang.Environment{} }
+		return New(nil)
 	}
 	return &Crawlspace{env: env}
 }
 
+func sessionEnv(env func(out io.Writer) reflectlang.Environment) func(
+	*Session) reflectlang.Environment {
+	if env == nil {
+		return func(*Session) reflectlang.Environment { return reflectlang.Environment{} }
+	}
+	return func(s *Session) reflectlang.Environment { return env(s.Out()) }
+}
+
 // Interact takes input from `in` and returns output to `out`. It runs until
 // there is an error, or the user runs `quit()`. In the case of the input
 // returning io.EOF or the user entering `quit()`, no error will be returned.
+//
+// Interact evaluates each command with EvalOnce, in a Session that lasts
+// until it returns, with the session builtins (see ConflictPolicy) bound.
+// Commands that end with parentheses, brackets, braces, or a string left
+// open continue on the following lines, after the Continuation prompt, until
+// they are complete or a blank line is entered. Errors from goroutines
+// started with `go` are printed when they happen.
+//
+// Errors are rendered with their chain of wrapped errors, and addresses with
+// the symbol they point into, looked up with `$symbolize` if the environment
+// binds it to a func(uintptr) string. Control characters other than newlines
+// and tabs are escaped so that values can't send escape sequences to the
+// client's terminal.
 func (m *Crawlspace) Interact(in io.Reader, out io.Writer) (err error) {
+	return m.interact(context.Background(), in, out, m.env, SessionOptions{})
+}
+
+func (m *Crawlspace) interact(ctx context.Context, in io.Reader, out io.Writer,
+	envFn func(s *Session) reflectlang.Environment, opts SessionOptions) (err error) {
 	defer func() {
 		if rec := recover(); rec != nil {
 			err = fmt.Errorf("panic: %+v", rec)
 		}
 	}()
-	_, err = fmt.Fprintf(out, "%s\n%s\n", crawlspaceVersion, processVersion)
+	if size := m.limits().OutputBuffer; size > 0 {
+		w := newAsyncWriter(out, size, m.SlowClient)
+		defer func() {
+			if closeErr := w.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		out = w
+	}
+	msgs := m.messages()
+	_, err = fmt.Fprintf(out, msgs.Banner, crawlspaceVersion, processVersion)
 	if err != nil {
 		return err
 	}
 
-	env := m.env(out)
-	eof := false
-	env["quit"] = reflect.ValueOf(func() { eof = true })
+	s, err := m.newSession(ctx, out, envFn, opts)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
 
 	stdin := bufio.NewReader(in)
-	for !eof {
-		_, err := fmt.Fprintf(out, "> ")
+	eof := false
+	for !eof && !s.Ended() {
+		s.mtx.Lock()
+		_, err := io.WriteString(out, msgs.Prompt)
+		s.mtx.Unlock()
 		if err != nil {
 			return err
 		}
@@ -81,37 +298,114 @@ func (m *Crawlspace) Interact(in io.Reader, out io.Writer) (err error) {
 			eof = errors.Is(err, io.EOF)
 			line = strings.TrimSpace(line)
 			empty := len(line) == 0
-			if err != nil && (!eof || empty) {
+			if eof && empty {
+				// input ending at the prompt is how most sessions end, so
+				// as documented, it isn't an error.
+				return nil
+			}
+			if err != nil && !eof {
 				return err
 			}
 			if !empty {
 				break
 			}
 		}
-		rv, err := reflectlang.Eval(line, env)
-		if err != nil {
-			_, err = fmt.Fprintf(out, "%v\n", err)
+		for !eof {
+			if _, err := reflectlang.Parse(line); !errors.Is(err, reflectlang.ErrIncomplete) {
+				break
+			}
+			s.mtx.Lock()
+			_, err := io.WriteString(out, msgs.Continuation)
+			s.mtx.Unlock()
 			if err != nil {
 				return err
 			}
-			continue
-		}
-		env["_"] = reflectlang.LowerFunc(env, func(args []reflect.Value) ([]reflect.Value, error) {
-			if len(args) != 0 {
-				return nil, fmt.Errorf("unexpected argument")
-			}
-			return rv, nil
-		})
-		for _, val := range rv {
-			_, err = fmt.Fprintf(out, "%s\n", reflectlang.Repr(val))
-			if err != nil {
+			var next string
+			next, err = stdin.ReadString('\n')
+			eof = errors.Is(err, io.EOF)
+			if err != nil && !eof {
 				return err
 			}
+			next = strings.TrimSpace(next)
+			if next == "" {
+				// a blank line gives up on the command, showing why it is
+				// incomplete.
+				break
+			}
+			line = continueCommand(line, next)
+		}
+		res, err := m.EvalOnce(s, line)
+		if err != nil {
+			return err
+		}
+		err = m.writeCommandResult(s, res)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// continueCommand returns the incomplete command continued by the next
+// line, after a newline, or, in a string left open, after an escaped one,
+// since strings can't span lines.
+func continueCommand(command, next string) string {
+	tokens, err := reflectlang.Tokenize(command)
+	if n := len(tokens); n > 0 && tokens[n-1].Kind == reflectlang.TokenString &&
+		errors.Is(err, reflectlang.ErrIncomplete) {
+		return command + `\n` + next
+	}
+	return command + "\n" + next
+}
+
+// isFlailing returns true if err suggests the user is struggling, for safe
+// mode.
+func isFlailing(err error) bool {
+	var panicErr *reflectlang.PanicError
+	return errors.As(err, &panicErr) ||
+		errors.Is(err, reflectlang.ErrTypeMismatch) ||
+		errors.Is(err, reflectlang.ErrRuntime)
+}
+
+// builtinBinder applies the conflict policy to the session builtins, and
+// returns a function for binding them.
+func (m *Crawlspace) builtinBinder(env reflectlang.Environment, out io.Writer) (
+	func(name string, v reflect.Value), error) {
+	conflicts := map[string]bool{}
+	names := sessionBuiltins
+	if m.Exec.enabled() {
+		// exec("cmd", args...) runs the commands Exec allows.
+		names = append(names[:len(names):len(names)], "exec")
+	}
+	if m.Internals != HideInternals {
+		// crawlspace is a namespace of the Crawlspace's own state, such as
+		// crawlspace.sessions() and crawlspace.metrics(), as Internals
+		// allows. It isn't in std when it is inspect-only.
+		names = append(names[:len(names):len(names)], "crawlspace")
+	}
+	for _, name := range names {
+		if _, exists := reflectlang.Lookup(env, name); exists {
+			conflicts[name] = true
+			switch m.Conflicts {
+			case RejectConflicts:
+				return nil, fmt.Errorf("environment binds reserved name %q", name)
+			case ShadowEnvironment:
+				_, err := fmt.Fprintf(out, m.messages().Shadowed+"\n", name)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	std := reflectlang.Std(env)
+	return func(name string, v reflect.Value) {
+		std.Set(name, v)
+		if !conflicts[name] || m.Conflicts != KeepEnvironment {
+			env[name] = v
+		}
+	}, nil
+}
+
 // ListenAndServe listens on the given address. It calls Serve with an
 // appropriate listener.
 func (m *Crawlspace) ListenAndServe(addr string) error {
@@ -125,32 +419,25 @@ func (m *Crawlspace) ListenAndServe(addr string) error {
 // Serve accepts incoming connections and calls Interact with both sides of
 // incoming client connections. Careful, it's probably a security mistake to
 // use a listener that can accept connections from anywhere.
+// Serve is the same as ServeWith with zero ListenerOptions.
 func (m *Crawlspace) Serve(l net.Listener) error {
-	defer l.Close()
-	var delay time.Duration
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
-				if delay == 0 {
-					delay = 5 * time.Millisecond
-				} else {
-					delay *= 2
-				}
-				if delay > time.Second {
-					delay = time.Second
-				}
-				time.Sleep(delay)
-				continue
-			}
-			return err
-		}
-		delay = 0
-		go func() {
-			defer conn.Close()
-			m.Interact(&eotTranslate{conn}, conn)
-		}()
+	return m.ServeWith(l, ListenerOptions{})
+}
+
+func (m *Crawlspace) acceptError(listener string, err error) {
+	m.count(func(counts *Metrics) { counts.AcceptErrors++ })
+	if m.OnAcceptError != nil {
+		m.OnAcceptError(err)
+	}
+	m.acceptLog.logf(m.Logf, "crawlspace: %s: accept error: %v", listener, err)
+}
+
+func (m *Crawlspace) sessionError(listener string, remote net.Addr, err error) {
+	m.count(func(counts *Metrics) { counts.SessionErrors++ })
+	if m.OnSessionError != nil {
+		m.OnSessionError(err)
 	}
+	m.sessionLog.logf(m.Logf, "crawlspace: %s: session %v: %v", listener, remote, err)
 }
 
 type eotTranslate struct {
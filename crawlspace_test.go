@@ -0,0 +1,2078 @@
+package crawlspace
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsTemporaryAcceptError(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		temporary bool
+	}{
+		{nil, false},
+		{net.ErrClosed, false},
+		{fmt.Errorf("wrapped: %w", net.ErrClosed), false},
+		{errors.New("something else"), false},
+		{&net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.EMFILE)}, true},
+		{&net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.ECONNABORTED)}, true},
+		{&net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.EBADF)}, false},
+		{timeoutError{}, true},
+	} {
+		if got := IsTemporaryAcceptError(test.err); got != test.temporary {
+			t.Errorf("IsTemporaryAcceptError(%v) = %v, expected %v", test.err, got, test.temporary)
+		}
+	}
+}
+
+func TestRetryPolicyDelays(t *testing.T) {
+	p := RetryPolicy{MinDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	var delay time.Duration
+	var delays []time.Duration
+	for i := 0; i < 5; i++ {
+		delay = p.next(delay)
+		delays = append(delays, delay)
+	}
+	expected := []time.Duration{1, 2, 4, 5, 5}
+	for i := range expected {
+		if delays[i] != expected[i]*time.Millisecond {
+			t.Fatalf("unexpected delays %v", delays)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.jitter(10 * time.Millisecond)
+		if d < 5*time.Millisecond || d > 15*time.Millisecond {
+			t.Fatalf("jittered delay %v out of range", d)
+		}
+	}
+}
+
+func TestErrorLimiter(t *testing.T) {
+	var mtx sync.Mutex
+	var lines []string
+	logf := func(format string, args ...interface{}) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	logged := func() string {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return strings.Join(lines, "\n")
+	}
+
+	l := errorLimiter{interval: 50 * time.Millisecond}
+	for i := 1; i <= 4; i++ {
+		l.logf(logf, "error %d", i)
+	}
+	if logged() != "error 1" {
+		t.Fatalf("unexpected lines %q", logged())
+	}
+	// the burst stops, and its last error is reported at the end of the
+	// interval.
+	await := func(expected string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); logged() != expected; {
+			if time.Now().After(deadline) {
+				t.Fatalf("unexpected lines %q", logged())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	await("error 1\nerror 4 (2 similar errors suppressed)")
+
+	time.Sleep(60 * time.Millisecond)
+	l.logf(logf, "error 5")
+	l.logf(logf, "error 6")
+	await("error 1\nerror 4 (2 similar errors suppressed)\nerror 5\nerror 6")
+}
+
+type failingListener struct {
+	errs    []error
+	accepts int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.accepts++
+	if len(l.errs) == 0 {
+		return nil, net.ErrClosed
+	}
+	err := l.errs[0]
+	if len(l.errs) > 1 {
+		l.errs = l.errs[1:]
+	}
+	return nil, err
+}
+
+func (l *failingListener) Close() error   { return nil }
+func (l *failingListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestServeRetries(t *testing.T) {
+	var acceptErrs int
+	m := New(nil)
+	m.OnAcceptError = func(error) { acceptErrs++ }
+	m.AcceptRetry = RetryPolicy{MinDelay: time.Microsecond, MaxRetries: 3}
+
+	l := &failingListener{errs: []error{timeoutError{}}}
+	err := m.Serve(l)
+	if _, ok := err.(timeoutError); !ok {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if l.accepts != 4 || acceptErrs != 4 {
+		t.Fatalf("unexpected accepts %d, errors %d", l.accepts, acceptErrs)
+	}
+
+	m.AcceptRetry = RetryPolicy{
+		MinDelay:  time.Microsecond,
+		Retryable: func(err error) bool { return err.Error() == "retry me" },
+	}
+	l = &failingListener{errs: []error{errors.New("retry me"), errors.New("retry me"), net.ErrClosed}}
+	if err := m.Serve(l); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if l.accepts != 3 {
+		t.Fatalf("unexpected accepts %d", l.accepts)
+	}
+}
+
+func TestShutdownMultipleListeners(t *testing.T) {
+	m := New(nil)
+	var authenticated int
+	serveErrs := make(chan error, 2)
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, l.Addr().String())
+		opts := ListenerOptions{}
+		if i == 1 {
+			opts.Authenticate = func(net.Conn) error {
+				authenticated++
+				return nil
+			}
+		}
+		go func() { serveErrs <- m.ServeWith(l, opts) }()
+	}
+
+	for _, addr := range addrs {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := bufio.NewReader(conn).ReadString('>'); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected shutdown error %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-serveErrs; !errors.Is(err, ErrClosed) {
+			t.Fatalf("unexpected serve error %v", err)
+		}
+	}
+	if authenticated != 1 {
+		t.Fatalf("unexpected authentication count %d", authenticated)
+	}
+}
+
+func TestShutdownBusySession(t *testing.T) {
+	started, ended := make(chan struct{}), make(chan struct{})
+	m := New(func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{
+			"block": reflect.ValueOf(func(s *Session) {
+				close(started)
+				<-s.Context().Done()
+				close(ended)
+			}),
+		}
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = m.Serve(l) }()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if _, err := r.ReadString('>'); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(conn, "block(session)\n"); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected shutdown error %v", err)
+	}
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session context wasn't canceled")
+	}
+}
+
+func interact(t *testing.T, m *Crawlspace, input string) []string {
+	t.Helper()
+	var out strings.Builder
+	if err := m.Interact(strings.NewReader(input), &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	// skip the version banner
+	return lines[2:]
+}
+
+func TestInteractEOF(t *testing.T) {
+	m := New(func(io.Writer) reflectlang.Environment { return reflectlang.Environment{} })
+	for _, input := range []string{"", "\n", "1\n", "1", "1\n\n  "} {
+		if err := m.Interact(strings.NewReader(input), io.Discard); err != nil {
+			t.Fatalf("%q: %v", input, err)
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	m := New(func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{
+			"xs":   reflect.ValueOf(make([]int, 5)),
+			"two":  reflect.ValueOf(func() (int, error) { return 1, nil }),
+			"one":  reflect.ValueOf(func() error { return nil }),
+			"none": reflect.ValueOf(func() {}),
+		}
+	})
+	m.MaxElements = 3
+	out := interact(t, m, "xs\ntwo()\none()\nnone()\n")
+	expected := []string{
+		"> []int{0, 0, 0} ...",
+		"(1 value: []int len=5 (truncated to 3))",
+		"> 1",
+		"(2 values: int, error(nil))",
+		"> ok",
+		"> (no results)",
+		"> ",
+	}
+	if strings.Join(out, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected output:\n%s", strings.Join(out, "\n"))
+	}
+}
+
+func TestErrorRendering(t *testing.T) {
+	base := errors.New("base")
+	m := New(func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{
+			"fail": reflect.ValueOf(func() (int, error) {
+				return 0, fmt.Errorf("outer: %w", base)
+			}),
+		}
+	})
+	m.NoSummary = true
+	out := interact(t, m, "fail()\nraw()\n")
+	expected := []string{
+		"> 0",
+		"error(*fmt.wrapError): outer: base",
+		"  caused by (*errors.errorString): base",
+		"> 0",
+		"(*fmt.wrapError)(0x",
+	}
+	for i := range expected {
+		if !strings.HasPrefix(out[i], expected[i]) {
+			t.Fatalf("unexpected output:\n%s", strings.Join(out, "\n"))
+		}
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	envFn := func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{
+			"quit": reflect.ValueOf(func() int { return 5 }),
+		}
+	}
+	m := New(envFn)
+	m.Conflicts = KeepEnvironment
+	out := interact(t, m, "quit()\nstd.quit()\n1\n")
+	if strings.Join(out, "\n") != "> 5\n> (no results)" {
+		t.Fatalf("unexpected output:\n%s", strings.Join(out, "\n"))
+	}
+
+	m.Conflicts = ShadowEnvironment
+	out = interact(t, m, "quit()\n")
+	if strings.Join(out, "\n") != "warning: \"quit\" is shadowed by the session builtin\n> (no results)" {
+		t.Fatalf("unexpected output:\n%s", strings.Join(out, "\n"))
+	}
+
+	m.Conflicts = RejectConflicts
+	if err := m.Interact(strings.NewReader(""), io.Discard); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSharedBase(t *testing.T) {
+	base := reflectlang.NewStandardEnvironment()
+	base["limit"] = reflect.ValueOf(int64(3))
+	m := New(func(io.Writer) reflectlang.Environment { return reflectlang.NewScope(base) })
+	m.NoSummary = true
+	out := interact(t, m, "mine := limit + 1\nmine\nlimit = 4\n")
+	if strings.Join(out[:2], "\n") != "> (no results)\n> 4" {
+		t.Fatalf("unexpected output:\n%s", strings.Join(out, "\n"))
+	}
+	out = interact(t, m, "limit\nmine\n")
+	if out[0] != "> 4" || !strings.Contains(out[1], "unbound variable") {
+		t.Fatalf("unexpected output:\n%s", strings.Join(out, "\n"))
+	}
+	for _, name := range []string{"session", "quit", "mine"} {
+		if _, ok := base[name]; ok {
+			t.Fatalf("session bound %q in the shared base", name)
+		}
+		if _, found, _ := reflectlang.Std(base).Get(name); found {
+			t.Fatalf("session bound %q in the shared base's std", name)
+		}
+	}
+}
+
+func TestAddressRendering(t *testing.T) {
+	pc := reflect.ValueOf(TestAddressRendering).Pointer()
+	m := New(func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{
+			"pc":    reflect.ValueOf(pc + 1),
+			"other": reflect.ValueOf(uintptr(0x10)),
+		}
+	})
+	out := interact(t, m, "pc\nother\n")
+	expected := fmt.Sprintf("> %#x <github.com/jtolio/crawlspace.TestAddressRendering+0x1>\n> 0x10\n> ", pc+1)
+	if strings.Join(out, "\n") != expected {
+		t.Fatalf("unexpected output:\n%s", strings.Join(out, "\n"))
+	}
+}
+
+func TestTags(t *testing.T) {
+	m := New(func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{
+			"conn": reflect.ValueOf(&net.TCPAddr{Port: 1234}),
+		}
+	})
+	out := interact(t, m, strings.Join([]string{
+		`tag(conn, "suspect-conn")`,
+		`tags("suspect-conn").Port`,
+		`tag(conn.Port, "port")`,
+		`tags()["port"]`,
+		`tags("missing")`,
+	}, "\n")+"\n")
+	expected := strings.Join([]string{
+		"> &net.TCPAddr{IP:net.IP(nil), Port:1234, Zone:\"\"}",
+		"> 1234",
+		"> 1234",
+		"> 1234",
+		"> no value tagged \"missing\" (tags: [port suspect-conn])",
+		"> ",
+	}, "\n")
+	if strings.Join(out, "\n") != expected {
+		t.Fatalf("unexpected output:\n%s", strings.Join(out, "\n"))
+	}
+}
+
+type counter struct {
+	Count int
+}
+
+func (c *counter) Inc() { c.Count++ }
+
+func TestOnChange(t *testing.T) {
+	m := New(func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{
+			"c": reflect.ValueOf(&counter{}),
+		}
+	})
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Interact(inR, outW)
+		_ = outW.Close()
+	}()
+	input := make(chan string, 10)
+	go func() {
+		for line := range input {
+			_, _ = io.WriteString(inW, line+"\n")
+		}
+		_ = inW.Close()
+	}()
+	lines := bufio.NewScanner(outR)
+	expect := func(expected string) {
+		t.Helper()
+		for lines.Scan() {
+			if lines.Text() == expected {
+				return
+			}
+		}
+		t.Fatalf("missing output %q", expected)
+	}
+
+	input <- `w := onchange(c, "Count", 10ms, "new * 10")`
+	input <- "c.Inc()"
+	expect("onchange: Count: 0 → 1")
+	expect("10")
+	input <- "w.Stop()"
+	input <- "c.Inc()"
+	close(input)
+	for lines.Scan() {
+		if strings.HasPrefix(lines.Text(), "onchange") {
+			t.Fatalf("unexpected output after stop: %q", lines.Text())
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnChangeLimits(t *testing.T) {
+	ws := &watchSet{mtx: &sync.Mutex{}, env: reflectlang.Environment{}, out: io.Discard}
+	defer ws.stopAll()
+	c := reflect.ValueOf(&counter{})
+	onchange := func(obj reflect.Value, interval time.Duration) error {
+		_, err := ws.onchange([]reflect.Value{obj, reflect.ValueOf("Count"),
+			reflect.ValueOf(interval)})
+		return err
+	}
+
+	for _, tc := range []struct {
+		obj      reflect.Value
+		interval time.Duration
+		err      string
+	}{
+		{reflect.Value{}, time.Second, "usage: onchange"},
+		{reflect.ValueOf((*counter)(nil)), time.Second, "nil *crawlspace.counter"},
+		{c, time.Nanosecond, "at least 10ms"},
+		{c, 0, "at least 10ms"},
+	} {
+		err := onchange(tc.obj, tc.interval)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Fatalf("expected %q, got %v", tc.err, err)
+		}
+	}
+
+	for i := 0; i < maxWatches; i++ {
+		if err := onchange(c, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := onchange(c, time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Fatalf("expected too many watches, got %v", err)
+	}
+	ws.watches[0].Stop()
+	if err := onchange(c, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSafeMode(t *testing.T) {
+	c := &counter{}
+	m := New(func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{
+			"c":     reflect.ValueOf(c),
+			"boom":  reflect.ValueOf(func() { panic("boom") }),
+			"names": reflect.ValueOf(map[string]int{}),
+		}
+	})
+	m.SafeMode = 2
+	out := interact(t, m, strings.Join([]string{
+		"boom()",
+		"c.Inc()",
+		"boom()",
+		`c.Count + "a"`,
+		"c.Inc()",
+		`names["a"] = 1`,
+		"x := c.Count",
+		"unlock()",
+		"c.Inc()",
+	}, "\n")+"\n")
+	expected := strings.Join([]string{
+		"> panic: boom",
+		"> (no results)",
+		"> panic: boom",
+		"> type mismatch: line 1, column 9: cannot use \"a\" (untyped constant) as int",
+		"safe mode: 2 consecutive errors, the session is now read-only. run unlock() to continue.",
+		"> read-only: line 1, column 6: cannot call func()",
+		"> read-only: line 1, column 6: cannot assign to index",
+		"> (no results)",
+		"> (no results)",
+		"> (no results)",
+		"> ",
+	}, "\n")
+	if strings.Join(out, "\n") != expected {
+		t.Fatalf("unexpected output:\n%s", strings.Join(out, "\n"))
+	}
+	if c.Count != 2 {
+		t.Fatalf("unexpected count %d", c.Count)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	m := New(func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{
+			"boom": reflect.ValueOf(func() { panic("boom") }),
+			"one":  reflect.ValueOf(func() error { return nil }),
+			"none": reflect.ValueOf(func() {}),
+			"quit": reflect.ValueOf(1),
+		}
+	})
+	m.SafeMode = 1
+	m.Messages = Messages{
+		Banner:      "welcome to %[2]s\n",
+		Prompt:      "$ ",
+		NoResults:   "(rien)",
+		OK:          "d'accord",
+		ErrorPrefix: "erreur: ",
+		SafeMode:    "mode sans échec après %d erreur",
+		Shadowed:    "attention: %q est masqué",
+	}
+	var out strings.Builder
+	if err := m.Interact(strings.NewReader("none()\none()\nboom()\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join([]string{
+		"welcome to " + processVersion,
+		`attention: "quit" est masqué`,
+		"$ (rien)",
+		"$ d'accord",
+		"$ erreur: panic: boom",
+		"mode sans échec après 1 erreur",
+		"$ ",
+	}, "\n")
+	if out.String() != expected {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+}
+
+func TestContinuation(t *testing.T) {
+	m := New(func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{
+			"length": reflect.ValueOf(func(s string) int { return len(s) }),
+		}
+	})
+	input := "f := func(x) {\nreturn x + 1 }\nf(1)\nlength(\"a\nb\")\nf(\n\n"
+	var out strings.Builder
+	if err := m.Interact(strings.NewReader(input), &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join([]string{
+		"> ... (no results)",
+		"> 2",
+		"> ... 3",
+		"> ... parser error: incomplete input: line 1, column 3: unexpected missing argument",
+		"> ",
+	}, "\n")
+	if !strings.HasSuffix(out.String(), expected) {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+}
+
+func TestSlowCommand(t *testing.T) {
+	m := New(func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{
+			"sleep": reflect.ValueOf(time.Sleep),
+			"fail": reflect.ValueOf(func() {
+				time.Sleep(20 * time.Millisecond)
+				panic("failed")
+			}),
+		}
+	})
+	m.SlowCommand = 10 * time.Millisecond
+	var logged []string
+	m.Logf = func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	type command struct {
+		line    string
+		elapsed time.Duration
+		err     error
+	}
+	var commands []command
+	m.OnCommand = func(line string, elapsed time.Duration, err error) {
+		commands = append(commands, command{line, elapsed, err})
+	}
+
+	var out strings.Builder
+	err := m.Interact(strings.NewReader("sleep(20ms)\n1\nfail()\n"), &out)
+	if err != nil && !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	// the results of slow commands, or their errors, are followed by how
+	// long they took.
+	elapsed := regexp.MustCompile(`\([\d.]+m?s elapsed\)$`)
+	lines := strings.Split(out.String(), "\n")
+	var slow []string
+	for i, line := range lines {
+		if elapsed.MatchString(line) {
+			slow = append(slow, lines[i-1])
+		}
+	}
+	if len(slow) != 2 || !strings.Contains(slow[1], "failed") {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+
+	if len(commands) != 3 {
+		t.Fatalf("unexpected commands %v", commands)
+	}
+	for i, expected := range []string{"sleep(20ms)", "1", "fail()"} {
+		c := commands[i]
+		slow := c.elapsed >= 20*time.Millisecond
+		if c.line != expected || slow != (i != 1) || (c.err != nil) != (i == 2) {
+			t.Fatalf("unexpected command %d: %v", i, c)
+		}
+	}
+	if len(logged) != 2 || !strings.HasPrefix(logged[0], "crawlspace: slow command (") ||
+		!strings.HasSuffix(logged[0], `): "sleep(20ms)"`) ||
+		!strings.HasSuffix(logged[1], `): "fail()"`) {
+		t.Fatalf("unexpected log lines %q", logged)
+	}
+}
+
+func TestSpill(t *testing.T) {
+	dir := t.TempDir()
+	m := New(func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{
+			"small": reflect.ValueOf("hi"),
+			"big":   reflect.ValueOf(strings.Repeat("é", 5000)),
+		}
+	})
+	m.SpillSize = 100
+	m.SpillFS = SpillDir(dir)
+	out := interact(t, m, "small\nbig\n")
+	if out[0] != `> "hi"` {
+		t.Fatalf("unexpected output %q", out[0])
+	}
+	if !strings.HasPrefix(out[1], `> "éé`) || !strings.HasSuffix(out[1], " ...") ||
+		len(out[1]) > spillPageSize+10 {
+		t.Fatalf("unexpected first page %q", out[1])
+	}
+	prefix := "(10002 bytes, spilled to "
+	if !strings.HasPrefix(out[2], prefix) {
+		t.Fatalf("unexpected spill line %q", out[2])
+	}
+	path := strings.TrimSuffix(strings.TrimPrefix(out[2], prefix), ")")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != fmt.Sprintf("%q", strings.Repeat("é", 5000)) {
+		t.Fatalf("unexpected spilled data of length %d", len(data))
+	}
+
+	s, err := m.NewSession(context.Background(), io.Discard, SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	res, err := m.EvalOnce(s, "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Reprs[0]) > spillPageSize || !strings.HasPrefix(res.Reprs[0], `"éé`) ||
+		res.Spills[0].Size != 10002 || res.Spills[0].Err != nil ||
+		filepath.Dir(res.Spills[0].Name) != dir {
+		t.Fatalf("unexpected result %q, %#v", res.Reprs[0], res.Spills)
+	}
+	m.SpillFS = SpillDir(filepath.Join(dir, "missing"))
+	res, err = m.EvalOnce(s, "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Reprs[0]) > spillPageSize || res.Spills[0].Size != 10002 || res.Spills[0].Err == nil {
+		t.Fatalf("unexpected result %q, %#v", res.Reprs[0], res.Spills)
+	}
+	if text := resultText(res.Reprs[0], res.Spills[0], m.messages()); !strings.Contains(text,
+		" ...\n(10002 bytes, spilling failed: ") {
+		t.Fatalf("unexpected output %q", text)
+	}
+
+	// by default, results are spilled to a private directory, and files and
+	// symlinks planted there aren't written through.
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	m.SpillFS = nil
+	out = interact(t, m, "big\n")
+	path = strings.TrimSuffix(strings.TrimPrefix(out[1], prefix), ")")
+	if filepath.Dir(path) != userTempDir("crawlspace-output") || !strings.HasPrefix(path, tmp) {
+		t.Fatalf("unexpected spill line %q", out[1])
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fileOwner(fi); ok && fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected spilled file mode %v", fi.Mode())
+	}
+	target := filepath.Join(tmp, "target")
+	if err := os.Symlink(target, filepath.Join(dir, "planted")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SpillDir(dir).Create("planted"); err == nil {
+		t.Fatal("expected creating over a symlink to fail")
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Fatalf("symlink was written through: %v", err)
+	}
+
+	shared := filepath.Join(tmp, "shared")
+	if err := os.Mkdir(shared, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(shared, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, filepath.Join(tmp, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := privateDir(filepath.Join(tmp, "private")); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{shared, filepath.Join(tmp, "link")} {
+		if err := privateDir(path); err == nil {
+			t.Fatalf("expected %s not to be private", path)
+		}
+	}
+}
+
+// gatedWriter blocks writes until open is closed.
+type gatedWriter struct {
+	open chan struct{}
+	out  strings.Builder
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.open
+	return w.out.Write(p)
+}
+
+// eofSignal closes done when in returns io.EOF.
+type eofSignal struct {
+	in   io.Reader
+	done chan struct{}
+}
+
+func (r *eofSignal) Read(p []byte) (int, error) {
+	n, err := r.in.Read(p)
+	if err == io.EOF {
+		close(r.done)
+	}
+	return n, err
+}
+
+func TestSlowClient(t *testing.T) {
+	m := New(func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{
+			"big": reflect.ValueOf(strings.Repeat("x", 1000)),
+		}
+	})
+	m.OutputBuffer = 256
+
+	w := &gatedWriter{open: make(chan struct{})}
+	in := &eofSignal{in: strings.NewReader("big\nbig\n1\n"), done: make(chan struct{})}
+	errs := make(chan error, 1)
+	go func() { errs <- m.Interact(in, w) }()
+	select {
+	case <-in.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("evaluation blocked on a stalled client")
+	}
+	close(w.open)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(w.out.String(), "(client too slow: ") {
+		t.Fatalf("missing diagnostic in %q", w.out.String())
+	}
+	if len(w.out.String()) > 512 {
+		t.Fatalf("too much output buffered: %d bytes", len(w.out.String()))
+	}
+
+	m.SlowClient = AbortSession
+	w = &gatedWriter{open: make(chan struct{})}
+	defer close(w.open)
+	err := m.Interact(strings.NewReader("big\n1\n"), w)
+	if !errors.Is(err, ErrClientTooSlow) {
+		t.Fatalf("expected client too slow, got %v", err)
+	}
+}
+
+func TestTelnet(t *testing.T) {
+	m := New(func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{"s": reflect.ValueOf("a\nb")}
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = m.ServeWith(l, ListenerOptions{Telnet: true}) }()
+	defer func() { _ = m.Shutdown(context.Background()) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	input := []byte{telnetIAC, telnetDo, telnetOptEcho, '1', ' ', '+', telnetIAC, 241, ' ', '1', '\r', '\n'}
+	input = append(input, []byte{telnetIAC, telnetSB, 24, 0, 'x', telnetIAC, telnetSE}...)
+	input = append(input, "s\r\x00quit()\r\n"...)
+	if _, err := conn.Write(input); err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(out), string(telnetNegotiation)) {
+		t.Fatalf("missing negotiation in %q", out)
+	}
+	out = out[len(telnetNegotiation):]
+	if strings.Contains(strings.ReplaceAll(string(out), "\r\n", ""), "\n") {
+		t.Fatalf("bare line feed in %q", out)
+	}
+	if !strings.Contains(string(out), "> 2\r\n> \"a\\nb\"\r\n> ") {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+// ansi renders as itself.
+type ansi string
+
+func (a ansi) GoString() string { return string(a) }
+
+func TestSanitize(t *testing.T) {
+	m := New(func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{
+			"e": reflect.ValueOf(ansi("\x1b[31mred\x1b[0m")),
+			"fail": reflectlang.LowerFunc(func([]reflect.Value) ([]reflect.Value, error) {
+				return nil, errors.New("\x1b]0;title\a")
+			}),
+		}
+	})
+	out := interact(t, m, "e\nfail()\nraw(e)\n")
+	for _, line := range out[:2] {
+		if strings.ContainsAny(line, "\x1b\a") {
+			t.Fatalf("unsanitized output %q", line)
+		}
+	}
+	if !strings.Contains(out[0], `\x1b[31mred\x1b[0m`) {
+		t.Fatalf("unexpected output %q", out[0])
+	}
+	if !strings.Contains(out[1], `\x1b]0;title\x07`) {
+		t.Fatalf("unexpected output %q", out[1])
+	}
+	if !strings.Contains(out[2], "\x1b[31mred\x1b[0m") {
+		t.Fatalf("unexpected raw output %q", out[2])
+	}
+
+	for in, expected := range map[string]string{
+		"plain\n\ttext": "plain\n\ttext",
+		"a\rb":          `a\x0db`,
+		"\u009b2J":      `\x9b2J`,
+		"bad\xffbyte":   `bad\xffbyte`,
+		" ":             " ",
+		"é\x1bé":        `é\x1bé`,
+		"trailing\xc3":  `trailing\xc3`,
+	} {
+		if got := sanitize(in); got != expected {
+			t.Errorf("sanitize(%q) = %q, expected %q", in, got, expected)
+		}
+		// characters split across writes are sanitized whole.
+		var b strings.Builder
+		w := &sanitizer{w: &b}
+		for i := 0; i < len(in); i++ {
+			_, _ = w.Write([]byte{in[i]})
+		}
+		if err := w.Flush(); err != nil || b.String() != expected {
+			t.Errorf("sanitizer wrote %q, %v, expected %q", b.String(), err, expected)
+		}
+	}
+}
+
+func TestEvalOnce(t *testing.T) {
+	m := New(func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{
+			"xs": reflect.ValueOf([]int{1, 2, 3}),
+		}
+	})
+	var out strings.Builder
+	s, err := m.NewSession(context.Background(), &out, SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	res, err := m.EvalOnce(s, "xs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Err != nil || len(res.Values) != 1 || res.Reprs[0] != "[]int{1, 2, 3}" ||
+		res.TruncatedTo[0] != -1 || res.Summary != "1 value: []int len=3" {
+		t.Fatalf("unexpected result %#v", res)
+	}
+
+	res, err = m.EvalOnce(s, "_()[1]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Err != nil || res.Reprs[0] != "2" {
+		t.Fatalf("unexpected result %#v", res)
+	}
+
+	res, err = m.EvalOnce(s, "nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Err == nil || res.ErrMessage != res.Err.Error() || len(res.Values) != 0 {
+		t.Fatalf("unexpected result %#v", res)
+	}
+
+	if _, err = m.EvalOnce(s, "xylophone := 1"); err != nil {
+		t.Fatal(err)
+	}
+	candidates, start, err := m.Complete(s, "len(xy", 6)
+	if err != nil || start != 4 || !reflect.DeepEqual(candidates, []string{"xylophone"}) {
+		t.Fatalf("unexpected completion %q at %d, %v", candidates, start, err)
+	}
+
+	if _, err = m.EvalOnce(s, "quit()"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Ended() {
+		t.Fatal("expected the session to end")
+	}
+	if _, err = m.EvalOnce(s, "xs"); !errors.Is(err, ErrSessionEnded) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, _, err = m.Complete(s, "x", 1); !errors.Is(err, ErrSessionEnded) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+}
+
+func TestEvalOnceConcurrent(t *testing.T) {
+	m := New(func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{}
+	})
+	s, err := m.NewSession(context.Background(), io.Discard, SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := m.EvalOnce(s, "n := 0"); err != nil {
+		t.Fatal(err)
+	}
+
+	const commands = 20
+	seen := make(chan string, commands)
+	var wg sync.WaitGroup
+	for i := 0; i < commands; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := m.EvalOnce(s, "n = n + 1; n")
+			if err != nil || res.Err != nil {
+				t.Errorf("unexpected result %#v, %v", res, err)
+				return
+			}
+			seen <- res.Reprs[0]
+		}()
+	}
+	wg.Wait()
+	close(seen)
+	distinct := map[string]bool{}
+	for repr := range seen {
+		distinct[repr] = true
+	}
+	if len(distinct) != commands {
+		t.Fatalf("expected %d distinct results, got %v", commands, distinct)
+	}
+	res, err := m.EvalOnce(s, "n")
+	if err != nil || res.Reprs[0] != fmt.Sprint(commands) {
+		t.Fatalf("unexpected result %#v, %v", res, err)
+	}
+}
+
+func TestInternals(t *testing.T) {
+	type counter struct{ N int }
+	c := &counter{}
+	m := New(func(io.Writer) reflectlang.Environment {
+		env := reflectlang.NewStandardEnvironment()
+		env["c"], env["second"] = reflect.ValueOf(c), reflect.ValueOf(time.Second)
+		return env
+	})
+	var mu sync.Mutex
+	m.RegisterPausePoint("state", PauseLocker(&mu))
+	other, err := m.NewSession(context.Background(), io.Discard, SessionOptions{User: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if res, err := m.EvalOnce(other, `onchange(c, "N", second)`); err != nil || res.Err != nil {
+		t.Fatalf("unexpected result %#v, %v", res, err)
+	}
+	s, err := m.NewSession(context.Background(), io.Discard, SessionOptions{User: "me"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := m.EvalOnce(s, "nope"); err != nil {
+		t.Fatal(err)
+	}
+	if metrics := m.Metrics(); metrics.Commands != 2 || metrics.FailedCommands != 1 ||
+		metrics.Sessions != 2 || metrics.SessionsStarted != 2 {
+		t.Fatalf("unexpected metrics %#v", metrics)
+	}
+
+	for command, expected := range map[string]string{
+		"len(crawlspace.sessions())":               "2",
+		"crawlspace.sessions()[1]":                 "for me>",
+		"crawlspace.pausePoints()":                 `[]string{"state"}`,
+		"len(crawlspace.watches())":                "1",
+		"crawlspace.metrics().Sessions":            "2",
+		"crawlspace.instance.MaxElements":          "0",
+		"crawlspace.instance.MaxElements = 5":      "read-only",
+		"crawlspace.sessions()[0].Close()":         "read-only",
+		"std.crawlspace":                           "not found in namespace",
+		"s := crawlspace.sessions()[0]; s.Close()": "read-only",
+		"len(crawlspace.listeners())":              "0",
+	} {
+		res, err := m.EvalOnce(s, command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := res.ErrMessage
+		if res.Err == nil {
+			got = res.Reprs[0]
+		}
+		if !strings.Contains(got, expected) {
+			t.Fatalf("%q: got %q, expected %q", command, got, expected)
+		}
+	}
+	if other.Ended() {
+		t.Fatal("session was closed through immutable internals")
+	}
+
+	m.Internals = ModifyInternals
+	s2, err := m.NewSession(context.Background(), io.Discard, SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if res, err := m.EvalOnce(s2, "std.crawlspace.instance.MaxElements = 5"); err != nil || res.Err != nil {
+		t.Fatalf("unexpected result %#v, %v", res, err)
+	}
+	if m.MaxElements != 5 {
+		t.Fatalf("expected MaxElements to be modified, got %d", m.MaxElements)
+	}
+
+	m.Internals = HideInternals
+	s3, err := m.NewSession(context.Background(), io.Discard, SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s3.Close()
+	if res, err := m.EvalOnce(s3, "crawlspace"); err != nil || res.Err == nil {
+		t.Fatalf("expected crawlspace to be unbound, got %#v, %v", res, err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	m := NewWithSession(func(s *Session) reflectlang.Environment {
+		return reflectlang.Environment{
+			"greeting": reflect.ValueOf("hello " + s.User()),
+		}
+	})
+	s, err := m.NewSession(context.Background(), io.Discard, SessionOptions{User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ command, repr string }{
+		{"greeting", `"hello alice"`},
+		{"session.User()", `"alice"`},
+		{"session", "<session 1 for alice>"},
+		{`session.Set("k", 3)`, ""},
+		{`session.Get("k")`, "3"},
+	} {
+		res, err := m.EvalOnce(s, test.command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Err != nil {
+			t.Fatalf("%q: %v", test.command, res.Err)
+		}
+		if test.repr != "" && res.Reprs[0] != test.repr {
+			t.Fatalf("%q: unexpected result %q", test.command, res.Reprs[0])
+		}
+	}
+	if s.Get("k") != 3 {
+		t.Fatalf("unexpected stored value %#v", s.Get("k"))
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.Context().Done():
+	default:
+		t.Fatal("expected the session's context to be canceled")
+	}
+
+	s2, err := m.NewSession(context.Background(), io.Discard, SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if s2.ID() == s.ID() || s2.Get("k") != nil {
+		t.Fatal("expected sessions to be distinct")
+	}
+}
+
+func TestGoError(t *testing.T) {
+	m := New(nil)
+	var out strings.Builder
+	var mtx sync.Mutex
+	s, err := m.NewSession(context.Background(), writerFunc(func(p []byte) (int, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return out.Write(p)
+	}), SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	res, err := m.EvalOnce(s, "go (func() { missing })()")
+	if err != nil || res.Err != nil {
+		t.Fatal(err, res.Err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		mtx.Lock()
+		got := out.String()
+		mtx.Unlock()
+		if strings.Contains(got, "\ngo: ") && strings.Contains(got, "missing") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected output %q", got)
+		}
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (fn writerFunc) Write(p []byte) (int, error) { return fn(p) }
+
+func TestExec(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh")
+	}
+	var audits []ExecAudit
+	var logs []string
+	m := New(nil)
+	m.Logf = func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	m.Exec = ExecPolicy{
+		Allow:     map[string]string{"sh": sh},
+		Timeout:   100 * time.Millisecond,
+		MaxOutput: 4,
+		Audit:     func(audit ExecAudit) { audits = append(audits, audit) },
+	}
+	s, err := m.NewSession(context.Background(), io.Discard, SessionOptions{User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	res, err := m.EvalOnce(s, `exec("sh", "-c", "echo hello; exit 3")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Err != nil || len(res.Values) != 2 || !res.Values[1].IsNil() {
+		t.Fatalf("unexpected result %#v", res)
+	}
+	if result := res.Values[0].Interface().(ExecResult); result.Stdout != "hell" ||
+		!result.Truncated || result.ExitCode != 3 {
+		t.Fatalf("unexpected exec result %#v", result)
+	}
+
+	res, err = m.EvalOnce(s, `exec("rm", "-rf", "/")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := res.Values[1].Interface().(error); !errors.Is(err, ErrExecDenied) {
+		t.Fatalf("expected denial, got %#v", res)
+	}
+
+	res, err = m.EvalOnce(s, `exec("sh", "-c", "exec sleep 5")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := res.Values[1].Interface().(error); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected timeout, got %#v", res)
+	}
+
+	if len(audits) != 3 || audits[0].ExitCode != 3 || audits[0].Session != s ||
+		audits[1].Path != "" || audits[2].Err == nil {
+		t.Fatalf("unexpected audits %#v", audits)
+	}
+	if len(logs) != 3 || !strings.Contains(logs[1], "alice") || !strings.Contains(logs[1], `"rm"`) {
+		t.Fatalf("unexpected logs %q", logs)
+	}
+
+	// children that keep the command's output open are killed with it.
+	start := time.Now()
+	res, err = m.EvalOnce(s, `exec("sh", "-c", "sleep 5 & sleep 5")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := res.Values[1].Interface().(error); !errors.Is(err, context.DeadlineExceeded) ||
+		time.Since(start) > 2*time.Second {
+		t.Fatalf("expected timeout, got %#v", res)
+	}
+
+	m.Exec = ExecPolicy{}
+	s, err = m.NewSession(context.Background(), io.Discard, SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	res, err = m.EvalOnce(s, `exec("sh")`)
+	if err != nil || !errors.Is(res.Err, reflectlang.ErrUnboundVar) {
+		t.Fatalf("expected exec to be unbound, got %#v, %v", res, err)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	var mu sync.RWMutex
+	var events []string
+	release := make(chan struct{})
+	m := New(func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{
+			"block": reflect.ValueOf(func() { <-release }),
+			"tryWrite": reflect.ValueOf(func() bool {
+				if !mu.TryLock() {
+					return false
+				}
+				mu.Unlock()
+				return true
+			}),
+		}
+	})
+	m.RegisterPausePoint("state", PauseLocker(mu.RLocker()))
+	m.RegisterPausePoint("queue", PauseHooks(func(ctx context.Context) error {
+		events = append(events, "drain")
+		return nil
+	}, func() { events = append(events, "restart") }))
+	s, err := m.NewSession(context.Background(), io.Discard, SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, test := range []struct {
+		script   string
+		expected string
+	}{
+		{`freeze("tryWrite()")`, "false"},
+		{`freeze(func() { return tryWrite() })`, "false"},
+		{`freeze("tryWrite()", "queue")`, "true"},
+		{`tryWrite()`, "true"},
+	} {
+		res, err := m.EvalOnce(s, test.script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Err != nil || len(res.Reprs) != 1 || res.Reprs[0] != test.expected {
+			t.Fatalf("%q: unexpected result %#v", test.script, res)
+		}
+	}
+	if strings.Join(events, " ") != "drain restart drain restart drain restart" {
+		t.Fatalf("unexpected events %q", events)
+	}
+
+	events = nil
+	m.FreezeTimeout = 10 * time.Millisecond
+	m.RegisterPausePoint("stuck", PauseHooks(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, func() { t.Error("unexpected resume") }))
+	res, err := m.EvalOnce(s, `freeze("tryWrite()")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(res.Err, context.DeadlineExceeded) || !strings.Contains(res.ErrMessage, "stuck") {
+		t.Fatalf("unexpected result %#v", res)
+	}
+	if strings.Join(events, " ") != "drain restart" || !mu.TryLock() {
+		t.Fatalf("pause points weren't resumed: %q", events)
+	}
+	mu.Unlock()
+
+	m.RegisterPausePoint("stuck", nil)
+	for _, script := range []string{`freeze("1", "stuck")`, `freeze(1)`, `freeze()`} {
+		res, err := m.EvalOnce(s, script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Err == nil {
+			t.Fatalf("%q: expected error", script)
+		}
+	}
+
+	events = nil
+	go func() {
+		// block() waits on the paused lock, so it returns once freeze
+		// releases it.
+		mu.Lock()
+		mu.Unlock()
+		release <- struct{}{}
+	}()
+	res, err = m.EvalOnce(s, `freeze("block()")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(res.Err, reflectlang.ErrRuntime) || !strings.Contains(res.ErrMessage, "released") {
+		t.Fatalf("unexpected result %#v", res)
+	}
+	if strings.Join(events, " ") != "drain restart" {
+		t.Fatalf("pause points weren't released: %q", events)
+	}
+
+	res, err = m.EvalOnce(s, `readonly(); freeze("1")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(res.Err, reflectlang.ErrReadOnly) {
+		t.Fatalf("unexpected result %#v", res)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "discovery")
+	host, _ := os.Hostname()
+	api := Endpoint{Network: "tcp", Address: "127.0.0.1:1", Host: host,
+		Labels: map[string]string{"app": "api", "zone": "east"}}
+	worker := Endpoint{Network: "unix", Address: "/tmp/worker.sock", Host: host,
+		Labels: map[string]string{"app": "worker", "zone": "east"}}
+	removeAPI, err := Announce(dir, api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Announce(dir, worker); err != nil {
+		t.Fatal(err)
+	}
+	// a crashed process on this host, and one on another host.
+	if _, err := Announce(dir, Endpoint{Network: "tcp", Address: "127.0.0.1:2", PID: 1 << 30,
+		Host: host}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Announce(dir, Endpoint{Network: "tcp", Address: "10.0.0.1:3", PID: 1 << 30,
+		Host: host + ".elsewhere"}); err != nil {
+		t.Fatal(err)
+	}
+
+	eps, err := Discover(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addrs []string
+	for _, ep := range eps {
+		addrs = append(addrs, ep.Address)
+	}
+	if strings.Join(addrs, " ") != "/tmp/worker.sock 127.0.0.1:1 10.0.0.1:3" ||
+		eps[0].PID != os.Getpid() {
+		t.Fatalf("unexpected endpoints %v", eps)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 3 {
+		t.Fatalf("stale announcement wasn't removed: %v", files)
+	}
+
+	for selector, expected := range map[string]string{
+		"app=api":                   "127.0.0.1:1",
+		" app = worker , zone=east": "/tmp/worker.sock",
+		"zone=east":                 "2 crawlspace endpoints match",
+		"app=db":                    "no crawlspace endpoint matches",
+		"app":                       "expected key=value",
+	} {
+		labels, err := ParseSelector(selector)
+		var ep Endpoint
+		if err == nil {
+			ep, err = Pick(eps, labels)
+		}
+		if ep.Address != expected && (err == nil || !strings.Contains(err.Error(), expected)) {
+			t.Fatalf("%q: unexpected endpoint %v, %v", selector, ep, err)
+		}
+	}
+	if labels, err := ParseSelector(""); err != nil || len(labels) != 0 {
+		t.Fatalf("unexpected selector %v, %v", labels, err)
+	}
+
+	if err := removeAPI(); err != nil {
+		t.Fatal(err)
+	}
+	if eps, err := Discover(dir); err != nil || len(eps) != 2 {
+		t.Fatalf("unexpected endpoints %v, %v", eps, err)
+	}
+	if _, err := Announce(filepath.Join(dir, "missing", "nested"), api); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, fmt.Sprintf("%d-127.0.0.1_4.json", os.Getpid())), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Announce(dir, Endpoint{Network: "tcp", Address: "127.0.0.1:4"}); err == nil {
+		t.Fatal("expected announcing over a directory to fail")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(files) != 0 {
+		t.Fatalf("temporary files were left behind: %v", files)
+	}
+
+	// announcements that aren't regular files, or that belong to another
+	// user, are skipped.
+	if err := os.Symlink(filepath.Join(dir, fmt.Sprintf("%d-_tmp_worker.sock.json", os.Getpid())),
+		filepath.Join(dir, "1-127.0.0.1_5.json")); err != nil {
+		t.Fatal(err)
+	}
+	if os.Getuid() == 0 {
+		data, err := json.Marshal(Endpoint{Network: "tcp", Address: "127.0.0.1:6", PID: os.Getpid(), Host: host})
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "1-127.0.0.1_6.json")
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chown(path, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if eps, err := Discover(dir); err != nil || len(eps) != 2 {
+		t.Fatalf("unexpected endpoints %v, %v", eps, err)
+	}
+
+	// a directory other users can write to is refused.
+	shared := filepath.Join(t.TempDir(), "shared")
+	if err := os.Mkdir(shared, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Announce(shared, api); err == nil {
+		t.Fatal("expected announcing into a shared directory to fail")
+	}
+
+	worker.PID, worker.Auth, worker.BuildID, worker.Process = 42, "token", "build", "worker@v1"
+	annotations := worker.Annotations()
+	annotations["unrelated"] = "x"
+	ep, ok := EndpointFromAnnotations(annotations)
+	if !ok || !reflect.DeepEqual(ep, worker) {
+		t.Fatalf("unexpected endpoint %#v", ep)
+	}
+	if _, ok := EndpointFromAnnotations(map[string]string{AnnotationPrefix + "network": "tcp"}); ok {
+		t.Fatal("expected annotations without an address not to describe an endpoint")
+	}
+}
+
+// serveFleet serves a crawlspace for each environment, announced in dir
+// with the label name set to the environment's key.
+func serveFleet(t *testing.T, dir string, envs map[string]reflectlang.Environment) {
+	for name, env := range envs {
+		env := env
+		m := New(func(io.Writer) reflectlang.Environment {
+			e := reflectlang.NewStandardEnvironment()
+			for k, v := range env {
+				e[k] = v
+			}
+			return e
+		})
+		m.Conflicts = KeepEnvironment
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() { _ = m.Serve(l) }()
+		t.Cleanup(func() { _ = m.Shutdown(context.Background()) })
+		ep := EndpointFor(l)
+		ep.Labels = map[string]string{"name": name, "app": "test"}
+		remove, err := Announce(dir, ep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = remove() })
+	}
+}
+
+// lines renders as one line per element.
+type lines []string
+
+func (l lines) GoString() string { return strings.Join(l, "\n") }
+
+func TestCompare(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "discovery")
+	serveFleet(t, dir, map[string]reflectlang.Environment{
+		"a": {"xs": reflect.ValueOf(lines{"x", "y", "z"}), "n": reflect.ValueOf(1)},
+		"b": {"xs": reflect.ValueOf(lines{"x", "z", "w"}), "n": reflect.ValueOf(1)},
+	})
+
+	eps, err := Discover(dir)
+	if err != nil || len(eps) != 2 {
+		t.Fatalf("unexpected endpoints %v, %v", eps, err)
+	}
+	r, err := DialRemote(context.Background(), eps[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := r.Eval(context.Background(), "n + 1")
+	if err != nil || output != "2" {
+		t.Fatalf("unexpected output %q, %v", output, err)
+	}
+	output, err = r.Eval(context.Background(), "nope")
+	if err != nil || !strings.Contains(output, "nope") {
+		t.Fatalf("unexpected output %q, %v", output, err)
+	}
+	if _, err := r.Eval(context.Background(), "f("); !errors.Is(err, reflectlang.ErrIncomplete) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !strings.HasPrefix(r.Process(), processVersion) {
+		t.Fatalf("unexpected process %q", r.Process())
+	}
+	_ = r.Close()
+
+	hub := &Hub{Dir: dir, Timeout: 5 * time.Second}
+	m := New(hub.Env)
+	s, err := m.NewSession(context.Background(), io.Discard, SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	res, err := m.EvalOnce(s, `len(endpoints("app=test")?)`)
+	if err != nil || res.Err != nil || res.Reprs[0] != "2" {
+		t.Fatalf("unexpected result %#v, %v", res, err)
+	}
+	res, err = m.EvalOnce(s, `compare("name=a", "name=b", "xs")`)
+	if err != nil || res.Err != nil {
+		t.Fatalf("unexpected result %#v, %v", res, err)
+	}
+	c := res.Values[0].Interface().(Comparison)
+	diff := strings.SplitN(c.String(), "\n", 3)[2]
+	if c.Same() || !strings.HasPrefix(diff, "  x\n- y\n  z\n+ w\n") {
+		t.Fatalf("unexpected diff\n%s", c)
+	}
+	res, err = m.EvalOnce(s, `compare(endpoints("name=a")?[0], "name=b", "n")`)
+	if err != nil || res.Err != nil || !res.Values[0].Interface().(Comparison).Same() {
+		t.Fatalf("unexpected result %#v, %v", res, err)
+	}
+	res, err = m.EvalOnce(s, `compare("app=test", "name=b", "n")?`)
+	if err != nil || res.Err == nil || !strings.Contains(res.ErrMessage, "2 crawlspace endpoints") {
+		t.Fatalf("unexpected result %#v, %v", res, err)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "discovery")
+	values := map[string]*int64{"a": new(int64), "b": new(int64), "c": new(int64)}
+	*values["c"] = 1
+	envs := map[string]reflectlang.Environment{}
+	for name, v := range values {
+		envs[name] = reflectlang.Environment{
+			"n":   reflect.ValueOf(v).Elem(),
+			"set": reflect.ValueOf(func(x int64) { *v = x }),
+		}
+	}
+	serveFleet(t, dir, envs)
+	hub := &Hub{Dir: dir, Timeout: 5 * time.Second, Concurrency: 2}
+	m := New(hub.Env)
+	s, err := m.NewSession(context.Background(), io.Discard, SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	res, err := m.EvalOnce(s, `broadcast("app=test", "n")?`)
+	if err != nil || res.Err != nil {
+		t.Fatalf("unexpected result %#v, %v", res, err)
+	}
+	b := res.Values[0].Interface().(Broadcast)
+	outputs := map[string]int{}
+	for _, row := range b.Rows {
+		if row.Err != nil {
+			t.Fatal(row.Err)
+		}
+		outputs[row.Output]++
+	}
+	if len(b.Rows) != 3 || outputs["0"] != 2 || outputs["1"] != 1 ||
+		!strings.HasPrefix(b.String(), "3 endpoints, 2 distinct outputs, 0 failed\n") {
+		t.Fatalf("unexpected broadcast\n%s", b)
+	}
+
+	for _, expr := range []string{"set(5)", "unlock(); set(5)"} {
+		res, err := m.EvalOnce(s, fmt.Sprintf(`broadcast("name=a", %q)?`, expr))
+		if err != nil || res.Err != nil {
+			t.Fatalf("unexpected result %#v, %v", res, err)
+		}
+		b := res.Values[0].Interface().(Broadcast)
+		if len(b.Rows) != 1 || !strings.Contains(b.Rows[0].Output, "read-only") {
+			t.Fatalf("%q: unexpected broadcast\n%s", expr, b)
+		}
+	}
+	if *values["a"] != 0 {
+		t.Fatalf("broadcast changed a value")
+	}
+
+	// the target's own readonly doesn't keep its session writable.
+	var d int64
+	dir = filepath.Join(t.TempDir(), "discovery")
+	serveFleet(t, dir, map[string]reflectlang.Environment{"d": {
+		"readonly": reflect.ValueOf(func() {}),
+		"set":      reflect.ValueOf(func(x int64) { d = x }),
+	}})
+	hub.Dir = dir
+	res, err = m.EvalOnce(s, `broadcast("name=d", "set(5)")?`)
+	if err != nil || res.Err != nil {
+		t.Fatalf("unexpected result %#v, %v", res, err)
+	}
+	b = res.Values[0].Interface().(Broadcast)
+	if len(b.Rows) != 1 || !strings.Contains(b.Rows[0].Output, "read-only") || d != 0 {
+		t.Fatalf("unexpected broadcast\n%s", b)
+	}
+}
+
+func TestBroadcastCache(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "discovery")
+	a, b := new(int64), new(int64)
+	*b = 1
+	serveFleet(t, dir, map[string]reflectlang.Environment{
+		"a": {"n": reflect.ValueOf(a).Elem()},
+		"b": {"n": reflect.ValueOf(b).Elem()},
+	})
+	hub := &Hub{Dir: dir, Timeout: 5 * time.Second, CacheTTL: time.Hour}
+
+	// every process in the fleet is this test binary, so a pure expression
+	// is evaluated in only one of them.
+	res, err := hub.Broadcast(context.Background(), "app=test", "n", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Rows) != 2 || res.Rows[0].Output != res.Rows[1].Output ||
+		res.Rows[0].Cached == res.Rows[1].Cached || res.Rows[0].Endpoint.BuildID == "" {
+		t.Fatalf("unexpected broadcast\n%s", res)
+	}
+	first := res.Rows[0].Output
+
+	*a, *b = 2, 2
+	res, err = hub.Broadcast(context.Background(), "app=test", "n", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range res.Rows {
+		if !row.Cached || row.Output != first {
+			t.Fatalf("unexpected broadcast\n%s", res)
+		}
+	}
+	if !strings.HasPrefix(res.String(), "2 endpoints, 1 distinct outputs, 0 failed, 2 cached\n") {
+		t.Fatalf("unexpected broadcast\n%s", res)
+	}
+
+	res, err = hub.Broadcast(context.Background(), "app=test", "n", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range res.Rows {
+		if row.Cached || row.Output != "2" {
+			t.Fatalf("unexpected broadcast\n%s", res)
+		}
+	}
+}
+
+func TestNotebook(t *testing.T) {
+	dir := t.TempDir()
+	m := New(func(io.Writer) reflectlang.Environment {
+		return reflectlang.Environment{"x": reflect.ValueOf(5)}
+	})
+	m.NotebookFS = SpillDir(dir)
+	var out bytes.Buffer
+	input := "notebook.keep()\nx\nnotebook.keep()\nnotebook.note(\"looks <fine>\")\n" +
+		"nope\nnotebook.keep()\nnotebook.markdown()\n"
+	if err := m.Interact(strings.NewReader(input), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "there is no previous command to keep") ||
+		!strings.Contains(out.String(), "```\n> x\n5\n```") ||
+		!strings.Contains(out.String(), "notebook saved to "+filepath.Join(dir, "crawlspace-notebook-")) {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+
+	md, err := filepath.Glob(filepath.Join(dir, "*.md"))
+	if err != nil || len(md) != 1 {
+		t.Fatalf("unexpected files %v, %v", md, err)
+	}
+	data, err := os.ReadFile(md[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"# Crawlspace notebook\n\nSession ", "> x\n5\n",
+		"\nlooks <fine>\n", "> nope\nunbound variable"} {
+		if !strings.Contains(string(data), expected) {
+			t.Fatalf("missing %q in %s", expected, data)
+		}
+	}
+	data, err = os.ReadFile(strings.TrimSuffix(md[0], ".md") + ".html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"<p>looks &lt;fine&gt;</p>", `<pre class="failed"><b>&gt; nope</b>`} {
+		if !strings.Contains(string(data), expected) {
+			t.Fatalf("missing %q in %s", expected, data)
+		}
+	}
+
+	// by default, notebooks are saved in a private directory, and saving
+	// again writes new files.
+	t.Setenv("TMPDIR", t.TempDir())
+	m.NotebookFS = nil
+	interact(t, m, "notebook.note(\"a\")\nnotebook.save()\nnotebook.note(\"b\")\n")
+	md, err = filepath.Glob(filepath.Join(userTempDir("crawlspace-output"), "*.md"))
+	if err != nil || len(md) != 2 {
+		t.Fatalf("unexpected files %v, %v", md, err)
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	got := string(highlight(`if x < 1 then "<a>" else 5ms // why`))
+	expected := `<span class="keyword">if</span> x &lt; <span class="number">1</span> ` +
+		`<span class="keyword">then</span> <span class="string">&#34;&lt;a&gt;&#34;</span> ` +
+		`<span class="keyword">else</span> <span class="duration">5ms</span> <span class="comment">// why</span>`
+	if got != expected {
+		t.Fatalf("got %q, expected %q", got, expected)
+	}
+	if got := string(highlight(`x $ "y`)); got != `x $ <span class="string">&#34;y</span>` {
+		t.Fatalf("unexpected highlighting %q", got)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "crawlspace.sock")
+	cfg, err := LoadConfig(strings.NewReader(`{
+		"banner": "100% careful",
+		"startup": ["greeting := \"hi\""],
+		"limits": {"max_elements": 2, "slow_command": "1h"},
+		"profiles": {"viewer": {"read_only": true, "startup": ["who := \"viewer\""], "deny": ["*.Inc"],
+			"pure": ["time.Duration.String"]}},
+		"listeners": [{"network": "unix", "address": ` + fmt.Sprintf("%q", sock) + `, "profile": "viewer"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := New(func(io.Writer) reflectlang.Environment {
+		env := reflectlang.NewStandardEnvironment()
+		env["touch"] = reflect.ValueOf(func() {})
+		env["hits"] = reflect.ValueOf(&counter{Count: 3})
+		env["second"] = reflect.ValueOf(time.Second)
+		return env
+	})
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- m.ServeConfig(cfg) }()
+
+	var conn net.Conn
+	for i := 0; ; i++ {
+		if conn, err = net.Dial("unix", sock); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r, err := NewRemote(context.Background(), conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.banner) != 3 || r.banner[2] != "100% careful" {
+		t.Fatalf("unexpected banner %q", r.banner)
+	}
+	for command, expected := range map[string]string{
+		"greeting + who": `"hiviewer"`,
+		"touch()":        "read-only: line 1, column 6: cannot call func()",
+		"unlock()":       "read-only: the session was made read-only with readonly()",
+		"len(touch())": "read-only: line 1, column 10: cannot call func()\n" +
+			"\tat line 1, column 10: touch()\n\tat line 1, column 4: len(touch())",
+		"hits.Count":      "3",
+		"second.String()": `"1s"`,
+		"hits.Inc":        "access denied: line 1, column 5: github.com/jtolio/crawlspace.counter.Inc is not permitted",
+	} {
+		output, err := r.Eval(context.Background(), command)
+		if err != nil || output != expected {
+			t.Fatalf("%q: unexpected output %q, %v", command, output, err)
+		}
+	}
+	if limits := m.limits(); limits.MaxElements != 2 || limits.SlowCommand != Duration(time.Hour) {
+		t.Fatalf("limits not applied: %+v", limits)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serveErr; !errors.Is(err, ErrClosed) {
+		t.Fatalf("unexpected serve error %v", err)
+	}
+
+	for config, expected := range map[string][]string{
+		`{"listener": []}`:                            {`unknown field "listener"`},
+		`{"limits": {"slow_command": 5}}`:             {"durations are strings"},
+		`{"limits": {"freeze_timeout": "5 seconds"}}`: {`unknown unit " seconds"`},
+		`{"startup": ["x :="], "limits": {"safe_mode": -1},
+		  "auth": {"users": {"bob": {"profile": "admin"}}},
+		  "listeners": [{"address": ""}, {"address": "a", "network": "udp", "authenticate": true},
+		                {"address": "a", "tls": {"cert_file": "c"}}]}`: {
+			`config: startup command "x :="`, "limits can't be negative",
+			`user "bob": unknown profile "admin"`, "listener 0: missing address",
+			`listener "a": unsupported network "udp"`, `listener "a": authenticate needs tls`,
+			`listener "a": duplicate listener`, `listener "a": tls needs a cert_file and a key_file`},
+	} {
+		_, err := LoadConfig(strings.NewReader(config))
+		for _, problem := range expected {
+			if err == nil || !strings.Contains(err.Error(), problem) {
+				t.Fatalf("%s: expected error containing %q, got %v", config, problem, err)
+			}
+		}
+	}
+}
+
+// writeTestCerts writes PEM files to dir for a CA, a server certificate for
+// 127.0.0.1 named server, and client certificates named after users, all
+// signed by the CA. It returns the CA's pool.
+func writeTestCerts(t *testing.T, dir string, users ...string) *x509.CertPool {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err = x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, kind string, der []byte) {
+		data := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("ca.pem", "CERTIFICATE", caDER)
+	for i, name := range append([]string{"server"}, users...) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		if name == "server" {
+			cert.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+			cert.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+		}
+		der, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(name+".pem", "CERTIFICATE", der)
+		write(name+".key", "PRIVATE KEY", keyDER)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return pool
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	pool := writeTestCerts(t, dir, "alice", "bob", "mallory")
+	config := func(users, profiles, extra string) *Config {
+		t.Helper()
+		cfg, err := LoadConfig(strings.NewReader(fmt.Sprintf(`{
+			"profiles": {%s},
+			"auth": {"users": {%s}},
+			"listeners": [{"name": "ops", "address": "127.0.0.1:0", "profile": "viewer",
+			  "authenticate": true,
+			  "tls": {"cert_file": %q, "key_file": %q, "client_ca_file": %q}}%s]
+		}`, profiles, users, filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"),
+			filepath.Join(dir, "ca.pem"), extra)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	m := New(func(io.Writer) reflectlang.Environment {
+		env := reflectlang.NewStandardEnvironment()
+		env["touch"] = reflect.ValueOf(func() {})
+		return env
+	})
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- m.ServeConfig(config(`"alice": {"profile": "admin"}, "bob": {}`,
+			`"viewer": {"read_only": true}, "admin": {}`, ""))
+	}()
+	var addr string
+	for i := 0; addr == ""; i++ {
+		m.mtx.Lock()
+		if served := m.served["ops"]; served != nil {
+			addr = served.listener.Addr().String()
+		}
+		m.mtx.Unlock()
+		if i == 100 {
+			t.Fatal("ops listener not served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	connect := func(user string) (*Remote, error) {
+		cert, err := tls.LoadX509KeyPair(filepath.Join(dir, user+".pem"), filepath.Join(dir, user+".key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := tls.Dial("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool})
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return NewRemote(ctx, conn)
+	}
+	eval := func(r *Remote, command, expected string) {
+		t.Helper()
+		output, err := r.Eval(context.Background(), command)
+		if err != nil || output != expected {
+			t.Fatalf("%q: unexpected output %q, %v", command, output, err)
+		}
+	}
+	const readOnly = "read-only: line 1, column 6: cannot call func()"
+
+	alice, err := connect("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := connect("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := connect("mallory"); err == nil {
+		t.Fatal("expected mallory to be rejected")
+	}
+	eval(alice, "session.User()", `"alice"`)
+	eval(alice, "touch()", "(no results)")
+	eval(bob, "touch()", readOnly)
+
+	sock := filepath.Join(dir, "crawlspace.sock")
+	err = m.Reload(config(`"alice": {"profile": "admin"}`,
+		`"viewer": {"read_only": true}, "admin": {"read_only": true}`,
+		fmt.Sprintf(`, {"network": "unix", "address": %q}`, sock)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Eval(context.Background(), "1"); err == nil {
+		t.Fatal("expected bob's session to be revoked")
+	}
+	eval(alice, "touch()", readOnly)
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := NewRemote(context.Background(), conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eval(local, "touch()", "(no results)")
+
+	if err := m.Reload(&Config{Listeners: []ListenerConfig{{Network: "udp"}}}); err == nil {
+		t.Fatal("expected an invalid config to be rejected")
+	}
+	cfg := config("", `"viewer": {}`, "")
+	cfg.Listeners = cfg.Listeners[1:]
+	cfg.Listeners = append(cfg.Listeners, ListenerConfig{Network: "unix", Address: sock})
+	if err := m.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := connect("alice"); err == nil {
+		t.Fatal("expected the ops listener to be stopped")
+	}
+	eval(alice, "1 + 1", "2")
+
+	for _, r := range []*Remote{alice, bob, local} {
+		_ = r.Close()
+	}
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serveErr; !errors.Is(err, ErrClosed) {
+		t.Fatalf("unexpected serve error %v", err)
+	}
+}
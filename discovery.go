@@ -0,0 +1,276 @@
+package crawlspace
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Endpoint describes how to reach a crawlspace listener.
+type Endpoint struct {
+	Network string            `json:"network"`
+	Address string            `json:"address"`
+	Auth    string            `json:"auth,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	PID     int               `json:"pid,omitempty"`
+	// Host is the hostname of the process's host, so that Discover can
+	// tell which announcements are from processes it can check on.
+	Host    string `json:"host,omitempty"`
+	Process string `json:"process,omitempty"`
+	// BuildID identifies the process's build, so that processes running the
+	// same executable can be recognized.
+	BuildID string `json:"build_id,omitempty"`
+}
+
+// EndpointFor returns an Endpoint describing l in the current process.
+func EndpointFor(l net.Listener) Endpoint {
+	addr := l.Addr()
+	host, _ := os.Hostname()
+	return Endpoint{
+		Network: addr.Network(),
+		Address: addr.String(),
+		PID:     os.Getpid(),
+		Host:    host,
+		Process: processVersion,
+		BuildID: buildID(),
+	}
+}
+
+// Dial connects to the endpoint.
+func (ep Endpoint) Dial() (net.Conn, error) {
+	return net.Dial(ep.Network, ep.Address)
+}
+
+// Matches returns true if every label in selector has the same value in
+// the endpoint's labels.
+func (ep Endpoint) Matches(selector map[string]string) bool {
+	for k, v := range selector {
+		if ep.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (ep Endpoint) String() string {
+	return fmt.Sprintf("%s (pid %d, %s://%s)", ep.Process, ep.PID, ep.Network, ep.Address)
+}
+
+// DefaultDiscoveryDir is the directory Announce and Discover use when
+// given an empty directory. It is in os.TempDir(), named after the current
+// user's uid.
+func DefaultDiscoveryDir() string {
+	return userTempDir("crawlspace")
+}
+
+// Announce writes ep into the discovery directory dir so that it can be found
+// with Discover. dir is created if it doesn't exist, and it is an error if it
+// is not a directory that only the current user can access. The returned
+// function removes the announcement and should be called when the listener
+// is closed.
+func Announce(dir string, ep Endpoint) (remove func() error, err error) {
+	if dir == "" {
+		dir = DefaultDiscoveryDir()
+	}
+	if ep.PID == 0 {
+		ep.PID = os.Getpid()
+	}
+	if err := privateDir(dir); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(ep)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d-%s.json", ep.PID, sanitizeAddress(ep.Address)))
+	err = os.WriteFile(path+".tmp", data, 0600)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		_ = os.Remove(path + ".tmp")
+		return nil, err
+	}
+	return func() error { return os.Remove(path) }, nil
+}
+
+func sanitizeAddress(addr string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '[', ']':
+			return '_'
+		}
+		return r
+	}, addr)
+}
+
+// Discover returns all endpoints announced in the discovery directory dir,
+// ordered by pid and address. Unreadable entries, and entries that aren't
+// regular files owned by the current user, are skipped. Entries from
+// processes on this host that no longer exist, such as processes that
+// crashed before removing their announcements, are skipped and removed.
+func Discover(dir string) ([]Endpoint, error) {
+	if dir == "" {
+		dir = DefaultDiscoveryDir()
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	var eps []Endpoint
+	for _, path := range paths {
+		fi, err := os.Lstat(path)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if uid, ok := fileOwner(fi); ok && uid != os.Getuid() {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var ep Endpoint
+		if err := json.Unmarshal(data, &ep); err != nil {
+			continue
+		}
+		if host != "" && ep.Host == host && ep.PID != 0 && !processExists(ep.PID) {
+			_ = os.Remove(path)
+			continue
+		}
+		eps = append(eps, ep)
+	}
+	sort.Slice(eps, func(i, j int) bool {
+		if eps[i].PID != eps[j].PID {
+			return eps[i].PID < eps[j].PID
+		}
+		return eps[i].Address < eps[j].Address
+	})
+	return eps, nil
+}
+
+// processExists returns false if there is no process with pid on this
+// host. If it can't tell, it returns true.
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return !errors.Is(err, os.ErrProcessDone) && !errors.Is(err, syscall.ESRCH)
+}
+
+// ParseSelector parses a label selector of comma-separated key=value pairs,
+// as in "app=api,zone=east", for Matches and Pick. An empty selector matches
+// every endpoint.
+func ParseSelector(selector string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(selector, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		eq := strings.Index(pair, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("invalid label selector %q: expected key=value", selector)
+		}
+		labels[strings.TrimSpace(pair[:eq])] = strings.TrimSpace(pair[eq+1:])
+	}
+	return labels, nil
+}
+
+// Pick returns the single endpoint in eps matching selector. It is an error
+// if no endpoints or more than one endpoint match.
+func Pick(eps []Endpoint, selector map[string]string) (Endpoint, error) {
+	var matches []Endpoint
+	for _, ep := range eps {
+		if ep.Matches(selector) {
+			matches = append(matches, ep)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return Endpoint{}, fmt.Errorf("no crawlspace endpoint matches %v", selector)
+	case 1:
+		return matches[0], nil
+	}
+	descs := make([]string, 0, len(matches))
+	for _, ep := range matches {
+		descs = append(descs, ep.String())
+	}
+	return Endpoint{}, fmt.Errorf("%d crawlspace endpoints match %v: %s",
+		len(matches), selector, strings.Join(descs, ", "))
+}
+
+// AnnotationPrefix is the prefix used for Kubernetes annotation keys by
+// Annotations and EndpointFromAnnotations.
+const AnnotationPrefix = "crawlspace.jtolio.com/"
+
+// Annotations returns the endpoint encoded as Kubernetes pod annotations,
+// suitable for adding to a pod template so operators can find the endpoint
+// with kubectl.
+func (ep Endpoint) Annotations() map[string]string {
+	annotations := map[string]string{
+		AnnotationPrefix + "network": ep.Network,
+		AnnotationPrefix + "address": ep.Address,
+	}
+	if ep.Auth != "" {
+		annotations[AnnotationPrefix+"auth"] = ep.Auth
+	}
+	if ep.PID != 0 {
+		annotations[AnnotationPrefix+"pid"] = strconv.Itoa(ep.PID)
+	}
+	if ep.Host != "" {
+		annotations[AnnotationPrefix+"host"] = ep.Host
+	}
+	if ep.Process != "" {
+		annotations[AnnotationPrefix+"process"] = ep.Process
+	}
+	if ep.BuildID != "" {
+		annotations[AnnotationPrefix+"build"] = ep.BuildID
+	}
+	for k, v := range ep.Labels {
+		annotations[AnnotationPrefix+"label."+k] = v
+	}
+	return annotations
+}
+
+// EndpointFromAnnotations is the inverse of Annotations. It returns false if
+// the annotations don't describe an endpoint.
+func EndpointFromAnnotations(annotations map[string]string) (Endpoint, bool) {
+	var ep Endpoint
+	for k, v := range annotations {
+		if !strings.HasPrefix(k, AnnotationPrefix) {
+			continue
+		}
+		switch key := strings.TrimPrefix(k, AnnotationPrefix); {
+		case key == "network":
+			ep.Network = v
+		case key == "address":
+			ep.Address = v
+		case key == "auth":
+			ep.Auth = v
+		case key == "pid":
+			ep.PID, _ = strconv.Atoi(v)
+		case key == "host":
+			ep.Host = v
+		case key == "process":
+			ep.Process = v
+		case key == "build":
+			ep.BuildID = v
+		case strings.HasPrefix(key, "label."):
+			if ep.Labels == nil {
+				ep.Labels = map[string]string{}
+			}
+			ep.Labels[strings.TrimPrefix(key, "label.")] = v
+		}
+	}
+	return ep, ep.Network != "" && ep.Address != ""
+}
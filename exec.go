@@ -0,0 +1,201 @@
+package crawlspace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrExecDenied is returned by exec(...) for commands that aren't allowed.
+var ErrExecDenied = errors.New("command not allowed")
+
+// defaultExecOutput is how much of each of a command's stdout and stderr
+// exec(...) keeps, by default.
+const defaultExecOutput = 1 << 20
+
+// ExecPolicy controls the exec(...) session builtin, which runs a limited set
+// of host commands, for environments where commands like ss or nvidia-smi
+// are part of standard diagnostics. exec is only available if Allow is not
+// empty.
+type ExecPolicy struct {
+	// Allow maps the command names exec(...) accepts to the executables they
+	// run, as in "ss": "/usr/sbin/ss". Commands are run directly, not by a
+	// shell, with the session's arguments.
+	Allow map[string]string
+
+	// Timeout, if positive, is how long a command may run before it is
+	// killed. Commands are also killed when the session ends.
+	Timeout time.Duration
+
+	// MaxOutput is how many bytes of each of stdout and stderr are kept. If
+	// zero, 1 MiB is used.
+	MaxOutput int
+
+	// Audit, if not nil, is called for every exec(...), including denied
+	// ones, after it finishes. Every exec(...) is also logged with Logf.
+	Audit func(ExecAudit)
+}
+
+// ExecAudit describes a use of exec(...).
+type ExecAudit struct {
+	Session *Session
+	Command string
+	Args    []string
+	// Path is the executable run, or empty if the command was denied.
+	Path     string
+	Start    time.Time
+	Elapsed  time.Duration
+	ExitCode int
+	Err      error
+}
+
+// ExecResult is the result of exec(...). A command that runs but exits
+// with a non-zero code is not an error.
+type ExecResult struct {
+	Stdout, Stderr string
+	ExitCode       int
+	// Truncated is true if output beyond MaxOutput was discarded.
+	Truncated bool
+}
+
+// enabled returns true if exec(...) is available.
+func (p *ExecPolicy) enabled() bool { return len(p.Allow) > 0 }
+
+// exec implements exec(command, args...) for the session s.
+func (m *Crawlspace) exec(s *Session, command string, args ...string) (
+	res ExecResult, err error) {
+	audit := ExecAudit{Session: s, Command: command, Args: args, Start: time.Now(), ExitCode: -1}
+	defer func() {
+		audit.Elapsed, audit.ExitCode, audit.Err = time.Since(audit.Start), res.ExitCode, err
+		m.auditExec(audit)
+	}()
+
+	policy := &m.Exec
+	audit.Path = policy.Allow[command]
+	if audit.Path == "" {
+		return ExecResult{ExitCode: -1}, fmt.Errorf("%w: %q (allowed: %s)", ErrExecDenied,
+			command, strings.Join(policy.allowed(), ", "))
+	}
+	ctx := s.Context()
+	if policy.Timeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		defer cancel()
+	}
+	max := policy.MaxOutput
+	if max <= 0 {
+		max = defaultExecOutput
+	}
+	stdout, stderr := &limitedBuffer{max: max}, &limitedBuffer{max: max}
+	cmd := exec.Command(audit.Path, args...)
+	setProcessGroup(cmd)
+	err = runContext(ctx, cmd, stdout, stderr)
+	res = ExecResult{
+		Stdout:    stdout.String(),
+		Stderr:    stderr.String(),
+		ExitCode:  -1,
+		Truncated: stdout.truncated || stderr.truncated,
+	}
+	if cmd.ProcessState != nil {
+		res.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		err = nil
+	}
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("%s: %w", command, ctx.Err())
+	}
+	return res, err
+}
+
+// runContext runs cmd, copying its output to stdout and stderr. If ctx is
+// done first, cmd's process group is killed, and cmd's output pipes are
+// closed rather than waiting for any children that escaped it.
+func runContext(ctx context.Context, cmd *exec.Cmd, stdout, stderr io.Writer) error {
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	copied := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(stdout, stdoutPipe)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(stderr, stderrPipe)
+	}()
+	go func() {
+		wg.Wait()
+		close(copied)
+	}()
+	select {
+	case <-copied:
+	case <-ctx.Done():
+		killProcessGroup(cmd.Process)
+		_ = stdoutPipe.Close()
+		_ = stderrPipe.Close()
+		<-copied
+	}
+	return cmd.Wait()
+}
+
+func (m *Crawlspace) auditExec(audit ExecAudit) {
+	if m.Logf != nil {
+		outcome := fmt.Sprintf("exit %d", audit.ExitCode)
+		if audit.Err != nil {
+			outcome = audit.Err.Error()
+		}
+		m.Logf("crawlspace: %v: exec %q %q: %s (%v elapsed)", audit.Session, audit.Command,
+			audit.Args, outcome, audit.Elapsed.Round(time.Microsecond))
+	}
+	if m.Exec.Audit != nil {
+		m.Exec.Audit(audit)
+	}
+}
+
+// allowed returns the allowed command names, sorted.
+func (p *ExecPolicy) allowed() []string {
+	names := make([]string, 0, len(p.Allow))
+	for name := range p.Allow {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// limitedBuffer keeps the first max bytes written to it, and discards the
+// rest.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.max - b.buf.Len(); len(p) > room {
+		p, b.truncated = p[:room], true
+	}
+	_, _ = b.buf.Write(p)
+	return n, nil
+}
+
+func (b *limitedBuffer) String() string { return b.buf.String() }
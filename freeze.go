@@ -0,0 +1,208 @@
+package crawlspace
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+// defaultFreezeTimeout is how long freeze(...) waits for pause points, and
+// then holds them, by default.
+const defaultFreezeTimeout = 5 * time.Second
+
+// PausePoint is a place where the application can briefly stop mutating
+// related state, so that a session can read it consistently. Pause points
+// are registered with RegisterPausePoint and engaged with freeze(...).
+type PausePoint interface {
+	// Pause blocks until the state is safe to read and stays that way until
+	// Resume is called, or until ctx is done, in which case it returns an
+	// error and Resume isn't called.
+	Pause(ctx context.Context) error
+	// Resume lets the application continue.
+	Resume()
+}
+
+// PauseLocker returns a PausePoint that holds l while paused, such as a
+// sync.Mutex guarding the state, or the read side of a sync.RWMutex, as in
+// PauseLocker(mu.RLocker()), which stops writers but not readers.
+func PauseLocker(l sync.Locker) PausePoint {
+	return PauseHooks(func(ctx context.Context) error {
+		acquired := make(chan struct{})
+		go func() {
+			l.Lock()
+			close(acquired)
+		}()
+		select {
+		case <-acquired:
+			return nil
+		case <-ctx.Done():
+			// the lock can't be abandoned, so release it once it's acquired.
+			go func() {
+				<-acquired
+				l.Unlock()
+			}()
+			return ctx.Err()
+		}
+	}, l.Unlock)
+}
+
+// PauseHooks returns a PausePoint that calls pause and resume, such as hooks
+// that drain and restart a work queue.
+func PauseHooks(pause func(ctx context.Context) error, resume func()) PausePoint {
+	return pauseHooks{pause: pause, resume: resume}
+}
+
+type pauseHooks struct {
+	pause  func(ctx context.Context) error
+	resume func()
+}
+
+func (p pauseHooks) Pause(ctx context.Context) error { return p.pause(ctx) }
+func (p pauseHooks) Resume()                         { p.resume() }
+
+// RegisterPausePoint registers p under name for freeze(...), replacing any
+// pause point already registered under name. A nil p unregisters name.
+func (m *Crawlspace) RegisterPausePoint(name string, p PausePoint) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if p == nil {
+		delete(m.pausePoints, name)
+		return
+	}
+	if m.pausePoints == nil {
+		m.pausePoints = map[string]PausePoint{}
+	}
+	m.pausePoints[name] = p
+}
+
+// freeze implements freeze(f, names...), which engages the named pause
+// points, or all of them if none are named, calls f, a function with no
+// arguments or an expression string, and then releases the pause points,
+// returning f's results. Only one freeze happens at a time, and pause points
+// are engaged in order of name, so that freezes can't deadlock with each
+// other. If f takes longer than the freeze timeout, the pause points are
+// released anyway, so that the application can't stall on a slow f, and
+// freeze fails once f returns, since its results weren't read frozen.
+// Read-only sessions can't freeze.
+func (m *Crawlspace) freeze(env reflectlang.Environment, args []reflect.Value) (
+	[]reflect.Value, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("usage: freeze(f, names...)")
+	}
+	if reflectlang.IsReadOnly(env) {
+		return nil, fmt.Errorf("%w: cannot freeze in a read-only session", reflectlang.ErrReadOnly)
+	}
+	var call func() ([]reflect.Value, error)
+	fn := indirectInterface(args[0])
+	if callable, ok := asCallable(fn); ok {
+		call = func() ([]reflect.Value, error) { return callable.CallLowered(env, nil) }
+	} else if fn.Kind() == reflect.String {
+		expr := fn.String()
+		call = func() ([]reflect.Value, error) { return reflectlang.Eval(expr, env) }
+	} else {
+		return nil, fmt.Errorf("%w: freeze expected a function or an expression, not %s",
+			reflectlang.ErrTypeMismatch, reflectlang.Repr(fn))
+	}
+
+	m.mtx.Lock()
+	registered := make(map[string]PausePoint, len(m.pausePoints))
+	for name, p := range m.pausePoints {
+		registered[name] = p
+	}
+	m.mtx.Unlock()
+	var names []string
+	for _, arg := range args[1:] {
+		arg = indirectInterface(arg)
+		if arg.Kind() != reflect.String {
+			return nil, fmt.Errorf("%w: freeze expected pause point names", reflectlang.ErrTypeMismatch)
+		}
+		if registered[arg.String()] == nil {
+			return nil, fmt.Errorf("unknown pause point %q (registered: %s)", arg.String(),
+				strings.Join(sortedKeys(registered), ", "))
+		}
+		names = append(names, arg.String())
+	}
+	if len(args) == 1 {
+		names = sortedKeys(registered)
+	}
+	sort.Strings(names)
+
+	timeout := time.Duration(m.limits().FreezeTimeout)
+	if timeout <= 0 {
+		timeout = defaultFreezeTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	m.freezeMtx.Lock()
+	defer m.freezeMtx.Unlock()
+	for i, name := range names {
+		if err := registered[name].Pause(ctx); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				registered[names[j]].Resume()
+			}
+			return nil, fmt.Errorf("failed pausing %q: %w", name, err)
+		}
+	}
+	released := false
+	release := func() {
+		if !released {
+			released = true
+			for i := len(names) - 1; i >= 0; i-- {
+				registered[names[i]].Resume()
+			}
+		}
+	}
+	defer release()
+
+	type result struct {
+		values []reflect.Value
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		defer func() {
+			if r := recover(); r != nil {
+				res.err = &reflectlang.PanicError{Value: r}
+			}
+			done <- res
+		}()
+		res.values, res.err = call()
+	}()
+	hold := time.NewTimer(timeout)
+	defer hold.Stop()
+	select {
+	case res := <-done:
+		return res.values, res.err
+	case <-hold.C:
+	}
+	// f may be waiting on the application, such as for a paused lock, so
+	// the pause points are released before waiting for it to return.
+	release()
+	<-done
+	return nil, fmt.Errorf("%w: freeze released its pause points after %v, before f returned",
+		reflectlang.ErrRuntime, timeout)
+}
+
+func asCallable(v reflect.Value) (reflectlang.Callable, bool) {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil, false
+	}
+	c, ok := v.Interface().(reflectlang.Callable)
+	return c, ok
+}
+
+func sortedKeys(m map[string]PausePoint) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,437 @@
+package crawlspace
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+// defaultHubTimeout is how long a hub waits for a remote command by default.
+const defaultHubTimeout = 30 * time.Second
+
+// Hub provides the environment for a hub: a crawlspace for investigating a
+// fleet of processes through their own crawlspaces, as announced in a
+// discovery directory. Serve it with New(hub.Env).
+type Hub struct {
+	// Dir is the discovery directory endpoints are found in, as with
+	// Discover.
+	Dir string
+	// Timeout limits each remote command, including connecting. If zero, 30
+	// seconds is used.
+	Timeout time.Duration
+	// Concurrency is how many endpoints broadcast(...) evaluates in at once.
+	// If zero, 8 is used.
+	Concurrency int
+	// CacheTTL is how long outputs of cached(selector, "expr") are reused
+	// for. If zero, 1 minute is used.
+	CacheTTL time.Duration
+
+	cacheMtx sync.Mutex
+	cache    map[hubCacheKey]hubCacheEntry
+}
+
+// Env returns the standard environment with the hub's builtins:
+// endpoints(selector) lists the announced endpoints matching a label
+// selector, compare(a, b, "expr") evaluates expr in both a and b, each an
+// Endpoint or a selector matching exactly one endpoint, and renders the
+// difference between their outputs, and broadcast(selector, "expr")
+// evaluates expr in every endpoint matching selector and tabulates the
+// outputs. broadcast's sessions are made read-only with readonly() first,
+// and endpoints without readonly() are skipped, so expressions can't change
+// the fleet. cached(selector, "expr") is like broadcast, but for expressions
+// that depend only on the build, as with Hub.Broadcast.
+func (h *Hub) Env(out io.Writer) reflectlang.Environment {
+	env := reflectlang.NewStandardEnvironment()
+	reflectlang.DefineBuiltin(env, "endpoints", reflect.ValueOf(h.endpoints))
+	reflectlang.Std(env).SetDoc("endpoints", `endpoints("app=api") lists the announced `+
+		`endpoints matching a label selector`)
+	reflectlang.DefineBuiltin(env, "compare", reflect.ValueOf(h.compare))
+	reflectlang.Std(env).SetDoc("compare", `compare(a, b, "expr") evaluates expr in two `+
+		`processes and shows how their outputs differ`)
+	reflectlang.DefineBuiltin(env, "broadcast", reflect.ValueOf(
+		func(selector, expr string) (Broadcast, error) {
+			return h.Broadcast(context.Background(), selector, expr, false)
+		}))
+	reflectlang.Std(env).SetDoc("broadcast", `broadcast("app=api", "expr") evaluates expr `+
+		`read-only in every matching process and tabulates the outputs`)
+	reflectlang.DefineBuiltin(env, "cached", reflect.ValueOf(
+		func(selector, expr string) (Broadcast, error) {
+			return h.Broadcast(context.Background(), selector, expr, true)
+		}))
+	reflectlang.Std(env).SetDoc("cached", `cached("app=api", "expr") is broadcast for `+
+		`expressions that depend only on the build, evaluated once per build and cached`)
+	return env
+}
+
+func (h *Hub) endpoints(selector string) ([]Endpoint, error) {
+	labels, err := ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	eps, err := Discover(h.Dir)
+	if err != nil {
+		return nil, err
+	}
+	matches := []Endpoint{}
+	for _, ep := range eps {
+		if ep.Matches(labels) {
+			matches = append(matches, ep)
+		}
+	}
+	return matches, nil
+}
+
+// resolve returns the endpoint target refers to, either an Endpoint or a
+// selector matching exactly one endpoint.
+func (h *Hub) resolve(target interface{}) (Endpoint, error) {
+	switch target := target.(type) {
+	case Endpoint:
+		return target, nil
+	case *Endpoint:
+		if target != nil {
+			return *target, nil
+		}
+	case string:
+		labels, err := ParseSelector(target)
+		if err != nil {
+			return Endpoint{}, err
+		}
+		eps, err := Discover(h.Dir)
+		if err != nil {
+			return Endpoint{}, err
+		}
+		return Pick(eps, labels)
+	}
+	return Endpoint{}, fmt.Errorf("%w: expected an Endpoint or a label selector, not %T",
+		reflectlang.ErrTypeMismatch, target)
+}
+
+// eval evaluates command in a new session with ep.
+func (h *Hub) eval(ctx context.Context, ep Endpoint, command string) (string, error) {
+	output, err := h.session(ctx, ep, func(ctx context.Context, r *Remote) (string, error) {
+		return r.Eval(ctx, command)
+	})
+	if err != nil {
+		return "", fmt.Errorf("%v: %w", ep, err)
+	}
+	return output, nil
+}
+
+// session calls fn with a new session with ep, limited by Timeout.
+func (h *Hub) session(ctx context.Context, ep Endpoint,
+	fn func(ctx context.Context, r *Remote) (string, error)) (string, error) {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = defaultHubTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	r, err := DialRemote(ctx, ep)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = r.Close() }()
+	return fn(ctx, r)
+}
+
+// Comparison is the result of compare(a, b, "expr"). It renders as a line
+// diff of the outputs.
+type Comparison struct {
+	A, B             Endpoint
+	Expr             string
+	OutputA, OutputB string
+}
+
+func (h *Hub) compare(a, b interface{}, expr string) (Comparison, error) {
+	c := Comparison{Expr: expr}
+	var err error
+	if c.A, err = h.resolve(a); err != nil {
+		return c, err
+	}
+	if c.B, err = h.resolve(b); err != nil {
+		return c, err
+	}
+	errs := make(chan error, 1)
+	go func() {
+		var err error
+		c.OutputB, err = h.eval(context.Background(), c.B, expr)
+		errs <- err
+	}()
+	c.OutputA, err = h.eval(context.Background(), c.A, expr)
+	if errB := <-errs; err == nil {
+		err = errB
+	}
+	return c, err
+}
+
+// Same returns true if both processes had the same output.
+func (c Comparison) Same() bool { return c.OutputA == c.OutputB }
+
+func (c Comparison) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %v\n+++ %v\n", c.A, c.B)
+	if c.Same() {
+		fmt.Fprintf(&b, "(same output)\n")
+	}
+	for _, line := range diffLines(strings.Split(c.OutputA, "\n"), strings.Split(c.OutputB, "\n")) {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// GoString is the same as String, for rendering in sessions.
+func (c Comparison) GoString() string { return c.String() }
+
+// maxDiffCells bounds the work diffLines does. Larger inputs are shown as
+// entirely replaced.
+const maxDiffCells = 1 << 22
+
+// diffLines returns a line diff of a and b, with lines prefixed by "  ",
+// "- ", or "+ " for lines in both, only a, or only b, using the longest
+// common subsequence of lines.
+func diffLines(a, b []string) []string {
+	if (len(a)+1)*(len(b)+1) > maxDiffCells {
+		diff := make([]string, 0, len(a)+len(b))
+		for _, line := range a {
+			diff = append(diff, "- "+line)
+		}
+		for _, line := range b {
+			diff = append(diff, "+ "+line)
+		}
+		return diff
+	}
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			diff = append(diff, "  "+a[i])
+			i, j = i+1, j+1
+		case j == len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, "- "+a[i])
+			i++
+		default:
+			diff = append(diff, "+ "+b[j])
+			j++
+		}
+	}
+	return diff
+}
+
+// defaultHubConcurrency is how many endpoints broadcast(...) evaluates in at
+// once by default.
+const defaultHubConcurrency = 8
+
+// Broadcast is the result of broadcast(selector, "expr"). It renders as a
+// table of each endpoint's output.
+type Broadcast struct {
+	Selector string
+	Expr     string
+	Rows     []BroadcastRow
+}
+
+// BroadcastRow is an endpoint's part of a Broadcast. Err is set if the
+// expression couldn't be evaluated there, not if it failed; the failure is
+// the Output. Cached is true if Output came from another process with the
+// same build, or from the hub's cache.
+type BroadcastRow struct {
+	Endpoint Endpoint
+	Output   string
+	Err      error
+	Cached   bool
+}
+
+// Broadcast evaluates expr read-only in every endpoint matching selector, as
+// broadcast(...) does. If pure is true, expr is assumed to depend only on the
+// build of the process, like a version or a compiled-in default, so it is
+// evaluated in one process per build ID and its output is cached per build
+// ID for CacheTTL. This keeps frontends that repeat the same expressions,
+// such as dashboards, from hammering the fleet. Endpoints that don't
+// announce a build ID are always evaluated.
+func (h *Hub) Broadcast(ctx context.Context, selector, expr string, pure bool) (
+	Broadcast, error) {
+	eps, err := h.endpoints(selector)
+	if err != nil {
+		return Broadcast{}, err
+	}
+	b := Broadcast{Selector: selector, Expr: expr, Rows: make([]BroadcastRow, len(eps))}
+
+	// each group of rows is evaluated until one succeeds, whose output the
+	// rest of the group shares. Only pure expressions group rows, by build.
+	var groups [][]*BroadcastRow
+	byBuild := map[string]int{}
+	for i, ep := range eps {
+		row := &b.Rows[i]
+		row.Endpoint = ep
+		if pure && ep.BuildID != "" {
+			if output, ok := h.cached(ep.BuildID, expr); ok {
+				row.Output, row.Cached = output, true
+				continue
+			}
+			if j, ok := byBuild[ep.BuildID]; ok {
+				groups[j] = append(groups[j], row)
+				continue
+			}
+			byBuild[ep.BuildID] = len(groups)
+		}
+		groups = append(groups, []*BroadcastRow{row})
+	}
+
+	concurrency := h.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultHubConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, group := range groups {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(group []*BroadcastRow) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			for i, row := range group {
+				row.Output, row.Err = h.evalReadOnly(ctx, row.Endpoint, expr)
+				if row.Err != nil {
+					continue
+				}
+				for _, other := range group[i+1:] {
+					other.Output, other.Cached = row.Output, true
+				}
+				if pure && row.Endpoint.BuildID != "" {
+					h.store(row.Endpoint.BuildID, expr, row.Output)
+				}
+				return
+			}
+		}(group)
+	}
+	wg.Wait()
+	return b, nil
+}
+
+// defaultHubCacheTTL is how long cached outputs are reused by default.
+const defaultHubCacheTTL = time.Minute
+
+type hubCacheKey struct {
+	buildID, expr string
+}
+
+type hubCacheEntry struct {
+	output  string
+	expires time.Time
+}
+
+// cached returns the cached output of expr for buildID, if there is one
+// that hasn't expired.
+func (h *Hub) cached(buildID, expr string) (string, bool) {
+	h.cacheMtx.Lock()
+	defer h.cacheMtx.Unlock()
+	entry, ok := h.cache[hubCacheKey{buildID: buildID, expr: expr}]
+	if !ok || !time.Now().Before(entry.expires) {
+		return "", false
+	}
+	return entry.output, true
+}
+
+// store caches the output of expr for buildID, dropping expired entries.
+func (h *Hub) store(buildID, expr, output string) {
+	ttl := h.CacheTTL
+	if ttl <= 0 {
+		ttl = defaultHubCacheTTL
+	}
+	now := time.Now()
+	h.cacheMtx.Lock()
+	defer h.cacheMtx.Unlock()
+	if h.cache == nil {
+		h.cache = map[hubCacheKey]hubCacheEntry{}
+	}
+	for key, entry := range h.cache {
+		if !now.Before(entry.expires) {
+			delete(h.cache, key)
+		}
+	}
+	h.cache[hubCacheKey{buildID: buildID, expr: expr}] = hubCacheEntry{
+		output: output, expires: now.Add(ttl)}
+}
+
+// evalReadOnly evaluates command in a new session with ep, after making the
+// session read-only. readonly is called from std, since ep's environment may
+// bind its own.
+func (h *Hub) evalReadOnly(ctx context.Context, ep Endpoint, command string) (string, error) {
+	return h.session(ctx, ep, func(ctx context.Context, r *Remote) (string, error) {
+		output, err := r.Eval(ctx, "std.readonly()")
+		if err != nil {
+			return "", err
+		}
+		if output != "(no results)" {
+			return "", fmt.Errorf("can't make the session read-only: %s", output)
+		}
+		return r.Eval(ctx, command)
+	})
+}
+
+func (b Broadcast) String() string {
+	distinct := map[string]bool{}
+	failed, cached := 0, 0
+	for _, row := range b.Rows {
+		if row.Err != nil {
+			failed++
+		} else {
+			distinct[row.Output] = true
+		}
+		if row.Cached {
+			cached++
+		}
+	}
+	var out strings.Builder
+	fmt.Fprintf(&out, "%d endpoints, %d distinct outputs, %d failed", len(b.Rows),
+		len(distinct), failed)
+	if cached > 0 {
+		fmt.Fprintf(&out, ", %d cached", cached)
+	}
+	out.WriteByte('\n')
+	w := tabwriter.NewWriter(&out, 0, 8, 2, ' ', 0)
+	for _, row := range b.Rows {
+		output := row.Output
+		if row.Err != nil {
+			output = "error: " + row.Err.Error()
+		}
+		// continuation lines of multi-line outputs leave the endpoint
+		// column empty.
+		label := row.Endpoint.String()
+		for _, line := range strings.Split(output, "\n") {
+			fmt.Fprintf(w, "%s\t%s\n", label, line)
+			label = ""
+		}
+	}
+	_ = w.Flush()
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+// GoString is the same as String, for rendering in sessions.
+func (b Broadcast) GoString() string { return b.String() }
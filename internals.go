@@ -0,0 +1,134 @@
+package crawlspace
+
+import (
+	"net"
+	"reflect"
+	"sort"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+// InternalsPolicy controls the crawlspace session builtin, a namespace of
+// the Crawlspace's own state, for debugging the debugger when sessions
+// misbehave. Its members are instance, the Crawlspace itself, and the
+// functions sessions(), listeners(), pausePoints(), watches(), and
+// metrics().
+type InternalsPolicy int
+
+const (
+	// InspectInternals binds crawlspace immutably (see
+	// reflectlang.MarkImmutable), so it can be looked at but not changed.
+	// Since the std namespace can't be protected that way, crawlspace isn't
+	// bound there.
+	InspectInternals InternalsPolicy = iota
+	// ModifyInternals binds crawlspace like other session builtins, so that
+	// operators can, e.g., close stuck sessions or adjust limits.
+	ModifyInternals
+	// HideInternals doesn't bind crawlspace.
+	HideInternals
+)
+
+// Metrics are counts of what a Crawlspace has done, for monitoring it.
+type Metrics struct {
+	// Sessions is how many sessions are open, and SessionsStarted is how
+	// many were ever started.
+	Sessions        int
+	SessionsStarted uint64
+	// Commands is how many commands were evaluated by EvalOnce, and
+	// FailedCommands is how many of them failed.
+	Commands       uint64
+	FailedCommands uint64
+	// AcceptErrors and SessionErrors are how many errors were passed to
+	// OnAcceptError and OnSessionError.
+	AcceptErrors  uint64
+	SessionErrors uint64
+	// Listeners is how many listeners are being served.
+	Listeners int
+}
+
+// Metrics returns the crawlspace's metrics so far.
+func (m *Crawlspace) Metrics() Metrics {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	metrics := m.counts
+	metrics.Sessions = len(m.live)
+	metrics.SessionsStarted = m.lastSessionID
+	metrics.Listeners = len(m.listeners)
+	return metrics
+}
+
+// count updates the crawlspace's counts with f.
+func (m *Crawlspace) count(f func(counts *Metrics)) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	f(&m.counts)
+}
+
+// Sessions returns the open sessions, in the order they started.
+func (m *Crawlspace) Sessions() []*Session {
+	m.mtx.Lock()
+	sessions := make([]*Session, 0, len(m.live))
+	for s := range m.live {
+		sessions = append(sessions, s)
+	}
+	m.mtx.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].id < sessions[j].id })
+	return sessions
+}
+
+// bindInternals binds the crawlspace namespace in env, as InternalsPolicy
+// describes.
+func (m *Crawlspace) bindInternals(env reflectlang.Environment,
+	setBuiltin func(name string, v reflect.Value)) {
+	ns := reflectlang.NewNamespace("crawlspace", "the crawlspace's own state, for debugging it")
+	ns.Set("instance", reflect.ValueOf(m))
+	ns.SetDoc("instance", "instance is the *Crawlspace serving this session")
+	set := func(name, doc string, fn func() interface{}) {
+		ns.Set(name, reflectlang.LowerFunc(func(args []reflect.Value) ([]reflect.Value, error) {
+			return []reflect.Value{reflect.ValueOf(fn())}, nil
+		}))
+		ns.SetDoc(name, doc)
+	}
+	set("sessions", "sessions() returns the open sessions, in the order they started",
+		func() interface{} { return m.Sessions() })
+	set("listeners", "listeners() returns the addresses being served, in order",
+		func() interface{} {
+			m.mtx.Lock()
+			addrs := make([]net.Addr, 0, len(m.listeners))
+			for l := range m.listeners {
+				addrs = append(addrs, l.Addr())
+			}
+			m.mtx.Unlock()
+			sort.Slice(addrs, func(i, j int) bool { return addrs[i].String() < addrs[j].String() })
+			return addrs
+		})
+	set("pausePoints", "pausePoints() returns the names of the registered pause points",
+		func() interface{} {
+			m.mtx.Lock()
+			defer m.mtx.Unlock()
+			return sortedKeys(m.pausePoints)
+		})
+	set("watches", "watches() returns the running onchange watches of each open session, "+
+		"by session ID",
+		func() interface{} {
+			watches := map[uint64][]*Watch{}
+			for _, s := range m.Sessions() {
+				if running := s.Watches(); len(running) > 0 {
+					watches[s.id] = running
+				}
+			}
+			return watches
+		})
+	set("metrics", "metrics() returns counts of sessions, commands, and errors",
+		func() interface{} { return m.Metrics() })
+
+	switch m.Internals {
+	case ModifyInternals:
+		setBuiltin("crawlspace", reflect.ValueOf(ns))
+	case InspectInternals:
+		if _, exists := reflectlang.Lookup(env, "crawlspace"); !exists || m.Conflicts != KeepEnvironment {
+			env["crawlspace"] = reflect.ValueOf(ns)
+			reflectlang.MarkImmutable(env, "crawlspace")
+		}
+	}
+}
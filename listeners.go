@@ -0,0 +1,229 @@
+package crawlspace
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+// ErrClosed is returned by Serve and ServeWith after Shutdown is called, or
+// after Reload stops their listener.
+var ErrClosed = errors.New("crawlspace: closed")
+
+// ListenerOptions configures how connections from a single listener are
+// served, so that one Crawlspace can serve, e.g., a unix socket and a TLS
+// listener with different policies.
+type ListenerOptions struct {
+	// Name identifies the listener in logs. If empty, the listener's address
+	// is used.
+	Name string
+
+	// Authenticate, if not nil, is called with each new connection before a
+	// session starts. If it returns an error, the connection is closed.
+	// For a listener from crypto/tls, conn will be a *tls.Conn.
+	Authenticate func(conn net.Conn) error
+
+	// Telnet enables telnet terminal handling, for clients like Windows
+	// telnet. The client is asked to echo input locally, telnet commands
+	// are stripped from input, input line endings are normalized, and
+	// output lines end with CRLF.
+	Telnet bool
+
+	// User, if not nil, is called with each new connection, after
+	// Authenticate, to name who the session is for. For a listener from
+	// crypto/tls, conn will be a *tls.Conn.
+	User func(conn net.Conn) string
+
+	// Profile, if not nil, is called with the user of each new session,
+	// after User, to choose the session's policy.
+	Profile func(user string) Profile
+
+	// Env, if not nil, is used instead of the Crawlspace's environment
+	// constructor for sessions from this listener. SessionEnv, if not nil,
+	// takes precedence over Env.
+	Env        func(out io.Writer) reflectlang.Environment
+	SessionEnv func(s *Session) reflectlang.Environment
+
+	// listener is the name of the config listener being served, if any.
+	listener string
+}
+
+// ServeWith is like Serve but uses opts for connections accepted from l.
+// ServeWith can be called concurrently with different listeners. All of
+// them are stopped by Shutdown.
+func (m *Crawlspace) ServeWith(l net.Listener, opts ListenerOptions) error {
+	defer l.Close()
+	if !m.trackListener(l, true) {
+		return ErrClosed
+	}
+	defer m.trackListener(l, false)
+
+	name := opts.Name
+	if name == "" {
+		name = l.Addr().String()
+	}
+	envFn := opts.SessionEnv
+	switch {
+	case envFn != nil:
+	case opts.Env != nil:
+		envFn = sessionEnv(opts.Env)
+	default:
+		envFn = m.env
+	}
+
+	var delay time.Duration
+	retries := 0
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if m.isClosed() || !m.isListening(l) {
+				return ErrClosed
+			}
+			m.acceptError(name, err)
+			if m.AcceptRetry.retryable(err, retries) {
+				retries++
+				delay = m.AcceptRetry.next(delay)
+				time.Sleep(m.AcceptRetry.jitter(delay))
+				continue
+			}
+			return err
+		}
+		delay, retries = 0, 0
+		if !m.trackConn(conn, true) {
+			conn.Close()
+			return ErrClosed
+		}
+		go func() {
+			defer m.sessions.Done()
+			defer m.trackConn(conn, false)
+			defer conn.Close()
+			if opts.Authenticate != nil {
+				if err := opts.Authenticate(conn); err != nil {
+					m.sessionError(name, conn.RemoteAddr(), err)
+					return
+				}
+			}
+			var in io.Reader = conn
+			var out io.Writer = conn
+			if opts.Telnet {
+				if _, err := conn.Write(telnetNegotiation); err != nil {
+					m.sessionError(name, conn.RemoteAddr(), err)
+					return
+				}
+				in = &telnetReader{in: conn}
+				out = &telnetWriter{out: conn}
+			}
+			sessionOpts := SessionOptions{
+				RemoteAddr: conn.RemoteAddr(),
+				listener:   opts.listener,
+				disconnect: func() { _ = conn.Close() },
+			}
+			if opts.User != nil {
+				sessionOpts.User = opts.User(conn)
+			}
+			if opts.Profile != nil {
+				sessionOpts.Profile = opts.Profile(sessionOpts.User)
+			}
+			if err := m.interact(context.Background(), &eotTranslate{in}, out, envFn, sessionOpts); err != nil {
+				m.sessionError(name, conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Shutdown stops all listeners being served and waits for active sessions
+// to end. If ctx is canceled first, the remaining session connections are
+// closed, the contexts of live sessions are canceled, and ctx's error is
+// returned without waiting for the sessions to end, like
+// http.Server.Shutdown.
+func (m *Crawlspace) Shutdown(ctx context.Context) error {
+	m.mtx.Lock()
+	m.closed = true
+	for l := range m.listeners {
+		l.Close()
+	}
+	m.mtx.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.sessions.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		m.mtx.Lock()
+		for conn := range m.conns {
+			conn.Close()
+		}
+		for s := range m.live {
+			s.cancel()
+		}
+		m.mtx.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (m *Crawlspace) isClosed() bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.closed
+}
+
+func (m *Crawlspace) trackListener(l net.Listener, add bool) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if !add {
+		delete(m.listeners, l)
+		return true
+	}
+	if m.closed {
+		return false
+	}
+	if m.listeners == nil {
+		m.listeners = map[net.Listener]struct{}{}
+	}
+	m.listeners[l] = struct{}{}
+	return true
+}
+
+// isListening returns true if l is being served and wasn't stopped with
+// stopListener.
+func (m *Crawlspace) isListening(l net.Listener) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	_, ok := m.listeners[l]
+	return ok
+}
+
+// stopListener stops serving l, so that ServeWith returns ErrClosed.
+func (m *Crawlspace) stopListener(l net.Listener) {
+	m.mtx.Lock()
+	delete(m.listeners, l)
+	m.mtx.Unlock()
+	_ = l.Close()
+}
+
+func (m *Crawlspace) trackConn(conn net.Conn, add bool) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if !add {
+		delete(m.conns, conn)
+		return true
+	}
+	if m.closed {
+		return false
+	}
+	if m.conns == nil {
+		m.conns = map[net.Conn]struct{}{}
+	}
+	m.conns[conn] = struct{}{}
+	m.sessions.Add(1)
+	return true
+}
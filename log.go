@@ -0,0 +1,85 @@
+package crawlspace
+
+import (
+	"sync"
+	"time"
+)
+
+const errorLogInterval = 10 * time.Second
+
+// errorLimiter rate limits log lines, logging at most one line per
+// errorLogInterval. Lines in between are suppressed, and at the end of the
+// interval, the last of them is logged with how many were suppressed, so
+// that a burst of errors that stops is still reported.
+type errorLimiter struct {
+	// interval, if not zero, is used instead of errorLogInterval.
+	interval time.Duration
+
+	mtx        sync.Mutex
+	last       time.Time
+	suppressed int
+	// flush logs the suppressed lines at the end of the interval, if any
+	// were.
+	flush *time.Timer
+	// pending logs the last suppressed line.
+	pending func(suppressed int)
+}
+
+func (l *errorLimiter) logf(logf func(format string, args ...interface{}),
+	format string, args ...interface{}) {
+	if logf == nil {
+		return
+	}
+	log := func(suppressed int) {
+		if suppressed > 0 {
+			logf(format+" (%d similar errors suppressed)",
+				append(args[:len(args):len(args)], suppressed)...)
+			return
+		}
+		logf(format, args...)
+	}
+	interval := l.interval
+	if interval <= 0 {
+		interval = errorLogInterval
+	}
+
+	l.mtx.Lock()
+	now := time.Now()
+	if !l.last.IsZero() && now.Sub(l.last) < interval {
+		l.suppressed++
+		l.pending = log
+		if l.flush == nil {
+			l.flush = time.AfterFunc(l.last.Add(interval).Sub(now), l.flushSuppressed)
+		}
+		l.mtx.Unlock()
+		return
+	}
+	if l.flush != nil {
+		l.flush.Stop()
+		l.flush = nil
+	}
+	suppressed := l.suppressed
+	l.last, l.suppressed, l.pending = now, 0, nil
+	l.mtx.Unlock()
+
+	log(suppressed)
+}
+
+// flushSuppressed logs the last suppressed line, with how many were
+// suppressed, starting a new interval.
+func (l *errorLimiter) flushSuppressed() {
+	l.mtx.Lock()
+	suppressed, pending := l.suppressed, l.pending
+	if pending == nil {
+		// a line that wasn't suppressed already reported them.
+		l.mtx.Unlock()
+		return
+	}
+	l.last, l.suppressed, l.pending, l.flush = time.Now(), 0, nil, nil
+	l.mtx.Unlock()
+
+	if suppressed > 0 {
+		// the last suppressed line is logged itself, so it isn't counted.
+		pending(suppressed - 1)
+	}
+}
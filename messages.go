@@ -0,0 +1,104 @@
+package crawlspace
+
+import "strings"
+
+// Messages are the operator-facing strings of sessions, so that they can be
+// localized or rebranded. Empty fields use the defaults, which are noted
+// with each field. Formats use fmt verbs for the values described.
+//
+// Remote, and so Hub, expect the default Banner, Prompt, and NoResults, so
+// processes meant for a hub should keep them.
+type Messages struct {
+	// Banner is the format of the start of a session, with crawlspace's
+	// version and the process's version. Default: "%s\n%s\n".
+	Banner string
+	// Prompt is printed before each command. Default: "> ".
+	Prompt string
+	// Continuation is printed before each further line of a command that
+	// is incomplete, such as with a parenthesis left open. Default: "... ".
+	Continuation string
+
+	// NoResults is printed for commands without results, and OK for
+	// commands whose only result is a nil error. Defaults: "(no results)"
+	// and "ok".
+	NoResults string
+	OK        string
+
+	// ErrorPrefix is printed before command errors, and GoErrorPrefix
+	// before errors from go statements. Defaults: "" and "go: ".
+	ErrorPrefix   string
+	GoErrorPrefix string
+
+	// Elapsed is the format of how long a slow command took. Default:
+	// "(%v elapsed)".
+	Elapsed string
+	// SafeMode is the format of the notice that SafeMode made the session
+	// read-only, with the number of errors. Default: "safe mode: %d
+	// consecutive errors, the session is now read-only. run unlock() to
+	// continue."
+	SafeMode string
+	// Shadowed is the format of the warning that a session builtin shadows
+	// an environment value, with the name. Default: "warning: %q is shadowed
+	// by the session builtin".
+	Shadowed string
+	// Spilled and SpillFailed are the formats of the notices after a
+	// spilled result's first page, with its size and where it was spilled
+	// or why spilling failed. Defaults: "(%d bytes, spilled to %s)" and
+	// "(%d bytes, spilling failed: %v)".
+	Spilled     string
+	SpillFailed string
+	// NotebookSaved is the format of the notice that the session's notebook
+	// was saved, with the file names. Default: "notebook saved to %s".
+	NotebookSaved string
+	// Revoked is the notice that the session ended because Reload revoked
+	// its user. Default: "session ended: access revoked".
+	Revoked string
+}
+
+var defaultMessages = Messages{
+	Banner:        "%s\n%s\n",
+	Prompt:        "> ",
+	Continuation:  "... ",
+	NoResults:     "(no results)",
+	OK:            "ok",
+	GoErrorPrefix: "go: ",
+	Elapsed:       "(%v elapsed)",
+	SafeMode: "safe mode: %d consecutive errors, the session is now read-only. " +
+		"run unlock() to continue.",
+	Shadowed:      "warning: %q is shadowed by the session builtin",
+	Spilled:       "(%d bytes, spilled to %s)",
+	SpillFailed:   "(%d bytes, spilling failed: %v)",
+	NotebookSaved: "notebook saved to %s",
+	Revoked:       "session ended: access revoked",
+}
+
+// messages returns m.Messages with the defaults filled in.
+func (m *Crawlspace) messages() Messages {
+	msgs := m.Messages
+	for _, field := range []struct {
+		value *string
+		def   string
+	}{
+		{&msgs.Banner, defaultMessages.Banner},
+		{&msgs.Prompt, defaultMessages.Prompt},
+		{&msgs.Continuation, defaultMessages.Continuation},
+		{&msgs.NoResults, defaultMessages.NoResults},
+		{&msgs.OK, defaultMessages.OK},
+		{&msgs.GoErrorPrefix, defaultMessages.GoErrorPrefix},
+		{&msgs.Elapsed, defaultMessages.Elapsed},
+		{&msgs.SafeMode, defaultMessages.SafeMode},
+		{&msgs.Shadowed, defaultMessages.Shadowed},
+		{&msgs.Spilled, defaultMessages.Spilled},
+		{&msgs.SpillFailed, defaultMessages.SpillFailed},
+		{&msgs.NotebookSaved, defaultMessages.NotebookSaved},
+		{&msgs.Revoked, defaultMessages.Revoked},
+	} {
+		if *field.value == "" {
+			*field.value = field.def
+		}
+	}
+	if banner := m.currentConfig().Banner; banner != "" {
+		msgs.Banner += strings.ReplaceAll(banner, "%", "%%") + "\n"
+	}
+	return msgs
+}
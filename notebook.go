@@ -0,0 +1,298 @@
+package crawlspace
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+// NotebookEntry is a kept command with its output, or a note.
+type NotebookEntry struct {
+	Time time.Time
+	// Command and Output are set for kept commands. Failed is true if the
+	// command failed, in which case Output is its error.
+	Command string
+	Output  string
+	Failed  bool
+	// Note is set for notes.
+	Note string
+}
+
+// Notebook accumulates commands and notes selected during a session, to be
+// exported as an incident artifact. It is safe for concurrent use.
+type Notebook struct {
+	header string
+
+	mtx     sync.Mutex
+	entries []NotebookEntry
+	saved   int
+	saves   int
+}
+
+// Entries returns the notebook's entries so far.
+func (nb *Notebook) Entries() []NotebookEntry {
+	nb.mtx.Lock()
+	defer nb.mtx.Unlock()
+	return append([]NotebookEntry(nil), nb.entries...)
+}
+
+func (nb *Notebook) add(entry NotebookEntry) {
+	nb.mtx.Lock()
+	defer nb.mtx.Unlock()
+	nb.entries = append(nb.entries, entry)
+}
+
+// Markdown renders the notebook as a Markdown document.
+func (nb *Notebook) Markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Crawlspace notebook\n\n%s\n", nb.header)
+	for _, entry := range nb.Entries() {
+		fmt.Fprintf(&b, "\n## %s\n\n", entry.Time.UTC().Format(time.RFC3339))
+		if entry.Command == "" {
+			fmt.Fprintf(&b, "%s\n", entry.Note)
+			continue
+		}
+		text := "> " + entry.Command + "\n" + entry.Output
+		fence := "```"
+		for strings.Contains(text, fence) {
+			fence += "`"
+		}
+		fmt.Fprintf(&b, "%s\n%s\n%s\n", fence, text, fence)
+	}
+	return b.String()
+}
+
+var notebookHTML = template.Must(template.New("notebook").Funcs(template.FuncMap{
+	"highlight": highlight,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Crawlspace notebook</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: auto; }
+pre { background: #f4f4f4; padding: 0.5em; overflow-x: auto; }
+pre.failed { background: #fbeaea; }
+.keyword { color: #7a1f8c; }
+.number, .duration { color: #1f5c8c; }
+.string { color: #2e7d32; }
+.comment { color: #777; }
+</style>
+</head>
+<body>
+<h1>Crawlspace notebook</h1>
+<p>{{.Header}}</p>
+{{range .Entries}}<h2>{{.Time.UTC.Format "2006-01-02T15:04:05Z07:00"}}</h2>
+{{if .Command}}<pre{{if .Failed}} class="failed"{{end}}><b>&gt; {{highlight .Command}}</b>
+{{.Output}}</pre>
+{{else}}<p>{{.Note}}</p>
+{{end}}{{end}}</body>
+</html>
+`))
+
+// highlightedTokens are the kinds of tokens highlight marks, by their
+// class.
+var highlightedTokens = map[reflectlang.TokenKind]bool{
+	reflectlang.TokenKeyword: true, reflectlang.TokenNumber: true,
+	reflectlang.TokenDuration: true, reflectlang.TokenString: true,
+	reflectlang.TokenComment: true,
+}
+
+// highlight renders command as HTML, with its keywords, literals, and
+// comments in spans of classes named after their kinds.
+func highlight(command string) template.HTML {
+	// tokens come back even if some of the command can't be tokenized.
+	tokens, _ := reflectlang.Tokenize(command)
+	source := []rune(command)
+	var b strings.Builder
+	offset := 0
+	for _, tok := range tokens {
+		if !highlightedTokens[tok.Kind] {
+			continue
+		}
+		b.WriteString(template.HTMLEscapeString(string(source[offset:tok.Start.Offset])))
+		fmt.Fprintf(&b, `<span class="%s">%s</span>`, tok.Kind, template.HTMLEscapeString(tok.Text))
+		offset = tok.End.Offset
+	}
+	b.WriteString(template.HTMLEscapeString(string(source[offset:])))
+	return template.HTML(b.String())
+}
+
+// HTML renders the notebook as a standalone HTML document.
+func (nb *Notebook) HTML() string {
+	var b strings.Builder
+	err := notebookHTML.Execute(&b, struct {
+		Header  string
+		Entries []NotebookEntry
+	}{Header: nb.header, Entries: nb.Entries()})
+	if err != nil {
+		// the template only fails if writing does, which a strings.Builder
+		// doesn't.
+		panic(err)
+	}
+	return b.String()
+}
+
+// save writes the notebook to fsys as Markdown and HTML files named after
+// the session, unless nothing was added since it was last saved. Each save
+// writes new files, numbered after the first, rather than replacing the
+// previous ones. It returns the names of the files, or how they are known
+// on disk.
+func (nb *Notebook) save(fsys SpillFS, s *Session) ([]string, error) {
+	nb.mtx.Lock()
+	count, saved, saves := len(nb.entries), nb.saved, nb.saves
+	nb.mtx.Unlock()
+	if count == saved {
+		return nil, nil
+	}
+	base := fmt.Sprintf("crawlspace-notebook-%d-%s-%d", os.Getpid(),
+		s.start.UTC().Format("20060102T150405"), s.id)
+	if saves > 0 {
+		base += fmt.Sprintf("-%d", saves+1)
+	}
+	var names []string
+	for _, export := range []struct {
+		ext     string
+		content func() string
+	}{{".md", nb.Markdown}, {".html", nb.HTML}} {
+		name := base + export.ext
+		if err := spill(fsys, name, export.content()); err != nil {
+			return names, err
+		}
+		if dir, ok := fsys.(SpillDir); ok {
+			name = filepath.Join(string(dir), name)
+		}
+		names = append(names, name)
+	}
+	nb.mtx.Lock()
+	nb.saved, nb.saves = count, saves+1
+	nb.mtx.Unlock()
+	return names, nil
+}
+
+// document is an exported notebook, which renders as its text.
+type document string
+
+func (d document) GoString() string { return string(d) }
+
+// resultOutput returns what Interact shows for res, other than its summary
+// and timing.
+func resultOutput(res Result, msgs Messages) string {
+	if res.Err != nil {
+		return msgs.ErrorPrefix + res.ErrMessage
+	}
+	var lines []string
+	for i, repr := range res.Reprs {
+		if i == len(res.Values)-1 && isNilError(res.Values[i]) {
+			continue
+		}
+		lines = append(lines, resultText(repr, res.spill(i), msgs))
+	}
+	switch {
+	case len(res.Values) == 0:
+		lines = append(lines, msgs.NoResults)
+	case len(res.Values) == 1 && isNilError(res.Values[0]):
+		lines = append(lines, msgs.OK)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// notebookFS returns where notebooks are saved.
+func (m *Crawlspace) notebookFS() (SpillFS, error) {
+	if m.NotebookFS != nil {
+		return m.NotebookFS, nil
+	}
+	return defaultSpillDir()
+}
+
+// saveNotebook saves s's notebook, as described by Notebook.save.
+func (m *Crawlspace) saveNotebook(s *Session) ([]string, error) {
+	fsys, err := m.notebookFS()
+	if err != nil {
+		return nil, err
+	}
+	return s.notebook.save(fsys, s)
+}
+
+// bindNotebook gives s a notebook, saved when s is closed, and binds the
+// notebook namespace, whose commands add to it and export it.
+func (m *Crawlspace) bindNotebook(s *Session) {
+	header := fmt.Sprintf("Session %d", s.id)
+	if s.user != "" {
+		header += " for " + s.user
+	}
+	if s.remote != nil {
+		header += " from " + s.remote.String()
+	}
+	s.notebook = &Notebook{header: fmt.Sprintf("%s with %s, started %s.", header,
+		processVersion, s.start.UTC().Format(time.RFC3339))}
+	s.onClose = func() {
+		names, err := m.saveNotebook(s)
+		if err != nil && m.Logf != nil {
+			m.Logf("crawlspace: session %d: saving notebook: %v", s.id, err)
+		}
+		if len(names) > 0 {
+			s.mtx.Lock()
+			_, _ = fmt.Fprintf(s.out, m.messages().NotebookSaved+"\n", strings.Join(names, ", "))
+			s.mtx.Unlock()
+		}
+	}
+
+	ns := reflectlang.NewNamespace("notebook", "an incident notebook of selected commands and notes")
+	set := func(name, doc string, fn func(args []reflect.Value) ([]reflect.Value, error)) {
+		ns.Set(name, reflectlang.LowerFunc(fn))
+		ns.SetDoc(name, doc)
+	}
+	set("keep", "keep() adds the previous command and its output to the notebook",
+		func(args []reflect.Value) ([]reflect.Value, error) {
+			if len(args) != 0 {
+				return nil, fmt.Errorf("usage: notebook.keep()")
+			}
+			if s.previous.Command == "" {
+				return nil, fmt.Errorf("there is no previous command to keep")
+			}
+			s.notebook.add(NotebookEntry{
+				Time:    time.Now(),
+				Command: s.previous.Command,
+				Output:  resultOutput(s.previous, m.messages()),
+				Failed:  s.previous.Err != nil,
+			})
+			return nil, nil
+		})
+	set("note", `note("text") adds a note to the notebook`,
+		func(args []reflect.Value) ([]reflect.Value, error) {
+			if len(args) != 1 || args[0].Kind() != reflect.String {
+				return nil, fmt.Errorf("usage: notebook.note(\"text\")")
+			}
+			s.notebook.add(NotebookEntry{Time: time.Now(), Note: args[0].String()})
+			return nil, nil
+		})
+	set("markdown", "markdown() exports the notebook as Markdown",
+		func(args []reflect.Value) ([]reflect.Value, error) {
+			return []reflect.Value{reflect.ValueOf(document(s.notebook.Markdown()))}, nil
+		})
+	set("html", "html() exports the notebook as HTML",
+		func(args []reflect.Value) ([]reflect.Value, error) {
+			return []reflect.Value{reflect.ValueOf(document(s.notebook.HTML()))}, nil
+		})
+	set("save", "save() writes the notebook to files as Markdown and HTML, returning their "+
+		"names, as happens when the session ends",
+		func(args []reflect.Value) ([]reflect.Value, error) {
+			names, err := m.saveNotebook(s)
+			if err != nil {
+				return nil, err
+			}
+			if names == nil {
+				return nil, fmt.Errorf("there is nothing new in the notebook to save")
+			}
+			return []reflect.Value{reflect.ValueOf(names)}, nil
+		})
+	s.setBuiltin("notebook", reflect.ValueOf(ns))
+}
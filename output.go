@@ -0,0 +1,141 @@
+package crawlspace
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrClientTooSlow ends sessions whose clients fall more than OutputBuffer
+// bytes behind, when SlowClient is AbortSession.
+var ErrClientTooSlow = errors.New("client too slow")
+
+// SlowClientPolicy controls what happens when a session's output buffer is
+// full because the client isn't reading output fast enough.
+type SlowClientPolicy int
+
+const (
+	// DropOutput discards output that doesn't fit in the buffer. Once there
+	// is room again, a diagnostic saying how much was dropped is written.
+	DropOutput SlowClientPolicy = iota
+	// AbortSession ends the session with ErrClientTooSlow.
+	AbortSession
+)
+
+// asyncWriter buffers writes to out, writing them from a separate goroutine,
+// so that writers are never blocked by a slow out.
+type asyncWriter struct {
+	out    io.Writer
+	size   int
+	policy SlowClientPolicy
+
+	mtx     sync.Mutex
+	cond    sync.Cond
+	buf     []byte
+	dropped int
+	closed  bool
+	err     error
+	done    chan struct{}
+}
+
+func newAsyncWriter(out io.Writer, size int, policy SlowClientPolicy) *asyncWriter {
+	w := &asyncWriter{
+		out:    out,
+		size:   size,
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+	w.cond.L = &w.mtx
+	go w.flush()
+	return w
+}
+
+func (w *asyncWriter) Write(p []byte) (n int, err error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if w.dropped > 0 {
+		diag := droppedDiagnostic(w.dropped)
+		if len(w.buf)+len(diag)+len(p) > w.size {
+			w.dropped += len(p)
+			return len(p), nil
+		}
+		w.buf = append(w.buf, diag...)
+		w.dropped = 0
+	}
+	if len(w.buf)+len(p) > w.size {
+		if w.policy == AbortSession {
+			w.err = ErrClientTooSlow
+			w.cond.Signal()
+			return 0, w.err
+		}
+		room := w.size - len(w.buf)
+		if room < 0 {
+			room = 0
+		}
+		w.buf = append(w.buf, p[:room]...)
+		w.dropped += len(p) - room
+		w.cond.Signal()
+		return len(p), nil
+	}
+	w.buf = append(w.buf, p...)
+	w.cond.Signal()
+	return len(p), nil
+}
+
+func droppedDiagnostic(dropped int) string {
+	return fmt.Sprintf("\n(client too slow: %d bytes of output dropped)\n", dropped)
+}
+
+func (w *asyncWriter) flush() {
+	defer close(w.done)
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for {
+		for len(w.buf) == 0 && !w.closed && w.err == nil {
+			w.cond.Wait()
+		}
+		if w.err != nil || len(w.buf) == 0 {
+			return
+		}
+		chunk := w.buf
+		w.buf = nil
+		w.mtx.Unlock()
+		_, err := w.out.Write(chunk)
+		w.mtx.Lock()
+		if err != nil && w.err == nil {
+			w.err = err
+		}
+	}
+}
+
+// Close writes any remaining output and stops the writer. If the writer
+// already failed, it returns without waiting for the output to be written.
+func (w *asyncWriter) Close() error {
+	w.mtx.Lock()
+	if w.closed {
+		w.mtx.Unlock()
+		return nil
+	}
+	w.closed = true
+	if w.dropped > 0 {
+		w.buf = append(w.buf, droppedDiagnostic(w.dropped)...)
+		w.dropped = 0
+	}
+	err := w.err
+	w.cond.Signal()
+	w.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	<-w.done
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.err
+}
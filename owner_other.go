@@ -0,0 +1,9 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package crawlspace
+
+import "io/fs"
+
+// fileOwner returns false, as files have no owner uid on this platform.
+func fileOwner(fi fs.FileInfo) (uid int, ok bool) { return 0, false }
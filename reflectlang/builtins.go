@@ -0,0 +1,639 @@
+package reflectlang
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// EachResult is the outcome of evaluating an each(...) expression for one
+// element.
+type EachResult struct {
+	Index int
+	// Value is the expression's result, nil if it had none, or a
+	// []interface{} if it had more than one. A trailing error result is
+	// moved to Err.
+	Value interface{}
+	Err   error
+}
+
+// each implements each(xs, "expr"), which evaluates expr once per element of
+// the slice or array xs, with the element bound as it. Failures are recorded
+// per element rather than stopping the loop.
+func each(env Environment, args []reflect.Value) ([]reflect.Value, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf(`usage: each(xs, "expr")`)
+	}
+	xs, expr := args[0], args[1]
+	if xs.Kind() == reflect.Interface {
+		xs = xs.Elem()
+	}
+	if expr.Kind() == reflect.Interface {
+		expr = expr.Elem()
+	}
+	if expr.Kind() != reflect.String {
+		return nil, fmt.Errorf("each expected an expression string")
+	}
+	switch xs.Kind() {
+	case reflect.Slice, reflect.Array:
+	default:
+		return nil, fmt.Errorf("%w: each expected a slice or array, not %s", ErrTypeMismatch, typeName(xs))
+	}
+	val, err := Parse(expr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := allocate(env, int64(xs.Len())*int64(reflect.TypeOf(EachResult{}).Size()),
+		"results for %d elements", xs.Len()); err != nil {
+		return nil, err
+	}
+	results := make([]EachResult, 0, xs.Len())
+	for i := 0; i < xs.Len(); i++ {
+		scope := NewScope(env)
+		scope["it"] = xs.Index(i)
+		rv, err := run(val, scope)
+		result := EachResult{Index: i, Err: err}
+		if err == nil {
+			result.Value, result.Err = resultValue(rv)
+		}
+		results = append(results, result)
+	}
+	return []reflect.Value{reflect.ValueOf(results)}, nil
+}
+
+// resultValue returns rv as a single value, nil if empty, or []interface{}
+// if it has more than one value, after removing a trailing error result.
+func resultValue(rv []reflect.Value) (interface{}, error) {
+	var err error
+	if n := len(rv); n > 0 && rv[n-1].IsValid() && rv[n-1].Type() == errorType {
+		if !rv[n-1].IsNil() {
+			err = rv[n-1].Interface().(error)
+		}
+		rv = rv[:n-1]
+	}
+	values := make([]interface{}, 0, len(rv))
+	for _, v := range rv {
+		if v.IsValid() && v.CanInterface() {
+			values = append(values, v.Interface())
+		} else {
+			values = append(values, nil)
+		}
+	}
+	switch len(values) {
+	case 0:
+		return nil, err
+	case 1:
+		return values[0], err
+	}
+	return values, err
+}
+
+// RetryResult is the outcome of a retry(...) call.
+type RetryResult struct {
+	Attempts int
+	// Value is the result of the last attempt, as with EachResult.
+	Value interface{}
+	Err   error
+}
+
+// retry implements retry(n, backoff, f), which calls f, a function taking no
+// arguments or an expression string, up to n times until it succeeds. An
+// attempt fails if it panics, fails to evaluate, or returns a non-nil error
+// as its last result. The delay between attempts starts at backoff and
+// doubles after each attempt.
+func retry(env Environment, args []reflect.Value) ([]reflect.Value, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("usage: retry(n, backoff, func)")
+	}
+	n, backoff, fn := args[0], args[1], args[2]
+	if n.Kind() == reflect.Interface {
+		n = n.Elem()
+	}
+	if backoff.Kind() == reflect.Interface {
+		backoff = backoff.Elem()
+	}
+	if fn.Kind() == reflect.Interface {
+		fn = fn.Elem()
+	}
+	if !n.CanInt() || n.Int() < 1 {
+		return nil, fmt.Errorf("retry expected a positive number of attempts")
+	}
+	if !backoff.IsValid() || !backoff.CanInt() || !backoff.Type().ConvertibleTo(durationType) {
+		return nil, fmt.Errorf("retry expected a backoff duration")
+	}
+	delay := backoff.Convert(durationType).Interface().(time.Duration)
+
+	attempt, err := thunk(env, "retry", fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var result RetryResult
+	for result.Attempts < int(n.Int()) {
+		if result.Attempts > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		result.Attempts++
+		rv, err := run(evaluableFunc(attempt), env)
+		result.Value, result.Err = nil, err
+		if err == nil {
+			result.Value, result.Err = resultValue(rv)
+		}
+		if result.Err == nil {
+			break
+		}
+	}
+	return []reflect.Value{reflect.ValueOf(result)}, nil
+}
+
+// thunk returns a function that calls fn, a function with no arguments, or
+// evaluates it, if it is an expression string. name is the builtin that
+// takes fn, for errors.
+func thunk(env Environment, name string, fn reflect.Value) (func() ([]reflect.Value, error), error) {
+	if callable, ok := asCallable(fn); ok {
+		return func() ([]reflect.Value, error) { return callable.CallLowered(env, nil) }, nil
+	}
+	if fn.Kind() == reflect.Func && fn.Type().NumIn() == 0 {
+		if access, ok := funcAccess(fn); ok {
+			if p := policyOf(env, "$policy"); p != nil && !p.Permit(access) {
+				return nil, fmt.Errorf("%w: %s is not permitted", ErrDenied, access)
+			}
+		}
+		if IsReadOnly(env) && !pureCall(env, fn) {
+			return nil, fmt.Errorf("%w: cannot call %s", ErrReadOnly, typeName(fn))
+		}
+		return func() ([]reflect.Value, error) { return fn.Call(nil), nil }, nil
+	}
+	if fn.Kind() == reflect.String {
+		val, err := Parse(fn.String())
+		if err != nil {
+			return nil, err
+		}
+		return func() ([]reflect.Value, error) { return val.Run(env) }, nil
+	}
+	return nil, fmt.Errorf("%w: %s expected a function with no arguments or an expression, not %s",
+		ErrTypeMismatch, name, typeName(fn))
+}
+
+// panicValue implements panic(v), which fails evaluation with a PanicError
+// holding v, unless it is caught.
+func panicValue(args []reflect.Value) ([]reflect.Value, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("usage: panic(v)")
+	}
+	var v interface{}
+	if args[0].IsValid() && args[0].CanInterface() {
+		v = args[0].Interface()
+	}
+	return nil, &PanicError{Value: v}
+}
+
+// catch implements catch(f), which calls f, a function with no arguments or
+// an expression string, and returns its value and error, where the error is
+// the error f failed with, a panic included, or an error f returned last.
+func catch(env Environment, args []reflect.Value) ([]reflect.Value, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf(`usage: catch(func) or catch("expr")`)
+	}
+	fn := args[0]
+	if fn.Kind() == reflect.Interface {
+		fn = fn.Elem()
+	}
+	attempt, err := thunk(env, "catch", fn)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	rv, err := run(evaluableFunc(attempt), env)
+	if err == nil {
+		value, err = resultValue(rv)
+	}
+	return []reflect.Value{reflect.ValueOf(&value).Elem(), reflect.ValueOf(&err).Elem()}, nil
+}
+
+// evaluableFunc adapts a function to an Evaluable.
+type evaluableFunc func() ([]reflect.Value, error)
+
+func (f evaluableFunc) Run(env Environment) ([]reflect.Value, error) { return f() }
+
+// deleteEntry implements delete(m, key), which removes key from the map m,
+// like Go's delete. Deleting from a nil map or a missing key does nothing.
+func deleteEntry(env Environment, args []reflect.Value) ([]reflect.Value, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("usage: delete(m, key)")
+	}
+	m, key := args[0], args[1]
+	if m.Kind() == reflect.Interface {
+		m = m.Elem()
+	}
+	if m.Kind() != reflect.Map {
+		return nil, fmt.Errorf("%w: delete expected a map, not %s", ErrTypeMismatch, typeName(m))
+	}
+	if IsReadOnly(env) {
+		return nil, fmt.Errorf("%w: cannot delete from %s", ErrReadOnly, typeName(m))
+	}
+	if !m.CanInterface() {
+		return nil, fmt.Errorf("%w: cannot delete from a map obtained through an unexported field",
+			ErrTypeMismatch)
+	}
+	k, err := assignable(key, m.Type().Key(), false)
+	if err != nil {
+		// the key may be an untyped constant, such as 1 for a map[int32]T.
+		k, err = assignable(key, m.Type().Key(), true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !m.IsNil() {
+		m.SetMapIndex(k, reflect.Value{})
+	}
+	return nil, nil
+}
+
+// copyElements implements copy(dst, src), which copies elements from the
+// slice or string src to the slice dst, like Go's copy, returning how many
+// were copied.
+func copyElements(env Environment, args []reflect.Value) ([]reflect.Value, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("usage: copy(dst, src)")
+	}
+	dst, src := args[0], args[1]
+	if dst.Kind() == reflect.Interface {
+		dst = dst.Elem()
+	}
+	if src.Kind() == reflect.Interface {
+		src = src.Elem()
+	}
+	if dst.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("%w: copy expected a slice destination, not %s",
+			ErrTypeMismatch, typeName(dst))
+	}
+	switch {
+	case src.Kind() == reflect.String && dst.Type().Elem().Kind() == reflect.Uint8:
+	case src.Kind() == reflect.Slice || src.Kind() == reflect.Array:
+		if src.Type().Elem() != dst.Type().Elem() {
+			return nil, fmt.Errorf("%w: cannot copy %s to %s", ErrTypeMismatch,
+				typeName(src), typeName(dst))
+		}
+	default:
+		return nil, fmt.Errorf("%w: copy expected a slice or string source, not %s",
+			ErrTypeMismatch, typeName(src))
+	}
+	if IsReadOnly(env) {
+		return nil, fmt.Errorf("%w: cannot copy to %s", ErrReadOnly, typeName(dst))
+	}
+	if !dst.CanInterface() || !src.CanInterface() {
+		return nil, fmt.Errorf("%w: cannot copy a slice obtained through an unexported field",
+			ErrTypeMismatch)
+	}
+	return []reflect.Value{reflect.ValueOf(reflect.Copy(dst, src))}, nil
+}
+
+// selectRecv implements selectrecv(ch1, ch2, ..., timeout), which waits for
+// whichever channel can receive first, like a select statement of receive
+// cases, and returns the index of the channel, the received value, and
+// whether it was a value sent rather than the channel being closed. If the
+// optional final timeout, a time.Duration, passes first, the index is -1.
+// Receiving takes values other code is waiting for, so it isn't allowed in
+// read-only environments.
+func selectRecv(env Environment, args []reflect.Value) ([]reflect.Value, error) {
+	var cases []reflect.SelectCase
+	timeout := -1
+	for i, arg := range args {
+		if arg.Kind() == reflect.Interface {
+			arg = arg.Elem()
+		}
+		if i == len(args)-1 && i > 0 && arg.IsValid() && arg.Type() == durationType {
+			timer := time.NewTimer(arg.Interface().(time.Duration))
+			defer timer.Stop()
+			timeout = len(cases)
+			cases = append(cases, reflect.SelectCase{
+				Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)})
+			break
+		}
+		if arg.Kind() != reflect.Chan || arg.Type().ChanDir()&reflect.RecvDir == 0 {
+			return nil, fmt.Errorf("%w: selectrecv expected a channel to receive from, not %s",
+				ErrTypeMismatch, typeName(arg))
+		}
+		if !arg.CanInterface() {
+			return nil, fmt.Errorf("%w: cannot receive from a channel obtained through an "+
+				"unexported field", ErrTypeMismatch)
+		}
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: arg})
+	}
+	if len(cases) == 0 {
+		return nil, fmt.Errorf("usage: selectrecv(ch1, ch2, ..., timeout)")
+	}
+	if IsReadOnly(env) {
+		return nil, fmt.Errorf("%w: cannot receive from channels", ErrReadOnly)
+	}
+	chosen, val, ok := reflect.Select(cases)
+	if chosen == timeout {
+		return []reflect.Value{reflect.ValueOf(-1), reflect.ValueOf(nil), reflect.ValueOf(false)}, nil
+	}
+	return []reflect.Value{reflect.ValueOf(chosen), val, reflect.ValueOf(ok)}, nil
+}
+
+// sortedMapKeys returns the keys of args[0], a map, in the order of
+// compareKeys, for keys and values.
+func sortedMapKeys(name string, args []reflect.Value) (m reflect.Value, keys []reflect.Value,
+	err error) {
+	if len(args) != 1 {
+		return m, nil, fmt.Errorf("usage: %s(m)", name)
+	}
+	m = args[0]
+	if m.Kind() == reflect.Interface {
+		m = m.Elem()
+	}
+	if m.Kind() != reflect.Map {
+		return m, nil, fmt.Errorf("%w: %s expected a map, not %s", ErrTypeMismatch, name,
+			typeName(m))
+	}
+	if !m.CanInterface() {
+		return m, nil, fmt.Errorf("%w: cannot use a map obtained through an unexported field",
+			ErrTypeMismatch)
+	}
+	keys = m.MapKeys()
+	sort.SliceStable(keys, func(i, j int) bool { return compareKeys(keys[i], keys[j]) < 0 })
+	return m, keys, nil
+}
+
+// keys implements keys(m), which returns the keys of the map m as a sorted
+// slice.
+func keys(env Environment, args []reflect.Value) ([]reflect.Value, error) {
+	m, keys, err := sortedMapKeys("keys", args)
+	if err != nil {
+		return nil, err
+	}
+	if err := allocate(env, int64(len(keys))*int64(m.Type().Key().Size()),
+		"keys of %d entries", len(keys)); err != nil {
+		return nil, err
+	}
+	rv := reflect.MakeSlice(reflect.SliceOf(m.Type().Key()), len(keys), len(keys))
+	for i, key := range keys {
+		rv.Index(i).Set(key)
+	}
+	return []reflect.Value{rv}, nil
+}
+
+// values implements values(m), which returns the values of the map m as a
+// slice, in the order of keys(m).
+func values(env Environment, args []reflect.Value) ([]reflect.Value, error) {
+	m, keys, err := sortedMapKeys("values", args)
+	if err != nil {
+		return nil, err
+	}
+	if err := allocate(env, int64(len(keys))*int64(m.Type().Elem().Size()),
+		"values of %d entries", len(keys)); err != nil {
+		return nil, err
+	}
+	rv := reflect.MakeSlice(reflect.SliceOf(m.Type().Elem()), len(keys), len(keys))
+	for i, key := range keys {
+		rv.Index(i).Set(m.MapIndex(key))
+	}
+	return []reflect.Value{rv}, nil
+}
+
+// sprintf implements sprintf(format, args...), which formats like
+// fmt.Sprintf.
+func sprintf(env Environment, args []reflect.Value) ([]reflect.Value, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("usage: sprintf(format, args...)")
+	}
+	format := args[0]
+	if format.Kind() == reflect.Interface {
+		format = format.Elem()
+	}
+	if format.Kind() != reflect.String {
+		return nil, fmt.Errorf("%w: sprintf expected a format string, not %s", ErrTypeMismatch,
+			typeName(format))
+	}
+	operands := make([]interface{}, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		switch {
+		case !arg.IsValid():
+			operands = append(operands, nil)
+		case arg.CanInterface():
+			operands = append(operands, arg.Interface())
+		default:
+			// fmt prints values obtained through unexported fields, which
+			// can't be converted to interfaces, as reflect.Values.
+			operands = append(operands, arg)
+		}
+	}
+	rv := reflect.ValueOf(fmt.Sprintf(format.String(), operands...))
+	if err := allocate(env, int64(rv.Len()), "a string of %d bytes", rv.Len()); err != nil {
+		return nil, err
+	}
+	return []reflect.Value{rv}, nil
+}
+
+var regexpType = reflect.TypeOf((*regexp.Regexp)(nil))
+
+// regex implements regex(pattern), which compiles a regular expression.
+func regex(args []reflect.Value) ([]reflect.Value, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("usage: regex(pattern)")
+	}
+	re, err := asRegexp("regex", args[0])
+	if err != nil {
+		return nil, err
+	}
+	return []reflect.Value{reflect.ValueOf(re)}, nil
+}
+
+// asRegexp returns pattern as a regular expression, compiling it if it is a
+// string.
+func asRegexp(name string, pattern reflect.Value) (*regexp.Regexp, error) {
+	if pattern.Kind() == reflect.Interface {
+		pattern = pattern.Elem()
+	}
+	switch {
+	case pattern.Kind() == reflect.String:
+		return regexp.Compile(pattern.String())
+	case pattern.IsValid() && pattern.Type() == regexpType && !pattern.IsNil():
+		return pattern.Interface().(*regexp.Regexp), nil
+	}
+	return nil, fmt.Errorf("%w: %s expected a pattern string or regex, not %s", ErrTypeMismatch,
+		name, typeName(pattern))
+}
+
+// regexOperands returns the regular expression and string arguments of
+// match and find.
+func regexOperands(name string, args []reflect.Value) (*regexp.Regexp, string, error) {
+	if len(args) != 2 {
+		return nil, "", fmt.Errorf("usage: %s(pattern, s)", name)
+	}
+	re, err := asRegexp(name, args[0])
+	if err != nil {
+		return nil, "", err
+	}
+	s := args[1]
+	if s.Kind() == reflect.Interface {
+		s = s.Elem()
+	}
+	if s.Kind() != reflect.String {
+		return nil, "", fmt.Errorf("%w: %s expected a string, not %s", ErrTypeMismatch, name,
+			typeName(s))
+	}
+	return re, s.String(), nil
+}
+
+// match implements match(pattern, s), which reports whether s contains a
+// match of pattern.
+func match(args []reflect.Value) ([]reflect.Value, error) {
+	re, s, err := regexOperands("match", args)
+	if err != nil {
+		return nil, err
+	}
+	return []reflect.Value{reflect.ValueOf(re.MatchString(s))}, nil
+}
+
+// find implements find(pattern, s), which returns all matches of pattern in
+// s.
+func find(args []reflect.Value) ([]reflect.Value, error) {
+	re, s, err := regexOperands("find", args)
+	if err != nil {
+		return nil, err
+	}
+	matches := re.FindAllString(s, -1)
+	if matches == nil {
+		matches = []string{}
+	}
+	return []reflect.Value{reflect.ValueOf(matches)}, nil
+}
+
+// grep implements grep(pattern, xs), which returns the strings of the slice
+// or array xs that contain a match of pattern, as a slice of xs's element
+// type.
+func grep(env Environment, args []reflect.Value) ([]reflect.Value, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("usage: grep(pattern, xs)")
+	}
+	re, err := asRegexp("grep", args[0])
+	if err != nil {
+		return nil, err
+	}
+	xs := args[1]
+	if xs.Kind() == reflect.Interface {
+		xs = xs.Elem()
+	}
+	if (xs.Kind() != reflect.Slice && xs.Kind() != reflect.Array) ||
+		xs.Type().Elem().Kind() != reflect.String {
+		return nil, fmt.Errorf("%w: grep expected a slice of strings, not %s", ErrTypeMismatch,
+			typeName(xs))
+	}
+	matches := reflect.MakeSlice(reflect.SliceOf(xs.Type().Elem()), 0, 0)
+	for i := 0; i < xs.Len(); i++ {
+		if re.MatchString(xs.Index(i).String()) {
+			matches = reflect.Append(matches, xs.Index(i))
+		}
+	}
+	if err := allocate(env, int64(matches.Len())*int64(matches.Type().Elem().Size()),
+		"%d matches", matches.Len()); err != nil {
+		return nil, err
+	}
+	return []reflect.Value{matches}, nil
+}
+
+// compareKeys orders map keys the way fmt prints maps: numbers, strings,
+// and bools by value, with NaNs first and false before true, pointers and
+// channels by address, structs and arrays element by element, and
+// interfaces by their dynamic types' names, and then by value. It returns
+// -1, 0, or 1.
+func compareKeys(a, b reflect.Value) int {
+	if a.Kind() != b.Kind() {
+		return compareOrdered(a.Kind() < b.Kind(), a.Kind() > b.Kind())
+	}
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return compareOrdered(a.Int() < b.Int(), a.Int() > b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr:
+		return compareOrdered(a.Uint() < b.Uint(), a.Uint() > b.Uint())
+	case reflect.String:
+		return compareOrdered(a.String() < b.String(), a.String() > b.String())
+	case reflect.Float32, reflect.Float64:
+		return compareFloats(a.Float(), b.Float())
+	case reflect.Complex64, reflect.Complex128:
+		if c := compareFloats(real(a.Complex()), real(b.Complex())); c != 0 {
+			return c
+		}
+		return compareFloats(imag(a.Complex()), imag(b.Complex()))
+	case reflect.Bool:
+		return compareOrdered(!a.Bool() && b.Bool(), a.Bool() && !b.Bool())
+	case reflect.Pointer, reflect.UnsafePointer, reflect.Chan:
+		return compareOrdered(a.Pointer() < b.Pointer(), a.Pointer() > b.Pointer())
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if c := compareKeys(a.Field(i), b.Field(i)); c != 0 {
+				return c
+			}
+		}
+		return 0
+	case reflect.Array:
+		for i := 0; i < a.Len(); i++ {
+			if c := compareKeys(a.Index(i), b.Index(i)); c != 0 {
+				return c
+			}
+		}
+		return 0
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return compareOrdered(a.IsNil() && !b.IsNil(), !a.IsNil() && b.IsNil())
+		}
+		ta, tb := a.Elem().Type().String(), b.Elem().Type().String()
+		if ta != tb {
+			return compareOrdered(ta < tb, ta > tb)
+		}
+		return compareKeys(a.Elem(), b.Elem())
+	}
+	return 0
+}
+
+func compareOrdered(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return compareOrdered(math.IsNaN(a) && !math.IsNaN(b), !math.IsNaN(a) && math.IsNaN(b))
+	}
+	return compareOrdered(a < b, a > b)
+}
+
+// parseTime implements time(s), which parses s as an RFC 3339 timestamp, or
+// a date alone, as in 2006-01-02, for midnight UTC.
+func parseTime(args []reflect.Value) ([]reflect.Value, error) {
+	if len(args) != 1 || args[0].Kind() != reflect.String {
+		return nil, fmt.Errorf("usage: time(\"2006-01-02T15:04:05Z\")")
+	}
+	s := args[0].String()
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		var dateErr error
+		if t, dateErr = time.Parse("2006-01-02", s); dateErr != nil {
+			return nil, err
+		}
+	}
+	return []reflect.Value{reflect.ValueOf(t)}, nil
+}
+
+// now implements now(), which returns the current time.
+func now(args []reflect.Value) ([]reflect.Value, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("usage: now()")
+	}
+	return []reflect.Value{reflect.ValueOf(time.Now())}, nil
+}
@@ -0,0 +1,548 @@
+package reflectlang
+
+import (
+	"reflect"
+	"sort"
+)
+
+// Check finds problems in expr without running it: names that are bound
+// neither in env nor by expr itself, and fields and methods that don't exist
+// on the values they are accessed on, where the checker knows the values'
+// types. It knows the types of the values bound in env, of literals and
+// conversions, and of what is reached from them by fields, methods, calls,
+// indexing, and range, and of variables defined from those, unless they are
+// later assigned values of other types. Function literals are checked with
+// every name their enclosing scopes bind, since they may be called after
+// those names are bound. Importing a package without naming it, or with
+// import ., binds names only env's importer knows, so no unbound names are
+// reported after such an import. The problems are returned in source order.
+func Check(expr Evaluable, env Environment) []Diagnostic {
+	c := &checker{env: env}
+	c.check(expr)
+	sort.SliceStable(c.diagnostics, func(i, j int) bool {
+		a, b := c.diagnostics[i], c.diagnostics[j]
+		return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+	})
+	return c.diagnostics
+}
+
+// check checks expr, and then the function literals in it.
+func (c *checker) check(expr Evaluable) {
+	c.expr(expr, &checkScope{names: map[string]reflect.Type{}})
+	for len(c.funcs) > 0 {
+		fn := c.funcs[0]
+		c.funcs = c.funcs[1:]
+		scope := fn.scope.nest()
+		for _, param := range fn.lit.Params {
+			scope.define(param.Name, nil)
+		}
+		c.block(fn.lit.Body, scope)
+	}
+}
+
+type checker struct {
+	env         Environment
+	diagnostics []Diagnostic
+	// funcs are the function literals yet to be checked, which are checked
+	// after everything else.
+	funcs []pendingFunc
+	// open is true once expr has imported names the checker doesn't know.
+	open bool
+	// probe, if set, is called with the scope of each Ident and the value
+	// of each FieldAccess the checker comes across, for completion.
+	probe func(n Evaluable, s *checkScope, val fact)
+}
+
+type pendingFunc struct {
+	lit   *FuncLit
+	scope *checkScope
+}
+
+// checkScope is the names bound by expr in one of the scopes it runs in,
+// with their types, or nil where their types aren't known.
+type checkScope struct {
+	parent *checkScope
+	names  map[string]reflect.Type
+}
+
+func (s *checkScope) nest() *checkScope {
+	return &checkScope{parent: s, names: map[string]reflect.Type{}}
+}
+
+func (s *checkScope) define(name string, typ reflect.Type) {
+	if name != "_" {
+		s.names[name] = typ
+	}
+}
+
+// lookup returns the scope that binds name, or nil.
+func (s *checkScope) lookup(name string) *checkScope {
+	for ; s != nil; s = s.parent {
+		if _, ok := s.names[name]; ok {
+			return s
+		}
+	}
+	return nil
+}
+
+// visible returns the names bound in s and the scopes it is in.
+func (s *checkScope) visible() []string {
+	var names []string
+	for ; s != nil; s = s.parent {
+		for name := range s.names {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fact is what the checker knows about the value of an expression: its type,
+// if known, and the value itself, if it is bound in the environment.
+type fact struct {
+	typ reflect.Type
+	val reflect.Value
+}
+
+// factOf returns what is known about v, looking through interfaces to the
+// dynamic value.
+func factOf(v reflect.Value) fact {
+	for v.IsValid() && v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+	if !v.IsValid() || v.Kind() == reflect.Interface {
+		return fact{}
+	}
+	return fact{typ: v.Type(), val: v}
+}
+
+func (c *checker) report(err error) {
+	c.diagnostics = append(c.diagnostics, diagnostic(err))
+}
+
+// block checks body in a scope of its own.
+func (c *checker) block(body *Sequence, s *checkScope) {
+	if body != nil {
+		c.expr(body, s.nest())
+	}
+}
+
+func (c *checker) exprs(exprs []Evaluable, s *checkScope) {
+	for _, expr := range exprs {
+		c.expr(expr, s)
+	}
+}
+
+// expr checks expr, which runs in s, and returns what is known about its
+// value.
+func (c *checker) expr(expr Evaluable, s *checkScope) fact {
+	switch n := expr.(type) {
+	case *Sequence:
+		c.exprs(n.Statements, s)
+	case *For:
+		c.expr(n.Cond, s)
+		c.block(n.Body, s)
+	case *ForRange:
+		over := c.expr(n.Over, s)
+		key, value := rangeTypes(over.typ)
+		if n.Define {
+			loop := s.nest()
+			for _, bind := range []struct {
+				target Evaluable
+				typ    reflect.Type
+			}{{n.Key, key}, {n.Value, value}} {
+				if ident, ok := bind.target.(*Ident); ok {
+					loop.define(ident.Name, bind.typ)
+				}
+			}
+			s = loop
+		} else {
+			c.target(n.Key, key, s)
+			c.target(n.Value, value, s)
+		}
+		c.block(n.Body, s)
+	case *FuncLit:
+		c.funcs = append(c.funcs, pendingFunc{lit: n, scope: s})
+	case *Return:
+		c.exprs(n.Values, s)
+	case *TypeSwitch:
+		c.expr(n.Subject, s)
+		for _, clause := range n.Clauses {
+			var single reflect.Type
+			for _, typ := range clause.Types {
+				single, _ = asType(c.expr(typ, s).val)
+			}
+			clauseScope := s
+			if n.Bind != nil {
+				clauseScope = s.nest()
+				if len(clause.Types) != 1 || (single != nil && single.Kind() == reflect.Interface) {
+					single = nil
+				}
+				clauseScope.define(n.Bind.Name, single)
+			}
+			c.block(clause.Body, clauseScope)
+		}
+	case *ValueSwitch:
+		c.expr(n.Tag, s)
+		for _, clause := range n.Clauses {
+			c.exprs(clause.Values, s)
+			c.block(clause.Body, s)
+		}
+	case *Subexpression:
+		return c.expr(n.Expr, s)
+	case *Call:
+		if results := c.call(n, s); len(results) == 1 {
+			return fact{typ: results[0]}
+		}
+	case *Conditional:
+		c.expr(n.Cond, s)
+		then, els := c.expr(n.Then, s), c.expr(n.Else, s)
+		if then.typ == els.typ {
+			return fact{typ: then.typ}
+		}
+	case *Propagate:
+		return c.checked(n.Expr, s)
+	case *Go:
+		c.call(n.Call, s)
+	case *Defer:
+		c.call(n.Call, s)
+	case *FieldAccess:
+		if n.Safe {
+			return c.field(n, c.checked(n.Val, s))
+		}
+		return c.field(n, c.expr(n.Val, s))
+	case *SafeChain:
+		return c.expr(n.Expr, s)
+	case *ArrayAccess:
+		array := c.expr(n.Array, s)
+		c.expr(n.Index, s)
+		if t := array.typ; t != nil {
+			if t.Kind() == reflect.Pointer && t.Elem().Kind() == reflect.Array {
+				t = t.Elem()
+			}
+			switch t.Kind() {
+			case reflect.Slice, reflect.Array, reflect.Map:
+				return fact{typ: t.Elem()}
+			case reflect.String:
+				return fact{typ: reflect.TypeOf(byte(0))}
+			}
+		}
+	case *SliceAccess:
+		array := c.expr(n.Array, s)
+		c.expr(n.Low, s)
+		c.expr(n.High, s)
+		if t := array.typ; t != nil {
+			switch t.Kind() {
+			case reflect.Slice, reflect.String:
+				return fact{typ: t}
+			case reflect.Array:
+				return fact{typ: reflect.SliceOf(t.Elem())}
+			}
+		}
+	case *CompositeLit:
+		return c.compositeLit(n, s)
+	case *Operation:
+		c.expr(n.Left, s)
+		c.expr(n.Right, s)
+		switch n.Type {
+		case OpAnd, OpOr, OpLess, OpLessEqual, OpEqual, OpNotEqual, OpGreater, OpGreaterEqual:
+			return fact{typ: reflect.TypeOf(false)}
+		}
+	case *Modifier:
+		val := c.expr(n.Val, s)
+		switch n.Type {
+		case ModNot:
+			return fact{typ: reflect.TypeOf(false)}
+		case ModNeg, ModComplement:
+			return fact{typ: val.typ}
+		case ModRef:
+			if val.typ != nil {
+				return fact{typ: reflect.PointerTo(val.typ)}
+			}
+		case ModDeref:
+			if val.typ != nil && val.typ.Kind() == reflect.Pointer {
+				return fact{typ: val.typ.Elem()}
+			}
+		}
+	case *Assignment:
+		c.assignment(n, s)
+	case *Const:
+		var types []reflect.Type
+		for _, value := range n.Values {
+			types = append(types, c.expr(value, s).typ)
+		}
+		for i, name := range n.Names {
+			var typ reflect.Type
+			if len(types) == len(n.Names) {
+				typ = types[i]
+			}
+			s.define(name.Name, typ)
+		}
+	case *Ident:
+		return c.ident(n, s)
+	case *Value:
+		if n.Val.IsValid() {
+			return fact{typ: n.Val.Type()}
+		}
+	}
+	return fact{}
+}
+
+// ident returns what is known about the value of the name ident, reporting
+// it if it isn't bound.
+func (c *checker) ident(ident *Ident, s *checkScope) fact {
+	if c.probe != nil {
+		c.probe(ident, s, fact{})
+	}
+	if scope := s.lookup(ident.Name); scope != nil {
+		return fact{typ: scope.names[ident.Name]}
+	}
+	if v, ok := Lookup(c.env, ident.Name); ok {
+		return factOf(v)
+	}
+	if !c.open {
+		c.report(ident.span.Err(ErrUnboundVar, "%q%s", ident.Name,
+			didYouMean(ident.Name, append(s.visible(), Names(c.env)...))))
+	}
+	return fact{}
+}
+
+// checked returns what is known about the value of expr once its error
+// result, if any, is checked, as by expr? or expr?.X.
+func (c *checker) checked(expr Evaluable, s *checkScope) fact {
+	call, ok := expr.(*Call)
+	if !ok {
+		return c.expr(expr, s)
+	}
+	results := c.call(call, s)
+	if len(results) > 0 && results[len(results)-1] == errorType {
+		results = results[:len(results)-1]
+	}
+	if len(results) == 1 {
+		return fact{typ: results[0]}
+	}
+	return fact{}
+}
+
+// call checks a call and returns the types of its results, if they are
+// known.
+func (c *checker) call(call *Call, s *checkScope) []reflect.Type {
+	if ident, ok := call.Func.(*Ident); ok && ident.Name == "$import" && len(call.Args) == 2 {
+		c.importStatement(call.Args[0], s)
+		return nil
+	}
+	fn := c.expr(call.Func, s)
+	c.exprs(call.Args, s)
+	if typ, ok := asType(fn.val); ok {
+		return []reflect.Type{typ}
+	}
+	if fn.typ == nil || fn.typ.Kind() != reflect.Func {
+		return nil
+	}
+	if _, ok := asCallable(fn.val); ok {
+		return nil
+	}
+	results := make([]reflect.Type, 0, fn.typ.NumOut())
+	for i := 0; i < fn.typ.NumOut(); i++ {
+		results = append(results, fn.typ.Out(i))
+	}
+	return results
+}
+
+// importStatement records the name bound by an import of a package as
+// target.
+func (c *checker) importStatement(target Evaluable, s *checkScope) {
+	v, ok := target.(*Value)
+	if !ok || v.Val.Kind() != reflect.String {
+		c.expr(target, s)
+		return
+	}
+	switch name := v.Val.String(); name {
+	case "", ".":
+		c.open = true
+	default:
+		s.define(name, nil)
+	}
+}
+
+// field checks that the field or method of a FieldAccess exists on val, and
+// returns what is known about it.
+func (c *checker) field(a *FieldAccess, val fact) fact {
+	if c.probe != nil {
+		c.probe(a, nil, val)
+	}
+	name := a.Field.Name
+	if ns := AsNamespace(val.val); ns != nil {
+		ns.mtx.Lock()
+		member, set := ns.members[name]
+		ns.mtx.Unlock()
+		if set {
+			return factOf(member)
+		}
+		dir := ns.Dir()
+		if i := sort.SearchStrings(dir, name); i == len(dir) || dir[i] != name {
+			c.report(a.span.Err(ErrTypeMismatch, "%q not found in namespace %s%s",
+				name, ns.Name(), didYouMean(name, dir)))
+		}
+		return fact{}
+	}
+	typ := val.typ
+	if typ == nil || typ.Kind() == reflect.Interface ||
+		typ.Implements(reflect.TypeOf((*FieldResolver)(nil)).Elem()) {
+		return fact{}
+	}
+
+	// values are looked in, and through pointers, and addressable values
+	// have the methods of their pointers, so all are allowed.
+	types := []reflect.Type{typ}
+	if typ.Kind() == reflect.Pointer {
+		types = append(types, typ.Elem())
+	} else {
+		types = append(types, reflect.PointerTo(typ))
+	}
+	var candidates []string
+	for _, t := range types {
+		if method, ok := t.MethodByName(name); ok {
+			return fact{typ: methodValueType(method.Type)}
+		}
+		if t.Kind() == reflect.Struct {
+			if field, ok := t.FieldByName(name); ok {
+				return fact{typ: field.Type}
+			}
+			candidates = append(candidates, exportedFields(t)...)
+		}
+		for i := 0; i < t.NumMethod(); i++ {
+			candidates = append(candidates, t.Method(i).Name)
+		}
+	}
+	c.report(a.span.Err(ErrTypeMismatch, "%s has no field or method %s%s",
+		typ, name, didYouMean(name, candidates)))
+	return fact{}
+}
+
+// methodValueType returns the type of the method value of a method of the
+// type fn, which takes the receiver first.
+func methodValueType(fn reflect.Type) reflect.Type {
+	in := make([]reflect.Type, 0, fn.NumIn()-1)
+	for i := 1; i < fn.NumIn(); i++ {
+		in = append(in, fn.In(i))
+	}
+	out := make([]reflect.Type, 0, fn.NumOut())
+	for i := 0; i < fn.NumOut(); i++ {
+		out = append(out, fn.Out(i))
+	}
+	return reflect.FuncOf(in, out, fn.IsVariadic())
+}
+
+// compositeLit checks a composite literal, including the names of the fields
+// of struct literals.
+func (c *checker) compositeLit(lit *CompositeLit, s *checkScope) fact {
+	var typ reflect.Type
+	if lit.Type != nil {
+		typ, _ = asType(c.expr(lit.Type, s).val)
+	}
+	for _, elem := range lit.Elements {
+		if name, ok := elem.Key.(*Ident); ok && typ != nil && typ.Kind() == reflect.Struct {
+			if field, ok := typ.FieldByName(name.Name); !ok || len(field.Index) != 1 {
+				c.report(name.span.Err(ErrTypeMismatch, "unknown field %s in %s literal%s",
+					name.Name, typ, didYouMean(name.Name, exportedFields(typ))))
+			}
+		} else if elem.Key != nil {
+			c.expr(elem.Key, s)
+		}
+		c.expr(elem.Value, s)
+	}
+	return fact{typ: typ}
+}
+
+// assignment checks an assignment, binding the names it defines.
+func (c *checker) assignment(a *Assignment, s *checkScope) {
+	var types []reflect.Type
+	if len(a.Values) == 1 && len(a.Targets) > 1 {
+		if call, ok := a.Values[0].(*Call); ok {
+			types = c.call(call, s)
+		} else {
+			c.expr(a.Values[0], s)
+		}
+	} else {
+		for _, value := range a.Values {
+			types = append(types, c.expr(value, s).typ)
+		}
+	}
+	for i, target := range a.Targets {
+		var typ reflect.Type
+		if len(types) == len(a.Targets) {
+			typ = types[i]
+		}
+		ident, ok := target.(*Ident)
+		if ok && a.Define {
+			s.define(ident.Name, typ)
+			continue
+		}
+		if ok && s.lookup(ident.Name) == nil && !c.open {
+			if _, bound := Lookup(c.env, ident.Name); !bound && ident.Name != "_" {
+				c.report(ident.span.Err(ErrUnboundVar, "%q (use := to define it)", ident.Name))
+				continue
+			}
+		}
+		c.target(target, typ, s)
+	}
+}
+
+// target checks the target of an assignment of a value of type typ, which
+// must already be bound if it is a name. Names assigned values of types
+// other than their own are no longer known to be of a type.
+func (c *checker) target(target Evaluable, typ reflect.Type, s *checkScope) {
+	ident, ok := target.(*Ident)
+	if !ok {
+		c.expr(target, s)
+		return
+	}
+	if ident.Name == "_" {
+		return
+	}
+	if scope := s.lookup(ident.Name); scope != nil {
+		if scope.names[ident.Name] != typ {
+			scope.names[ident.Name] = nil
+		}
+		return
+	}
+	known := c.ident(ident, s)
+	if _, ok := Lookup(c.env, ident.Name); ok {
+		// the name is bound in env, so the assignment is to a name expr
+		// doesn't bind, whose type is now only known if it is unchanged.
+		root := s
+		for root.parent != nil {
+			root = root.parent
+		}
+		if known.typ == typ {
+			root.names[ident.Name] = typ
+		} else {
+			root.names[ident.Name] = nil
+		}
+	}
+}
+
+// rangeTypes returns the types of the keys and values ranging over a value
+// of type typ produces, where known.
+func rangeTypes(typ reflect.Type) (key, value reflect.Type) {
+	if typ == nil {
+		return nil, nil
+	}
+	if typ.Kind() == reflect.Pointer && typ.Elem().Kind() == reflect.Array {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Slice, reflect.Array:
+		return reflect.TypeOf(0), typ.Elem()
+	case reflect.String:
+		return reflect.TypeOf(0), reflect.TypeOf(rune(0))
+	case reflect.Map:
+		return typ.Key(), typ.Elem()
+	case reflect.Chan:
+		return typ.Elem(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return typ, nil
+	}
+	return nil, nil
+}
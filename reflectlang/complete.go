@@ -0,0 +1,177 @@
+package reflectlang
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// completionProbe is the name CompleteAt puts at the cursor to find what
+// is in scope there. It can't be typed, since names can't contain $, so
+// it is spliced into the tokens rather than the source.
+const completionProbe = "$complete"
+
+// CompleteAt returns the completions of the name that ends at offset in
+// source, counted in runes, such as a cursor at the end of a command being
+// typed: the names of the variables in scope there whose names start with
+// it, or, after a dot, the names of the fields and methods of the value
+// before the dot, or the members of the namespace, that start with it.
+// Fields and methods are those a FieldAccess could select: exported
+// fields and methods of the value's type, and of the type it points to,
+// or of the pointer to it. The value is never evaluated; its type is found
+// as Check finds it. Names that are keywords are completed with @. start
+// is the offset the name starts at, so that completing replaces
+// source[start:offset] with a candidate. The candidates are sorted, and
+// empty if nothing completes the name, such as in a string or comment.
+func CompleteAt(source string, offset int, env Environment) (candidates []string, start int) {
+	runes := []rune(source)
+	if offset < 0 || offset > len(runes) {
+		offset = len(runes)
+	}
+	start = offset
+	l := newLexer(string(runes[:offset]))
+	tokens, _ := l.tokens(true)
+	tokens = tokens[:len(tokens)-1]
+
+	var word string
+	if n := len(tokens); n > 0 && tokens[n-1].end.offset == offset {
+		switch last := tokens[n-1]; {
+		case last.kind == tokenIdent || last.kind == tokenKeyword:
+			word, start = last.text, last.pos.offset
+			tokens = tokens[:n-1]
+		case last.kind != tokenOperator:
+			// in or right after a literal or comment.
+			return nil, start
+		}
+	}
+
+	names, selector, found := probeNames(tokens, l, env)
+	if !found {
+		// such as in an incomplete statement, so try the operand the name
+		// is selected from, or else the names in env.
+		names, selector, found = probeNames(tokens[operandStart(tokens):], l, env)
+	}
+	if !found {
+		if n := len(tokens); n > 0 && (tokens[n-1].is(".") || tokens[n-1].is("?.")) {
+			return nil, start
+		}
+		names = Names(env)
+	}
+
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] || !strings.HasPrefix(name, word) || strings.HasPrefix(name, "$") {
+			continue
+		}
+		seen[name] = true
+		if keywords[name] && !selector {
+			name = "@" + name
+		}
+		candidates = append(candidates, name)
+	}
+	sort.Strings(candidates)
+	return candidates, start
+}
+
+// memberNames returns the names of the fields and methods a FieldAccess
+// could select from the value val is about, or the members of the
+// namespace it is.
+func memberNames(val fact) []string {
+	if ns := AsNamespace(val.val); ns != nil {
+		return ns.Dir()
+	}
+	typ := val.typ
+	if typ == nil || typ.Implements(reflect.TypeOf((*FieldResolver)(nil)).Elem()) {
+		// the fields of field resolvers can't be listed.
+		return nil
+	}
+	types := []reflect.Type{typ}
+	switch {
+	case typ.Kind() == reflect.Pointer:
+		types = append(types, typ.Elem())
+	case typ.Kind() != reflect.Interface:
+		types = append(types, reflect.PointerTo(typ))
+	}
+	var names []string
+	for _, t := range types {
+		if t.Kind() == reflect.Struct {
+			names = append(names, exportedFields(t)...)
+		}
+		for i := 0; i < t.NumMethod(); i++ {
+			names = append(names, t.Method(i).Name)
+		}
+	}
+	return names
+}
+
+// probeNames parses and checks tokens followed by the completion probe, as
+// far as l has lexed, and returns the names that could be where the probe
+// is, and whether they are fields, methods, or namespace members. found is
+// false if the probe couldn't be parsed.
+func probeNames(tokens []token, l *lexer, env Environment) (names []string, selector, found bool) {
+	// the brackets left open before the probe are closed, so that what
+	// comes before parses.
+	var code []token
+	var closers []string
+	for _, tok := range tokens {
+		switch {
+		case tok.kind == tokenComment || tok.kind == tokenInvalid:
+			continue
+		case tok.is("(") || tok.is("[") || tok.is("{"):
+			closers = append(closers, map[string]string{"(": ")", "[": "]", "{": "}"}[tok.text])
+		case (tok.is(")") || tok.is("]") || tok.is("}")) && len(closers) > 0:
+			closers = closers[:len(closers)-1]
+		}
+		code = append(code, tok)
+	}
+	at := l.position
+	code = append(code, token{kind: tokenIdent, text: completionProbe, pos: at, end: at})
+	for i := len(closers) - 1; i >= 0; i-- {
+		code = append(code, token{kind: tokenOperator, text: closers[i], pos: at, end: at})
+	}
+	code = append(code, token{kind: tokenEOF, pos: at, end: at})
+
+	p := &Parser{source: l.source, tokens: code}
+	expr, _ := p.ParsePartial()
+	if expr == nil {
+		return nil, false, false
+	}
+	c := &checker{env: env, probe: func(n Evaluable, s *checkScope, val fact) {
+		switch n := n.(type) {
+		case *Ident:
+			if n.Name == completionProbe && !found {
+				found, names = true, append(s.visible(), Names(env)...)
+			}
+		case *FieldAccess:
+			if n.Field.Name == completionProbe && !found {
+				found, selector, names = true, true, memberNames(val)
+			}
+		}
+	}}
+	c.check(expr)
+	return names, selector, found
+}
+
+// operandStart returns the index of the first of the tokens at the end of
+// tokens that make up an operand and the selectors, calls, and indexes
+// applied to it, such as s.Items[0].Get(x).
+func operandStart(tokens []token) int {
+	depth := 0
+	for i := len(tokens) - 1; i >= 0; i-- {
+		tok := tokens[i]
+		switch {
+		case tok.is(")") || tok.is("]"):
+			depth++
+		case tok.is("(") || tok.is("["):
+			if depth == 0 {
+				return i + 1
+			}
+			depth--
+		case depth > 0 || tok.kind == tokenIdent || tok.kind == tokenComment ||
+			tok.is(".") || tok.is("?."):
+		default:
+			return i + 1
+		}
+	}
+	return 0
+}
@@ -1,25 +1,46 @@
 package reflectlang
 
 import (
+	"fmt"
 	"reflect"
 	"unsafe"
 )
 
-func convert(v reflect.Value, t reflect.Type) reflect.Value {
-	switch t {
-	case reflect.TypeOf(unsafe.Pointer(nil)):
-		switch v.Type() {
-		case reflect.TypeOf(uintptr(0)):
-			return reflect.ValueOf(unsafe.Pointer(v.Interface().(uintptr)))
-		default:
-		}
-	case reflect.TypeOf(uintptr(0)):
-		switch v.Type() {
-		case reflect.TypeOf(unsafe.Pointer(nil)):
-			return reflect.ValueOf(uintptr(v.UnsafePointer()))
-		default:
-		}
-	default:
+// convert converts v to t like a Go conversion, t(v). Besides what
+// reflect.Value.Convert supports, uintptrs and unsafe.Pointers convert to
+// each other, and nil converts to types that can be nil.
+func convert(v reflect.Value, t reflect.Type) (reflect.Value, error) {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
 	}
-	return v.Convert(t)
+	if !v.IsValid() {
+		return assignable(v, t, false)
+	}
+	switch {
+	case t.Kind() == reflect.UnsafePointer && v.Kind() == reflect.Uintptr:
+		addr := uintptr(v.Uint())
+		return reflect.ValueOf(*(*unsafe.Pointer)(unsafe.Pointer(&addr))).Convert(t), nil
+	case t.Kind() == reflect.Uintptr && v.Kind() == reflect.UnsafePointer:
+		return reflect.ValueOf(uintptr(v.Pointer())).Convert(t), nil
+	}
+	if !v.Type().ConvertibleTo(t) {
+		return reflect.Value{}, fmt.Errorf("%w: cannot convert %s to %s", ErrTypeMismatch,
+			typeName(v), t)
+	}
+	return v.Convert(t), nil
+}
+
+// conversionSize returns how many bytes converting v to t allocates, if it
+// copies v's elements, as conversions between strings and slices do.
+func conversionSize(v reflect.Value, t reflect.Type) int64 {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	switch {
+	case v.Kind() == reflect.String && t.Kind() == reflect.Slice:
+		return int64(v.Len()) * int64(t.Elem().Size())
+	case v.Kind() == reflect.Slice && t.Kind() == reflect.String:
+		return int64(v.Len()) * int64(v.Type().Elem().Size())
+	}
+	return 0
 }
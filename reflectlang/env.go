@@ -7,56 +7,359 @@ import (
 
 type Environment map[string]reflect.Value
 
+// NewScope returns an empty environment scoped over parent: names it
+// doesn't bind are looked up in parent, and assigning to them assigns in
+// parent, while names defined in it shadow parent's. This layers an
+// environment over a shared one, such as a read-only base shared by
+// sessions, without copying it. Function calls and blocks run in scopes
+// of their own, so that they are lexically scoped.
+func NewScope(parent Environment) Environment {
+	return Environment{"$parent": reflect.ValueOf(parent)}
+}
+
+// Parent returns the environment env is scoped over, or nil if env isn't a
+// scope.
+func Parent(env Environment) Environment {
+	if v, ok := env["$parent"]; ok && v.IsValid() && v.CanInterface() {
+		parent, _ := v.Interface().(Environment)
+		return parent
+	}
+	return nil
+}
+
+// Lookup returns the value bound to name in env or, if env doesn't bind it,
+// in the environments env is scoped over.
+func Lookup(env Environment, name string) (reflect.Value, bool) {
+	for ; env != nil; env = Parent(env) {
+		if v, ok := env[name]; ok {
+			return v, true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// scopeOf returns the innermost of env and the environments it is scoped
+// over that binds name, or nil if none do.
+func scopeOf(env Environment, name string) Environment {
+	for ; env != nil; env = Parent(env) {
+		if _, ok := env[name]; ok {
+			return env
+		}
+	}
+	return nil
+}
+
+// bindingScope returns the scope that binds name, for looking up what
+// applies to the binding, or env if name is unbound.
+func bindingScope(env Environment, name string) Environment {
+	if scope := scopeOf(env, name); scope != nil {
+		return scope
+	}
+	return env
+}
+
+// StdNamespace is the name of the namespace holding builtins. Builtins are
+// bound both at the top level and in this namespace, so that they remain
+// reachable as, e.g., std.len, when an application binds the same name.
+const StdNamespace = "std"
+
+// Std returns the std namespace in env, creating it if needed. If env binds
+// StdNamespace to something other than a namespace, a detached namespace is
+// returned. If env is a scope that doesn't bind its own, it gets a copy of
+// the namespace it would see, so that defining builtins in it doesn't
+// modify its parent's.
+func Std(env Environment) *Namespace {
+	if v, ok := env[StdNamespace]; ok {
+		if ns := AsNamespace(v); ns != nil {
+			return ns
+		}
+		return NewNamespace(StdNamespace, "")
+	}
+	ns := NewNamespace(StdNamespace, "builtins")
+	if v, ok := Lookup(env, StdNamespace); ok {
+		if inherited := AsNamespace(v); inherited != nil {
+			mergeNamespace(ns, inherited)
+		}
+	}
+	env[StdNamespace] = reflect.ValueOf(ns)
+	return ns
+}
+
+// mergeNamespace sets all of src's members in dst.
+func mergeNamespace(dst, src *Namespace) {
+	for _, name := range src.Dir() {
+		if v, found, err := src.Get(name); err == nil && found {
+			dst.Set(name, v)
+		}
+	}
+}
+
+// DefineBuiltin binds v to name in both env and env's std namespace.
+func DefineBuiltin(env Environment, name string, v reflect.Value) {
+	env[name] = v
+	Std(env).Set(name, v)
+}
+
+// SetReadOnly sets whether evaluation in env is read-only. In read-only
+// environments, assigning to fields, map entries, and elements, and calling
+// Go functions, fail with ErrReadOnly. Variables can still be bound, and
+// lowered functions can still be called.
+func SetReadOnly(env Environment, readOnly bool) {
+	if readOnly {
+		env["$readonly"] = reflect.ValueOf(true)
+	} else {
+		delete(env, "$readonly")
+		if IsReadOnly(env) {
+			env["$readonly"] = reflect.ValueOf(false)
+		}
+	}
+}
+
+// IsReadOnly returns true if env is read-only. Scopes are read-only if
+// their parents are, unless set otherwise.
+func IsReadOnly(env Environment) bool {
+	v, ok := Lookup(env, "$readonly")
+	return ok && v.Kind() == reflect.Bool && v.Bool()
+}
+
+// SetAutoRef sets whether calls to Go functions in env adapt arguments to
+// pointer and non-pointer parameters, which they do by default. With it,
+// an addressable T is passed by address where a *T is expected, and a
+// non-nil *T is dereferenced where a T is expected, if the argument
+// wouldn't fit otherwise.
+func SetAutoRef(env Environment, enabled bool) {
+	if enabled {
+		delete(env, "$noautoref")
+		if !AutoRef(env) {
+			env["$noautoref"] = reflect.ValueOf(false)
+		}
+	} else {
+		env["$noautoref"] = reflect.ValueOf(true)
+	}
+}
+
+// AutoRef returns true if calls in env adapt arguments as described by
+// SetAutoRef. Scopes inherit the setting of their parents, unless set
+// otherwise.
+func AutoRef(env Environment) bool {
+	v, ok := Lookup(env, "$noautoref")
+	return !ok || v.Kind() != reflect.Bool || !v.Bool()
+}
+
+// MarkImmutable protects the value bound to name in env, such as a critical
+// singleton exposed for inspection, from modification. Evaluation fails with
+// ErrReadOnly when rebinding name, assigning to anything reached through it,
+// calling methods with pointer receivers on it, or passing anything reached
+// through it to Go functions, other than basic values and strings.
+// Variables bound to values reached through it are protected the same way,
+// and lowered functions, such as builtins and function literals, run
+// read-only when passed such values.
+func MarkImmutable(env Environment, name string) {
+	immutables(env, true)[name] = true
+}
+
+// IsImmutable returns true if name was marked with MarkImmutable in env, or
+// is bound to a value reached through such a name. For scopes, marks in the
+// scopes env is in count too, up to the one that binds name.
+func IsImmutable(env Environment, name string) bool {
+	_, ok := immutableMark(env, name)
+	return ok
+}
+
+// immutableMark returns whether name is immutable as seen from env, and if
+// so, whether it was marked with MarkImmutable rather than bound to a value
+// reached through such a name.
+func immutableMark(env Environment, name string) (marked, ok bool) {
+	for ; env != nil; env = Parent(env) {
+		if marked, ok := immutables(env, false)[name]; ok {
+			return marked, true
+		}
+		if _, bound := env[name]; bound {
+			break
+		}
+	}
+	return false, false
+}
+
+// MarkConst makes name a constant in env, like those declared with const:
+// evaluation fails with ErrReadOnly when assigning to or redefining it.
+// Unlike MarkImmutable, what the constant refers to can still be modified,
+// such as through its fields or methods.
+func MarkConst(env Environment, name string) {
+	consts(env, true)[name] = true
+}
+
+// IsConst returns true if name is a constant in env, or in the scopes env
+// is in, up to the one that binds name.
+func IsConst(env Environment, name string) bool {
+	for ; env != nil; env = Parent(env) {
+		if consts(env, false)[name] {
+			return true
+		}
+		if _, bound := env[name]; bound {
+			break
+		}
+	}
+	return false
+}
+
+// consts returns the constant names of env. If there are none, nil is
+// returned, unless create is true.
+func consts(env Environment, create bool) map[string]bool {
+	if v, ok := env["$const"]; ok && v.IsValid() && v.CanInterface() {
+		if names, ok := v.Interface().(map[string]bool); ok {
+			return names
+		}
+	}
+	if !create {
+		return nil
+	}
+	names := map[string]bool{}
+	env["$const"] = reflect.ValueOf(names)
+	return names
+}
+
+// immutables returns the immutable names of env. Names marked with
+// MarkImmutable map to true, and names bound to values reached through them
+// map to false. If there are none, nil is returned, unless create is true.
+func immutables(env Environment, create bool) map[string]bool {
+	if v, ok := env["$immutable"]; ok && v.IsValid() && v.CanInterface() {
+		if names, ok := v.Interface().(map[string]bool); ok {
+			return names
+		}
+	}
+	if !create {
+		return nil
+	}
+	names := map[string]bool{}
+	env["$immutable"] = reflect.ValueOf(names)
+	return names
+}
+
+// copyEnv returns a shallow copy of env, with its own immutable names,
+// constants, and name index.
+func copyEnv(env Environment) Environment {
+	c := make(Environment, len(env))
+	for name, v := range env {
+		c[name] = v
+	}
+	delete(c, "$names")
+	if names := immutables(env, false); names != nil {
+		copied := make(map[string]bool, len(names))
+		for name, marked := range names {
+			copied[name] = marked
+		}
+		c["$immutable"] = reflect.ValueOf(copied)
+	}
+	if names := consts(env, false); names != nil {
+		copied := make(map[string]bool, len(names))
+		for name := range names {
+			copied[name] = true
+		}
+		c["$const"] = reflect.ValueOf(copied)
+	}
+	return c
+}
+
+// Layer binds all of child's values over parent's, so child takes precedence,
+// and returns parent. Members of both std namespaces are merged the same way.
+// parent is modified in place, rather than copied, so that builtins that
+// refer to parent keep working. To layer an environment over another
+// without modifying it, use NewScope.
+func Layer(parent, child Environment) Environment {
+	for name, v := range child {
+		if name == "$names" || name == "$parent" {
+			continue
+		}
+		if name == StdNamespace {
+			if sub := AsNamespace(v); sub != nil {
+				if _, exists := parent[name]; !exists || AsNamespace(parent[name]) != nil {
+					mergeNamespace(Std(parent), sub)
+					continue
+				}
+			}
+		}
+		parent[name] = v
+	}
+	return parent
+}
+
 func NewStandardEnvironment() Environment {
 	env := Environment{}
 	env["nil"] = reflect.ValueOf(nil)
 	env["true"] = reflect.ValueOf(true)
 	env["false"] = reflect.ValueOf(false)
-	env["$import"] = LowerFunc(env, func(args []reflect.Value) ([]reflect.Value, error) {
+	env["$import"] = LowerFunc(func(args []reflect.Value) ([]reflect.Value, error) {
 		return nil, fmt.Errorf("import unsupported in this session")
 	})
 
-	assignment := func(mutate bool) reflect.Value {
-		return LowerFunc(env, func(lhs []reflect.Value) ([]reflect.Value, error) {
-			for _, arg := range lhs {
-				if arg.Kind() != reflect.String {
-					return nil, fmt.Errorf("programmer error")
-				}
-				/*
-					key := arg.String()
-					if mutate {
-						if _, exists := env[key]; !exists {
-							return nil, fmt.Errorf("variable %q does not exist", key)
-						}
-					} else {
-						if _, exists := env[key]; exists {
-							return nil, fmt.Errorf("variable %q already exists", key)
-						}
-					}
-				*/
-			}
-			return []reflect.Value{
-				LowerFunc(env, func(rhs []reflect.Value) ([]reflect.Value, error) {
-					if len(lhs) != len(rhs) {
-						return nil, fmt.Errorf("variable definition expected a variable for each value (%d != %d)", len(lhs), len(rhs))
-					}
-					for i, arg := range lhs {
-						env[arg.String()] = rhs[i]
-					}
-					return []reflect.Value{}, nil
-				})}, nil
-		})
-	}
-
-	env["$define"] = assignment(false)
-	env["$mutate"] = assignment(true)
-
-	env["len"] = LowerFunc(env, func(args []reflect.Value) ([]reflect.Value, error) {
+	DefineBuiltin(env, "len", LowerFunc(func(args []reflect.Value) ([]reflect.Value, error) {
 		if len(args) != 1 {
 			return nil, fmt.Errorf("len expected 1 argument")
 		}
 		return []reflect.Value{reflect.ValueOf(args[0].Len())}, nil
-	})
+	}))
+	Std(env).SetDoc("len", "len(v) returns the length of a string, slice, array, map, or channel")
+
+	DefineBuiltin(env, "copy", LowerEnvFunc(copyElements))
+	Std(env).SetDoc("copy", "copy(dst, src) copies elements from the slice or string src to the "+
+		"slice dst, returning how many were copied")
+
+	DefineBuiltin(env, "delete", LowerEnvFunc(deleteEntry))
+	Std(env).SetDoc("delete", "delete(m, key) removes key from the map m")
+
+	DefineBuiltin(env, "keys", LowerEnvFunc(keys))
+	Std(env).SetDoc("keys", "keys(m) returns the keys of the map m as a sorted slice")
+
+	DefineBuiltin(env, "values", LowerEnvFunc(values))
+	Std(env).SetDoc("values", "values(m) returns the values of the map m as a slice, in the "+
+		"order of keys(m)")
+
+	DefineBuiltin(env, "sprintf", LowerEnvFunc(sprintf))
+	Std(env).SetDoc("sprintf", "sprintf(format, args...) formats args according to format, "+
+		"like fmt.Sprintf, and returns the string")
+
+	DefineBuiltin(env, "regex", LowerFunc(regex))
+	Std(env).SetDoc("regex", "regex(pattern) compiles the regular expression pattern, in the "+
+		"syntax of package regexp, returning a *regexp.Regexp")
+	DefineBuiltin(env, "match", LowerFunc(match))
+	Std(env).SetDoc("match", "match(pattern, s) returns whether the string s contains a match "+
+		"of pattern, a regex or a string to compile as one")
+	DefineBuiltin(env, "find", LowerFunc(find))
+	Std(env).SetDoc("find", "find(pattern, s) returns all matches of pattern, a regex or a "+
+		"string to compile as one, in the string s")
+	DefineBuiltin(env, "grep", LowerEnvFunc(grep))
+	Std(env).SetDoc("grep", "grep(pattern, xs) returns the strings in the slice xs that "+
+		"contain a match of pattern, a regex or a string to compile as one")
+
+	DefineBuiltin(env, "time", LowerFunc(parseTime))
+	Std(env).SetDoc("time", `time("2006-01-02T15:04:05Z") parses an RFC 3339 timestamp, or a `+
+		"date alone for midnight UTC, as a time.Time, which compares with <, >, and ==, and "+
+		"supports adding and subtracting durations and subtracting times")
+
+	DefineBuiltin(env, "now", LowerFunc(now))
+	Std(env).SetDoc("now", "now() returns the current time")
+
+	DefineBuiltin(env, "each", LowerEnvFunc(each))
+	Std(env).SetDoc("each", `each(xs, "expr") evaluates expr once per element of xs, bound as it`)
+
+	DefineBuiltin(env, "panic", LowerFunc(panicValue))
+	Std(env).SetDoc("panic", "panic(v) stops evaluation with an error holding v, unless it "+
+		"is caught with catch")
+
+	DefineBuiltin(env, "catch", LowerEnvFunc(catch))
+	Std(env).SetDoc("catch", `catch(f) or catch("expr") calls f, a function with no `+
+		"arguments, or evaluates expr, returning its value and the error it failed or "+
+		"panicked with, if any, instead of stopping evaluation")
+
+	DefineBuiltin(env, "selectrecv", LowerEnvFunc(selectRecv))
+	Std(env).SetDoc("selectrecv", "selectrecv(ch1, ch2, ..., timeout) waits to receive from "+
+		"whichever channel is ready first, returning its index, the value, and ok, or an "+
+		"index of -1 if the optional timeout passes first")
+
+	DefineBuiltin(env, "retry", LowerEnvFunc(retry))
+	Std(env).SetDoc("retry", "retry(n, backoff, f) calls f up to n times until it succeeds, "+
+		"doubling the delay between attempts from backoff")
 
 	return env
 }
@@ -0,0 +1,425 @@
+package reflectlang
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format renders expr, as returned by Parse, as canonical source, which
+// parses back to an equivalent expression. Operators are spaced, and
+// spelled as symbols rather than words, statements are separated by "; ",
+// and parentheses are kept where the source had them, and added where the
+// tree needs them. Names that are keywords are written with @.
+func Format(expr Evaluable) string {
+	var f formatter
+	f.node(expr, precLowest)
+	return f.b.String()
+}
+
+// The precedence levels of expressions, from loosest to tightest.
+const (
+	precLowest = iota // statements and conditional expressions
+	precOr
+	precAnd
+	precNot
+	precComparison
+	precAddition
+	precMultiplication
+	precUnary
+	precPrimary
+)
+
+var opPrecedence = map[OpType]int{
+	OpOr:  precOr,
+	OpAnd: precAnd,
+
+	OpLess: precComparison, OpLessEqual: precComparison, OpEqual: precComparison,
+	OpNotEqual: precComparison, OpGreater: precComparison, OpGreaterEqual: precComparison,
+
+	OpAdd: precAddition, OpSub: precAddition, OpBitOr: precAddition, OpBitXor: precAddition,
+
+	OpMul: precMultiplication, OpDiv: precMultiplication, OpShl: precMultiplication,
+	OpShr: precMultiplication, OpBitAnd: precMultiplication, OpAndNot: precMultiplication,
+}
+
+// precedence returns the precedence level of expr.
+func precedence(expr Evaluable) int {
+	switch expr := expr.(type) {
+	case *Conditional:
+		return precLowest
+	case *Operation:
+		return opPrecedence[expr.Type]
+	case *Modifier:
+		if expr.Type == ModNot {
+			return precNot
+		}
+		return precUnary
+	case *Value:
+		if strings.HasPrefix(formatValue(expr.Val), "-") {
+			return precUnary
+		}
+	case *SafeChain:
+		return precedence(expr.Expr)
+	}
+	return precPrimary
+}
+
+type formatter struct {
+	b strings.Builder
+	// controlClause is true while writing the header of a for or switch,
+	// where composite literals need parentheses.
+	controlClause bool
+}
+
+func (f *formatter) write(s string) { f.b.WriteString(s) }
+
+// nested writes expressions with write outside of any control clause, for
+// expressions between brackets.
+func (f *formatter) nested(write func()) {
+	prev := f.controlClause
+	f.controlClause = false
+	write()
+	f.controlClause = prev
+}
+
+// header writes the expressions of a control clause with write.
+func (f *formatter) header(write func()) {
+	prev := f.controlClause
+	f.controlClause = true
+	write()
+	f.controlClause = prev
+}
+
+// list writes exprs separated by commas.
+func (f *formatter) list(exprs []Evaluable, min int) {
+	for i, expr := range exprs {
+		if i > 0 {
+			f.write(", ")
+		}
+		f.node(expr, min)
+	}
+}
+
+// node writes expr, in parentheses if it binds more loosely than min.
+func (f *formatter) node(expr Evaluable, min int) {
+	if expr == nil {
+		return
+	}
+	if precedence(expr) < min {
+		f.write("(")
+		f.nested(func() { f.node(expr, precLowest) })
+		f.write(")")
+		return
+	}
+
+	switch n := expr.(type) {
+	case *Sequence:
+		for i, stmt := range n.Statements {
+			if i > 0 {
+				f.write("; ")
+			}
+			f.node(stmt, precLowest)
+		}
+	case *Break:
+		f.write("break")
+	case *Continue:
+		f.write("continue")
+	case *For:
+		f.write("for ")
+		if n.Cond != nil {
+			f.header(func() { f.node(n.Cond, precLowest) })
+			f.write(" ")
+		}
+		f.block(n.Body)
+	case *ForRange:
+		f.write("for ")
+		if n.Key != nil || n.Value != nil {
+			targets := []Evaluable{n.Key, n.Value}
+			if n.Value == nil {
+				targets = targets[:1]
+			}
+			for i, target := range targets {
+				if i > 0 {
+					f.write(", ")
+				}
+				if target == nil {
+					f.write("_")
+				} else {
+					f.node(target, precPrimary)
+				}
+			}
+			if n.Define {
+				f.write(" := ")
+			} else {
+				f.write(" = ")
+			}
+		}
+		f.write("range ")
+		f.header(func() { f.node(n.Over, precLowest) })
+		f.write(" ")
+		f.block(n.Body)
+	case *FuncLit:
+		f.write("func(")
+		for i, param := range n.Params {
+			if i > 0 {
+				f.write(", ")
+			}
+			f.node(param, precLowest)
+		}
+		f.write(") ")
+		f.block(n.Body)
+	case *Return:
+		f.write("return")
+		if len(n.Values) > 0 {
+			f.write(" ")
+			f.list(n.Values, precLowest)
+		}
+	case *TypeSwitch:
+		f.write("switch ")
+		if n.Bind != nil {
+			f.node(n.Bind, precLowest)
+			f.write(" := ")
+		}
+		f.header(func() { f.node(n.Subject, precPrimary) })
+		f.write(".(type) ")
+		clauses := make([]CaseClause, 0, len(n.Clauses))
+		for _, clause := range n.Clauses {
+			clauses = append(clauses, CaseClause{Values: clause.Types, Body: clause.Body})
+		}
+		f.clauses(clauses)
+	case *ValueSwitch:
+		f.write("switch ")
+		if n.Tag != nil {
+			f.header(func() { f.node(n.Tag, precLowest) })
+			f.write(" ")
+		}
+		f.clauses(n.Clauses)
+	case *BadStatement:
+		f.write("/* bad statement */")
+	case *Subexpression:
+		f.write("(")
+		f.nested(func() { f.node(n.Expr, precLowest) })
+		f.write(")")
+	case *Call:
+		if ident, ok := n.Func.(*Ident); ok && ident.Name == "$import" && len(n.Args) == 2 {
+			f.importStatement(n.Args[0], n.Args[1])
+			return
+		}
+		f.node(n.Func, precPrimary)
+		f.write("(")
+		f.nested(func() { f.list(n.Args, precLowest) })
+		if n.Spread {
+			f.write("...")
+		}
+		f.write(")")
+	case *Conditional:
+		f.write("if ")
+		f.node(n.Cond, precLowest)
+		f.write(" then ")
+		f.node(n.Then, precLowest)
+		f.write(" else ")
+		f.node(n.Else, precLowest)
+	case *Propagate:
+		f.node(n.Expr, precPrimary)
+		f.write("?")
+	case *Go:
+		f.write("go ")
+		f.node(n.Call, precLowest)
+	case *Defer:
+		f.write("defer ")
+		f.node(n.Call, precLowest)
+	case *FieldAccess:
+		f.node(n.Val, precPrimary)
+		if n.Safe {
+			f.write("?.")
+		} else {
+			f.write(".")
+		}
+		f.write(n.Field.Name)
+	case *SafeChain:
+		f.node(n.Expr, min)
+	case *ArrayAccess:
+		f.node(n.Array, precPrimary)
+		f.write("[")
+		f.nested(func() { f.node(n.Index, precLowest) })
+		f.write("]")
+	case *SliceAccess:
+		f.node(n.Array, precPrimary)
+		f.write("[")
+		f.nested(func() {
+			f.node(n.Low, precLowest)
+			f.write(":")
+			f.node(n.High, precLowest)
+		})
+		f.write("]")
+	case *CompositeLit:
+		if n.Type != nil && f.controlClause {
+			f.write("(")
+			f.nested(func() { f.node(n, precLowest) })
+			f.write(")")
+			return
+		}
+		f.node(n.Type, precPrimary)
+		f.write("{")
+		f.nested(func() {
+			for i, elem := range n.Elements {
+				if i > 0 {
+					f.write(", ")
+				}
+				if elem.Key != nil {
+					f.node(elem.Key, precLowest)
+					f.write(": ")
+				}
+				f.node(elem.Value, precLowest)
+			}
+		})
+		f.write("}")
+	case *Operation:
+		prec := opPrecedence[n.Type]
+		f.node(n.Left, prec)
+		f.write(" " + n.Type + " ")
+		f.node(n.Right, prec+1)
+	case *Modifier:
+		f.write(n.Type)
+		if n.Type == ModNot {
+			f.node(n.Val, precComparison)
+		} else {
+			f.node(n.Val, precPrimary)
+		}
+	case *Assignment:
+		for i, target := range n.Targets {
+			if i > 0 {
+				f.write(", ")
+			}
+			f.node(target, precPrimary)
+		}
+		if n.Define {
+			f.write(" := ")
+		} else {
+			f.write(" = ")
+		}
+		f.list(n.Values, precLowest)
+	case *Const:
+		f.write("const ")
+		for i, name := range n.Names {
+			if i > 0 {
+				f.write(", ")
+			}
+			f.node(name, precLowest)
+		}
+		f.write(" = ")
+		f.list(n.Values, precLowest)
+	case *Ident:
+		if keywords[n.Name] {
+			f.write("@")
+		}
+		f.write(n.Name)
+	case *Value:
+		f.write(formatValue(n.Val))
+	default:
+		f.write(fmt.Sprintf("/* %T */", expr))
+	}
+}
+
+// block writes body as a braced block.
+func (f *formatter) block(body *Sequence) {
+	if body == nil || len(body.Statements) == 0 {
+		f.write("{}")
+		return
+	}
+	f.write("{ ")
+	f.nested(func() { f.node(body, precLowest) })
+	f.write(" }")
+}
+
+// clauses writes the braced case clauses of a switch.
+func (f *formatter) clauses(clauses []CaseClause) {
+	if len(clauses) == 0 {
+		f.write("{}")
+		return
+	}
+	f.write("{ ")
+	f.nested(func() {
+		for i, clause := range clauses {
+			if i > 0 {
+				f.write("; ")
+			}
+			f.clause(clause)
+		}
+	})
+	f.write(" }")
+}
+
+// clause writes a case clause of a switch.
+func (f *formatter) clause(clause CaseClause) {
+	if clause.Values == nil {
+		f.write("default:")
+	} else {
+		f.write("case ")
+		f.list(clause.Values, precLowest)
+		f.write(":")
+	}
+	if clause.Body != nil && len(clause.Body.Statements) > 0 {
+		f.write(" ")
+		f.node(clause.Body, precLowest)
+	}
+}
+
+// importStatement writes the import statement that parses as a call of
+// $import with target and pkg.
+func (f *formatter) importStatement(target, pkg Evaluable) {
+	f.write("import ")
+	if v, ok := target.(*Value); ok && v.Val.Kind() == reflect.String && v.Val.String() != "" {
+		f.write(v.Val.String() + " ")
+	}
+	f.node(pkg, precLowest)
+}
+
+// formatValue renders a constant as a literal, if it is of a type that
+// literals have, and otherwise as its Repr.
+func formatValue(v reflect.Value) string {
+	if !v.IsValid() {
+		return "nil"
+	}
+	switch v.Type() {
+	case reflect.TypeOf(""):
+		return strconv.Quote(v.String())
+	case reflect.TypeOf(0):
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.TypeOf(uint64(0)):
+		return strconv.FormatUint(v.Uint(), 10) + "u"
+	case reflect.TypeOf(float64(0)):
+		s := strconv.FormatFloat(v.Float(), 'g', -1, 64)
+		if !stringContains(s, isUniquelyFloatingPointChar) {
+			s += ".0"
+		}
+		return s
+	case durationType:
+		return formatDuration(time.Duration(v.Int()))
+	}
+	return Repr(v)
+}
+
+// formatDuration renders d as a duration literal in the largest unit that
+// divides it.
+func formatDuration(d time.Duration) string {
+	if d < 0 {
+		return "-" + formatDuration(-d)
+	}
+	for _, unit := range []struct {
+		suffix string
+		size   time.Duration
+	}{{"h", time.Hour}, {"m", time.Minute}, {"s", time.Second},
+		{"ms", time.Millisecond}, {"us", time.Microsecond}} {
+		if d != 0 && d%unit.size == 0 {
+			return strconv.FormatInt(int64(d/unit.size), 10) + unit.suffix
+		}
+	}
+	if d == 0 {
+		return "0s"
+	}
+	return strconv.FormatInt(int64(d), 10) + "ns"
+}
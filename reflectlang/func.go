@@ -0,0 +1,127 @@
+package reflectlang
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Func is a function defined by a function literal. Calling it binds its
+// parameters to the arguments in a new scope of the environment it was
+// defined in, so that it sees and assigns to the variables in scope where it
+// was defined, while its parameters and definitions are its own.
+//
+// When a Func is passed to a Go function or assigned to a variable of a Go
+// function type, it is converted with MakeFunc. The environment is not
+// synchronized, so the converted function must not be called concurrently
+// with other evaluation in the same environment.
+type Func struct {
+	lit *FuncLit
+	env Environment
+}
+
+func (f *Func) CallLowered(_ Environment, args []reflect.Value) ([]reflect.Value, error) {
+	results, _, err := f.call(args)
+	return results, err
+}
+
+// call calls f, returning its results, and which results came from untyped
+// constants.
+func (f *Func) call(args []reflect.Value) (results []reflect.Value, untyped []bool, err error) {
+	if len(args) != len(f.lit.Params) {
+		return nil, nil, f.lit.span.Err(ErrTypeMismatch,
+			"%s called with %d arguments", f, len(args))
+	}
+	env := NewScope(f.env)
+	for i, param := range f.lit.Params {
+		env[param.Name] = args[i]
+	}
+	_, err = f.lit.Body.Run(env)
+	var ret *returnSignal
+	if errors.As(err, &ret) {
+		return ret.values, ret.untyped, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return []reflect.Value{}, nil, nil
+}
+
+// MakeFunc returns f as a Go function of type typ, which must have as many
+// parameters as f. The results f returns are converted to typ's result
+// types, like assignments. If f returns an error, or results that can't be
+// converted, the Go function panics.
+func (f *Func) MakeFunc(typ reflect.Type) (reflect.Value, error) {
+	if typ.Kind() != reflect.Func {
+		return reflect.Value{}, fmt.Errorf("%w: cannot use %s as %s", ErrTypeMismatch, f, typ)
+	}
+	if typ.NumIn() != len(f.lit.Params) {
+		return reflect.Value{}, fmt.Errorf("%w: cannot use %s as %s (wrong number of parameters)",
+			ErrTypeMismatch, f, typ)
+	}
+	return reflect.MakeFunc(typ, func(args []reflect.Value) []reflect.Value {
+		results, untyped, err := f.call(args)
+		if err != nil {
+			panic(err)
+		}
+		if len(results) != typ.NumOut() {
+			panic(fmt.Errorf("%w: %s returned %d values, %s has %d results",
+				ErrTypeMismatch, f, len(results), typ, typ.NumOut()))
+		}
+		for i := range results {
+			results[i], err = assignable(results[i], typ.Out(i), i < len(untyped) && untyped[i])
+			if err != nil {
+				panic(err)
+			}
+		}
+		return results
+	}), nil
+}
+
+func (f *Func) String() string {
+	params := make([]string, 0, len(f.lit.Params))
+	for _, param := range f.lit.Params {
+		params = append(params, param.Name)
+	}
+	return fmt.Sprintf("func(%s)", strings.Join(params, ", "))
+}
+
+// GoString is the same as String, for rendering in sessions.
+func (f *Func) GoString() string { return f.String() }
+
+func asFunc(v reflect.Value) (*Func, bool) {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil, false
+	}
+	f, ok := v.Interface().(*Func)
+	return f, ok && f != nil
+}
+
+// funcArgs converts the Funcs in args to the types of fnType's parameters.
+func funcArgs(fnType reflect.Type, args []reflect.Value) error {
+	for i, arg := range args {
+		f, ok := asFunc(arg)
+		if !ok {
+			continue
+		}
+		var typ reflect.Type
+		switch {
+		case fnType.IsVariadic() && i >= fnType.NumIn()-1:
+			typ = fnType.In(fnType.NumIn() - 1).Elem()
+		case i < fnType.NumIn():
+			typ = fnType.In(i)
+		default:
+			continue
+		}
+		if typ.Kind() != reflect.Func {
+			continue
+		}
+		made, err := f.MakeFunc(typ)
+		if err != nil {
+			return err
+		}
+		args[i] = made
+	}
+	return nil
+}
@@ -3,20 +3,29 @@ package reflectlang
 import (
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
-	"unicode"
 )
 
 var (
-	ErrParser       = errors.New("parser error")
-	ErrUnboundVar   = errors.New("unbound variable")
-	ErrTypeMismatch = errors.New("type mismatch")
-	ErrUnknownOp    = errors.New("unknown op")
-	ErrRuntime      = errors.New("runtime error")
+	ErrParser              = errors.New("parser error")
+	ErrUnboundVar          = errors.New("unbound variable")
+	ErrTypeMismatch        = errors.New("type mismatch")
+	ErrUnknownOp           = errors.New("unknown op")
+	ErrRuntime             = errors.New("runtime error")
+	ErrReadOnly            = errors.New("read-only")
+	ErrRateLimited         = errors.New("rate limited")
+	ErrBudgetExceeded      = errors.New("budget exceeded")
+	ErrAllocBudgetExceeded = errors.New("allocation budget exceeded")
+	ErrDenied              = errors.New("access denied")
+
+	// ErrIncomplete is the ErrParser of source that ends in an unterminated
+	// string, or with parentheses, brackets, or braces left open, which
+	// more input could complete, such as for a REPL to read more lines.
+	ErrIncomplete = fmt.Errorf("%w: incomplete input", ErrParser)
 )
 
 var (
@@ -31,339 +40,271 @@ type position struct {
 	offset, line, col int
 }
 
-type Parser struct {
-	source []rune
-	position
-	currentChar rune
-}
-
-func NewParser(source string) *Parser {
-	p := &Parser{
-		source:      []rune(source),
-		position:    position{offset: 0, line: 1, col: 1},
-		currentChar: -1,
-	}
-	if len(p.source) > 0 {
-		p.currentChar = p.source[0]
-	}
-	return p
+func (p position) Err(errType error, messagef string, args ...interface{}) error {
+	return span{pos: p, start: p, end: p}.Err(errType, messagef, args...)
 }
 
-func (p *Parser) advance(distance int) error {
-	for i := 0; i < distance; i++ {
-		if p.eof() {
-			return errors.New("unexpected eof")
-		}
-		if p.currentChar == '\n' {
-			p.line++
-			p.col = 1
-		} else {
-			p.col++
-		}
-		p.offset++
-		if p.offset >= len(p.source) {
-			p.currentChar = -1
-		} else {
-			p.currentChar = p.source[p.offset]
-		}
-	}
-	return nil
+// span is the range of source a node was parsed from, from start up to but
+// not including end. Errors about the node are reported at pos, which is the
+// node's operator, such as the + of an addition or the ( of a call, or else
+// its start.
+type span struct {
+	pos, start, end position
 }
 
-func (p *Parser) checkpoint() position {
-	return p.position
+func (s span) Err(errType error, messagef string, args ...interface{}) error {
+	return &LangError{Kind: errType, Line: s.pos.line, Col: s.pos.col,
+		Msg: fmt.Sprintf(messagef, args...), span: s}
 }
 
-func (p *Parser) restore(pos position) {
-	p.position = pos
-	if p.offset >= len(p.source) {
-		p.currentChar = -1
-	} else {
-		p.currentChar = p.source[p.offset]
+// wrap annotates err, which should already wrap one of the sentinel errors,
+// with the position.
+func (s span) wrap(err error) error {
+	kind := errorKind(err)
+	msg := err.Error()
+	if kind != nil {
+		msg = strings.TrimPrefix(msg, kind.Error()+": ")
 	}
+	return &LangError{Kind: kind, Line: s.pos.line, Col: s.pos.col, Msg: msg, Err: err, span: s}
 }
 
-func (p position) Err(errType error, messagef string, args ...interface{}) error {
-	return fmt.Errorf("%w: line %d, column %d: %s",
-		errType, p.line, p.col,
-		fmt.Sprintf(messagef, args...))
-}
-
-func (p *Parser) sourceError(messagef string, args ...interface{}) error {
-	return p.position.Err(ErrParser, messagef, args...)
-}
+// LangError is an error about the source at a position, from parsing or
+// evaluating it. It matches its Kind with errors.Is, and errors.As finds it
+// in the errors Parse and Eval return.
+type LangError struct {
+	// Kind is the sentinel error, such as ErrTypeMismatch, that the error
+	// is an instance of, or nil for errors from Go that aren't any of them,
+	// such as those returned to ?.
+	Kind error
+	// Line and Col are where the error is, counting from 1, with columns
+	// in runes.
+	Line, Col int
+	// Msg is the message, without the kind or position.
+	Msg string
+	// Err is the error at the position, if the error is about another
+	// error, such as one returned by a Go function or a failed conversion.
+	Err error
 
-func (p *Parser) eof() bool {
-	return p.offset >= len(p.source)
+	span span
 }
 
-func (p *Parser) char(lookahead int) rune {
-	if p.offset+lookahead >= len(p.source) || p.offset+lookahead < 0 {
-		return -1
+// Error returns the kind, if any, the position, and the message, as in
+// "type mismatch: line 1, column 5: ...", whether or not the error is about
+// another error, so that the layout is the same for every error.
+func (e *LangError) Error() string {
+	msg := fmt.Sprintf("line %d, column %d: %s", e.Line, e.Col, e.Msg)
+	if e.Kind == nil {
+		return msg
 	}
-	return p.source[p.offset+lookahead]
+	return fmt.Sprintf("%v: %s", e.Kind, msg)
 }
 
-func charRepr(c rune) string {
-	if c == -1 {
-		return "eof"
+// Unwrap returns the error the LangError is about, or else its kind.
+func (e *LangError) Unwrap() error {
+	if e.Err != nil {
+		return e.Err
 	}
-	return fmt.Sprintf("%q", string(c))
+	return e.Kind
 }
 
-func (p *Parser) string(width int) string {
-	remaining := p.source[p.offset:]
-	if len(remaining) < width {
-		width = len(remaining)
-	}
-	return string(remaining[:width])
-}
+// kinds are the sentinel errors that LangErrors are kinds of.
+var kinds = []error{ErrIncomplete, ErrParser, ErrUnboundVar, ErrTypeMismatch, ErrUnknownOp, ErrRuntime,
+	ErrReadOnly, ErrRateLimited, ErrBudgetExceeded, ErrAllocBudgetExceeded, ErrDenied}
 
-func (p *Parser) skipComment() (bool, error) {
-	current := p.string(2)
-	commentEnd := ""
-	switch current {
-	case "//":
-		commentEnd = "\n"
-	case "/*":
-		commentEnd = "*/"
-	default:
-		return false, nil
-	}
-	if err := p.advance(2); err != nil {
-		return false, err
-	}
-	for {
-		if p.eof() {
-			return true, nil
-		}
-		if p.string(len(commentEnd)) == commentEnd {
-			return true, p.advance(len(commentEnd))
-		}
-		if err := p.advance(1); err != nil {
-			return false, err
+// errorKind returns the sentinel error err matches, or nil if it matches
+// none.
+func errorKind(err error) error {
+	for _, kind := range kinds {
+		if errors.Is(err, kind) {
+			return kind
 		}
 	}
+	return nil
 }
 
-func (p *Parser) skipWhitespace() (bool, error) {
-	if p.eof() {
-		return false, nil
-	}
-	skipped, err := p.skipComment()
-	if err != nil {
-		return false, err
-	}
-	if skipped {
-		return true, nil
-	}
-	switch p.currentChar {
-	case ' ', '\t', '\r', '\n':
-		return true, p.advance(1)
-	}
-	return false, nil
+// Parser parses source into an Evaluable. It tokenizes the source up front
+// and parses the tokens by recursive descent, backtracking with checkpoint
+// and restore where the grammar is ambiguous.
+type Parser struct {
+	source []rune
+	tokens []token
+	index  int
+	// errs are the errors from tokenizing.
+	errs []error
+	// loops and blocks are how many loops and blocks enclose the current
+	// token.
+	loops, blocks int
+	// funcs is how many function literals enclose the current token.
+	funcs int
+	// switches is how many switch statements enclose the current token, for
+	// break.
+	switches int
+	// controlClause is true in the header of a for loop or switch, where {
+	// starts the body rather than a composite literal, unless it is in
+	// parentheses or brackets.
+	controlClause bool
+
+	recovering  bool
+	diagnostics []Diagnostic
 }
 
-func (p *Parser) skipAllWhitespace() (bool, error) {
-	anySkipped := false
-	for {
-		skipped, err := p.skipWhitespace()
-		if err != nil {
-			return false, err
-		}
-		if !skipped {
-			return anySkipped, nil
-		}
-		anySkipped = true
+func NewParser(source string) *Parser {
+	tokens, errs := tokenize(source)
+	return &Parser{
+		source: []rune(source),
+		tokens: tokens,
+		errs:   errs,
 	}
 }
 
-func isIdentifierChar(c rune) bool {
-	return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+// peek returns the token lookahead tokens past the current one. Past the
+// end of input, it returns the EOF token.
+func (p *Parser) peek(lookahead int) token {
+	if i := p.index + lookahead; i >= 0 && i < len(p.tokens) {
+		return p.tokens[i]
+	}
+	return p.tokens[len(p.tokens)-1]
 }
 
-func IsIdentifier(v string) bool {
-	chars := []rune(v)
-	if len(chars) == 0 {
-		return false
-	}
-	if unicode.IsDigit(chars[0]) {
-		return false
+// next consumes and returns the current token.
+func (p *Parser) next() token {
+	tok := p.peek(0)
+	if tok.kind != tokenEOF {
+		p.index++
 	}
-	for _, c := range chars {
-		if !isIdentifierChar(c) {
-			return false
-		}
-	}
-	return true
+	return tok
 }
 
-func (p *Parser) parseIdentifier() (*Ident, error) {
-	cp := p.checkpoint()
-	if unicode.IsDigit(p.currentChar) {
-		return nil, nil
-	}
-	chars, err := p.parseChars(isIdentifierChar)
-	if err != nil {
-		return nil, err
-	}
-	if _, err = p.skipAllWhitespace(); err != nil {
-		return nil, err
-	}
-	if chars == "" {
-		return nil, nil
+// accept consumes the current token and returns true if it is the given
+// operator or keyword.
+func (p *Parser) accept(text string) bool {
+	if p.peek(0).is(text) {
+		p.next()
+		return true
 	}
-	return &Ident{Name: chars, pos: cp}, nil
+	return false
 }
 
-func (p *Parser) parseChars(allowed func(rune) bool) (string, error) {
-	if !allowed(p.currentChar) {
-		return "", nil
-	}
-	chars := string(p.currentChar)
-	if err := p.advance(1); err != nil {
-		return "", err
-	}
-	for allowed(p.currentChar) {
-		chars += string(p.currentChar)
-		if err := p.advance(1); err != nil {
-			return "", err
-		}
-	}
-	return chars, nil
+// pos returns the position of the current token.
+func (p *Parser) pos() position {
+	return p.peek(0).pos
 }
 
-func isUniquelyFloatingPointChar(c rune) bool {
-	switch c {
-	case '.', '+', '-', 'p', 'P': // floating point
-		return true
+// spanFrom returns the span from start up to the end of the last consumed
+// token, with errors reported at pos.
+func (p *Parser) spanFrom(start, pos position) span {
+	end := start
+	if p.index > 0 && p.tokens[p.index-1].end.offset > start.offset {
+		end = p.tokens[p.index-1].end
 	}
-	return false
+	return span{pos: pos, start: start, end: end}
 }
 
-func isNumberChar(c rune) bool {
-	if unicode.IsDigit(c) {
-		return true
-	}
-	if isUniquelyFloatingPointChar(c) {
-		return true
-	}
-	switch c {
-	case 'b', 'B': // binary
-		return true
-	case 'o', 'O': // octal
-		return true
-	case 'x', 'X', 'a', 'A', 'c', 'C', 'd', 'D', 'e', 'E', 'f', 'F': // hex
-		return true
-	case '_': // separators
-		return true
-	}
-	return false
+func (p *Parser) checkpoint() int {
+	return p.index
 }
 
-func stringContains(val string, matcher func(rune) bool) bool {
-	for _, c := range val {
-		if matcher(c) {
-			return true
-		}
-	}
-	return false
+func (p *Parser) restore(index int) {
+	p.index = index
 }
 
-func (p *Parser) parseDurationSuffix() (string, error) {
-	for _, suffix := range durationSuffixes {
-		if p.string(len(suffix)) == suffix {
-			return suffix, p.advance(len(suffix))
-		}
-	}
-	return "", nil
+func (p *Parser) sourceError(messagef string, args ...interface{}) error {
+	return p.peek(0).span().Err(ErrParser, messagef, args...)
 }
 
-func (p *Parser) parseNumber() (Evaluable, error) {
-	if !unicode.IsDigit(p.currentChar) {
+func (p *Parser) eof() bool {
+	return p.peek(0).kind == tokenEOF
+}
+
+// parseIdentifier parses a name. Keywords are not names unless quoted with
+// @.
+func (p *Parser) parseIdentifier() (*Ident, error) {
+	tok := p.peek(0)
+	if tok.kind != tokenIdent {
 		return nil, nil
 	}
+	p.next()
+	return &Ident{Name: tok.text, span: tok.span()}, nil
+}
 
-	num, err := p.parseChars(isNumberChar)
-	if err != nil {
-		return nil, err
+// parseFieldName parses a name after a dot, where keywords are unambiguous
+// and need not be quoted.
+func (p *Parser) parseFieldName() (*Ident, error) {
+	tok := p.peek(0)
+	if tok.kind != tokenIdent && tok.kind != tokenKeyword {
+		return nil, nil
 	}
+	p.next()
+	return &Ident{Name: tok.text, span: tok.span()}, nil
+}
 
-	suffix, err := p.parseDurationSuffix()
-	if err != nil {
-		return nil, err
+// keywordError returns a parse error if the input is at a keyword, for when
+// no syntax accepted the input.
+func (p *Parser) keywordError() error {
+	tok := p.peek(0)
+	if tok.kind != tokenKeyword {
+		return nil
 	}
+	return tok.span().Err(ErrParser, "unexpected keyword %s (use @%s for a name)", tok.text, tok.text)
+}
 
-	if _, err = p.skipAllWhitespace(); err != nil {
-		return nil, err
-	}
-	if num == "" {
+func (p *Parser) parseNumber() (Evaluable, error) {
+	tok := p.peek(0)
+	switch tok.kind {
+	case tokenDuration:
+		p.next()
+		dur, err := time.ParseDuration(tok.text)
+		if err != nil {
+			return nil, tok.span().Err(ErrParser, "invalid duration %q", tok.text)
+		}
+		return &Value{Val: reflect.ValueOf(dur), span: tok.span()}, nil
+	case tokenNumber:
+		p.next()
+	default:
 		return nil, nil
 	}
 
-	if suffix != "" {
-		dur, err := time.ParseDuration(num + suffix)
+	num := tok.text
+	if strings.HasSuffix(num, "u") {
+		num = strings.TrimSuffix(num, "u")
+		if stringContains(num, isUniquelyFloatingPointChar) {
+			return nil, tok.span().Err(ErrParser, "invalid unsigned number %q", tok.text)
+		}
+		val, err := strconv.ParseUint(num, 0, 64)
 		if err != nil {
-			return nil, err
+			return nil, tok.span().Err(ErrParser, "invalid number %q", tok.text)
 		}
-		return &Value{Val: reflect.ValueOf(dur)}, nil
+		return &Value{Val: reflect.ValueOf(val), span: tok.span()}, nil
 	}
-
 	if stringContains(num, isUniquelyFloatingPointChar) {
 		val, err := strconv.ParseFloat(num, 64)
 		if err != nil {
-			return nil, err
+			return nil, tok.span().Err(ErrParser, "invalid number %q", num)
 		}
-		return &Value{Val: reflect.ValueOf(val)}, nil
+		return &Value{Val: reflect.ValueOf(val), Untyped: true, span: tok.span()}, nil
 	}
-	val, err := strconv.ParseInt(num, 0, 64)
+	// like in Go, integers default to int.
+	val, err := strconv.ParseInt(num, 0, strconv.IntSize)
 	if err != nil {
-		return nil, err
+		return nil, tok.span().Err(ErrParser, "invalid number %q", num)
 	}
-	return &Value{Val: reflect.ValueOf(val)}, nil
+	return &Value{Val: reflect.ValueOf(int(val)), Untyped: true, span: tok.span()}, nil
 }
 
 func (p *Parser) parseString() (Evaluable, error) {
-	if p.char(0) != '"' {
+	tok := p.peek(0)
+	if tok.kind != tokenString {
 		return nil, nil
 	}
-	if err := p.advance(1); err != nil {
-		return nil, err
-	}
-	var val []rune
-	for {
-		r := p.char(0)
-		if err := p.advance(1); err != nil {
-			return nil, err
-		}
-		switch r {
-		case '\\':
-			r = p.char(0)
-			if err := p.advance(1); err != nil {
-				return nil, err
-			}
-			switch r {
-			case '\\', '"':
-				val = append(val, r)
-			case 'n':
-				val = append(val, '\n')
-			case 't':
-				val = append(val, '\t')
-			default:
-				return nil, p.sourceError("unexpected escape code: %s", charRepr(r))
-			}
-		case '"':
-			_, err := p.skipAllWhitespace()
-			return &Value{Val: reflect.ValueOf(string(val))}, err
-		case '\n':
-			return nil, p.sourceError("unexpected end of line")
-		default:
-			val = append(val, r)
-		}
-	}
+	p.next()
+	return &Value{Val: reflect.ValueOf(tok.text), Untyped: true, span: tok.span()}, nil
 }
 
 func (p *Parser) parseLiteral() (Evaluable, error) {
+	fn, err := p.parseFuncLit()
+	if fn != nil || err != nil {
+		return fn, err
+	}
 	str, err := p.parseString()
 	if err != nil {
 		return nil, err
@@ -381,18 +322,12 @@ func (p *Parser) parseLiteral() (Evaluable, error) {
 	return p.parseNumber()
 }
 
-func (p *Parser) parseFieldAccess(val Evaluable) (Evaluable, error) {
-	cp := p.checkpoint()
-	if p.char(0) != '.' {
+func (p *Parser) parseFieldAccess(val Evaluable, start position) (Evaluable, error) {
+	cp, pos := p.checkpoint(), p.pos()
+	if !p.accept(".") {
 		return nil, nil
 	}
-	if err := p.advance(1); err != nil {
-		return nil, err
-	}
-	if _, err := p.skipAllWhitespace(); err != nil {
-		return nil, err
-	}
-	field, err := p.parseIdentifier()
+	field, err := p.parseFieldName()
 	if err != nil {
 		return nil, err
 	}
@@ -400,120 +335,96 @@ func (p *Parser) parseFieldAccess(val Evaluable) (Evaluable, error) {
 		p.restore(cp)
 		return nil, nil
 	}
-	return &FieldAccess{Val: val, Field: field, pos: cp}, nil
+	return &FieldAccess{Val: val, Field: field, span: p.spanFrom(start, pos)}, nil
 }
 
-func (p *Parser) parseArrayAccess(val Evaluable) (Evaluable, error) {
-	if p.char(0) != '[' {
+func (p *Parser) parseArrayAccess(val Evaluable, start position) (Evaluable, error) {
+	pos := p.pos()
+	if !p.accept("[") {
 		return nil, nil
 	}
-	cp := p.checkpoint()
-	if err := p.advance(1); err != nil {
-		return nil, err
-	}
-	if _, err := p.skipAllWhitespace(); err != nil {
-		return nil, err
-	}
-	low, err := p.parseExpression()
-	if err != nil {
-		return nil, err
-	}
-
-	if p.char(0) == ':' {
-		if err := p.advance(1); err != nil {
-			return nil, err
-		}
-		if _, err := p.skipAllWhitespace(); err != nil {
-			return nil, err
-		}
-		high, err := p.parseExpression()
+	defer p.setControlClause(false)()
+	var low Evaluable
+	if !p.peek(0).is(":") {
+		var err error
+		low, err = p.parseExpression()
 		if err != nil {
 			return nil, err
 		}
-		val = &SliceAccess{
+	}
+
+	if p.accept(":") {
+		var high Evaluable
+		if !p.peek(0).is("]") {
+			var err error
+			high, err = p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+		}
+		slice := &SliceAccess{
 			Array: val,
 			Low:   low,
 			High:  high,
-			pos:   cp,
 		}
-	} else {
-		val = &ArrayAccess{
-			Array: val,
-			Index: low,
-			pos:   cp,
+		if !p.accept("]") {
+			return nil, p.sourceError("expected end of array access")
 		}
+		slice.span = p.spanFrom(start, pos)
+		return slice, nil
 	}
 
-	if p.char(0) != ']' {
-		return nil, p.sourceError("expected end of array access")
-	}
-	if err := p.advance(1); err != nil {
-		return nil, err
+	if low == nil {
+		return nil, p.sourceError("expected an index")
 	}
-	if _, err := p.skipAllWhitespace(); err != nil {
-		return nil, err
+	if !p.accept("]") {
+		return nil, p.sourceError("expected end of array access")
 	}
-
-	return val, nil
+	return &ArrayAccess{
+		Array: val,
+		Index: low,
+		span:  p.spanFrom(start, pos),
+	}, nil
 }
 
-func (p *Parser) parseArgs() ([]Evaluable, error) {
-	if p.char(0) != '(' {
-		return nil, nil
-	}
-	if err := p.advance(1); err != nil {
-		return nil, err
-	}
-	if _, err := p.skipAllWhitespace(); err != nil {
-		return nil, err
-	}
-	args := []Evaluable{}
-	if p.char(0) == ')' {
-		if err := p.advance(1); err != nil {
-			return nil, err
-		}
-		_, err := p.skipAllWhitespace()
-		return args, err
+// parseArgs parses call arguments. spread is true if the last argument is
+// followed by ..., as in f(xs...).
+func (p *Parser) parseArgs() (args []Evaluable, spread bool, err error) {
+	if !p.accept("(") {
+		return nil, false, nil
 	}
-	arg, err := p.parseExpression()
-	if err != nil {
-		return nil, err
+	defer p.setControlClause(false)()
+	args = []Evaluable{}
+	if p.accept(")") {
+		return args, false, nil
 	}
-	if arg == nil {
-		return nil, p.sourceError("unexpected missing argument")
-	}
-	args = append(args, arg)
 	for {
-		if p.char(0) == ')' {
-			if err := p.advance(1); err != nil {
-				return nil, err
-			}
-			_, err := p.skipAllWhitespace()
-			return args, err
-		}
-		if p.char(0) != ',' {
-			return nil, p.sourceError("unexpected character %s", charRepr(p.char(0)))
-		}
-		if err := p.advance(1); err != nil {
-			return nil, err
-		}
-		if _, err := p.skipAllWhitespace(); err != nil {
-			return nil, err
-		}
 		arg, err := p.parseExpression()
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 		if arg == nil {
-			return nil, p.sourceError("unexpected missing argument")
+			return nil, false, p.sourceError("unexpected missing argument")
 		}
 		args = append(args, arg)
+		if p.accept("...") {
+			if !p.accept(")") {
+				return nil, false, p.sourceError("expected ) after ..., found %s", p.peek(0))
+			}
+			return args, true, nil
+		}
+		if p.accept(")") {
+			return args, false, nil
+		}
+		if !p.accept(",") {
+			return nil, false, p.sourceError("unexpected %s", p.peek(0))
+		}
 	}
 }
 
-func (p *Parser) parseFunctionCall(val Evaluable) (Evaluable, error) {
-	cp := p.checkpoint()
-	args, err := p.parseArgs()
+func (p *Parser) parseFunctionCall(val Evaluable, start position) (Evaluable, error) {
+	pos := p.pos()
+	args, spread, err := p.parseArgs()
 	if err != nil {
 		return nil, err
 	}
@@ -521,22 +432,102 @@ func (p *Parser) parseFunctionCall(val Evaluable) (Evaluable, error) {
 		return nil, nil
 	}
 	return &Call{
-		Func: val,
-		Args: args,
-		pos:  cp,
+		Func:   val,
+		Args:   args,
+		Spread: spread,
+		span:   p.spanFrom(start, pos),
 	}, nil
 }
 
+// setControlClause sets whether a control clause is being parsed, and
+// returns a function that restores the previous setting.
+func (p *Parser) setControlClause(controlClause bool) (restore func()) {
+	prev := p.controlClause
+	p.controlClause = controlClause
+	return func() { p.controlClause = prev }
+}
+
+// isTypeName returns true if expr could name a type in a composite literal,
+// as in T{...} or pkg.T{...}.
+func isTypeName(expr Evaluable) bool {
+	switch expr := expr.(type) {
+	case *Ident:
+		return true
+	case *FieldAccess:
+		return !expr.Safe && isTypeName(expr.Val)
+	}
+	return false
+}
+
+// parseCompositeLit parses the elements of a composite literal of type typ,
+// which is nil for elements whose type is elided, as in []T{{...}}.
+func (p *Parser) parseCompositeLit(typ Evaluable, start position) (Evaluable, error) {
+	pos := p.pos()
+	if !p.accept("{") {
+		return nil, p.sourceError("expected {, found %s", p.peek(0))
+	}
+	defer p.setControlClause(false)()
+	lit := &CompositeLit{Type: typ}
+	for !p.accept("}") {
+		value, err := p.parseElement()
+		if err != nil {
+			return nil, err
+		}
+		elem := Element{Value: value}
+		if p.accept(":") {
+			elem.Key = value
+			if elem.Value, err = p.parseElement(); err != nil {
+				return nil, err
+			}
+		}
+		lit.Elements = append(lit.Elements, elem)
+		if !p.accept(",") {
+			if !p.accept("}") {
+				return nil, p.sourceError("expected , or } in composite literal, found %s", p.peek(0))
+			}
+			break
+		}
+	}
+	lit.span = p.spanFrom(start, pos)
+	return lit, nil
+}
+
+// parseElement parses a key or value in a composite literal.
+func (p *Parser) parseElement() (Evaluable, error) {
+	if p.peek(0).is("{") {
+		return p.parseCompositeLit(nil, p.pos())
+	}
+	expr, err := p.parseExpression()
+	if err == nil && expr == nil {
+		err = p.sourceError("expected composite literal element, found %s", p.peek(0))
+	}
+	return expr, err
+}
+
 func (p *Parser) parseModifiedSubexpression() (Evaluable, error) {
+	start := p.pos()
 	val, err := p.parseSubexpression()
 	if err != nil || val == nil {
 		return val, err
 	}
+	safe := false
 	for {
 		if p.eof() {
-			return val, nil
+			break
+		}
+		if pos := p.pos(); p.accept("?.") {
+			field, err := p.parseFieldName()
+			if err != nil {
+				return nil, err
+			}
+			if field == nil {
+				return nil, p.sourceError("expected field name after ?., found %s", p.peek(0))
+			}
+			val = &FieldAccess{Val: val, Field: field, Safe: true, span: p.spanFrom(start, pos)}
+			safe = true
+			continue
 		}
-		intermediate, err := p.parseFieldAccess(val)
+		intermediate, err := p.parseFieldAccess(val, start)
 		if err != nil {
 			return nil, err
 		}
@@ -544,7 +535,7 @@ func (p *Parser) parseModifiedSubexpression() (Evaluable, error) {
 			val = intermediate
 			continue
 		}
-		intermediate, err = p.parseArrayAccess(val)
+		intermediate, err = p.parseArrayAccess(val, start)
 		if err != nil {
 			return nil, err
 		}
@@ -552,7 +543,7 @@ func (p *Parser) parseModifiedSubexpression() (Evaluable, error) {
 			val = intermediate
 			continue
 		}
-		intermediate, err = p.parseFunctionCall(val)
+		intermediate, err = p.parseFunctionCall(val, start)
 		if err != nil {
 			return nil, err
 		}
@@ -560,21 +551,31 @@ func (p *Parser) parseModifiedSubexpression() (Evaluable, error) {
 			val = intermediate
 			continue
 		}
-		return val, nil
+		if p.peek(0).is("{") && !p.controlClause && isTypeName(val) {
+			val, err = p.parseCompositeLit(val, start)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if pos := p.pos(); p.accept("?") {
+			val = &Propagate{Expr: val, span: p.spanFrom(start, pos)}
+			continue
+		}
+		break
+	}
+	if safe {
+		val = &SafeChain{Expr: val, span: p.spanFrom(start, start)}
 	}
+	return val, nil
 }
 
 func (p *Parser) parseSubexpression() (Evaluable, error) {
-	cp := p.checkpoint()
-	if p.char(0) != '(' {
+	pos := p.pos()
+	if !p.accept("(") {
 		return p.parseLiteral()
 	}
-	if err := p.advance(1); err != nil {
-		return nil, err
-	}
-	if _, err := p.skipAllWhitespace(); err != nil {
-		return nil, err
-	}
+	defer p.setControlClause(false)()
 	expr, err := p.parseExpression()
 	if err != nil {
 		return nil, err
@@ -582,23 +583,20 @@ func (p *Parser) parseSubexpression() (Evaluable, error) {
 	if expr == nil {
 		return nil, p.sourceError("missing subexpression")
 	}
-	if p.char(0) != ')' {
-		return nil, p.sourceError("subexpression ended unexpectedly, found %s", charRepr(p.char(0)))
-	}
-	if err := p.advance(1); err != nil {
-		return nil, err
+	if !p.accept(")") {
+		return nil, p.sourceError("subexpression ended unexpectedly, found %s", p.peek(0))
 	}
-	_, err = p.skipAllWhitespace()
-	return &Subexpression{Expr: expr, pos: cp}, err
+	return &Subexpression{Expr: expr, span: p.spanFrom(pos, pos)}, nil
 }
 
 func (p *Parser) parseValNegation() (Evaluable, error) {
 	return p.parseModifier(
 		p.parseModifiedSubexpression,
 		map[string][]string{
-			ModNeg:   {"-"},
-			ModRef:   {"&"},
-			ModDeref: {"*"},
+			ModNeg:        {"-"},
+			ModRef:        {"&"},
+			ModDeref:      {"*"},
+			ModComplement: {"^"},
 		},
 	)
 }
@@ -607,8 +605,12 @@ func (p *Parser) parseMultiplicationDivision() (Evaluable, error) {
 	return p.parseOperation(
 		p.parseValNegation,
 		map[string][]string{
-			OpMul: {"*"},
-			OpDiv: {"/"},
+			OpMul:    {"*"},
+			OpDiv:    {"/"},
+			OpShl:    {"<<"},
+			OpShr:    {">>"},
+			OpBitAnd: {"&"},
+			OpAndNot: {"&^"},
 		},
 	)
 }
@@ -617,8 +619,10 @@ func (p *Parser) parseAdditionSubtraction() (Evaluable, error) {
 	return p.parseOperation(
 		p.parseMultiplicationDivision,
 		map[string][]string{
-			OpAdd: {"+"},
-			OpSub: {"-"},
+			OpAdd:    {"+"},
+			OpSub:    {"-"},
+			OpBitOr:  {"|"},
+			OpBitXor: {"^"},
 		},
 	)
 }
@@ -641,7 +645,7 @@ func (p *Parser) parseBoolNegation() (Evaluable, error) {
 	return p.parseModifier(
 		p.parseComparison,
 		map[string][]string{
-			ModNot: {"!"},
+			ModNot: {"!", "not"},
 		},
 	)
 }
@@ -650,7 +654,7 @@ func (p *Parser) parseConjunction() (Evaluable, error) {
 	return p.parseOperation(
 		p.parseBoolNegation,
 		map[string][]string{
-			OpAnd: {"&&"},
+			OpAnd: {"&&", "and"},
 		},
 	)
 }
@@ -659,13 +663,14 @@ func (p *Parser) parseDisjunction() (Evaluable, error) {
 	return p.parseOperation(
 		p.parseConjunction,
 		map[string][]string{
-			OpOr: {"||"},
+			OpOr: {"||", "or"},
 		},
 	)
 }
 
 func (p *Parser) parseOperation(valueParse func() (Evaluable, error),
 	opMap map[string][]string) (Evaluable, error) {
+	start := p.pos()
 	val, err := valueParse()
 	if err != nil {
 		return nil, err
@@ -677,7 +682,7 @@ func (p *Parser) parseOperation(valueParse func() (Evaluable, error),
 		if p.eof() {
 			return val, nil
 		}
-		cp := p.checkpoint()
+		pos := p.pos()
 		cls, rhs, err := parseOpAndRHS(p, valueParse, opMap)
 		if err != nil {
 			return nil, err
@@ -689,14 +694,14 @@ func (p *Parser) parseOperation(valueParse func() (Evaluable, error),
 			Type:  OpType(cls),
 			Left:  val,
 			Right: rhs,
-			pos:   cp,
+			span:  p.spanFrom(start, pos),
 		}
 	}
 }
 
 func (p *Parser) parseModifier(valueParse func() (Evaluable, error),
 	modMap map[string][]string) (Evaluable, error) {
-	cp := p.checkpoint()
+	pos := p.pos()
 	cls, val, err := parseOpAndRHS(p, valueParse, modMap)
 	if err != nil {
 		return nil, err
@@ -705,66 +710,98 @@ func (p *Parser) parseModifier(valueParse func() (Evaluable, error),
 		return &Modifier{
 			Type: ModType(cls),
 			Val:  val,
-			pos:  cp,
+			span: p.spanFrom(pos, pos),
 		}, nil
 	}
 	return valueParse()
 }
 
-func (p *Parser) isBoundary(char1, char2 rune) bool {
-	return !isIdentifierChar(char1) || !isIdentifierChar(char2)
-}
-
 func parseOpAndRHS(p *Parser, valueParse func() (Evaluable, error),
 	opMap map[string][]string) (key string, _ Evaluable, _ error) {
-	cpos := p.checkpoint()
+	tok := p.peek(0)
+	if tok.kind != tokenOperator && tok.kind != tokenKeyword {
+		return OpOrModNil, nil, nil
+	}
+	cp := p.checkpoint()
 	for cls, operators := range opMap {
 		for _, op := range operators {
-			if strings.ToLower(p.string(len(op))) == op && p.isBoundary(p.char(len(op)-1), p.char(len(op))) {
-				if err := p.advance(len(op)); err != nil {
-					return OpOrModNil, nil, err
-				}
-				if _, err := p.skipAllWhitespace(); err != nil {
-					return OpOrModNil, nil, err
-				}
-				rhs, err := valueParse()
-				if err != nil {
-					return OpOrModNil, nil, err
-				}
-				if rhs != nil {
-					return cls, rhs, nil
-				}
-				p.restore(cpos)
+			if tok.text != op {
+				continue
+			}
+			p.next()
+			rhs, err := valueParse()
+			if err != nil {
+				return OpOrModNil, nil, err
 			}
+			if rhs != nil {
+				return cls, rhs, nil
+			}
+			p.restore(cp)
+			return OpOrModNil, nil, nil
 		}
 	}
 	return OpOrModNil, nil, nil
 }
 
 func (p *Parser) parseExpression() (Evaluable, error) {
+	cond, err := p.parseConditional()
+	if cond != nil || err != nil {
+		return cond, err
+	}
 	return p.parseDisjunction()
 }
 
-func (p *Parser) parseImport() (Evaluable, error) {
-	cp := p.checkpoint()
-	if p.string(len("import ")) != "import " {
+// parseConditional parses the conditional expression
+// if cond then a else b. The else branch extends as far as possible, so
+// conditionals chain as in if a then 1 else if b then 2 else 3.
+func (p *Parser) parseConditional() (Evaluable, error) {
+	tok := p.peek(0)
+	if !tok.is("if") {
+		return nil, nil
+	}
+	switch next := p.peek(1); {
+	case next.kind == tokenEOF, next.is(";"), next.is("}"), next.is(")"), next.is(","),
+		next.is("="), next.is(":="):
+		// if used as a name, which is reported as such.
 		return nil, nil
 	}
-	if err := p.advance(len("import ")); err != nil {
+	p.next()
+	operand := func(after string) (Evaluable, error) {
+		expr, err := p.parseExpression()
+		if err == nil && expr == nil {
+			err = p.sourceError("expected expression after %s, found %s", after, p.peek(0))
+		}
+		return expr, err
+	}
+	cond := &Conditional{}
+	var err error
+	if cond.Cond, err = operand("if"); err != nil {
 		return nil, err
 	}
-	if _, err := p.skipAllWhitespace(); err != nil {
+	if !p.accept("then") {
+		return nil, p.sourceError("expected then in conditional expression, found %s", p.peek(0))
+	}
+	if cond.Then, err = operand("then"); err != nil {
 		return nil, err
 	}
-	target := &Value{Val: reflect.ValueOf("")}
-	if p.string(1) == "." {
-		target = &Value{Val: reflect.ValueOf(".")}
-		if err := p.advance(1); err != nil {
-			return nil, err
-		}
-		if _, err := p.skipAllWhitespace(); err != nil {
-			return nil, err
-		}
+	if !p.accept("else") {
+		return nil, p.sourceError("expected else in conditional expression, found %s", p.peek(0))
+	}
+	if cond.Else, err = operand("else"); err != nil {
+		return nil, err
+	}
+	cond.span = p.spanFrom(tok.pos, tok.pos)
+	return cond, nil
+}
+
+func (p *Parser) parseImport() (Evaluable, error) {
+	cp, pos := p.checkpoint(), p.pos()
+	if !p.accept("import") {
+		return nil, nil
+	}
+	target := &Value{Val: reflect.ValueOf("")}
+	if p.accept(".") {
+		target = &Value{Val: reflect.ValueOf(".")}
 	} else {
 		ident, err := p.parseIdentifier()
 		if err != nil {
@@ -786,368 +823,2268 @@ func (p *Parser) parseImport() (Evaluable, error) {
 	rv := &Call{
 		Func: &Ident{
 			Name: "$import",
-			pos:  cp,
+			span: p.spanFrom(pos, pos),
 		},
 		Args: []Evaluable{
 			target,
 			pkg,
 		},
-		pos: cp,
+		span: p.spanFrom(pos, pos),
 	}
 
 	return rv, nil
 }
 
 func (p *Parser) parseAssignment() (Evaluable, error) {
-	// TODO: parse field, array, or map assignment
-	// TODO: parse multiple rhs expressions
-
-	cp := p.checkpoint()
+	cp, pos := p.checkpoint(), p.pos()
 	var lhs []Evaluable
+	var lhsPos []position
 
-	first, err := p.parseIdentifier()
-	if err != nil || first == nil {
-		p.restore(cp)
-		return nil, err
-	}
-	lhs = append(lhs, &Value{Val: reflect.ValueOf(first.Name)})
-
-	extension := ""
+	define := false
 
 lhsParsing:
 	for {
+		targetPos := p.pos()
+		target, err := p.parseModifiedSubexpression()
+		if err != nil || target == nil {
+			p.restore(cp)
+			return nil, err
+		}
+		lhs = append(lhs, target)
+		lhsPos = append(lhsPos, targetPos)
+
 		switch {
-		case p.string(1) == ",":
-			if err := p.advance(1); err != nil {
-				return nil, err
-			}
-			if _, err := p.skipAllWhitespace(); err != nil {
-				return nil, err
-			}
-			next, err := p.parseIdentifier()
-			if err != nil || next == nil {
-				p.restore(cp)
-				return nil, err
-			}
-			lhs = append(lhs, &Value{Val: reflect.ValueOf(next.Name)})
+		case p.accept(","):
 			continue lhsParsing
-
-		case p.string(1) == "=":
-			if err := p.advance(1); err != nil {
-				return nil, err
-			}
-			extension = "$mutate"
+		case p.accept("="):
 			break lhsParsing
-
-		case p.string(2) == ":=":
-			if err := p.advance(2); err != nil {
-				return nil, err
-			}
-			extension = "$define"
+		case p.accept(":="):
+			define = true
 			break lhsParsing
-
 		default:
 			p.restore(cp)
 			return nil, nil
 		}
 	}
 
-	if _, err := p.skipAllWhitespace(); err != nil {
-		return nil, err
+	for i, target := range lhs {
+		switch target.(type) {
+		case *Ident:
+			continue
+		case *FieldAccess, *ArrayAccess:
+			if !define {
+				continue
+			}
+			return nil, lhsPos[i].Err(ErrParser, "non-name on left side of :=")
+		}
+		return nil, lhsPos[i].Err(ErrParser, "cannot assign to expression")
 	}
 
-	rhs, err := p.parseExpression()
-	if err != nil || rhs == nil {
-		p.restore(cp)
-		return nil, err
+	var rhs []Evaluable
+	for {
+		expr, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if expr == nil {
+			return nil, p.sourceError("expected expression")
+		}
+		rhs = append(rhs, expr)
+		if !p.accept(",") {
+			break
+		}
 	}
 
-	return &Call{
-		Func: &Call{
-			Func: &Ident{
-				Name: extension,
-				pos:  cp,
-			},
-			Args: lhs,
-			pos:  cp,
-		},
-		Args: []Evaluable{rhs},
-		pos:  cp,
+	return &Assignment{
+		Targets: lhs,
+		Values:  rhs,
+		Define:  define,
+		span:    p.spanFrom(pos, pos),
 	}, nil
 }
 
-func (p *Parser) parseStatement() (Evaluable, error) {
-	stmt, err := p.parseImport()
-	if stmt != nil || err != nil {
-		return stmt, err
-	}
-	stmt, err = p.parseAssignment()
-	if stmt != nil || err != nil {
-		return stmt, err
+// parseBlock parses semicolon-separated statements between braces.
+func (p *Parser) parseBlock() (*Sequence, error) {
+	start := p.pos()
+	if !p.accept("{") {
+		return nil, p.sourceError("expected {, found %s", p.peek(0))
+	}
+	p.blocks++
+	defer func() { p.blocks-- }()
+	defer p.setControlClause(false)()
+	block := &Sequence{}
+	for !p.accept("}") {
+		stmtStart := p.pos()
+		stmt, err := p.parseStatement()
+		if err == nil && stmt == nil {
+			err = p.keywordError()
+			if err == nil {
+				err = p.sourceError("expected statement or }, found %s", p.peek(0))
+			}
+		}
+		if err == nil && !p.peek(0).is(";") && !p.peek(0).is("}") {
+			err = p.sourceError("expected ; or }, found %s", p.peek(0))
+		}
+		if err != nil {
+			stmt, err = p.recoverStatement(err, stmt, stmtStart)
+			if err != nil {
+				return nil, err
+			}
+		}
+		block.Statements = append(block.Statements, stmt)
+		if p.eof() {
+			// only when recovering, after the missing brace was recorded.
+			break
+		}
+		p.accept(";")
 	}
-	return p.parseExpression()
+	block.span = p.spanFrom(start, start)
+	return block, nil
 }
 
-func (p *Parser) Parse() (Evaluable, error) {
-	if _, err := p.skipAllWhitespace(); err != nil {
+// parseFor parses the loops for { ... }, for cond { ... }, and
+// for [key[, value] (:= | =)] range x { ... }.
+func (p *Parser) parseFor() (Evaluable, error) {
+	pos := p.pos()
+	if !p.accept("for") {
+		return nil, nil
+	}
+	p.loops++
+	defer func() { p.loops-- }()
+	defer p.setControlClause(true)()
+
+	if p.peek(0).is("{") {
+		body, err := p.parseBlock()
+		if err != nil {
+			return nil, err
+		}
+		return &For{Body: body, span: p.spanFrom(pos, pos)}, nil
+	}
+
+	loop := &ForRange{}
+	if !p.accept("range") {
+		cp := p.checkpoint()
+		var targets []Evaluable
+		var targetsPos []position
+		for {
+			targetPos := p.pos()
+			target, err := p.parseModifiedSubexpression()
+			if err != nil || target == nil {
+				break
+			}
+			targets = append(targets, target)
+			targetsPos = append(targetsPos, targetPos)
+			if !p.accept(",") {
+				break
+			}
+		}
+		switch {
+		case len(targets) > 0 && p.accept(":="):
+			loop.Define = true
+		case len(targets) > 0 && p.accept("="):
+		case len(targets) > 1:
+			return nil, p.sourceError("expected := or = in range clause, found %s", p.peek(0))
+		default:
+			p.restore(cp)
+			return p.parseForCondition(pos)
+		}
+		if len(targets) > 2 {
+			return nil, targetsPos[2].Err(ErrParser,
+				"range clause permits at most two iteration variables")
+		}
+		for i, target := range targets {
+			switch target := target.(type) {
+			case *Ident:
+				if target.Name == "_" {
+					targets[i] = nil
+				}
+				continue
+			case *FieldAccess, *ArrayAccess:
+				if !loop.Define {
+					continue
+				}
+				return nil, targetsPos[i].Err(ErrParser, "non-name on left side of :=")
+			}
+			return nil, targetsPos[i].Err(ErrParser, "cannot assign to expression")
+		}
+		loop.Key = targets[0]
+		if len(targets) > 1 {
+			loop.Value = targets[1]
+		}
+		if !p.accept("range") {
+			return nil, p.sourceError("expected range, found %s", p.peek(0))
+		}
+	}
+	over, err := p.parseExpression()
+	if err != nil {
 		return nil, err
 	}
-	val, err := p.parseStatement()
+	if over == nil {
+		return nil, p.sourceError("expected expression after range")
+	}
+	loop.Over = over
+	loop.Body, err = p.parseBlock()
 	if err != nil {
 		return nil, err
 	}
-	if !p.eof() {
-		return nil, p.sourceError("unparsed input: %q", string(p.source[p.offset:]))
+	loop.span = p.spanFrom(pos, pos)
+	return loop, nil
+}
+
+// parseForCondition parses the rest of for cond { ... }.
+func (p *Parser) parseForCondition(pos position) (Evaluable, error) {
+	cond, err := p.parseExpression()
+	if err != nil {
+		return nil, err
 	}
-	if val == nil {
-		return nil, p.sourceError("nothing parsed")
+	if cond == nil {
+		return nil, p.sourceError("expected loop condition, found %s", p.peek(0))
 	}
-	return val, nil
+	body, err := p.parseBlock()
+	if err != nil {
+		return nil, err
+	}
+	return &For{Cond: cond, Body: body, span: p.spanFrom(pos, pos)}, nil
 }
 
-type Subexpression struct {
-	Expr Evaluable
-	pos  position
+// parseSwitch parses the type switch
+// switch [v :=] x.(type) { case T1, T2: ...; default: ... }, or the value
+// switch, switch [x] { case a, b: ...; default: ... }.
+func (p *Parser) parseSwitch() (Evaluable, error) {
+	pos := p.pos()
+	if !p.accept("switch") {
+		return nil, nil
+	}
+	restore := p.setControlClause(true)
+	sw := &TypeSwitch{}
+	if !p.peek(1).is(":=") {
+		cp := p.checkpoint()
+		subject, err := p.parseModifiedSubexpression()
+		isTypeSwitch := err == nil && subject != nil && p.peek(0).is(".")
+		p.restore(cp)
+		if !isTypeSwitch {
+			return p.parseValueSwitch(pos, restore)
+		}
+	}
+	if p.peek(1).is(":=") {
+		bind, err := p.parseIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		if bind == nil {
+			return nil, p.sourceError("expected name before :=, found %s", p.peek(0))
+		}
+		if bind.Name != "_" {
+			sw.Bind = bind
+		}
+		p.next()
+	}
+	subject, err := p.parseModifiedSubexpression()
+	if err != nil {
+		return nil, err
+	}
+	if subject == nil {
+		return nil, p.sourceError("expected expression after switch, found %s", p.peek(0))
+	}
+	sw.Subject = subject
+	for _, text := range []string{".", "(", "type", ")"} {
+		if !p.accept(text) {
+			return nil, p.sourceError("expected .(type) in switch, found %s", p.peek(0))
+		}
+	}
+	restore()
+
+	clauses, err := p.parseCaseClauses("type")
+	if err != nil {
+		return nil, err
+	}
+	for _, clause := range clauses {
+		sw.Clauses = append(sw.Clauses, TypeClause{
+			Types: clause.Values, Body: clause.Body, span: clause.span})
+	}
+	sw.span = p.spanFrom(pos, pos)
+	return sw, nil
 }
 
-func (s *Subexpression) Run(env Environment) ([]reflect.Value, error) {
-	return s.Expr.Run(env)
+// parseValueSwitch parses the rest of a value switch, after switch, calling
+// restore once its tag, if any, is parsed.
+func (p *Parser) parseValueSwitch(pos position, restore func()) (Evaluable, error) {
+	sw := &ValueSwitch{}
+	if !p.peek(0).is("{") {
+		tag, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if tag == nil {
+			return nil, p.sourceError("expected expression after switch, found %s", p.peek(0))
+		}
+		sw.Tag = tag
+	}
+	restore()
+
+	var err error
+	if sw.Clauses, err = p.parseCaseClauses("expression"); err != nil {
+		return nil, err
+	}
+	sw.span = p.spanFrom(pos, pos)
+	return sw, nil
 }
 
-type Call struct {
-	Func Evaluable
-	Args []Evaluable
-	pos  position
+// parseCaseClauses parses the braced case clauses of a switch, whose cases
+// are lists of what.
+func (p *Parser) parseCaseClauses(what string) ([]CaseClause, error) {
+	if !p.accept("{") {
+		return nil, p.sourceError("expected {, found %s", p.peek(0))
+	}
+	p.blocks++
+	p.switches++
+	defer func() {
+		p.blocks--
+		p.switches--
+	}()
+	defer p.setControlClause(false)()
+	var clauses []CaseClause
+	hasDefault := false
+	for !p.accept("}") {
+		clause := CaseClause{}
+		clausePos := p.pos()
+		switch {
+		case p.accept("case"):
+			for {
+				val, err := p.parseExpression()
+				if err != nil {
+					return nil, err
+				}
+				if val == nil {
+					return nil, p.sourceError("expected %s, found %s", what, p.peek(0))
+				}
+				clause.Values = append(clause.Values, val)
+				if !p.accept(",") {
+					break
+				}
+			}
+		case p.accept("default"):
+			if hasDefault {
+				return nil, clausePos.Err(ErrParser, "multiple defaults in switch")
+			}
+			hasDefault = true
+		default:
+			return nil, p.sourceError("expected case or default, found %s", p.peek(0))
+		}
+		if !p.accept(":") {
+			return nil, p.sourceError("expected :, found %s", p.peek(0))
+		}
+		clause.span = p.spanFrom(clausePos, clausePos)
+		var err error
+		if clause.Body, err = p.parseClauseBody(); err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, clause)
+		if p.eof() {
+			// only when recovering, after the missing brace was recorded.
+			break
+		}
+	}
+	return clauses, nil
 }
 
-var errorType = reflect.TypeOf((*error)(nil)).Elem()
+// parseClauseBody parses the semicolon-separated statements of a case
+// clause, up to the next clause or the end of the switch.
+func (p *Parser) parseClauseBody() (*Sequence, error) {
+	start := p.pos()
+	body := &Sequence{}
+	for {
+		for p.accept(";") {
+		}
+		if tok := p.peek(0); tok.is("case") || tok.is("default") || tok.is("}") || p.eof() {
+			break
+		}
+		stmtStart := p.pos()
+		stmt, err := p.parseStatement()
+		if err == nil && stmt == nil {
+			err = p.keywordError()
+			if err == nil {
+				err = p.sourceError("expected statement, case, default, or }, found %s", p.peek(0))
+			}
+		}
+		if err == nil && !p.peek(0).is(";") && !p.peek(0).is("}") {
+			err = p.sourceError("expected ; or }, found %s", p.peek(0))
+		}
+		if err != nil {
+			stmt, err = p.recoverStatement(err, stmt, stmtStart)
+			if err != nil {
+				return nil, err
+			}
+		}
+		body.Statements = append(body.Statements, stmt)
+	}
+	body.span = p.spanFrom(start, start)
+	return body, nil
+}
 
-func (pos position) singleValue(results []reflect.Value, err error) (reflect.Value, error) {
-	if len(results) == 0 {
-		return reflect.ValueOf(nil), err
+// parseBranch parses break, which is only allowed in loops and switches,
+// and continue, which is only allowed in loops.
+func (p *Parser) parseBranch() (Evaluable, error) {
+	tok := p.peek(0)
+	if !tok.is("break") && !tok.is("continue") {
+		return nil, nil
 	}
-	if len(results) == 1 {
-		return results[0], err
+	if tok.text == "break" && p.loops == 0 && p.switches == 0 {
+		return nil, p.sourceError("break is not in a loop or switch")
+	}
+	if tok.text == "continue" && p.loops == 0 {
+		return nil, p.sourceError("continue is not in a loop")
 	}
-	return reflect.Value{}, pos.Err(ErrRuntime, "multivalue result used in single value location")
+	p.next()
+	if tok.text == "break" {
+		return &Break{span: tok.span()}, nil
+	}
+	return &Continue{span: tok.span()}, nil
 }
 
-type lowerFunc struct {
-	Env  Environment
-	Func func([]reflect.Value) ([]reflect.Value, error)
-}
+// parseFuncLit parses a function literal, func(params) { ... }.
+func (p *Parser) parseFuncLit() (Evaluable, error) {
+	pos := p.pos()
+	if !p.accept("func") {
+		return nil, nil
+	}
+	if !p.accept("(") {
+		return nil, p.sourceError("expected ( after func, found %s", p.peek(0))
+	}
+	var params []*Ident
+	for !p.accept(")") {
+		if len(params) > 0 && !p.accept(",") {
+			return nil, p.sourceError("expected , or ), found %s", p.peek(0))
+		}
+		param, err := p.parseIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		if param == nil {
+			return nil, p.sourceError("expected parameter name, found %s", p.peek(0))
+		}
+		params = append(params, param)
+	}
 
-func LowerFunc(env Environment, fn func([]reflect.Value) ([]reflect.Value, error)) reflect.Value {
-	return reflect.ValueOf(lowerFunc{
-		Env:  env,
-		Func: fn,
-	})
+	// break and continue can't reach loops outside of the function.
+	loops, switches := p.loops, p.switches
+	p.loops, p.switches = 0, 0
+	p.funcs++
+	body, err := p.parseBlock()
+	p.loops, p.switches = loops, switches
+	p.funcs--
+	if err != nil {
+		return nil, err
+	}
+	return &FuncLit{Params: params, Body: body, span: p.spanFrom(pos, pos)}, nil
 }
 
-func IsLowerFunc(v interface{}) bool {
-	_, ok := v.(lowerFunc)
-	return ok
+// parseReturn parses return with zero or more results, which is only
+// allowed in function literals.
+func (p *Parser) parseReturn() (Evaluable, error) {
+	tok := p.peek(0)
+	if !tok.is("return") {
+		return nil, nil
+	}
+	if p.funcs == 0 {
+		return nil, p.sourceError("return is not in a function")
+	}
+	p.next()
+	ret := &Return{}
+	if !p.eof() && !p.peek(0).is(";") && !p.peek(0).is("}") {
+		for {
+			expr, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			if expr == nil {
+				return nil, p.sourceError("expected expression, found %s", p.peek(0))
+			}
+			ret.Values = append(ret.Values, expr)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	ret.span = p.spanFrom(tok.pos, tok.pos)
+	return ret, nil
 }
 
-func (c *Call) Run(env Environment) ([]reflect.Value, error) {
-	fn, err := c.pos.singleValue(c.Func.Run(env))
+func (p *Parser) parseGo() (Evaluable, error) {
+	tok := p.peek(0)
+	if !tok.is("go") {
+		return nil, nil
+	}
+	p.next()
+	expr, err := p.parseExpression()
 	if err != nil {
 		return nil, err
 	}
+	call, ok := expr.(*Call)
+	if !ok {
+		return nil, tok.pos.Err(ErrParser, "expression in go must be a function call")
+	}
+	return &Go{Call: call, span: p.spanFrom(tok.pos, tok.pos)}, nil
+}
 
-	args := make([]reflect.Value, 0, len(c.Args))
-	for i := range c.Args {
-		result, err := c.Args[i].Run(env)
+// parseConst parses the constant declaration const x, y = a, b.
+func (p *Parser) parseConst() (Evaluable, error) {
+	tok := p.peek(0)
+	if !tok.is("const") {
+		return nil, nil
+	}
+	p.next()
+	decl := &Const{}
+	for {
+		name, err := p.parseIdentifier()
 		if err != nil {
 			return nil, err
 		}
-		if i == 0 && len(c.Args) == 1 {
-			args = result
+		if name == nil {
+			return nil, p.sourceError("expected name in const declaration, found %s", p.peek(0))
+		}
+		decl.Names = append(decl.Names, name)
+		if !p.accept(",") {
 			break
 		}
-		arg, err := c.pos.singleValue(result, nil)
+	}
+	if !p.accept("=") {
+		return nil, p.sourceError("expected = in const declaration, found %s", p.peek(0))
+	}
+	for {
+		expr, err := p.parseExpression()
 		if err != nil {
 			return nil, err
 		}
-		args = append(args, arg)
-	}
-
-	if lf, ok := fn.Interface().(lowerFunc); ok &&
-		reflect.ValueOf(lf.Env).Pointer() == reflect.ValueOf(env).Pointer() {
-		return lf.Func(args)
-	}
-
-	if typ, ok := fn.Interface().(reflect.Type); ok {
-		if len(args) != 1 {
-			return nil, c.pos.Err(ErrTypeMismatch, "tried to cast more than one argument to %s", typ.Name())
+		if expr == nil {
+			return nil, p.sourceError("expected expression")
+		}
+		decl.Values = append(decl.Values, expr)
+		if !p.accept(",") {
+			break
 		}
-		return []reflect.Value{convert(args[0], typ)}, nil
 	}
-
-	return fn.Call(args), nil
+	decl.span = p.spanFrom(tok.pos, tok.pos)
+	return decl, nil
 }
 
-type lowerStruct struct {
-	Env Environment
-	Sub Environment
-}
-
-func LowerStruct(env Environment, sub Environment) reflect.Value {
-	return reflect.ValueOf(lowerStruct{
-		Env: env,
-		Sub: sub,
-	})
-}
-
-func (ls *lowerStruct) Field(name string) ([]reflect.Value, error) {
-	if v, ok := ls.Sub[name]; ok {
-		return []reflect.Value{v}, nil
+func (p *Parser) parseDefer() (Evaluable, error) {
+	tok := p.peek(0)
+	if !tok.is("defer") {
+		return nil, nil
 	}
-	return nil, fmt.Errorf("%w: field %q in LowerStruct not found",
-		ErrTypeMismatch, name)
-}
-
-func IsLowerStruct(v interface{}) Environment {
-	if v, ok := v.(lowerStruct); ok {
-		return v.Sub
+	p.next()
+	expr, err := p.parseExpression()
+	if err != nil {
+		return nil, err
 	}
-	return nil
-}
-
-type FieldAccess struct {
-	Val   Evaluable
-	Field *Ident
-	pos   position
+	call, ok := expr.(*Call)
+	if !ok {
+		return nil, tok.pos.Err(ErrParser, "expression in defer must be a function call")
+	}
+	return &Defer{Call: call, span: p.spanFrom(tok.pos, tok.pos)}, nil
 }
 
-func (a *FieldAccess) Run(env Environment) ([]reflect.Value, error) {
-	v, err := a.pos.singleValue(a.Val.Run(env))
+func (p *Parser) parseStatement() (Evaluable, error) {
+	stmt, err := p.parseImport()
+	if stmt != nil || err != nil {
+		return stmt, err
+	}
+	stmt, err = p.parseFor()
+	if stmt != nil || err != nil {
+		return stmt, err
+	}
+	stmt, err = p.parseSwitch()
+	if stmt != nil || err != nil {
+		return stmt, err
+	}
+	stmt, err = p.parseBranch()
+	if stmt != nil || err != nil {
+		return stmt, err
+	}
+	stmt, err = p.parseReturn()
+	if stmt != nil || err != nil {
+		return stmt, err
+	}
+	stmt, err = p.parseGo()
+	if stmt != nil || err != nil {
+		return stmt, err
+	}
+	stmt, err = p.parseDefer()
+	if stmt != nil || err != nil {
+		return stmt, err
+	}
+	stmt, err = p.parseConst()
+	if stmt != nil || err != nil {
+		return stmt, err
+	}
+	stmt, err = p.parseAssignment()
+	if stmt != nil || err != nil {
+		return stmt, err
+	}
+	return p.parseExpression()
+}
+
+func (p *Parser) Parse() (Evaluable, error) {
+	if len(p.errs) > 0 {
+		return nil, p.errs[0]
+	}
+	val, err := p.parse()
+	return val, p.incomplete(err)
+}
+
+// incomplete returns err as an ErrIncomplete if the input ends with
+// brackets or braces left open, and closing them would get past err, so
+// that what is missing could come after the input.
+func (p *Parser) incomplete(err error) error {
+	var lerr *LangError
+	if !errors.As(err, &lerr) || lerr.Kind != ErrParser {
+		return err
+	}
+	eof := p.tokens[len(p.tokens)-1]
+	var closers []string
+	for _, tok := range p.tokens {
+		switch {
+		case tok.is("(") || tok.is("[") || tok.is("{"):
+			closers = append(closers, map[string]string{"(": ")", "[": "]", "{": "}"}[tok.text])
+		case tok.is(")") || tok.is("]") || tok.is("}"):
+			if len(closers) == 0 || closers[len(closers)-1] != tok.text {
+				return err
+			}
+			closers = closers[:len(closers)-1]
+		}
+	}
+	if len(closers) == 0 {
+		return err
+	}
+	closed := append([]token(nil), p.tokens[:len(p.tokens)-1]...)
+	for i := len(closers) - 1; i >= 0; i-- {
+		closed = append(closed, token{kind: tokenOperator, text: closers[i], pos: eof.pos, end: eof.pos})
+	}
+	closed = append(closed, eof)
+	_, closedErr := (&Parser{source: p.source, tokens: closed}).parse()
+	var later *LangError
+	if closedErr != nil && (!errors.As(closedErr, &later) || later.span.pos.offset < eof.pos.offset) {
+		return err
+	}
+	incomplete := *lerr
+	incomplete.Kind = ErrIncomplete
+	return &incomplete
+}
+
+// ParsePartial parses like Parse, but doesn't stop at the first error.
+// Instead, it records the error, skips to the end of the statement, and
+// continues. It returns what it could parse, with the statements it
+// couldn't as BadStatements, along with the errors found, which is useful
+// for tools like completion that work on incomplete input.
+func (p *Parser) ParsePartial() (Evaluable, []Diagnostic) {
+	p.recovering = true
+	for _, err := range p.errs {
+		p.diagnose(err)
+	}
+	val, err := p.parse()
+	if err != nil {
+		p.diagnose(err)
+	}
+	return val, p.diagnostics
+}
+
+func (p *Parser) parse() (Evaluable, error) {
+	first := p.pos()
+	var stmts []Evaluable
+	for {
+		start := p.pos()
+		val, err := p.parseStatement()
+		if err == nil && val == nil {
+			err = p.keywordError()
+			if err == nil && p.eof() && len(stmts) == 0 {
+				err = p.sourceError("nothing parsed")
+			} else if err == nil {
+				err = p.sourceError("expected statement")
+			}
+		}
+		if err == nil && !p.eof() && !p.peek(0).is(";") {
+			err = p.keywordError()
+			if err == nil {
+				err = p.sourceError("unparsed input: %q", string(p.source[p.pos().offset:]))
+			}
+		}
+		if err != nil {
+			val, err = p.recoverStatement(err, val, start)
+			if err != nil {
+				return nil, err
+			}
+		}
+		stmts = append(stmts, val)
+		if !p.accept(";") || p.eof() {
+			// a trailing semicolon is allowed
+			break
+		}
+	}
+	if len(stmts) == 1 {
+		return stmts[0], nil
+	}
+	return &Sequence{Statements: stmts, span: p.spanFrom(first, first)}, nil
+}
+
+// Diagnostic is an error found by ParsePartial. Line and Column are where
+// the error is, and EndLine and EndColumn are just past the end of the source
+// it is about.
+type Diagnostic struct {
+	Line, Column       int
+	EndLine, EndColumn int
+	Err                error
+}
+
+func (p *Parser) diagnose(err error) {
+	p.diagnostics = append(p.diagnostics, diagnostic(err))
+}
+
+// diagnostic returns a Diagnostic for err, at its position, if it has one.
+func diagnostic(err error) Diagnostic {
+	d := Diagnostic{Err: err}
+	var perr *LangError
+	if errors.As(err, &perr) {
+		d.Line, d.Column = perr.span.pos.line, perr.span.pos.col
+		d.EndLine, d.EndColumn = perr.span.end.line, perr.span.end.col
+	}
+	return d
+}
+
+// recoverStatement handles err, found while parsing the statement starting
+// at start, of which val was parsed, if anything. Normally, it returns err.
+// When recovering from errors, it instead records err, skips to the end of
+// the statement, and returns val, or a BadStatement if val is nil.
+func (p *Parser) recoverStatement(err error, val Evaluable, start position) (Evaluable, error) {
+	if !p.recovering {
+		return nil, err
+	}
+	p.diagnose(err)
+	p.skipStatement()
+	if val == nil {
+		val = &BadStatement{Err: err, span: p.spanFrom(start, start)}
+	}
+	return val, nil
+}
+
+// skipStatement skips up to the semicolon ending the current statement, the
+// brace ending the current block, or the end of input.
+func (p *Parser) skipStatement() {
+	depth := 0
+	for !p.eof() {
+		tok := p.peek(0)
+		switch {
+		case depth == 0 && tok.is(";"):
+			return
+		case depth == 0 && tok.is("}") && p.blocks > 0:
+			return
+		case depth == 0 && (tok.is("case") || tok.is("default")) && p.switches > 0:
+			return
+		case tok.is("(") || tok.is("[") || tok.is("{"):
+			depth++
+		case tok.is(")") || tok.is("]") || tok.is("}"):
+			if depth > 0 {
+				depth--
+			}
+		}
+		p.next()
+	}
+}
+
+// Sequence is a list of statements separated by semicolons. Its results are
+// the results of the last statement.
+type Sequence struct {
+	Statements []Evaluable
+	span       span
+}
+
+func (s *Sequence) Run(env Environment) (rv []reflect.Value, err error) {
+	var deferred []func() error
+	defer func() {
+		if deferErr := runDeferred(deferred); deferErr != nil && (err == nil || isControlFlow(err)) {
+			rv, err = nil, deferErr
+		}
+	}()
+	for _, stmt := range s.Statements {
+		if d, ok := stmt.(*Defer); ok {
+			call, err := d.prepare(env)
+			if err != nil {
+				return nil, err
+			}
+			deferred = append(deferred, call)
+			rv = []reflect.Value{}
+			continue
+		}
+		rv, err = stmt.Run(env)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rv, nil
+}
+
+// runDeferred makes deferred calls, last first. Like Go's deferred calls,
+// they are all made even if one of them panics. The first error is returned.
+func runDeferred(calls []func() error) (err error) {
+	if len(calls) == 0 {
+		return nil
+	}
+	defer func() {
+		if rest := runDeferred(calls[:len(calls)-1]); err == nil {
+			err = rest
+		}
+	}()
+	return calls[len(calls)-1]()
+}
+
+// isControlFlow returns true if err unwinds statements for break,
+// continue, or return, rather than reporting a failure.
+func isControlFlow(err error) bool {
+	var ret *returnSignal
+	return errors.Is(err, errBreak) || errors.Is(err, errContinue) || errors.As(err, &ret)
+}
+
+// errBreak and errContinue unwind the statements of a loop body to the
+// innermost loop for break and continue.
+var (
+	errBreak    = errors.New("break is not in a loop")
+	errContinue = errors.New("continue is not in a loop")
+)
+
+// Break stops the innermost loop.
+type Break struct {
+	span span
+}
+
+func (b *Break) Run(env Environment) ([]reflect.Value, error) {
+	return nil, errBreak
+}
+
+// Continue skips to the next iteration of the innermost loop.
+type Continue struct {
+	span span
+}
+
+func (c *Continue) Run(env Environment) ([]reflect.Value, error) {
+	return nil, errContinue
+}
+
+// runBody runs a loop body once. It returns done if the loop should stop,
+// either because of a break or an error.
+func runBody(body *Sequence, env Environment) (done bool, err error) {
+	_, err = body.Run(NewScope(env))
+	switch {
+	case err == nil, errors.Is(err, errContinue):
+		return false, nil
+	case errors.Is(err, errBreak):
+		return true, nil
+	}
+	return true, err
+}
+
+// For is a loop that runs its body while Cond is true, or forever if Cond is
+// nil, until a break.
+type For struct {
+	Cond Evaluable
+	Body *Sequence
+	span span
+}
+
+func (f *For) Run(env Environment) ([]reflect.Value, error) {
+	for {
+		if f.Cond != nil {
+			cond, err := f.span.singleValue(f.Cond.Run(env))
+			if err != nil {
+				return nil, err
+			}
+			if cond.Kind() == reflect.Interface {
+				cond = cond.Elem()
+			}
+			if cond.Kind() != reflect.Bool {
+				return nil, f.span.Err(ErrTypeMismatch,
+					"non-boolean condition in for statement: %s", Repr(cond))
+			}
+			if !cond.Bool() {
+				return []reflect.Value{}, nil
+			}
+		}
+		if err := f.span.step(env); err != nil {
+			return nil, err
+		}
+		done, err := runBody(f.Body, env)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return []reflect.Value{}, nil
+		}
+	}
+}
+
+// FuncLit is a function literal, func(params) { ... }. Running it returns a
+// *Func.
+type FuncLit struct {
+	Params []*Ident
+	Body   *Sequence
+	span   span
+}
+
+func (f *FuncLit) Run(env Environment) ([]reflect.Value, error) {
+	return []reflect.Value{reflect.ValueOf(&Func{lit: f, env: env})}, nil
+}
+
+// returnSignal unwinds the statements of a function body for return.
+type returnSignal struct {
+	values  []reflect.Value
+	untyped []bool
+}
+
+func (r *returnSignal) Error() string { return "return is not in a function" }
+
+// Return returns from the innermost function literal with Values as its
+// results.
+type Return struct {
+	Values []Evaluable
+	span   span
+}
+
+func (r *Return) Run(env Environment) ([]reflect.Value, error) {
+	ret := &returnSignal{values: []reflect.Value{}}
+	if len(r.Values) == 1 {
+		values, err := r.Values[0].Run(env)
+		if err != nil {
+			return nil, err
+		}
+		ret.values = values
+		ret.untyped = []bool{IsUntyped(r.Values[0])}
+		return nil, ret
+	}
+	for _, expr := range r.Values {
+		val, err := r.span.singleValue(expr.Run(env))
+		if err != nil {
+			return nil, err
+		}
+		ret.values = append(ret.values, val)
+		ret.untyped = append(ret.untyped, IsUntyped(expr))
+	}
+	return nil, ret
+}
+
+// ForRange is a loop over the elements of a slice, array, string, map, or
+// channel, or over the integers from zero up to a count, as in
+// for k, v := range x { ... }. Key and Value are the assignment targets for
+// each iteration, either of which may be nil. If Define is true, they are
+// bound in a scope of the loop's own.
+type ForRange struct {
+	Key, Value Evaluable
+	Define     bool
+	Over       Evaluable
+	Body       *Sequence
+	span       span
+}
+
+func (f *ForRange) Run(env Environment) ([]reflect.Value, error) {
+	over, err := f.span.singleValue(f.Over.Run(env))
+	if err != nil {
+		return nil, err
+	}
+	if over.Kind() == reflect.Interface {
+		over = over.Elem()
+	}
+	if over.Kind() == reflect.Pointer && !over.IsNil() && over.Elem().Kind() == reflect.Array {
+		over = over.Elem()
+	}
+
+	if f.Define {
+		env = NewScope(env)
+	}
+
+	iterate := func(key, value reflect.Value) (done bool, err error) {
+		if err := f.span.step(env); err != nil {
+			return true, err
+		}
+		var targets, values []Evaluable
+		if f.Key != nil {
+			targets = append(targets, f.Key)
+			values = append(values, &Value{Val: key})
+		}
+		if f.Value != nil {
+			targets = append(targets, f.Value)
+			values = append(values, &Value{Val: value})
+		}
+		if len(targets) > 0 {
+			assignment := &Assignment{
+				Targets: targets,
+				Values:  values,
+				Define:  f.Define,
+				span:    f.span,
+			}
+			if _, err := assignment.Run(env); err != nil {
+				return true, err
+			}
+			if immutableRoot(env, f.Over) {
+				for _, target := range targets {
+					if ident, ok := target.(*Ident); ok {
+						markDerived(env, ident.Name, true)
+					}
+				}
+			}
+		}
+		return runBody(f.Body, env)
+	}
+
+	if err := f.loop(env, over, iterate); err != nil {
+		return nil, err
+	}
+	return []reflect.Value{}, nil
+}
+
+// loop calls iterate with each key and value of over until it returns done.
+func (f *ForRange) loop(env Environment, over reflect.Value,
+	iterate func(key, value reflect.Value) (done bool, err error)) error {
+	switch over.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < over.Len(); i++ {
+			if done, err := iterate(reflect.ValueOf(i), over.Index(i)); done {
+				return err
+			}
+		}
+	case reflect.String:
+		for i, r := range over.String() {
+			if done, err := iterate(reflect.ValueOf(i), reflect.ValueOf(r)); done {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := over.MapRange()
+		for iter.Next() {
+			if done, err := iterate(iter.Key(), iter.Value()); done {
+				return err
+			}
+		}
+	case reflect.Chan:
+		if f.Value != nil {
+			return f.span.Err(ErrTypeMismatch,
+				"range over channel permits only one iteration variable")
+		}
+		if IsReadOnly(env) {
+			return f.span.Err(ErrReadOnly, "cannot receive from channel")
+		}
+		for {
+			v, ok := over.Recv()
+			if !ok {
+				break
+			}
+			if done, err := iterate(v, reflect.Value{}); done {
+				return err
+			}
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if f.Value != nil {
+			return f.span.Err(ErrTypeMismatch,
+				"range over integer permits only one iteration variable")
+		}
+		for i := int64(0); i < over.Int(); i++ {
+			if done, err := iterate(reflect.ValueOf(i).Convert(over.Type()), reflect.Value{}); done {
+				return err
+			}
+		}
+	default:
+		return f.span.Err(ErrTypeMismatch, "cannot range over %s", Repr(over))
+	}
+	return nil
+}
+
+// TypeSwitch runs the first clause whose types include the dynamic type of
+// Subject, or the default clause, if any. A case matches if the dynamic type
+// is the case's type, or implements it, if it is an interface type. A nil
+// case matches a nil Subject. If Bind is set, it is bound to Subject for the
+// clause, as the case's type if the clause has exactly one.
+type TypeSwitch struct {
+	Bind    *Ident
+	Subject Evaluable
+	Clauses []TypeClause
+	span    span
+}
+
+// TypeClause is a case clause of a TypeSwitch. Types is nil for the default
+// clause.
+type TypeClause struct {
+	Types []Evaluable
+	Body  *Sequence
+	span  span
+}
+
+func (s *TypeSwitch) Run(env Environment) ([]reflect.Value, error) {
+	subject, err := s.span.singleValue(s.Subject.Run(env))
+	if err != nil {
+		return nil, err
+	}
+	dynamic := subject
+	if dynamic.Kind() == reflect.Interface {
+		dynamic = dynamic.Elem()
+	}
+	clause, typ, err := s.match(env, dynamic)
+	if err != nil {
+		return nil, err
+	}
+	if clause == nil {
+		return []reflect.Value{}, nil
+	}
+
+	if s.Bind != nil {
+		bound := subject
+		if typ != nil {
+			bound = dynamic
+			if typ.Kind() == reflect.Interface {
+				bound = reflect.New(typ).Elem()
+				bound.Set(dynamic)
+			}
+		}
+		env = NewScope(env)
+		assignment := &Assignment{
+			Targets: []Evaluable{s.Bind},
+			Values:  []Evaluable{&Value{Val: bound}},
+			Define:  true,
+			span:    s.span,
+		}
+		if _, err := assignment.Run(env); err != nil {
+			return nil, err
+		}
+		if immutableRoot(env, s.Subject) {
+			markDerived(env, s.Bind.Name, true)
+		}
+	}
+
+	return runClause(clause.Body, env)
+}
+
+// runClause runs the body of a switch's clause, which break leaves.
+func runClause(body *Sequence, env Environment) ([]reflect.Value, error) {
+	rv, err := body.Run(NewScope(env))
+	switch {
+	case errors.Is(err, errBreak):
+		return []reflect.Value{}, nil
+	case err != nil:
+		return nil, err
+	case rv == nil:
+		return []reflect.Value{}, nil
+	}
+	return rv, nil
+}
+
+// match returns the clause for the dynamic value, along with the type of its
+// case, if the clause has exactly one type and it isn't nil.
+func (s *TypeSwitch) match(env Environment, dynamic reflect.Value) (
+	*TypeClause, reflect.Type, error) {
+	var def *TypeClause
+	for i := range s.Clauses {
+		clause := &s.Clauses[i]
+		if clause.Types == nil {
+			def = clause
+			continue
+		}
+		for _, expr := range clause.Types {
+			v, err := clause.span.singleValue(expr.Run(env))
+			if err != nil {
+				return nil, nil, err
+			}
+			if !v.IsValid() {
+				if !dynamic.IsValid() {
+					return clause, nil, nil
+				}
+				continue
+			}
+			typ, ok := asType(v)
+			if !ok {
+				return nil, nil, clause.span.Err(ErrTypeMismatch, "%s is not a type", Repr(v))
+			}
+			if !dynamic.IsValid() ||
+				dynamic.Type() != typ && (typ.Kind() != reflect.Interface || !dynamic.Type().Implements(typ)) {
+				continue
+			}
+			if len(clause.Types) > 1 {
+				typ = nil
+			}
+			return clause, typ, nil
+		}
+	}
+	return def, nil, nil
+}
+
+// ValueSwitch runs the first clause with a case equal to Tag, comparing as
+// == does, or the default clause, if any. Cases are evaluated in order, only
+// until one matches. Without a Tag, cases are conditions, and the first that
+// is true matches.
+type ValueSwitch struct {
+	Tag     Evaluable
+	Clauses []CaseClause
+	span    span
+}
+
+// CaseClause is a case clause of a ValueSwitch. Values is nil for the
+// default clause.
+type CaseClause struct {
+	Values []Evaluable
+	Body   *Sequence
+	span   span
+}
+
+func (s *ValueSwitch) Run(env Environment) ([]reflect.Value, error) {
+	tag := reflect.ValueOf(true)
+	if s.Tag != nil {
+		var err error
+		tag, err = s.span.singleValue(s.Tag.Run(env))
+		if err != nil {
+			return nil, err
+		}
+	}
+	clause, err := s.match(env, tag)
+	if err != nil {
+		return nil, err
+	}
+	if clause == nil {
+		return []reflect.Value{}, nil
+	}
+	return runClause(clause.Body, env)
+}
+
+// match returns the clause for tag.
+func (s *ValueSwitch) match(env Environment, tag reflect.Value) (*CaseClause, error) {
+	var def *CaseClause
+	for i := range s.Clauses {
+		clause := &s.Clauses[i]
+		if clause.Values == nil {
+			def = clause
+			continue
+		}
+		for _, expr := range clause.Values {
+			v, err := clause.span.singleValue(expr.Run(env))
+			if err != nil {
+				return nil, err
+			}
+			if s.Tag == nil {
+				if v.Kind() != reflect.Bool {
+					return nil, clause.span.Err(ErrTypeMismatch, "non-bool case %s", Repr(v))
+				}
+				if v.Bool() {
+					return clause, nil
+				}
+				continue
+			}
+			left, right, err := coerce(OpEqual, tag, v, IsUntyped(s.Tag), IsUntyped(expr))
+			if err != nil {
+				return nil, clause.span.wrap(err)
+			}
+			eq, err := equal(left, right)
+			if err != nil {
+				return nil, clause.span.wrap(err)
+			}
+			if eq {
+				return clause, nil
+			}
+		}
+	}
+	return def, nil
+}
+
+// BadStatement stands in for a statement that ParsePartial couldn't parse.
+// Running it returns the parse error.
+type BadStatement struct {
+	Err  error
+	span span
+}
+
+func (b *BadStatement) Run(env Environment) ([]reflect.Value, error) {
+	return nil, b.Err
+}
+
+type Subexpression struct {
+	Expr Evaluable
+	span span
+}
+
+func (s *Subexpression) Run(env Environment) ([]reflect.Value, error) {
+	return s.Expr.Run(env)
+}
+
+// Call is a function call. If Spread is true, the last argument is a slice
+// or array whose elements are passed as the variadic arguments, as in
+// f(xs...).
+type Call struct {
+	Func   Evaluable
+	Args   []Evaluable
+	Spread bool
+	span   span
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+func (s span) singleValue(results []reflect.Value, err error) (reflect.Value, error) {
+	if len(results) == 0 {
+		return reflect.ValueOf(nil), err
+	}
+	if len(results) == 1 {
+		return results[0], err
+	}
+	return reflect.Value{}, s.Err(ErrRuntime, "multivalue result used in single value location")
+}
+
+// Run evaluates c, pushing it onto the script stack of any error, as a
+// StackError. Panics are returned as PanicErrors.
+func (c *Call) Run(env Environment) (_ []reflect.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r}
+		}
+		err = c.span.trace(err, c)
+	}()
+	return c.run(env)
+}
+
+// run evaluates the function and arguments of c and makes the call.
+func (c *Call) run(env Environment) ([]reflect.Value, error) {
+	fn, args, immutableArg, err := c.operands(env)
+	if err != nil {
+		return nil, err
+	}
+	if ident, ok := c.Func.(*Ident); ok && ident.Name == "$import" && len(args) == 2 &&
+		args[1].Kind() == reflect.String {
+		if err := c.span.permit(env, Access{Kind: AccessImport, Package: args[1].String()}); err != nil {
+			return nil, err
+		}
+	}
+	return c.call(env, fn, args, immutableArg)
+}
+
+// operands evaluates the function and arguments of c. immutableArg is the
+// index of the first argument reached through an immutable variable that
+// might refer to its memory, or -1.
+func (c *Call) operands(env Environment) (fn reflect.Value, args []reflect.Value,
+	immutableArg int, err error) {
+	if selector, ok := c.Func.(*FieldAccess); ok {
+		rv, access, err := selector.member(env)
+		fn, err = c.span.singleValue(rv, err)
+		if err != nil {
+			return fn, nil, -1, err
+		}
+		if fn.Kind() == reflect.Func && IsReadOnly(env) && isPure(env, access) {
+			fn = reflect.ValueOf(&pureFunc{fn: fn})
+		}
+	} else {
+		fn, err = c.span.singleValue(c.Func.Run(env))
+		if err != nil {
+			return fn, nil, -1, err
+		}
+	}
+
+	args = make([]reflect.Value, 0, len(c.Args))
+	for i := range c.Args {
+		result, err := c.Args[i].Run(env)
+		if err != nil {
+			return fn, nil, -1, err
+		}
+		if i == 0 && len(c.Args) == 1 && !c.Spread {
+			args = result
+			break
+		}
+		arg, err := c.span.singleValue(result, nil)
+		if err != nil {
+			return fn, nil, -1, err
+		}
+		args = append(args, arg)
+	}
+
+	immutableArg = -1
+	if len(args) == len(c.Args) {
+		for i, arg := range c.Args {
+			if immutableRoot(env, arg) && mayAlias(args[i]) {
+				immutableArg = i
+				break
+			}
+		}
+	}
+	return fn, args, immutableArg, nil
+}
+
+// call calls fn with args, which were evaluated by operands.
+func (c *Call) call(env Environment, fn reflect.Value, args []reflect.Value,
+	immutableArg int) ([]reflect.Value, error) {
+	if err := c.span.step(env); err != nil {
+		return nil, err
+	}
+	var limiter *Limiter
+	if f, ok := asLimitedFunc(fn); ok {
+		fn, limiter = f.fn, f.limiter
+	}
+	if callable, ok := asCallable(fn); ok {
+		if c.Spread {
+			spread, err := c.spreadArgs(args)
+			if err != nil {
+				return nil, err
+			}
+			args = spread
+		}
+		if immutableArg >= 0 && !IsReadOnly(env) {
+			// lowered functions can't be checked, so they run read-only.
+			SetReadOnly(env, true)
+			defer SetReadOnly(env, false)
+			if f, ok := callable.(*Func); ok && !IsReadOnly(f.env) {
+				SetReadOnly(f.env, true)
+				defer SetReadOnly(f.env, false)
+			}
+		}
+		if err := c.limit(limiter); err != nil {
+			return nil, err
+		}
+		return callable.CallLowered(env, args)
+	}
+
+	if typ, ok := fn.Interface().(reflect.Type); ok {
+		if c.Spread {
+			return nil, c.span.Err(ErrTypeMismatch, "cannot use ... in conversion to %s", typ)
+		}
+		if len(args) == 0 {
+			// T() is the zero value of T, unlike in Go.
+			if err := c.span.alloc(env, int64(typ.Size()), "a %s", typ); err != nil {
+				return nil, err
+			}
+			return []reflect.Value{reflect.New(typ).Elem()}, nil
+		}
+		if len(args) != 1 {
+			return nil, c.span.Err(ErrTypeMismatch, "conversion to %s takes one argument", typ)
+		}
+		if size := conversionSize(args[0], typ); size > 0 {
+			if err := c.span.alloc(env, size, "converting to %s", typ); err != nil {
+				return nil, err
+			}
+		}
+		var converted reflect.Value
+		var err error
+		switch classify(reflect.Zero(typ)) {
+		case signedClass, unsignedClass, floatClass:
+			if len(c.Args) == 1 && IsUntyped(c.Args[0]) {
+				// like Go, constants must fit, as in uint8(255) but not
+				// uint8(256).
+				converted, err = convertUntyped(args[0], typ)
+				break
+			}
+			fallthrough
+		default:
+			converted, err = convert(args[0], typ)
+		}
+		if err != nil {
+			return nil, c.span.wrap(err)
+		}
+		return []reflect.Value{converted}, nil
+	}
+
+	pure := false
+	if f, ok := asPureFunc(fn); ok {
+		fn, pure = f.fn, true
+	}
+	if fn.Kind() == reflect.Func && !fn.IsNil() {
+		if access, ok := funcAccess(fn); ok {
+			if err := c.span.permit(env, access); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if IsReadOnly(env) && !pure && !pureCall(env, fn) {
+		return nil, c.span.Err(ErrReadOnly, "cannot call %s", typeName(fn))
+	}
+	if immutableArg >= 0 {
+		return nil, c.span.Err(ErrReadOnly, "cannot pass immutable %s to %s",
+			rootName(c.Args[immutableArg]), typeName(fn))
+	}
+	if fn.Kind() == reflect.Func {
+		if err := funcArgs(fn.Type(), args); err != nil {
+			return nil, c.span.wrap(err)
+		}
+		if err := c.untypedArgs(fn.Type(), args); err != nil {
+			return nil, c.span.wrap(err)
+		}
+		if AutoRef(env) {
+			if err := c.autoRef(env, fn, args); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if c.Spread {
+		typ := fn.Type()
+		if fn.Kind() != reflect.Func || !typ.IsVariadic() {
+			return nil, c.span.Err(ErrTypeMismatch, "cannot use ... in call to non-variadic %s",
+				typeName(fn))
+		}
+		if len(args) != typ.NumIn() {
+			return nil, c.span.Err(ErrTypeMismatch, "%s called with %d arguments, expected %d",
+				typeName(fn), len(args), typ.NumIn())
+		}
+		last := args[len(args)-1]
+		if last.Kind() == reflect.Interface {
+			last = last.Elem()
+		}
+		last, err := assignable(last, typ.In(typ.NumIn()-1), false)
+		if err != nil {
+			return nil, c.span.wrap(err)
+		}
+		args[len(args)-1] = last
+		if err := c.limit(limiter); err != nil {
+			return nil, err
+		}
+		return fn.CallSlice(args), nil
+	}
+	if err := c.limit(limiter); err != nil {
+		return nil, err
+	}
+	return fn.Call(args), nil
+}
+
+// untypedArgs converts the arguments of a call of a Go function of type typ
+// that are untyped constants to the types of their parameters, like Go, so
+// that 1 can be passed as an int64 or a float64.
+func (c *Call) untypedArgs(typ reflect.Type, args []reflect.Value) error {
+	if len(args) != len(c.Args) {
+		return nil
+	}
+	for i, arg := range c.Args {
+		if !IsUntyped(arg) {
+			continue
+		}
+		var param reflect.Type
+		switch {
+		case typ.IsVariadic() && i >= typ.NumIn()-1:
+			if c.Spread {
+				continue
+			}
+			param = typ.In(typ.NumIn() - 1).Elem()
+		case i < typ.NumIn():
+			param = typ.In(i)
+		default:
+			continue
+		}
+		v, err := assignable(args[i], param, true)
+		if err != nil {
+			return err
+		}
+		args[i] = v
+	}
+	return nil
+}
+
+// limit returns an error if limiter, if not nil, doesn't allow the call.
+func (c *Call) limit(limiter *Limiter) error {
+	if limiter == nil {
+		return nil
+	}
+	ok, retryAfter := limiter.Allow()
+	if ok {
+		return nil
+	}
+	name := "the function"
+	if ident, isIdent := c.Func.(*Ident); isIdent {
+		name = ident.Name
+	}
+	if retryAfter <= 0 {
+		return c.span.Err(ErrRateLimited, "%s is limited to %s, which were used up", name, limiter)
+	}
+	return c.span.Err(ErrRateLimited, "%s is limited to %s, try again in %v", name, limiter,
+		retryAfter.Round(time.Millisecond))
+}
+
+// autoRef adapts args to the parameters of fn, as described by SetAutoRef.
+func (c *Call) autoRef(env Environment, fn reflect.Value, args []reflect.Value) error {
+	typ := fn.Type()
+	for i, arg := range args {
+		if c.Spread && i == len(args)-1 {
+			break
+		}
+		var param reflect.Type
+		switch {
+		case typ.IsVariadic() && i >= typ.NumIn()-1:
+			param = typ.In(typ.NumIn() - 1).Elem()
+		case i < typ.NumIn():
+			param = typ.In(i)
+		default:
+			return nil
+		}
+		if !arg.IsValid() || arg.Type().AssignableTo(param) {
+			continue
+		}
+		switch {
+		case param.Kind() == reflect.Pointer && arg.CanAddr() &&
+			arg.Type().AssignableTo(param.Elem()):
+			if len(args) == len(c.Args) && immutableRoot(env, c.Args[i]) {
+				return c.span.Err(ErrReadOnly, "cannot pass the address of immutable %s to %s",
+					rootName(c.Args[i]), typeName(fn))
+			}
+			args[i] = arg.Addr()
+		case arg.Kind() == reflect.Pointer && !arg.IsNil() &&
+			arg.Type().Elem().AssignableTo(param):
+			args[i] = arg.Elem()
+		}
+	}
+	return nil
+}
+
+// spreadArgs replaces the last of args, a slice or array, with its
+// elements.
+func (c *Call) spreadArgs(args []reflect.Value) ([]reflect.Value, error) {
+	last := args[len(args)-1]
+	if last.Kind() == reflect.Interface {
+		last = last.Elem()
+	}
+	if last.Kind() != reflect.Slice && last.Kind() != reflect.Array {
+		return nil, c.span.Err(ErrTypeMismatch, "cannot use ... with %s", typeName(last))
+	}
+	spread := append([]reflect.Value{}, args[:len(args)-1]...)
+	for i := 0; i < last.Len(); i++ {
+		spread = append(spread, last.Index(i))
+	}
+	return spread, nil
+}
+
+// Conditional is the conditional expression if Cond then Then else Else.
+// Only the chosen branch is evaluated.
+type Conditional struct {
+	Cond, Then, Else Evaluable
+	span             span
+}
+
+func (c *Conditional) Run(env Environment) ([]reflect.Value, error) {
+	cond, err := c.span.singleValue(c.Cond.Run(env))
+	if err != nil {
+		return nil, err
+	}
+	if cond.Kind() == reflect.Interface {
+		cond = cond.Elem()
+	}
+	if cond.Kind() != reflect.Bool {
+		return nil, c.span.Err(ErrTypeMismatch,
+			"non-boolean condition in conditional expression: %s", Repr(cond))
+	}
+	if cond.Bool() {
+		return c.Then.Run(env)
+	}
+	return c.Else.Run(env)
+}
+
+// Propagate is the postfix ? operator, as in f()?. If the last result of
+// Expr is a non-nil error, evaluation fails with it. Otherwise, the results
+// are Expr's results without the error.
+type Propagate struct {
+	Expr Evaluable
+	span span
+}
+
+func (p *Propagate) Run(env Environment) ([]reflect.Value, error) {
+	rv, err := p.Expr.Run(env)
+	if err != nil {
+		return nil, err
+	}
+	n := len(rv)
+	if n == 0 || !rv[n-1].IsValid() || rv[n-1].Kind() != reflect.Interface ||
+		!rv[n-1].Type().Implements(errorType) {
+		return nil, p.span.Err(ErrTypeMismatch, "? used on an expression without an error result")
+	}
+	if !rv[n-1].IsNil() {
+		return nil, p.span.wrap(rv[n-1].Interface().(error))
+	}
+	return rv[:n-1], nil
+}
+
+// Go is a go statement, as in go f(x). Call's function and arguments are
+// evaluated, and then the call is made in a new goroutine. The goroutine
+// evaluates in a copy of the environment, so that it doesn't race with
+// further evaluation, and its bindings don't affect the original. If the
+// environment binds $goerror to a func(error), it is called with the call's
+// error, if any.
+type Go struct {
+	Call *Call
+	span span
+}
+
+func (g *Go) Run(env Environment) ([]reflect.Value, error) {
+	fn, args, immutableArg, err := g.Call.operands(env)
+	if err != nil {
+		return nil, err
+	}
+	goEnv := copyEnv(env)
+	if f, ok := asFunc(fn); ok {
+		fnEnv := goEnv
+		if reflect.ValueOf(f.env).Pointer() != reflect.ValueOf(env).Pointer() {
+			fnEnv = copyEnv(f.env)
+		}
+		fn = reflect.ValueOf(&Func{lit: f.lit, env: fnEnv})
+	}
+	var report func(error)
+	if v, ok := Lookup(env, "$goerror"); ok && v.IsValid() && v.CanInterface() {
+		report, _ = v.Interface().(func(error))
+	}
+	go func() {
+		err := func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = &PanicError{Value: r}
+				}
+			}()
+			_, err = g.Call.call(goEnv, fn, args, immutableArg)
+			return err
+		}()
+		if err != nil && report != nil {
+			report(err)
+		}
+	}()
+	return []reflect.Value{}, nil
+}
+
+// Defer is a defer statement, as in defer mu.Unlock(). Call's function and
+// arguments are evaluated when the statement runs, but the call is made when
+// the enclosing block finishes, whether it finishes normally, by break,
+// continue, or return, or with an error or panic. Unlike Go, this is the
+// innermost block, such as a loop body, rather than the enclosing function,
+// though for statements directly in a function literal's body the two are
+// the same. A command is a block, so defers outside of braces run when the
+// command finishes. Deferred calls run last first, and if one fails, the
+// block fails with its error, unless it already failed.
+type Defer struct {
+	Call *Call
+	span span
+}
+
+// Run makes the call right away, as a defer statement that isn't in a
+// Sequence is the only statement of its block.
+func (d *Defer) Run(env Environment) ([]reflect.Value, error) {
+	call, err := d.prepare(env)
+	if err != nil {
+		return nil, err
+	}
+	return []reflect.Value{}, call()
+}
+
+// prepare evaluates the function and arguments of the deferred call,
+// returning a function that makes it.
+func (d *Defer) prepare(env Environment) (func() error, error) {
+	fn, args, immutableArg, err := d.Call.operands(env)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		_, err := d.Call.call(env, fn, args, immutableArg)
+		return err
+	}, nil
+}
+
+// FieldAccess is a field or method selector, as in a.B. If Safe is set, it
+// is the nil-safe a?.B, which, if a is nil, skips the rest of the enclosing
+// SafeChain. If Val results in a value and an error, as from a call, the
+// error is checked as by ?, so f()?.B fails with f's error, if any, and
+// otherwise selects B of f's value.
+type FieldAccess struct {
+	Val   Evaluable
+	Field *Ident
+	Safe  bool
+	span  span
+}
+
+// errNilChain is returned by a nil-safe FieldAccess on a nil value, for its
+// SafeChain.
+var errNilChain = errors.New("nil in a ?. chain")
+
+// SafeChain is a chain of selectors, indexes, and calls, such as a?.B.C(),
+// containing at least one nil-safe FieldAccess. If one of them is applied
+// to nil, the rest of the chain is skipped, and the result is nil.
+type SafeChain struct {
+	Expr Evaluable
+	span span
+}
+
+func (c *SafeChain) Run(env Environment) ([]reflect.Value, error) {
+	rv, err := c.Expr.Run(env)
+	if errors.Is(err, errNilChain) {
+		return []reflect.Value{reflect.ValueOf(nil)}, nil
+	}
+	return rv, err
+}
+
+// safeOperand returns the single value of the results of the operand of
+// a?.B, after checking the error result, if any, as a? does.
+func (a *FieldAccess) safeOperand(env Environment) (reflect.Value, error) {
+	rv, err := a.Val.Run(env)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	if n := len(rv); n > 1 && rv[n-1].Kind() == reflect.Interface &&
+		rv[n-1].Type().Implements(errorType) {
+		if !rv[n-1].IsNil() {
+			return reflect.Value{}, a.span.wrap(rv[n-1].Interface().(error))
+		}
+		rv = rv[:n-1]
+	}
+	v, err := a.span.singleValue(rv, nil)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	for v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Invalid:
+		return v, errNilChain
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan,
+		reflect.Interface, reflect.UnsafePointer:
+		if v.IsNil() {
+			return v, errNilChain
+		}
+	}
+	return v, nil
+}
+
+func (a *FieldAccess) Run(env Environment) ([]reflect.Value, error) {
+	rv, _, err := a.member(env)
+	return rv, err
+}
+
+// member returns the field or method a selects, along with the Access of
+// selecting it.
+func (a *FieldAccess) member(env Environment) ([]reflect.Value, Access, error) {
+	var v reflect.Value
+	var err error
+	if a.Safe {
+		v, err = a.safeOperand(env)
+	} else {
+		v, err = a.span.singleValue(a.Val.Run(env))
+	}
+	if err != nil {
+		return nil, Access{}, err
+	}
+	rv, access, err := a.selectFrom(env, v)
+	return rv, access, a.span.trace(err, a)
+}
+
+// selectFrom returns the field or method a selects from v, the value of
+// a.Val, along with the Access of selecting it.
+func (a *FieldAccess) selectFrom(env Environment, v reflect.Value) ([]reflect.Value, Access, error) {
+	access := memberAccess(v, a.Field.Name)
+	if err := a.span.permit(env, access); err != nil {
+		return nil, access, err
+	}
+
+	if resolver, ok := asFieldResolver(v); ok {
+		rv, err := resolver.LowerField(env, a.Field.Name)
+		return rv, access, err
+	}
+
+	tryAccess := func(v reflect.Value) ([]reflect.Value, bool) {
+		method := v.MethodByName(a.Field.Name)
+		if method != (reflect.Value{}) {
+			if mutatingMethod(v, a.Field.Name) && immutableRoot(env, a.Val) {
+				return nil, true
+			}
+			return []reflect.Value{method}, true
+		}
+		if v.Kind() == reflect.Struct {
+			return []reflect.Value{v.FieldByName(a.Field.Name)}, true
+		}
+		return nil, false
+	}
+
+	rv, found := tryAccess(v)
+	if !found && (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) {
+		rv, found = tryAccess(v.Elem())
+	}
+	if found && rv == nil {
+		return nil, access, a.span.Err(ErrReadOnly, "cannot call method %s of immutable %s",
+			a.Field.Name, rootName(a.Val))
+	}
+	if found {
+		return rv, access, nil
+	}
+
+	return nil, access, a.span.Err(ErrTypeMismatch, "tried to access field %q on value %#v, %v", a.Field.Name, v, v.Kind())
+}
+
+type ArrayAccess struct {
+	Array Evaluable
+	Index Evaluable
+	span  span
+}
+
+func (a *ArrayAccess) Run(env Environment) ([]reflect.Value, error) {
+	v, err := a.span.singleValue(a.Array.Run(env))
+	if err != nil {
+		return nil, err
+	}
+	index, err := a.span.singleValue(a.Index.Run(env))
+	if err != nil {
+		return nil, err
+	}
+
+	switch v.Kind() {
+	case reflect.Array, reflect.Slice, reflect.String:
+		i, err := a.span.index(index, v.Len())
+		if err != nil {
+			return nil, err
+		}
+		return []reflect.Value{v.Index(i)}, nil
+	case reflect.Map:
+		return []reflect.Value{v.MapIndex(index)}, nil
+	}
+	return nil, a.span.Err(ErrTypeMismatch, "tried to access index %q on value %#v (%v)", index, v, v.Kind())
+}
+
+// index returns index as an index into something of length n, failing at s
+// if it isn't an integer or is out of range.
+func (s span) index(index reflect.Value, n int) (int, error) {
+	i := -1
+	var shown interface{}
+	switch classify(index) {
+	case signedClass:
+		if int64(int(index.Int())) == index.Int() {
+			i = int(index.Int())
+		}
+		shown = index.Int()
+	case unsignedClass:
+		if j := int(index.Uint()); j >= 0 && uint64(j) == index.Uint() {
+			i = j
+		}
+		shown = index.Uint()
+	default:
+		return 0, s.Err(ErrTypeMismatch, "index %v is not an int", Repr(index))
+	}
+	if i < 0 || i >= n {
+		return 0, s.Err(ErrRuntime, "index out of range [%d] with length %d", shown, n)
+	}
+	return i, nil
+}
+
+// SliceAccess is a slice expression, a[Low:High]. Either bound may be nil,
+// meaning 0 and the length.
+type SliceAccess struct {
+	Array Evaluable
+	Low   Evaluable
+	High  Evaluable
+	span  span
+}
+
+func (a *SliceAccess) Run(env Environment) ([]reflect.Value, error) {
+	v, err := a.span.singleValue(a.Array.Run(env))
+	if err != nil {
+		return nil, err
+	}
+	switch v.Kind() {
+	default:
+		return nil, a.span.Err(ErrTypeMismatch, "tried to slice value %q", v)
+	case reflect.Array:
+		if !v.CanAddr() {
+			if err := a.span.alloc(env, int64(v.Type().Size()), "a copy of a %s", v.Type()); err != nil {
+				return nil, err
+			}
+			c := reflect.New(v.Type()).Elem()
+			c.Set(v)
+			v = c
+		}
+	case reflect.Slice, reflect.String:
+	}
+	l, err := a.bound(env, a.Low, 0)
+	if err != nil {
+		return nil, err
+	}
+	h, err := a.bound(env, a.High, v.Len())
 	if err != nil {
 		return nil, err
 	}
-
-	if v.Kind() == reflect.Struct {
-		if ls, ok := v.Interface().(lowerStruct); ok &&
-			reflect.ValueOf(ls.Env).Pointer() == reflect.ValueOf(env).Pointer() {
-			return ls.Field(a.Field.Name)
-		}
+	max, limit := v.Len(), "length"
+	if v.Kind() == reflect.Slice {
+		max, limit = v.Cap(), "capacity"
 	}
-
-	tryAccess := func(v reflect.Value) ([]reflect.Value, bool) {
-		method := v.MethodByName(a.Field.Name)
-		if method != (reflect.Value{}) {
-			return []reflect.Value{method}, true
-		}
-		if v.Kind() == reflect.Struct {
-			return []reflect.Value{v.FieldByName(a.Field.Name)}, true
-		}
-		return nil, false
+	if h < l || h > max {
+		return nil, a.span.Err(ErrRuntime, "slice bounds out of range [%d:%d] with %s %d",
+			l, h, limit, max)
 	}
+	return []reflect.Value{v.Slice(l, h)}, nil
+}
 
-	if rv, found := tryAccess(v); found {
-		return rv, nil
+// bound evaluates a slice bound, or returns def if it is omitted.
+func (a *SliceAccess) bound(env Environment, bound Evaluable, def int) (int, error) {
+	if bound == nil {
+		return def, nil
 	}
-
-	if v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
-		if rv, found := tryAccess(v.Elem()); found {
-			return rv, nil
+	v, err := a.span.singleValue(bound.Run(env))
+	if err != nil {
+		return 0, err
+	}
+	switch classify(v) {
+	case signedClass:
+		if i := int(v.Int()); i >= 0 && int64(i) == v.Int() {
+			return i, nil
+		}
+	case unsignedClass:
+		if i := int(v.Uint()); i >= 0 && uint64(i) == v.Uint() {
+			return i, nil
 		}
+	default:
+		return 0, a.span.Err(ErrTypeMismatch, "slice index %v is not an int", Repr(v))
 	}
+	return 0, a.span.Err(ErrRuntime, "slice index %v out of range", Repr(v))
+}
 
-	return nil, a.pos.Err(ErrTypeMismatch, "tried to access field %q on value %#v, %v", a.Field.Name, v, v.Kind())
+// CompositeLit constructs a value of the type Type evaluates to, a
+// reflect.Type, as in T{...}. Struct elements are either all keyed by field
+// name or all positional, slice and array elements may be keyed by index,
+// and map elements are keyed. Type is nil for elements whose type is elided,
+// as in []T{{...}}.
+type CompositeLit struct {
+	Type     Evaluable
+	Elements []Element
+	span     span
 }
 
-type ArrayAccess struct {
-	Array Evaluable
-	Index Evaluable
-	pos   position
+// Element is an element of a composite literal. Key is nil if the element
+// isn't keyed.
+type Element struct {
+	Key, Value Evaluable
 }
 
-func (a *ArrayAccess) Run(env Environment) ([]reflect.Value, error) {
-	v, err := a.pos.singleValue(a.Array.Run(env))
+func (c *CompositeLit) Run(env Environment) ([]reflect.Value, error) {
+	if c.Type == nil {
+		return nil, c.span.Err(ErrTypeMismatch, "missing type in composite literal")
+	}
+	tv, err := c.span.singleValue(c.Type.Run(env))
 	if err != nil {
 		return nil, err
 	}
-	index, err := a.pos.singleValue(a.Index.Run(env))
+	typ, ok := asType(tv)
+	if !ok {
+		return nil, c.span.Err(ErrTypeMismatch, "%s is not a type", typeName(tv))
+	}
+	v, err := c.build(env, typ)
 	if err != nil {
 		return nil, err
 	}
+	return []reflect.Value{v}, nil
+}
 
-	switch v.Kind() {
-	case reflect.Array, reflect.Slice, reflect.String:
-		if !index.CanInt() {
-			return nil, a.pos.Err(ErrTypeMismatch, "index %q is not an int", index)
+// build constructs the literal's value as a typ. The value is addressable,
+// so that &T{...} works.
+func (c *CompositeLit) build(env Environment, typ reflect.Type) (reflect.Value, error) {
+	if c.Type == nil && typ.Kind() == reflect.Pointer {
+		// like Go, elided types of pointer elements stand for &T{...}.
+		v, err := c.build(env, typ.Elem())
+		if err != nil {
+			return reflect.Value{}, err
 		}
-		return []reflect.Value{v.Index(int(index.Int()))}, nil
+		return v.Addr(), nil
+	}
+	if err := c.span.alloc(env, int64(typ.Size()), "a %s", typ); err != nil {
+		return reflect.Value{}, err
+	}
+	v := reflect.New(typ).Elem()
+	var err error
+	switch typ.Kind() {
+	case reflect.Struct:
+		err = c.buildStruct(env, v)
+	case reflect.Slice, reflect.Array:
+		v, err = c.buildSequence(env, v)
 	case reflect.Map:
-		return []reflect.Value{v.MapIndex(index)}, nil
+		err = c.buildMap(env, v)
+	default:
+		return reflect.Value{}, c.span.Err(ErrTypeMismatch,
+			"invalid composite literal type %s; use %s() for its zero value", typ, typ)
 	}
-	return nil, a.pos.Err(ErrTypeMismatch, "tried to access index %q on value %#v (%v)", index, v, v.Kind())
+	return v, err
 }
 
-type SliceAccess struct {
-	Array Evaluable
-	Low   Evaluable
-	High  Evaluable
-	pos   position
+func (c *CompositeLit) buildStruct(env Environment, v reflect.Value) error {
+	typ := v.Type()
+	keyed := len(c.Elements) > 0 && c.Elements[0].Key != nil
+	if !keyed && len(c.Elements) > 0 && len(c.Elements) != typ.NumField() {
+		return c.span.Err(ErrTypeMismatch, "%s literal has %d values, expected %d", typ,
+			len(c.Elements), typ.NumField())
+	}
+	set := map[string]bool{}
+	for i, elem := range c.Elements {
+		if (elem.Key != nil) != keyed {
+			return c.span.Err(ErrTypeMismatch,
+				"mixture of field:value and value elements in struct literal")
+		}
+		var field reflect.StructField
+		if !keyed {
+			field = typ.Field(i)
+		} else {
+			name, ok := elem.Key.(*Ident)
+			if !ok {
+				return c.span.Err(ErrTypeMismatch, "invalid field name in %s literal", typ)
+			}
+			// promoted fields can't be set in literals, as in Go.
+			field, ok = typ.FieldByName(name.Name)
+			if !ok || len(field.Index) != 1 {
+				return c.span.Err(ErrTypeMismatch, "unknown field %s in %s literal%s", name.Name,
+					typ, didYouMean(name.Name, exportedFields(typ)))
+			}
+			if set[field.Name] {
+				return c.span.Err(ErrTypeMismatch, "duplicate field %s in %s literal", field.Name, typ)
+			}
+			set[field.Name] = true
+		}
+		if field.PkgPath != "" {
+			return c.span.Err(ErrTypeMismatch, "cannot set unexported field %s in %s literal",
+				field.Name, typ)
+		}
+		val, err := c.value(env, elem.Value, field.Type)
+		if err != nil {
+			return err
+		}
+		v.Field(field.Index[0]).Set(val)
+	}
+	return nil
 }
 
-func (a *SliceAccess) Run(env Environment) ([]reflect.Value, error) {
-	v, err := a.pos.singleValue(a.Array.Run(env))
-	if err != nil {
-		return nil, err
+// buildSequence fills in v, a slice or array. Slices are made long enough
+// for the highest index, so v may be replaced.
+func (c *CompositeLit) buildSequence(env Environment, v reflect.Value) (reflect.Value, error) {
+	typ := v.Type()
+	values := make(map[int]reflect.Value, len(c.Elements))
+	index, length := 0, 0
+	for _, elem := range c.Elements {
+		if elem.Key != nil {
+			key, err := c.span.singleValue(elem.Key.Run(env))
+			if err != nil {
+				return v, err
+			}
+			switch classify(key) {
+			case signedClass:
+				index = int(key.Int())
+				if key.Int() < 0 || int64(index) != key.Int() {
+					return v, c.span.Err(ErrRuntime, "index %v must be non-negative", Repr(key))
+				}
+			case unsignedClass:
+				index = int(key.Uint())
+				if index < 0 || uint64(index) != key.Uint() {
+					return v, c.span.Err(ErrRuntime, "index %v out of range", Repr(key))
+				}
+			default:
+				return v, c.span.Err(ErrTypeMismatch, "index %v is not an int", Repr(key))
+			}
+		}
+		if typ.Kind() == reflect.Array && index >= typ.Len() {
+			return v, c.span.Err(ErrRuntime, "index %d out of bounds [0:%d]", index, typ.Len())
+		}
+		if _, exists := values[index]; exists {
+			return v, c.span.Err(ErrTypeMismatch, "duplicate index %d in %s literal", index, typ)
+		}
+		val, err := c.value(env, elem.Value, typ.Elem())
+		if err != nil {
+			return v, err
+		}
+		values[index] = val
+		index++
+		if index > length {
+			length = index
+		}
 	}
-	l, err := a.pos.singleValue(a.Low.Run(env))
-	if err != nil {
-		return nil, err
+	if typ.Kind() == reflect.Slice {
+		if err := c.span.alloc(env, int64(length)*int64(typ.Elem().Size()),
+			"a %s of %d elements", typ, length); err != nil {
+			return v, err
+		}
+		slice := reflect.MakeSlice(typ, length, length)
+		v.Set(slice)
+	}
+	for i, val := range values {
+		v.Index(i).Set(val)
+	}
+	return v, nil
+}
+
+func (c *CompositeLit) buildMap(env Environment, v reflect.Value) error {
+	typ := v.Type()
+	if err := c.span.alloc(env, int64(len(c.Elements))*int64(typ.Key().Size()+typ.Elem().Size()),
+		"a %s of %d entries", typ, len(c.Elements)); err != nil {
+		return err
+	}
+	v.Set(reflect.MakeMapWithSize(typ, len(c.Elements)))
+	for _, elem := range c.Elements {
+		if elem.Key == nil {
+			return c.span.Err(ErrTypeMismatch, "missing key in map literal")
+		}
+		key, err := c.value(env, elem.Key, typ.Key())
+		if err != nil {
+			return err
+		}
+		val, err := c.value(env, elem.Value, typ.Elem())
+		if err != nil {
+			return err
+		}
+		v.SetMapIndex(key, val)
+	}
+	return nil
+}
+
+// value evaluates an element of the literal as a typ.
+func (c *CompositeLit) value(env Environment, elem Evaluable, typ reflect.Type) (
+	reflect.Value, error) {
+	if lit, ok := elem.(*CompositeLit); ok && lit.Type == nil {
+		return lit.build(env, typ)
 	}
-	h, err := a.pos.singleValue(a.Low.Run(env))
+	v, err := c.span.singleValue(elem.Run(env))
 	if err != nil {
-		return nil, err
+		return reflect.Value{}, err
 	}
-	switch v.Kind() {
-	default:
-		return nil, a.pos.Err(ErrTypeMismatch, "tried to slice value %q", v)
-	case reflect.Array, reflect.Slice, reflect.String:
+	if immutableRoot(env, elem) && mayAlias(v) {
+		return reflect.Value{}, c.span.Err(ErrReadOnly,
+			"cannot use immutable %s in a composite literal", rootName(elem))
+	}
+	if v.Kind() == reflect.Interface && typ.Kind() != reflect.Interface {
+		v = v.Elem()
+	}
+	v, err = assignable(v, typ, IsUntyped(elem))
+	if err != nil {
+		return reflect.Value{}, c.span.wrap(err)
 	}
-	if !l.CanInt() {
-		return nil, a.pos.Err(ErrTypeMismatch, "slice index %q not an int", l)
+	return v, nil
+}
+
+// exportedFields returns the names of the exported fields of the struct type
+// typ, other than promoted fields.
+func exportedFields(typ reflect.Type) []string {
+	var names []string
+	for i := 0; i < typ.NumField(); i++ {
+		if field := typ.Field(i); field.PkgPath == "" {
+			names = append(names, field.Name)
+		}
 	}
-	if !h.CanInt() {
-		return nil, a.pos.Err(ErrTypeMismatch, "slice index %q not an int", h)
+	return names
+}
+
+// asType returns the reflect.Type v holds, if it holds one.
+func asType(v reflect.Value) (reflect.Type, bool) {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil, false
 	}
-	return []reflect.Value{v.Slice(int(l.Int()), int(h.Int()))}, nil
+	typ, ok := v.Interface().(reflect.Type)
+	return typ, ok
 }
 
 type Operation struct {
 	Type  OpType
 	Left  Evaluable
 	Right Evaluable
-	pos   position
+	span  span
 }
 
 func (o *Operation) Run(env Environment) ([]reflect.Value, error) {
-	left, err := o.pos.singleValue(o.Left.Run(env))
+	left, err := o.span.singleValue(o.Left.Run(env))
 	if err != nil {
 		return nil, err
 	}
 	switch o.Type {
-	case OpEqual, OpNotEqual:
-		right, err := o.pos.singleValue(o.Right.Run(env))
-		if err != nil {
-			return nil, err
-		}
-		rv := left.Equal(right)
-		if o.Type == OpNotEqual {
-			rv = !rv
-		}
-		return []reflect.Value{reflect.ValueOf(rv)}, nil
 	case OpAnd:
 		if !left.Bool() {
 			// short circuit eval
 			return []reflect.Value{left}, nil
 		}
-		rv, err := o.pos.singleValue(o.Right.Run(env))
+		rv, err := o.span.singleValue(o.Right.Run(env))
 		if err != nil {
 			return nil, err
 		}
@@ -1157,21 +3094,61 @@ func (o *Operation) Run(env Environment) ([]reflect.Value, error) {
 			// short circuit eval
 			return []reflect.Value{left}, nil
 		}
-		rv, err := o.pos.singleValue(o.Right.Run(env))
+		rv, err := o.span.singleValue(o.Right.Run(env))
 		if err != nil {
 			return nil, err
 		}
 		return []reflect.Value{rv}, nil
-	case OpMul:
-	case OpDiv:
-	case OpAdd:
-	case OpSub:
-	case OpLess:
-	case OpLessEqual:
-	case OpGreater:
-	case OpGreaterEqual:
 	}
-	return nil, o.pos.Err(ErrUnknownOp, "%q", o.Type)
+
+	right, err := o.span.singleValue(o.Right.Run(env))
+	if err != nil {
+		return nil, err
+	}
+	if rv, ok := timeArithmetic(o.Type, left, right); ok {
+		return []reflect.Value{rv}, nil
+	}
+	if rv, ok, err := durationArithmetic(o.Type, left, right); ok {
+		if err != nil {
+			return nil, o.span.wrap(err)
+		}
+		return []reflect.Value{rv}, nil
+	}
+	if o.Type != OpShl && o.Type != OpShr {
+		left, right, err = coerce(o.Type, left, right, IsUntyped(o.Left), IsUntyped(o.Right))
+		if err != nil {
+			return nil, o.span.wrap(err)
+		}
+	}
+
+	var rv reflect.Value
+	switch o.Type {
+	case OpEqual, OpNotEqual:
+		var eq bool
+		eq, err = equal(left, right)
+		if o.Type == OpNotEqual {
+			eq = !eq
+		}
+		rv = reflect.ValueOf(eq)
+	case OpMul, OpDiv, OpAdd, OpSub:
+		if left.Kind() == reflect.String && right.Kind() == reflect.String {
+			size := int64(left.Len() + right.Len())
+			if err := o.span.alloc(env, size, "a string of %d bytes", size); err != nil {
+				return nil, err
+			}
+		}
+		rv, err = arithmetic(o.Type, left, right)
+	case OpBitAnd, OpBitOr, OpBitXor, OpAndNot, OpShl, OpShr:
+		rv, err = bitwise(o.Type, left, right)
+	case OpLess, OpLessEqual, OpGreater, OpGreaterEqual:
+		rv, err = compare(o.Type, left, right)
+	default:
+		return nil, o.span.Err(ErrUnknownOp, "%q", o.Type)
+	}
+	if err != nil {
+		return nil, o.span.wrap(err)
+	}
+	return []reflect.Value{rv}, nil
 }
 
 type OpType = string
@@ -1190,32 +3167,75 @@ const (
 	OpGreaterEqual OpType = ">="
 	OpAnd          OpType = "&&"
 	OpOr           OpType = "||"
+	OpBitAnd       OpType = "&"
+	OpBitOr        OpType = "|"
+	OpBitXor       OpType = "^"
+	OpAndNot       OpType = "&^"
+	OpShl          OpType = "<<"
+	OpShr          OpType = ">>"
 )
 
 type Modifier struct {
 	Type ModType
 	Val  Evaluable
-	pos  position
+	span span
 }
 
 func (m *Modifier) Run(env Environment) ([]reflect.Value, error) {
-	val, err := m.pos.singleValue(m.Val.Run(env))
+	if m.Type == ModRef && IsReadOnly(env) && !isCompositeLit(m.Val) {
+		// pointers to anything but new values could be used to change them.
+		what := "value"
+		if _, ok := m.Val.(Node); ok {
+			what = Format(m.Val)
+		}
+		return nil, m.span.Err(ErrReadOnly, "cannot take the address of %s", what)
+	}
+	val, err := m.span.singleValue(m.Val.Run(env))
 	if err != nil {
 		return nil, err
 	}
 
 	switch m.Type {
 	case ModNeg:
+		switch classify(val) {
+		case signedClass:
+			return []reflect.Value{reflect.ValueOf(-val.Int()).Convert(val.Type())}, nil
+		case unsignedClass:
+			return []reflect.Value{reflect.ValueOf(-val.Uint()).Convert(val.Type())}, nil
+		case floatClass:
+			return []reflect.Value{reflect.ValueOf(-val.Float()).Convert(val.Type())}, nil
+		}
 	case ModNot:
 		if val.Kind() == reflect.Bool {
 			return []reflect.Value{reflect.ValueOf(!val.Bool())}, nil
 		}
+	case ModComplement:
+		switch classify(val) {
+		case signedClass:
+			return []reflect.Value{reflect.ValueOf(^val.Int()).Convert(val.Type())}, nil
+		case unsignedClass:
+			return []reflect.Value{reflect.ValueOf(^val.Uint()).Convert(val.Type())}, nil
+		}
 	case ModRef:
 		return []reflect.Value{val.Addr()}, nil
 	case ModDeref:
 		return []reflect.Value{val.Elem()}, nil
 	}
-	return nil, m.pos.Err(ErrUnknownOp, "%q", m.Type)
+	return nil, m.span.Err(ErrUnknownOp, "%q", m.Type)
+}
+
+// isCompositeLit returns true if expr is a composite literal, possibly in
+// parentheses.
+func isCompositeLit(expr Evaluable) bool {
+	for {
+		sub, ok := expr.(*Subexpression)
+		if !ok {
+			break
+		}
+		expr = sub.Expr
+	}
+	_, ok := expr.(*CompositeLit)
+	return ok
 }
 
 type ModType = string
@@ -1225,22 +3245,383 @@ const (
 	ModNot   ModType = "!"
 	ModRef   ModType = "&"
 	ModDeref ModType = "*"
+
+	ModComplement ModType = "^"
 )
 
+// Assignment is a statement that assigns values to its Targets, which are
+// Idents, FieldAccesses, or ArrayAccesses. Idents are bound in the
+// Environment. If Define is true (x := v), they are bound whether or not they
+// exist. Otherwise (x = v), they must already be bound. FieldAccesses must
+// refer to settable struct fields, and ArrayAccesses to map entries or
+// settable slice or array elements. If there is a single value with several
+// results, such as a call, each result is assigned to its target, as in
+// v, err := f(). The blank identifier _ discards its value, without binding
+// anything.
+type Assignment struct {
+	Targets []Evaluable
+	Values  []Evaluable
+	Define  bool
+	span    span
+}
+
+func (a *Assignment) Run(env Environment) ([]reflect.Value, error) {
+	var values []reflect.Value
+	if len(a.Values) == 1 {
+		rv, err := a.Values[0].Run(env)
+		if err != nil {
+			return nil, err
+		}
+		values = rv
+	} else {
+		for _, expr := range a.Values {
+			val, err := a.span.singleValue(expr.Run(env))
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, val)
+		}
+	}
+	if len(a.Targets) != len(values) {
+		return nil, a.span.Err(ErrTypeMismatch,
+			"assignment mismatch: %d variables but %d values", len(a.Targets), len(values))
+	}
+	for i, val := range values {
+		// values may refer to memory that is about to be assigned, such as
+		// in a.X, a.Y = a.Y, a.X, so copy them first.
+		if val.CanAddr() && val.CanInterface() {
+			c := reflect.New(val.Type()).Elem()
+			c.Set(val)
+			values[i] = c
+		}
+	}
+
+	untyped := func(i int) bool {
+		return len(a.Values) == len(a.Targets) && IsUntyped(a.Values[i])
+	}
+
+	// evaluate all targets before assigning anything, so that a failure
+	// leaves everything unchanged.
+	setters := make([]func(), 0, len(a.Targets))
+	for i, target := range a.Targets {
+		if isBlank(target) {
+			setters = append(setters, func() {})
+			continue
+		}
+		if _, ok := target.(*Ident); !ok && immutableRoot(env, target) {
+			return nil, a.span.Err(ErrReadOnly, "cannot assign through immutable %s",
+				rootName(target))
+		}
+		var set func()
+		var err error
+		switch target := target.(type) {
+		case *Ident:
+			set, err = a.identSetter(env, target, values[i], untyped(i))
+		case *FieldAccess:
+			if IsReadOnly(env) {
+				return nil, target.span.Err(ErrReadOnly, "cannot assign to %s", target.Field.Name)
+			}
+			set, err = fieldSetter(env, target, values[i], untyped(i))
+		case *ArrayAccess:
+			if IsReadOnly(env) {
+				return nil, target.span.Err(ErrReadOnly, "cannot assign to index")
+			}
+			set, err = indexSetter(env, target, values[i], untyped(i))
+		default:
+			err = a.span.Err(ErrTypeMismatch, "cannot assign to expression")
+		}
+		if err != nil {
+			return nil, err
+		}
+		setters = append(setters, set)
+	}
+
+	immutable := a.immutableValues(env)
+	for _, set := range setters {
+		set()
+	}
+	for i, target := range a.Targets {
+		if ident, ok := target.(*Ident); ok && !isBlank(ident) {
+			markDerived(env, ident.Name, immutable[i])
+		}
+	}
+	return []reflect.Value{}, nil
+}
+
+// Const is a constant declaration, as in const srv = server. Names are bound
+// to Values like x := v, and then marked with MarkConst, so that they can't
+// be assigned to or redefined, though what they refer to can still be
+// modified.
+type Const struct {
+	Names  []*Ident
+	Values []Evaluable
+	span   span
+}
+
+func (c *Const) Run(env Environment) ([]reflect.Value, error) {
+	targets := make([]Evaluable, 0, len(c.Names))
+	for _, name := range c.Names {
+		targets = append(targets, name)
+	}
+	assignment := &Assignment{Targets: targets, Values: c.Values, Define: true, span: c.span}
+	if _, err := assignment.Run(env); err != nil {
+		return nil, err
+	}
+	for _, name := range c.Names {
+		if !isBlank(name) {
+			MarkConst(env, name.Name)
+		}
+	}
+	return []reflect.Value{}, nil
+}
+
+// isBlank returns true if target is the blank identifier _.
+func isBlank(target Evaluable) bool {
+	ident, ok := target.(*Ident)
+	return ok && ident.Name == "_"
+}
+
+// immutableValues returns, for each target, whether the value assigned to
+// it is reached through an immutable variable.
+func (a *Assignment) immutableValues(env Environment) []bool {
+	immutable := make([]bool, len(a.Targets))
+	for i := range a.Targets {
+		if len(a.Values) == len(a.Targets) {
+			immutable[i] = immutableRoot(env, a.Values[i])
+		} else {
+			immutable[i] = immutableRoot(env, a.Values[0])
+		}
+	}
+	return immutable
+}
+
+func (a *Assignment) identSetter(env Environment, target *Ident,
+	val reflect.Value, untyped bool) (func(), error) {
+	// definitions bind in env, shadowing any binding in the scopes env is
+	// in, while assignments assign where the name is bound.
+	scope := env
+	marked, constant := immutables(env, false)[target.Name], consts(env, false)[target.Name]
+	if !a.Define {
+		scope = scopeOf(env, target.Name)
+		if scope == nil {
+			return nil, target.span.Err(ErrUnboundVar, "%q (use := to define it)", target.Name)
+		}
+		marked, _ = immutableMark(env, target.Name)
+		constant = IsConst(env, target.Name)
+	}
+	if marked {
+		return nil, target.span.Err(ErrReadOnly, "cannot assign to immutable %s", target.Name)
+	}
+	if constant {
+		return nil, target.span.Err(ErrReadOnly, "cannot assign to constant %s", target.Name)
+	}
+	existing := scope[target.Name]
+	if !a.Define && existing.IsValid() && untyped {
+		// like Go, untyped constants take the variable's type.
+		var err error
+		val, err = convertUntyped(val, existing.Type())
+		if err != nil {
+			return nil, target.span.wrap(err)
+		}
+	}
+	return func() { scope[target.Name] = val }, nil
+}
+
+func fieldSetter(env Environment, target *FieldAccess,
+	val reflect.Value, untyped bool) (func(), error) {
+	field, err := target.span.singleValue(target.Run(env))
+	if err != nil {
+		return nil, err
+	}
+	if !field.CanSet() {
+		reason := "value is not addressable; try assigning through a pointer"
+		if field.CanAddr() {
+			reason = "field is unexported"
+		} else if field.Kind() == reflect.Func {
+			reason = "it is a method"
+		}
+		return nil, target.span.Err(ErrTypeMismatch, "cannot assign to %s: %s",
+			target.Field.Name, reason)
+	}
+	val, err = assignable(val, field.Type(), untyped)
+	if err != nil {
+		return nil, target.span.wrap(err)
+	}
+	return func() { field.Set(val) }, nil
+}
+
+func indexSetter(env Environment, target *ArrayAccess,
+	val reflect.Value, untyped bool) (func(), error) {
+	container, err := target.span.singleValue(target.Array.Run(env))
+	if err != nil {
+		return nil, err
+	}
+	index, err := target.span.singleValue(target.Index.Run(env))
+	if err != nil {
+		return nil, err
+	}
+	if container.Kind() == reflect.Pointer && container.Elem().Kind() == reflect.Array {
+		container = container.Elem()
+	}
+
+	switch container.Kind() {
+	case reflect.Map:
+		if container.IsNil() {
+			return nil, target.span.Err(ErrRuntime, "assignment to entry in nil map")
+		}
+		key, err := assignable(index, container.Type().Key(), IsUntyped(target.Index))
+		if err != nil {
+			return nil, target.span.wrap(err)
+		}
+		val, err = assignable(val, container.Type().Elem(), untyped)
+		if err != nil {
+			return nil, target.span.wrap(err)
+		}
+		return func() { container.SetMapIndex(key, val) }, nil
+
+	case reflect.Slice, reflect.Array:
+		i, err := target.span.index(index, container.Len())
+		if err != nil {
+			return nil, err
+		}
+		elem := container.Index(i)
+		if !elem.CanSet() {
+			reason := "value is not addressable; try assigning through a pointer"
+			if elem.CanAddr() {
+				reason = "value was obtained through an unexported field"
+			}
+			return nil, target.span.Err(ErrTypeMismatch, "cannot assign to index %d: %s", i, reason)
+		}
+		val, err = assignable(val, elem.Type(), untyped)
+		if err != nil {
+			return nil, target.span.wrap(err)
+		}
+		return func() { elem.Set(val) }, nil
+	}
+	return nil, target.span.Err(ErrTypeMismatch, "cannot assign to index of %s", typeName(container))
+}
+
 type Ident struct {
 	Name string
-	pos  position
+	span span
+}
+
+// rootName returns the name of the variable expr reaches into, if any, such
+// as x for x.a[1].b, &x.c, or x.d().
+func rootName(expr Evaluable) string {
+	switch expr := expr.(type) {
+	case *Ident:
+		return expr.Name
+	case *FieldAccess:
+		return rootName(expr.Val)
+	case *ArrayAccess:
+		return rootName(expr.Array)
+	case *SliceAccess:
+		return rootName(expr.Array)
+	case *Subexpression:
+		return rootName(expr.Expr)
+	case *Modifier:
+		if expr.Type == ModRef || expr.Type == ModDeref {
+			return rootName(expr.Val)
+		}
+	case *Call:
+		if _, ok := expr.Func.(*FieldAccess); ok {
+			return rootName(expr.Func)
+		}
+	case *Propagate:
+		return rootName(expr.Expr)
+	case *SafeChain:
+		return rootName(expr.Expr)
+	}
+	return ""
+}
+
+// immutableRoot returns true if expr reaches into an immutable variable.
+func immutableRoot(env Environment, expr Evaluable) bool {
+	name := rootName(expr)
+	return name != "" && IsImmutable(env, name)
+}
+
+// markDerived records whether name is bound to a value reached through an
+// immutable variable.
+func markDerived(env Environment, name string, derived bool) {
+	names := immutables(bindingScope(env, name), derived)
+	if derived {
+		names[name] = false
+	} else if marked, ok := names[name]; ok && !marked {
+		delete(names, name)
+	}
+}
+
+// mutatingMethod returns true if the method name of v might modify what v
+// refers to: if it has a pointer receiver, or v is a map, slice, or channel.
+func mutatingMethod(v reflect.Value, name string) bool {
+	for v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Chan:
+		return true
+	case reflect.Pointer:
+		_, ok := v.Type().Elem().MethodByName(name)
+		return !ok || mutatingMethod(reflect.Zero(v.Type().Elem()), name)
+	}
+	return false
+}
+
+// mayAlias returns true if v might refer to memory it was reached through.
+func mayAlias(v reflect.Value) bool {
+	if !v.IsValid() {
+		return false
+	}
+	switch v.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr, reflect.Float32, reflect.Float64,
+		reflect.Complex64, reflect.Complex128:
+		return false
+	}
+	return true
 }
 
 func (i *Ident) Run(env Environment) ([]reflect.Value, error) {
-	if v, ok := env[i.Name]; ok {
+	if v, ok := Lookup(env, i.Name); ok {
 		return []reflect.Value{v}, nil
 	}
 	return nil, fmt.Errorf("%w: %#v", ErrUnboundVar, i.Name)
 }
 
+// Value is a constant. Untyped constants, such as number and string
+// literals, are converted to the type of the other operand when used in an
+// operation, like Go's untyped constants.
 type Value struct {
-	Val reflect.Value
+	Val     reflect.Value
+	Untyped bool
+	span    span
+}
+
+// IsUntyped returns true if e is an untyped constant expression: an untyped
+// Value, or an operation on only untyped constants.
+func IsUntyped(e Evaluable) bool {
+	switch e := e.(type) {
+	case *Value:
+		return e.Untyped
+	case *Subexpression:
+		return IsUntyped(e.Expr)
+	case *Conditional:
+		return IsUntyped(e.Then) && IsUntyped(e.Else)
+	case *Modifier:
+		return (e.Type == ModNeg || e.Type == ModComplement) && IsUntyped(e.Val)
+	case *Operation:
+		switch e.Type {
+		case OpEqual, OpNotEqual, OpLess, OpLessEqual, OpGreater,
+			OpGreaterEqual, OpAnd, OpOr:
+			return false
+		}
+		return IsUntyped(e.Left) && IsUntyped(e.Right)
+	}
+	return false
 }
 
 func (v *Value) Run(env Environment) ([]reflect.Value, error) {
@@ -1251,39 +3632,65 @@ func Parse(expression string) (Evaluable, error) {
 	return NewParser(expression).Parse()
 }
 
+// ParsePartial parses expression, recovering from errors. See
+// (*Parser).ParsePartial.
+func ParsePartial(expression string) (Evaluable, []Diagnostic) {
+	return NewParser(expression).ParsePartial()
+}
+
 func Eval(expression string, env Environment) (_ []reflect.Value, err error) {
 	val, err := Parse(expression)
 	if err != nil {
 		return nil, err
 	}
+	return run(val, env)
+}
+
+// run runs val, turning panics into errors.
+func run(val Evaluable, env Environment) (_ []reflect.Value, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			if re, ok := r.(error); ok {
-				err = fmt.Errorf("panic: %w", re)
-				return
-			}
-			err = fmt.Errorf("panic: %v", r)
+			err = &PanicError{Value: r}
 		}
 	}()
 	return val.Run(env)
 }
 
+// PanicError is returned by Eval when evaluation panics.
+type PanicError struct {
+	Value interface{}
+}
+
+func (e *PanicError) Error() string { return fmt.Sprintf("panic: %v", e.Value) }
+
+// Unwrap returns the panic value if it is an error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
 func Repr(x reflect.Value) string {
+	var b strings.Builder
+	_ = WriteRepr(&b, x)
+	return b.String()
+}
+
+// WriteRepr writes Repr(x) to w.
+func WriteRepr(w io.Writer, x reflect.Value) error {
 	if x == (reflect.Value{}) {
-		return "nil"
+		_, err := io.WriteString(w, "nil")
+		return err
 	}
 	if x.CanInterface() {
 		if IsLowerFunc(x.Interface()) {
-			return "<function>"
+			_, err := io.WriteString(w, "<function>")
+			return err
 		}
-		if sub := IsLowerStruct(x.Interface()); sub != nil {
-			keys := make([]string, 0, len(sub))
-			for k := range sub {
-				keys = append(keys, k)
-			}
-			sort.Strings(keys)
-			return "{" + strings.Join(keys, ", ") + "}"
+		if ns := AsNamespace(x); ns != nil {
+			_, err := io.WriteString(w, ns.String())
+			return err
 		}
 	}
-	return fmt.Sprintf("%#v", x)
+	_, err := fmt.Fprintf(w, "%#v", x)
+	return err
 }
@@ -1,9 +1,15 @@
 package reflectlang
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+	"unsafe"
 )
 
 type TestStruct struct {
@@ -89,3 +95,3032 @@ func TestLang(t *testing.T) {
 		t.Fatal("unexpected")
 	}
 }
+
+func TestArithmetic(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["s"] = reflect.ValueOf(&TestStruct{Field1: 20, Field2: "hi"})
+	env["u"] = reflect.ValueOf(uint64(7))
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"1 + 2", 3},
+		{"1+2*3", 7},
+		{"(1+2)*3", 9},
+		{"10 - 4 - 3", 3},
+		{"7 / 2", 3},
+		{"7.0 / 2.0", float64(3.5)},
+		{"1e+2 - 1.0", float64(99)},
+		{"s.GetField1() * 2 + 1", 41},
+		{"s.Field1 / 4", 5},
+		{"u * u", uint64(49)},
+		{`s.Field2 + " there"`, "hi there"},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if rv.Interface() != test.expected {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+
+	for _, script := range []string{"1 / 0", `"a" - "b"`, `1 + "a"`} {
+		if _, err := singleEval(script, env); err == nil {
+			t.Fatalf("%q: expected error", script)
+		}
+	}
+}
+
+func TestBitwise(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["flags"] = reflect.ValueOf(uint8(0xf0))
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"6 & 3", 2},
+		{"6 | 3", 7},
+		{"6 ^ 3", 5},
+		{"6 &^ 3", 4},
+		{"1 << 4", 16},
+		{"0-8 >> 1", -4},
+		{"^0", -1},
+		{"1 + 2 | 4", 7},
+		{"1 | 2 * 4", 9},
+		{"flags >> 4", uint8(0x0f)},
+		{"flags << 1", uint8(0xe0)},
+		{"flags & 0x30", uint8(0x30)},
+		{"^flags", uint8(0x0f)},
+		{"true && true", true},
+		{"false || 1 & 1 == 1", true},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if rv.Interface() != test.expected {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+
+	for _, script := range []string{"1 << (0-1)", "1.0 & 1.0", "flags & 256"} {
+		if _, err := singleEval(script, env); err == nil {
+			t.Fatalf("%q: expected error", script)
+		}
+	}
+}
+
+func TestUnsignedLiterals(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["counts"] = reflect.ValueOf(map[uint64]string{42: "answer"})
+	env["half"] = reflect.ValueOf(func(n uint64) uint64 { return n / 2 })
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"42u", uint64(42)},
+		{"0xffu", uint64(255)},
+		{"18446744073709551615u", uint64(18446744073709551615)},
+		{"42u + 1", uint64(43)},
+		{"half(10u)", uint64(5)},
+		{"counts[42u]", "answer"},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if rv.Interface() != test.expected {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+
+	for _, script := range []string{"1.5u", "1e3u", "18446744073709551616u", "42u + (0-1)"} {
+		if _, err := singleEval(script, env); err == nil {
+			t.Fatalf("%q: expected error", script)
+		}
+	}
+}
+
+func TestDurationArithmetic(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["timeout"] = reflect.ValueOf(1500 * time.Millisecond)
+	env["n"] = reflect.ValueOf(3)
+	env["k"] = reflect.ValueOf(uint8(2))
+	env["f"] = reflect.ValueOf(0.5)
+	env["min"] = reflect.ValueOf(time.Duration(math.MinInt64))
+	env["g"] = reflect.ValueOf(1e20)
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"5s * 3", 15 * time.Second},
+		{"3 * 5s", 15 * time.Second},
+		{"timeout + 100ms", 1600 * time.Millisecond},
+		{"timeout / 2", 750 * time.Millisecond},
+		{"timeout * n", 4500 * time.Millisecond},
+		{"n * timeout", 4500 * time.Millisecond},
+		{"timeout / k", 750 * time.Millisecond},
+		{"timeout * 1.5", 2250 * time.Millisecond},
+		{"timeout * f", 750 * time.Millisecond},
+		{"timeout / 0.5", 3 * time.Second},
+		{"1s / 3", 333333333 * time.Nanosecond},
+		{"timeout + 1", 1500*time.Millisecond + 1},
+		{"3s / 2s", time.Duration(1)},
+		{"timeout < 2s", true},
+		{"min * 1", time.Duration(math.MinInt64)},
+		{"min / 2", time.Duration(math.MinInt64 / 2)},
+		{"-1 * (min / 2)", time.Duration(-(math.MinInt64 / 2))},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if rv.Interface() != test.expected {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+
+	for _, script := range []string{"timeout + n", "timeout / 0", "timeout / 0.0", "n / timeout",
+		"timeout * 1e20", `timeout * "a"`} {
+		if _, err := singleEval(script, env); err == nil {
+			t.Fatalf("%q: expected error", script)
+		}
+	}
+
+	for _, script := range []string{"timeout * 10000000000", "10000000000 * timeout",
+		"min * -1", "-1 * min", "min / -1", "min * 2", "timeout * g"} {
+		if _, err := singleEval(script, env); !errors.Is(err, ErrRuntime) {
+			t.Fatalf("%q: expected overflow, got %v", script, err)
+		}
+	}
+}
+
+func TestTime(t *testing.T) {
+	type host struct{ LastSeen time.Time }
+	env := NewStandardEnvironment()
+	env["h"] = reflect.ValueOf(host{LastSeen: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)})
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{`h.LastSeen == time("2024-01-02T15:04:05Z")`, true},
+		{`h.LastSeen == time("2024-01-02T16:04:05+01:00")`, true},
+		{`h.LastSeen < time("2024-01-03")`, true},
+		{`h.LastSeen >= time("2024-01-02T15:04:05.5Z")`, false},
+		{`h.LastSeen < now()`, true},
+		{`h.LastSeen - time("2024-01-02")`, 15*time.Hour + 4*time.Minute + 5*time.Second},
+		{`h.LastSeen + 1h == time("2024-01-02T16:04:05Z")`, true},
+		{`1h + h.LastSeen - 2h == time("2024-01-02T14:04:05Z")`, true},
+		{`now() - h.LastSeen > 24h`, true},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if rv.Interface() != test.expected {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+
+	for _, script := range []string{`time("yesterday")`, "time(5)", "now(1)", `h.LastSeen + 1`} {
+		if _, err := singleEval(script, env); err == nil {
+			t.Fatalf("%q: expected error", script)
+		}
+	}
+}
+
+func TestWordOperators(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["andy"] = reflect.ValueOf(true)
+	env["oracle"] = reflect.ValueOf(false)
+	env["notable"] = reflect.ValueOf(3)
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"true and false", false},
+		{"true or false", true},
+		{"not false", true},
+		{"not true or true", true},
+		{"andy and oracle", false},
+		{"andy or oracle", true},
+		{"not oracle and andy", true},
+		{"notable == 3 and not (notable > 3)", true},
+		{"1 <2", true},
+		{"1 < -2", false},
+		{"6 &^ 3 == 4 && 1<<2 == 4", true},
+		{"3 &^3", 0},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if rv.Interface() != test.expected {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+
+	for _, script := range []string{"true AND false", "true And false", "NOT true", "true andy", "1 =< 2"} {
+		if _, err := Eval(script, env); err == nil {
+			t.Fatalf("%q: expected error", script)
+		}
+	}
+}
+
+func TestCoercion(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["s"] = reflect.ValueOf(&TestStruct{Field1: 20, Field2: "hi"})
+	env["i32"] = reflect.ValueOf(int32(3))
+	env["u8"] = reflect.ValueOf(uint8(200))
+	env["f32"] = reflect.ValueOf(float32(1.5))
+	env["dur"] = reflect.ValueOf(time.Second)
+	env["p"] = reflect.ValueOf((*TestStruct)(nil))
+	env["xs"] = reflect.ValueOf([]int{1})
+	env["m"] = reflect.ValueOf(map[string]int{})
+	env["nilxs"] = reflect.ValueOf([]int(nil))
+	env["pt"] = reflect.ValueOf(struct{ X, y int }{1, 2})
+	env["pt2"] = reflect.ValueOf(struct{ X, y int }{1, 3})
+	env["boxed"] = reflect.ValueOf([]interface{}{[]int{1}, 1})
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"1 + 1.0", float64(2)},
+		{"1.5 * 2", float64(3)},
+		{"s.Field1 * 2 + 1", 41},
+		{"i32 + 1", int32(4)},
+		{"1 - i32", int32(-2)},
+		{"i32 * 2.0", int32(6)},
+		{"u8 + 55", uint8(255)},
+		{"f32 * 2", float32(3)},
+		{"dur * 2", 2 * time.Second},
+		{"-i32", int32(-3)},
+		{"-(1 + 2.5)", float64(-3.5)},
+		{"i32 < 4", true},
+		{"s.Field1 >= 20", true},
+		{"u8 > 200", false},
+		{"f32 <= 1.5", true},
+		{`"a" < "b"`, true},
+		{"i32 == 3", true},
+		{"p == nil", true},
+		{"nil == p", true},
+		{"s == nil", false},
+		{"xs == nil", false},
+		{"nilxs == nil", true},
+		{"nil != m", true},
+		{"pt == pt", true},
+		{"pt == pt2", false},
+		{"boxed[1] == boxed[1]", true},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if rv.Interface() != test.expected {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+
+	for _, script := range []string{
+		"s.Field1 + i32", "u8 + 256", "u8 + (0-1)", "i32 * 1.5", "f32 + i32",
+		"i32 < u8", `i32 + "a"`, "xs == xs", "m != m", "switch xs { case xs: 1 }",
+		"boxed[0] == boxed[0]",
+	} {
+		_, err := singleEval(script, env)
+		if !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("%q: expected type mismatch, got %v", script, err)
+		}
+	}
+
+	_, err := singleEval("1 +\n s.Field1 + i32", env)
+	if err == nil || !strings.Contains(err.Error(), "line 2, column") {
+		t.Fatalf("expected position in error, got %v", err)
+	}
+}
+
+func TestAssignment(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["s"] = reflect.ValueOf(&TestStruct{Field1: 20, Field2: "hi"})
+	env["i32"] = reflect.ValueOf(int32(3))
+	for _, script := range []string{
+		"x := 1",
+		"y, z := s.Field2, x + 1",
+		"x = x * 10",
+		"y, z = z, y",
+		"i32 = 7",
+	} {
+		rv, err := Eval(script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", script, err)
+		}
+		if len(rv) != 0 {
+			t.Fatalf("%q: unexpected results %v", script, rv)
+		}
+	}
+	for name, expected := range map[string]interface{}{
+		"x":   10,
+		"y":   2,
+		"z":   "hi",
+		"i32": int32(7),
+	} {
+		if got := env[name].Interface(); got != expected {
+			t.Fatalf("%s: got %#v, expected %#v", name, got, expected)
+		}
+	}
+
+	for _, script := range []string{"w = 1", "x, y := 1", "x := 1, 2", "i32 = 1.5"} {
+		if _, err := Eval(script, env); err == nil {
+			t.Fatalf("%q: expected error", script)
+		}
+	}
+	if rv, err := singleEval("x == 10", env); err != nil || !rv.Bool() {
+		t.Fatalf("unexpected result %v, %v", rv, err)
+	}
+}
+
+func TestMultipleAssignment(t *testing.T) {
+	errBoom := errors.New("boom")
+	previous := LowerFunc(func(args []reflect.Value) ([]reflect.Value, error) { return nil, nil })
+	env := NewStandardEnvironment()
+	env["_"] = previous
+	env["parse"] = reflect.ValueOf(func(s string) (int, error) {
+		if s == "" {
+			return 0, errBoom
+		}
+		return len(s), nil
+	})
+	env["pair"] = reflect.ValueOf(func() (string, int, error) { return "a", 1, nil })
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{`v, err := parse("abc"); v`, 3},
+		{`v, err := parse(""); err == nil`, false},
+		{`v, _ := parse("ab"); v`, 2},
+		{`_, err := parse(""); err.Error()`, "boom"},
+		{`s, n, _ := pair(); sprintf("%s%d", s, n)`, "a1"},
+		{`_, _ = parse("x"); 1`, 1},
+		{`_ = 5; 2`, 2},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if rv.Interface() != test.expected {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+	if env["_"] != previous {
+		t.Fatal("assigning to _ rebound it")
+	}
+
+	for script, expected := range map[string]string{
+		`v := parse("a")`:         "1 variables but 2 values",
+		`a, b, c, d := pair()`:    "4 variables but 3 values",
+		`_ := nope`:               "unbound variable",
+		`v, err := parse("a"), 1`: "multivalue",
+	} {
+		_, err := Eval(script, env)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%q: expected error containing %q, got %v", script, expected, err)
+		}
+	}
+}
+
+type Point struct {
+	X, Y   int32
+	Label  string
+	Err    error
+	hidden int
+}
+
+func TestSequence(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["s"] = reflect.ValueOf(&TestStruct{Field1: 2})
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{`a := s; a.SetField2("five"); a.GetField2()`, "five"},
+		{"x := 1; x = x + 1; x * 10", 20},
+		{"s.Field1 = 7;", nil},
+		{"s.GetField1() ; ", 7},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if test.expected == nil {
+			if rv.IsValid() {
+				t.Fatalf("%q: unexpected result %#v", test.script, rv)
+			}
+			continue
+		}
+		if rv.Interface() != test.expected {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+
+	for _, script := range []string{";", "1;;2", "y := 1; y + \"a\"; y = 2"} {
+		if _, err := Eval(script, env); err == nil {
+			t.Fatalf("%q: expected error", script)
+		}
+	}
+	if env["y"].Interface() != 1 {
+		t.Fatalf("statements after an error ran")
+	}
+}
+
+func TestIdentifiers(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["if"] = reflect.ValueOf(1)
+	env["ns"] = reflect.ValueOf(NamespaceOf("ns", Environment{
+		"type": reflect.ValueOf(2),
+	}))
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"café := 1; café", 1},
+		{"π := 3.14; π", 3.14},
+		{"日本語 := \"ja\"; 日本語", "ja"},
+		{"_x1 := 2; _x1", 2},
+		{"x٣ := 3; x٣", 3},
+		{"Σx := 4; Σx", 4},
+		{"@if", 1},
+		{"@if + 1", 2},
+		{"@for := 5; @for", 5},
+		{"@café := 6; café", 6},
+		{"ns.type", 2},
+		{"ns.@type", 2},
+		{"iffy := 7; iffy", 7},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if rv.Interface() != test.expected {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+
+	for _, script := range []string{"if", "for := 1", "1 + range", "@", "@1", "٣x := 1", "ⅷ := 1"} {
+		if _, err := Eval(script, env); !errors.Is(err, ErrParser) {
+			t.Fatalf("%q: expected parse error, got %v", script, err)
+		}
+	}
+	_, err := Eval("if", env)
+	if err == nil || !strings.Contains(err.Error(), "use @if") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for name, expected := range map[string]bool{
+		"café": true, "_": true, "x٣": true, "٣x": false, "": false, "a-b": false,
+	} {
+		if IsIdentifier(name) != expected {
+			t.Fatalf("IsIdentifier(%q) != %v", name, expected)
+		}
+	}
+	if !IsKeyword("func") || IsKeyword("fun") {
+		t.Fatal("unexpected keyword table")
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tokens, err := tokenize("x &^ 0x1p-2 // first\n/* second */ @if(\"a\\tb\", 5ms)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type tok struct {
+		kind      tokenKind
+		text      string
+		line, col int
+	}
+	var got []tok
+	for _, token := range tokens {
+		got = append(got, tok{token.kind, token.text, token.pos.line, token.pos.col})
+	}
+	expected := []tok{
+		{tokenIdent, "x", 1, 1},
+		{tokenOperator, "&^", 1, 3},
+		{tokenNumber, "0x1p-2", 1, 6},
+		{tokenIdent, "if", 2, 14},
+		{tokenOperator, "(", 2, 17},
+		{tokenString, "a\tb", 2, 18},
+		{tokenOperator, ",", 2, 24},
+		{tokenDuration, "5ms", 2, 26},
+		{tokenOperator, ")", 2, 29},
+		{tokenEOF, "", 2, 30},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %v, expected %v", got, expected)
+	}
+	if comments := tokens[3].comments; !reflect.DeepEqual(comments, []string{"// first", "/* second */"}) {
+		t.Fatalf("unexpected comments %q", comments)
+	}
+
+	for _, script := range []string{`"abc`, `"\q"`, "x $ y"} {
+		if _, errs := tokenize(script); len(errs) != 1 || !errors.Is(errs[0], ErrParser) {
+			t.Fatalf("%q: expected parse error, got %v", script, errs)
+		}
+	}
+
+	tokens, errs := tokenize(`"\q" $ x # "y`)
+	if len(errs) != 4 {
+		t.Fatalf("expected 4 errors, got %v", errs)
+	}
+	if len(tokens) != 4 || tokens[1].text != "x" || tokens[2].text != "y" || tokens[3].kind != tokenEOF {
+		t.Fatalf("unexpected tokens %v", tokens)
+	}
+}
+
+func TestTokenizePublic(t *testing.T) {
+	tokens, err := Tokenize("x := @if // c\n\"a\\tb\" $ 5ms")
+	if !errors.Is(err, ErrParser) {
+		t.Fatalf("expected parse error, got %v", err)
+	}
+	var got []string
+	for _, tok := range tokens {
+		got = append(got, fmt.Sprintf("%s %s %d:%d-%d:%d", tok.Kind, tok.Text,
+			tok.Start.Line, tok.Start.Column, tok.End.Line, tok.End.Column))
+	}
+	expected := []string{
+		"ident x 1:1-1:2",
+		"operator := 1:3-1:5",
+		"ident @if 1:6-1:9",
+		"comment // c 1:10-1:14",
+		`string "a\tb" 2:1-2:7`,
+		"invalid $ 2:8-2:9",
+		"duration 5ms 2:10-2:13",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %q, expected %q", got, expected)
+	}
+	if tokens, err := Tokenize("for"); err != nil || len(tokens) != 1 || tokens[0].Kind != TokenKeyword {
+		t.Fatalf("unexpected tokens %v, %v", tokens, err)
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	env := NewStandardEnvironment()
+	for script, expected := range map[string]string{
+		`"a\\b\"c"`:             "a\\b\"c",
+		`"\r\n\t\a\b\f\v"`:      "\r\n\t\a\b\f\v",
+		`"\x00\xff\xFe"`:        "\x00\xff\xfe",
+		`"\0\07\101\377x"`:      "\x00\x07A\xffx",
+		`"\u00e9\U0001F600"`:    "é😀",
+		`"\x41\u0042" + "\103"`: "ABC",
+	} {
+		rv, err := singleEval(script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", script, err)
+		}
+		if rv.String() != expected {
+			t.Fatalf("%q: got %q, expected %q", script, rv.String(), expected)
+		}
+	}
+
+	// \x escapes are bytes, not code points.
+	rv, err := singleEval(`len("\xffé")`, env)
+	if err != nil || rv.Int() != 3 {
+		t.Fatalf("unexpected length %v, %v", rv, err)
+	}
+
+	for _, script := range []string{`"\x4"`, `"\xzz"`, `"\u12"`, `"\ud800"`,
+		`"\U00110000"`, `"\400"`, `"\8"`} {
+		if _, err := Eval(script, env); !errors.Is(err, ErrParser) {
+			t.Fatalf("%q: expected parse error, got %v", script, err)
+		}
+	}
+}
+
+func TestParsePartial(t *testing.T) {
+	val, diags := ParsePartial("x := 1; y := (2 +; z := x")
+	if len(diags) != 1 || diags[0].Line != 1 || diags[0].Column != 17 ||
+		!errors.Is(diags[0].Err, ErrParser) {
+		t.Fatalf("unexpected diagnostics %v", diags)
+	}
+	seq, ok := val.(*Sequence)
+	if !ok || len(seq.Statements) != 3 {
+		t.Fatalf("unexpected partial parse %#v", val)
+	}
+	if _, ok := seq.Statements[1].(*BadStatement); !ok {
+		t.Fatalf("expected bad statement, got %#v", seq.Statements[1])
+	}
+	env := Environment{}
+	if _, err := run(val, env); !errors.Is(err, ErrParser) {
+		t.Fatalf("expected parse error, got %v", err)
+	}
+	if _, found := env["x"]; !found {
+		t.Fatal("statements before the bad statement didn't run")
+	}
+
+	val, diags = ParsePartial("foo.")
+	if _, ok := val.(*Ident); !ok || len(diags) != 1 {
+		t.Fatalf("unexpected partial parse %#v, %v", val, diags)
+	}
+
+	for script, count := range map[string]int{
+		"x := 1; y := x":        0,
+		"for { x. }; y":         1,
+		"for { 1":               1,
+		"1 }; 2":                1,
+		"x $ 1":                 2,
+		`"\q" + 1; for (; ) {}`: 3,
+		"":                      1,
+	} {
+		val, diags := ParsePartial(script)
+		if val == nil || len(diags) != count {
+			t.Fatalf("%q: expected %d diagnostics, got %#v, %v", script, count, val, diags)
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+	source := "a.b(1, 2) + c[3]; for i := range xs { -i }"
+	val, err := Parse(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := func(s span) string {
+		return string([]rune(source)[s.start.offset:s.end.offset])
+	}
+	seq := val.(*Sequence)
+	op := seq.Statements[0].(*Operation)
+	call := op.Left.(*Call)
+	loop := seq.Statements[1].(*ForRange)
+	for _, test := range []struct {
+		span     span
+		expected string
+	}{
+		{seq.span, source},
+		{op.span, "a.b(1, 2) + c[3]"},
+		{call.span, "a.b(1, 2)"},
+		{call.Func.(*FieldAccess).span, "a.b"},
+		{call.Args[1].(*Value).span, "2"},
+		{op.Right.(*ArrayAccess).span, "c[3]"},
+		{loop.span, "for i := range xs { -i }"},
+		{loop.Body.span, "{ -i }"},
+		{loop.Body.Statements[0].(*Modifier).span, "-i"},
+	} {
+		if got := text(test.span); got != test.expected {
+			t.Fatalf("got span %q, expected %q", got, test.expected)
+		}
+	}
+	if op.span.pos.col != 11 || call.span.pos.col != 4 {
+		t.Fatalf("unexpected operator positions %v, %v", op.span.pos, call.span.pos)
+	}
+
+	env := NewStandardEnvironment()
+	env["x"] = reflect.ValueOf(int32(1))
+	_, err = Eval(`1 + (x + "a")`, env)
+	var perr *LangError
+	if !errors.As(err, &perr) || perr.span.start.col != 6 || perr.span.end.col != 13 ||
+		perr.span.pos.col != 8 || perr.Col != 8 || perr.Kind != ErrTypeMismatch {
+		t.Fatalf("unexpected error span for %v", err)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	source := "const limit = 3; f := func(n) { return n * 2 }; " +
+		"for k, v := range m { switch v { case 1: f(k) } }; p?.Q.R; T{A: x}"
+	val, err := Parse(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := func(s Span) string {
+		return string([]rune(source)[s.Start.Offset:s.End.Offset])
+	}
+	var idents []string
+	nodes := 0
+	Walk(val, func(node Node) bool {
+		nodes++
+		if node.Span().End.Offset <= node.Span().Start.Offset {
+			t.Fatalf("%T has an empty span", node)
+		}
+		if ident, ok := node.(*Ident); ok {
+			if text(ident.Span()) != ident.Name {
+				t.Fatalf("ident %s has span %q", ident.Name, text(ident.Span()))
+			}
+			idents = append(idents, ident.Name)
+		}
+		return true
+	})
+	expected := "limit f n n k v m v f k p Q R T A x"
+	if got := strings.Join(idents, " "); got != expected {
+		t.Fatalf("got idents %q, expected %q", got, expected)
+	}
+
+	pruned := 0
+	Walk(val, func(node Node) bool {
+		pruned++
+		_, isFunc := node.(*FuncLit)
+		_, isLoop := node.(*ForRange)
+		return !isFunc && !isLoop
+	})
+	if pruned >= nodes {
+		t.Fatalf("returning false didn't prune: %d nodes, %d visited", nodes, pruned)
+	}
+
+	call, err := Parse("g(a)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos := call.(Node).Span().Pos; pos.Line != 1 || pos.Column != 2 || pos.Offset != 1 {
+		t.Fatalf("unexpected call position %+v", pos)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	for source, expected := range map[string]string{
+		"1+2*3":                       "1 + 2 * 3",
+		"(1 + 2) * 3":                 "(1 + 2) * 3",
+		"a and not b or c <> d":       "a && !b || c != d",
+		"p := Point{X: 1, Y: 2}; p.X": "p := Point{X: 1, Y: 2}; p.X",
+		`f("a\tb", 1.5, 2u, 1500ms, 1e+3, xs...)`:     `f("a\tb", 1.5, 2u, 1500ms, 1000.0, xs...)`,
+		"for i := range 3 { if i > 1 then 1 else 2 }": "for i := range 3 { if i > 1 then 1 else 2 }",
+		"for k, v := range m { switch v { case 1, 2: f(k); default: break } }": "for k, v := range m " +
+			"{ switch v { case 1, 2: f(k); default: break } }",
+		"switch x := y.(type) { case int: x; default: }": "switch x := y.(type) { case int: x; default: }",
+		"switch { }":                            "switch {}",
+		"for _, v = range xs { }":               "for _, v = range xs {}",
+		"for { break }; for x < 3 { continue }": "for { break }; for x < 3 { continue }",
+		"g := func(a, b) { return a + b }; defer g(1, 2); go g(3, 4)": "g := func(a, b) " +
+			"{ return a + b }; defer g(1, 2); go g(3, 4)",
+		"f := func() { return }":            "f := func() { return }",
+		"const a, b = 1, 2":                 "const a, b = 1, 2",
+		"v := m?.A.B; w := f()?":            "v := m?.A.B; w := f()?",
+		`import str "strings"; import "os"`: `import str "strings"; import "os"`,
+		"@if := 1; x.if":                    "@if := 1; x.if",
+		"xs[1:]; xs[:2]; xs[i]; xs[:]":      "xs[1:]; xs[:2]; xs[i]; xs[:]",
+		"-(-x); ^1; *p; &q; -(a + b).c":     "-(-x); ^1; *p; &q; -(a + b).c",
+		"for (T{A: 1}).A > 0 { }":           "for (T{A: 1}).A > 0 {}",
+		"Ts{{A: 1}, {}}":                    "Ts{{A: 1}, {}}",
+	} {
+		val, err := Parse(source)
+		if err != nil {
+			t.Fatalf("%q: %v", source, err)
+		}
+		got := Format(val)
+		if got != expected {
+			t.Fatalf("%q: got %q, expected %q", source, got, expected)
+		}
+		reparsed, err := Parse(got)
+		if err != nil {
+			t.Fatalf("%q: formatted as %q, which doesn't parse: %v", source, got, err)
+		}
+		if again := Format(reparsed); again != got {
+			t.Fatalf("%q: formatted as %q, then as %q", source, got, again)
+		}
+	}
+
+	ident := func(name string) *Ident { return &Ident{Name: name} }
+	for _, test := range []struct {
+		expr     Evaluable
+		expected string
+	}{
+		{&Operation{Type: OpMul, Left: &Operation{Type: OpAdd, Left: ident("a"), Right: ident("b")},
+			Right: ident("c")}, "(a + b) * c"},
+		{&Operation{Type: OpSub, Left: ident("a"), Right: &Operation{Type: OpSub, Left: ident("b"),
+			Right: ident("c")}}, "a - (b - c)"},
+		{&FieldAccess{Val: &Value{Val: reflect.ValueOf(int64(-1))}, Field: ident("x")}, "(-1).x"},
+		{&For{Cond: &CompositeLit{Type: ident("T")}, Body: &Sequence{}}, "for (T{}) {}"},
+		{&Value{Val: reflect.ValueOf(90 * time.Second)}, "90s"},
+		{&ValueSwitch{Tag: ident("x"), Clauses: []CaseClause{{Values: []Evaluable{ident("a")},
+			Body: &Sequence{Statements: []Evaluable{ident("b")}}}}}, "switch x { case a: b }"},
+	} {
+		if got := Format(test.expr); got != test.expected {
+			t.Fatalf("got %q, expected %q", got, test.expected)
+		}
+	}
+}
+
+func TestFieldAssignment(t *testing.T) {
+	p := &Point{X: 1, Y: 2}
+	env := NewStandardEnvironment()
+	env["p"] = reflect.ValueOf(p)
+	env["v"] = reflect.ValueOf(Point{})
+	env["s"] = reflect.ValueOf(&TestStruct{})
+	for _, script := range []string{
+		"p.X = 10",
+		`p.Label = "origin"`,
+		"p.X, p.Y = p.Y, p.X",
+		"x := p.X",
+		"p.X = p.X + 1",
+		"s.Field1 = s.Field1 + 5",
+	} {
+		if _, err := Eval(script, env); err != nil {
+			t.Fatalf("%q: %v", script, err)
+		}
+	}
+	if p.X != 3 || p.Y != 10 || p.Label != "origin" {
+		t.Fatalf("unexpected value %#v", p)
+	}
+	if env["x"].Interface() != int32(2) {
+		t.Fatalf("unexpected value %#v", env["x"])
+	}
+	if env["s"].Interface().(*TestStruct).Field1 != 5 {
+		t.Fatalf("unexpected value %#v", env["s"])
+	}
+
+	for script, expected := range map[string]string{
+		"v.X = 1":             "not addressable",
+		"p.hidden = 1":        "unexported",
+		"s.GetField1 = 1":     "method",
+		`p.Label = 1`:         "type mismatch",
+		"p.X = 1 << 40":       "type mismatch",
+		"p.X, p.Label = 5, 6": "type mismatch",
+		"p.Err = 1":           "type mismatch",
+		"p.X := 1":            "non-name on left side of :=",
+		"p.GetX() = 1":        "cannot assign to expression",
+	} {
+		_, err := Eval(script, env)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%q: expected error containing %q, got %v", script, expected, err)
+		}
+	}
+	if p.X != 3 {
+		t.Fatalf("failed assignment was partially applied: %#v", p)
+	}
+}
+
+func TestIndexAssignment(t *testing.T) {
+	m := map[string]int32{"a": 1}
+	xs := []string{"x", "y", "z"}
+	arr := &[2]int{}
+	env := NewStandardEnvironment()
+	env["m"] = reflect.ValueOf(m)
+	env["xs"] = reflect.ValueOf(xs)
+	env["arr"] = reflect.ValueOf(arr)
+	env["p"] = reflect.ValueOf(&Point{})
+	env["v"] = reflect.ValueOf([2]int{})
+	env["nilmap"] = reflect.ValueOf(map[string]int(nil))
+	for _, script := range []string{
+		`m["b"] = 2`,
+		`m["a"] = m["a"] + m["b"]`,
+		`xs[1] = "why"`,
+		`xs[0], xs[2] = xs[2], xs[0]`,
+		`arr[1] = 7`,
+		`p.Label, m["c"] = "both", 3`,
+	} {
+		if _, err := Eval(script, env); err != nil {
+			t.Fatalf("%q: %v", script, err)
+		}
+	}
+	if m["a"] != 3 || m["b"] != 2 || m["c"] != 3 {
+		t.Fatalf("unexpected map %v", m)
+	}
+	if strings.Join(xs, ",") != "z,why,x" {
+		t.Fatalf("unexpected slice %v", xs)
+	}
+	if arr[1] != 7 {
+		t.Fatalf("unexpected array %v", arr)
+	}
+
+	for script, expected := range map[string]string{
+		`xs[3] = "w"`:            "index out of range",
+		`xs["a"] = "w"`:          "not an int",
+		`xs[0] = 1`:              "type mismatch",
+		`m[1] = 1`:               "type mismatch",
+		`m["d"] = 1 << 40`:       "type mismatch",
+		`v[0] = 1`:               "not addressable",
+		`nilmap["a"] = 1`:        "nil map",
+		`p.Label[0] = "a"`:       "cannot assign to index of string",
+		`xs[0] := "a"`:           "non-name on left side of :=",
+		`m["e"], xs[9] = 1, "a"`: "index out of range",
+	} {
+		_, err := Eval(script, env)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%q: expected error containing %q, got %v", script, expected, err)
+		}
+	}
+	for script, expected := range map[string]string{
+		"xs[5]":      "runtime error: line 1, column 3: index out of range [5] with length 3",
+		"xs[-1]":     "runtime error: line 1, column 3: index out of range [-1] with length 3",
+		"xs[3u]":     "runtime error: line 1, column 3: index out of range [3] with length 3",
+		`p.Label[9]`: "runtime error: line 1, column 8: index out of range [9] with length",
+		`xs["a"]`:    "type mismatch: line 1, column 3: index \"a\" is not an int",
+	} {
+		_, err := Eval(script, env)
+		if !errors.Is(err, ErrTypeMismatch) && !errors.Is(err, ErrRuntime) ||
+			!strings.HasPrefix(err.Error(), expected) {
+			t.Fatalf("%q: expected error %q, got %v", script, expected, err)
+		}
+	}
+	if _, found := m["e"]; found {
+		t.Fatalf("failed assignment was partially applied: %v", m)
+	}
+}
+
+func TestSlicing(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["xs"] = reflect.ValueOf([]int{1, 2, 3, 4})
+	env["arr"] = reflect.ValueOf([3]byte{'a', 'b', 'c'})
+	env["s"] = reflect.ValueOf("hello")
+	env["n"] = reflect.ValueOf(uint8(2))
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"xs[1:3]", []int{2, 3}},
+		{"xs[:2]", []int{1, 2}},
+		{"xs[2:]", []int{3, 4}},
+		{"xs[:]", []int{1, 2, 3, 4}},
+		{"xs[n:]", []int{3, 4}},
+		{"xs[:0]", []int{}},
+		{"s[1:]", "ello"},
+		{"s[:len(s)-1]", "hell"},
+		{"arr[1:]", []byte{'b', 'c'}},
+		{"xs[1:][1:][0]", 3},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if !reflect.DeepEqual(rv.Interface(), test.expected) {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+
+	for script, expected := range map[string]error{
+		"xs[3:1]":  ErrRuntime,
+		"xs[:5]":   ErrRuntime,
+		"xs[-1:]":  ErrRuntime,
+		"s[:6]":    ErrRuntime,
+		`xs["a":]`: ErrTypeMismatch,
+		"xs[]":     ErrParser,
+		"xs[:":     ErrParser,
+	} {
+		if _, err := Eval(script, env); !errors.Is(err, expected) {
+			t.Fatalf("%q: expected %v, got %v", script, expected, err)
+		}
+	}
+}
+
+func TestImmutable(t *testing.T) {
+	s := &TestStruct{Field1: 1}
+	points := []*Point{{X: 1}}
+	m := map[string]int{"a": 1}
+	env := NewStandardEnvironment()
+	env["s"] = reflect.ValueOf(s)
+	env["points"] = reflect.ValueOf(points)
+	env["m"] = reflect.ValueOf(m)
+	env["set"] = reflect.ValueOf(func(p *Point) { p.X = 100 })
+	env["double"] = reflect.ValueOf(func(x int) int { return 2 * x })
+	env["free"] = reflect.ValueOf(&Point{})
+	for _, name := range []string{"s", "points", "m"} {
+		MarkImmutable(env, name)
+	}
+
+	for _, script := range []string{
+		"s.Field1",
+		"double(s.Field1)",
+		"len(points)",
+		`m["a"]`,
+		"x := points[0].X",
+		"x = 5",
+		"p := points[0]",
+		"p = free",
+		"p.X = 2",
+	} {
+		if _, err := Eval(script, env); err != nil {
+			t.Fatalf("%q: %v", script, err)
+		}
+	}
+
+	for _, script := range []string{
+		"s = nil",
+		"s := 1",
+		"s.Field1 = 2",
+		"s.SetField1(2)",
+		"s.GetField1()",
+		"points[0].X = 2",
+		"points[0] = nil",
+		`m["a"] = 2`,
+		"set(points[0])",
+		"p := points[0]; p.X = 2",
+		"q := &points[0]; (*q).X = 2",
+		"for _, p := range points { p.X = 2 }",
+		"(func(p) { p.X = 2 })(points[0])",
+	} {
+		_, err := Eval(script, env)
+		if !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("%q: expected read-only error, got %v", script, err)
+		}
+	}
+	// each reports errors per element.
+	if _, err := Eval(`each(points, "it.X = 2")`, env); err != nil {
+		t.Fatal(err)
+	}
+	if s.Field1 != 1 || points[0].X != 1 || m["a"] != 1 {
+		t.Fatal("immutable values were modified")
+	}
+	if IsReadOnly(env) || IsImmutable(env, "x") || !IsImmutable(env, "points") {
+		t.Fatal("unexpected environment state")
+	}
+}
+
+func TestScope(t *testing.T) {
+	type config struct{ Level int }
+	base := NewStandardEnvironment()
+	base["x"] = reflect.ValueOf(int64(1))
+	base["cfg"] = reflect.ValueOf(&config{})
+	MarkImmutable(base, "cfg")
+	scope := NewScope(base)
+
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"x", int64(1)},
+		{"x = 2; x", int64(2)},
+		{"y := 3; y", 3},
+		{"cfg.Level", 0},
+	} {
+		rv, err := singleEval(test.script, scope)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if rv.Interface() != test.expected {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+	if x := base["x"].Interface(); x != int64(2) {
+		t.Fatalf("assignment didn't reach the parent: x is %v", x)
+	}
+	if _, ok := base["y"]; ok {
+		t.Fatal("definition leaked into the parent")
+	}
+	if _, err := singleEval("x := 5", scope); err != nil {
+		t.Fatal(err)
+	}
+	if x := base["x"].Interface(); x != int64(2) {
+		t.Fatalf("shadowing modified the parent: x is %v", x)
+	}
+	if _, err := singleEval("cfg.Level = 1", scope); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected read-only error, got %v", err)
+	}
+
+	names := Names(scope)
+	for _, name := range []string{"cfg", "len", "x", "y"} {
+		if i := sort.SearchStrings(names, name); i == len(names) || names[i] != name {
+			t.Fatalf("%q missing from %v", name, names)
+		}
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Fatalf("names not sorted: %v", names)
+	}
+
+	DefineBuiltin(scope, "extra", reflect.ValueOf(1))
+	if _, found, _ := Std(base).Get("extra"); found {
+		t.Fatal("defining a builtin in a scope modified the parent's std")
+	}
+	if _, found, _ := Std(scope).Get("len"); !found {
+		t.Fatal("the scope's std lost the parent's builtins")
+	}
+
+	SetReadOnly(base, true)
+	if !IsReadOnly(scope) {
+		t.Fatal("scope of a read-only environment isn't read-only")
+	}
+	SetReadOnly(scope, false)
+	if IsReadOnly(scope) || !IsReadOnly(base) {
+		t.Fatal("unexpected read-only settings")
+	}
+}
+
+func TestLexicalScope(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["fs"] = reflect.ValueOf(make([]interface{}, 2))
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"counter := func() { n := 0; return func() { n = n + 1; return n } }; " +
+			"a := counter(); b := counter(); a(); a(); b(); a()", 3},
+		{"n := 10; f := func(n) { return n * 2 }; f(1) + n", 12},
+		{"total := 0; for i := range 3 { total = total + i }; total", 3},
+		{"i := 7; for i := range 3 { i }; i", 7},
+		{"for i := range 2 { j := i; fs[i] = func() { return j } }; fs[0]() + fs[1]() * 10",
+			10},
+	} {
+		rv, err := singleEval(test.script, NewScope(env))
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if rv.Interface() != test.expected {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+
+	for _, script := range []string{
+		"f := func() { local := 1 }; f(); local",
+		"for i := range 3 { last := i }; last",
+		"for i := range 3 { }; i",
+		"switch 5 { case 5: w := 1 }; w",
+	} {
+		if _, err := Eval(script, NewScope(env)); !errors.Is(err, ErrUnboundVar) {
+			t.Fatalf("%q: expected unbound variable, got %v", script, err)
+		}
+	}
+}
+
+func TestConst(t *testing.T) {
+	srv := &Point{X: 1}
+	env := NewStandardEnvironment()
+	env["server"] = reflect.ValueOf(srv)
+	for _, script := range []string{
+		"const srv = server",
+		"const a, b = 1, 2",
+		"srv.X = 5",
+		"x := srv",
+		"x = nil",
+		"f := func(srv) { srv }; f(3)",
+		"go (func() { srv })()",
+	} {
+		if _, err := Eval(script, env); err != nil {
+			t.Fatalf("%q: %v", script, err)
+		}
+	}
+	if env["srv"].Interface() != srv || srv.X != 5 || env["b"].Interface() != 2 {
+		t.Fatalf("unexpected bindings %v, %v, %v", env["srv"], srv.X, env["b"])
+	}
+	if !IsConst(env, "srv") || IsConst(env, "x") {
+		t.Fatal("unexpected constants")
+	}
+
+	for script, expected := range map[string]string{
+		"srv = nil":                  "cannot assign to constant srv",
+		"srv := 1":                   "cannot assign to constant srv",
+		"x, a = 1, 2":                "cannot assign to constant a",
+		"const srv = 1":              "cannot assign to constant srv",
+		"const c":                    "expected = in const declaration",
+		"const = 1":                  "expected name in const declaration",
+		"const c, d = 1":             "assignment mismatch",
+		"f := func() { b = 3 }; f()": "cannot assign to constant b",
+	} {
+		_, err := Eval(script, env)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%q: expected error containing %q, got %v", script, expected, err)
+		}
+	}
+	if env["srv"].Interface() != srv || env["x"].IsValid() {
+		t.Fatalf("failed assignments changed bindings: %v, %v", env["srv"], env["x"])
+	}
+}
+
+func TestPropagate(t *testing.T) {
+	errBoom := errors.New("boom")
+	env := NewStandardEnvironment()
+	env["ok"] = reflect.ValueOf(func() (int, error) { return 7, nil })
+	env["fail"] = reflect.ValueOf(func() (int, error) { return 0, errBoom })
+	env["check"] = reflect.ValueOf(func(fail bool) error {
+		if fail {
+			return errBoom
+		}
+		return nil
+	})
+	env["two"] = reflect.ValueOf(func() (int, int) { return 1, 2 })
+
+	val, err := singleEval("ok()? + 1", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val.Interface() != 8 {
+		t.Fatalf("unexpected value %#v", val)
+	}
+	rv, err := Eval("check(false)?", env)
+	if err != nil || len(rv) != 0 {
+		t.Fatalf("unexpected results %v, %v", rv, err)
+	}
+
+	for script, expected := range map[string]error{
+		"fail()?":      errBoom,
+		"check(true)?": errBoom,
+		"x := fail()?": errBoom,
+		"two()?":       ErrTypeMismatch,
+		"1?":           ErrTypeMismatch,
+		"undefined()?": ErrUnboundVar,
+	} {
+		if _, err := Eval(script, env); !errors.Is(err, expected) {
+			t.Fatalf("%q: expected %v, got %v", script, expected, err)
+		}
+	}
+}
+
+func TestSafeFieldAccess(t *testing.T) {
+	type inner struct{ C int }
+	type middle struct {
+		B   *inner
+		Err error
+	}
+	type outer struct{ A *middle }
+	errBoom := errors.New("boom")
+	env := NewStandardEnvironment()
+	env["full"] = reflect.ValueOf(&outer{A: &middle{B: &inner{C: 3}}})
+	env["partial"] = reflect.ValueOf(&outer{A: &middle{}})
+	env["none"] = reflect.ValueOf((*outer)(nil))
+	env["get"] = reflect.ValueOf(func(fail bool) (*outer, error) {
+		if fail {
+			return nil, errBoom
+		}
+		return &outer{}, nil
+	})
+	env["any"] = reflect.ValueOf(func(v interface{}) interface{} { return v })
+	env["sum"] = reflect.ValueOf(func(xs ...int) int { return len(xs) })
+	env["ints"] = reflect.ValueOf(func() ([]int, error) { return []int{1, 2}, nil })
+
+	for script, expected := range map[string]interface{}{
+		"full?.A?.B?.C":           3,
+		"full.A?.B.C":             3,
+		"partial?.A?.B?.C":        nil,
+		"none?.A.B.C.D":           nil,
+		"none?.A.B.C":             nil,
+		"none?.A == nil":          true,
+		"any(partial.A.B)?.C":     nil,
+		"partial.A?.Err?.Error()": nil,
+		"get(false)?.A":           (*middle)(nil),
+		`if partial?.A?.B == nil then "missing" else "found"`: "missing",
+		"sum(ints()?...)": 2,
+	} {
+		val, err := singleEval(script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", script, err)
+		}
+		if expected == nil {
+			if val.IsValid() {
+				t.Fatalf("%q: expected nil, got %#v", script, val)
+			}
+			continue
+		}
+		if val.Interface() != expected {
+			t.Fatalf("%q: got %#v, expected %#v", script, val.Interface(), expected)
+		}
+	}
+
+	for script, expected := range map[string]string{
+		"get(true)?.A":       "boom",
+		"full?.1":            "expected field name after ?.",
+		"partial?.A.B = nil": "cannot assign",
+		// parentheses end the chain, so C is selected from nil.
+		"(partial.A?.B).C": "panic",
+	} {
+		_, err := Eval(script, env)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%q: expected error containing %q, got %v", script, expected, err)
+		}
+	}
+}
+
+func TestForRange(t *testing.T) {
+	nums := []int{1, 2, 3}
+	conns := map[string]int{"a": 1, "b": 2}
+	ch := make(chan int, 3)
+	ch <- 4
+	ch <- 5
+	close(ch)
+	env := NewStandardEnvironment()
+	env["nums"] = reflect.ValueOf(nums)
+	env["conns"] = reflect.ValueOf(conns)
+	env["ch"] = reflect.ValueOf(ch)
+	env["arr"] = reflect.ValueOf(&[2]int{7, 8})
+	env["i"] = reflect.ValueOf("outer")
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"total := 0; for _, v := range nums { total = total + v }; total", 6},
+		{"total := 0; for i := range nums { total = total + nums[i] }; total", 6},
+		{"n := 0; for i := range 4 { n = n + i; }; n", 6},
+		{`count := 0; for range "héllo" { count = count + 1 }; count`, 5},
+		{"sum := 0; for v := range ch { sum = sum + v }; sum", 9},
+		{"sum := 0; for _, v := range arr { sum = sum + v }; sum", 15},
+		{"last := 0; for _, last = range nums {}; last", 3},
+		{"for i := range nums {}; i", "outer"},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if rv.Interface() != test.expected {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+
+	if _, err := Eval("for k, v := range conns { conns[k] = v * 10 }", env); err != nil {
+		t.Fatal(err)
+	}
+	if conns["a"] != 10 || conns["b"] != 20 {
+		t.Fatalf("unexpected map %v", conns)
+	}
+	if _, found := env["k"]; found {
+		t.Fatal("loop variable leaked")
+	}
+
+	for script, expected := range map[string]string{
+		"for x range nums {}":              "expected {",
+		"for x, y range nums {}":           "expected := or =",
+		"for range nums":                   "expected {",
+		"for range nums { 1 2 }":           "expected ; or }",
+		"for a, b, c := range conns {}":    "at most two iteration variables",
+		"for nums[0] := range nums {}":     "non-name on left side of :=",
+		"for i, v := range 5 {}":           "only one iteration variable",
+		"for range 1.5 {}":                 "cannot range over",
+		"for _, v := range nums { v = x }": "unbound variable",
+	} {
+		_, err := Eval(script, env)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%q: expected error containing %q, got %v", script, expected, err)
+		}
+	}
+}
+
+func TestFor(t *testing.T) {
+	queue := []int{1, 2, 3, 4}
+	env := NewStandardEnvironment()
+	env["pop"] = reflect.ValueOf(func() int {
+		v := queue[0]
+		queue = queue[1:]
+		return v
+	})
+	env["depth"] = reflect.ValueOf(func() int { return len(queue) })
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"popped := 0; for depth() > 0 { pop(); popped = popped + 1 }; popped", 4},
+		{"n := 0; for { n = n + 1; break }; n", 1},
+		{"n := 0; for i := range 10 { n = n + i + 1; break; n = 100 }; n", 1},
+		{"n := 0; for n < 3 { n = n + 1; continue; n = 100 }; n", 3},
+		{"n := 0; for range 3 { for { n = n + 1; break } }; n", 3},
+		{"n := 0; for range 3 { for range 3 { continue }; n = n + 1 }; n", 3},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if rv.Interface() != test.expected {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+
+	for script, expected := range map[string]string{
+		"break":                    "break is not in a loop",
+		"for { }; continue":        "continue is not in a loop",
+		"for 1 { }":                "non-boolean condition",
+		"for depth() > 0":          "expected {",
+		"for { x }":                "unbound variable",
+		"for { break 1 }":          "expected ; or }",
+		"for depth() > 0 { pop( }": "unexpected",
+	} {
+		_, err := Eval(script, env)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%q: expected error containing %q, got %v", script, expected, err)
+		}
+	}
+}
+
+func TestTypeSwitch(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["items"] = reflect.ValueOf([]interface{}{
+		int64(1), "two", time.Second, errors.New("boom"), nil, 2.5})
+	env["int64"] = reflect.ValueOf(reflect.TypeOf(int64(0)))
+	env["float64"] = reflect.ValueOf(reflect.TypeOf(float64(0)))
+	env["string"] = reflect.ValueOf(reflect.TypeOf(""))
+	env["error"] = reflect.ValueOf(reflect.TypeOf((*error)(nil)).Elem())
+	env["Stringer"] = reflect.ValueOf(reflect.TypeOf((*fmt.Stringer)(nil)).Elem())
+	env["Node"] = reflect.ValueOf(reflect.TypeOf(ListNode{}))
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{`out := ""; for _, x := range items { switch v := x.(type) { ` +
+			`case int64, float64: out = out + "n"; case string: out = out + v; ` +
+			`case Stringer: out = out + v.String(); case error: out = out + v.Error(); ` +
+			`case nil: out = out + "nil"; default: out = out + "?" }; out = out + "," }; out`,
+			"n,two,1s,boom,nil,n,"},
+		{"switch v := items[0].(type) { case string: 0; case int64: v * 2 }", int64(2)},
+		{"switch (Node{}).(type) { default: 2; case Node: 1 }", 1},
+		{"switch items[3].(type) { case Stringer: 1; default: 2 }", 2},
+		{"n := 0; switch items[0].(type) { case int64: n = 1; break; n = 2 }; n", 1},
+		{"n := 0; for i := range 3 { switch items[i].(type) { case string: continue }; n = n + 1 }; n",
+			2},
+		{`v := "outer"; switch v := items[0].(type) { default: v }; v`, "outer"},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if rv.Interface() != test.expected {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+
+	rv, err := singleEval("switch v := items[2].(type) { case Stringer: v }", env)
+	if err != nil || rv.Type() != reflect.TypeOf((*fmt.Stringer)(nil)).Elem() {
+		t.Fatalf("expected a fmt.Stringer, got %v, %v", rv, err)
+	}
+	results, err := Eval("switch items[1].(type) { case int64: 1 }", env)
+	if err != nil || len(results) != 0 {
+		t.Fatalf("expected no results, got %v, %v", results, err)
+	}
+
+	for script, expected := range map[string]string{
+		"switch v := items[0] { }":                                   "expected .(type)",
+		"switch items[0].(type) { case 1: 1 }":                       "is not a type",
+		"switch items[0].(type) { default: 1; default: 2 }":          "multiple defaults",
+		"switch items[0].(type) { 1 }":                               "expected case or default",
+		"switch items[0].(type) { case int64 1 }":                    "expected :",
+		"switch items[0].(type) { default: continue }":               "continue is not in a loop",
+		"switch items[0].(type) { case int64: x }":                   "unbound variable",
+		"f := func() { switch items[0].(type) { default: } }; break": "break is not in a loop",
+	} {
+		_, err := Eval(script, env)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%q: expected error containing %q, got %v", script, expected, err)
+		}
+	}
+}
+
+func TestValueSwitch(t *testing.T) {
+	type state int32
+	env := NewStandardEnvironment()
+	env["st"] = reflect.ValueOf(state(2))
+	env["Closed"] = reflect.ValueOf(state(3))
+	env["name"] = reflect.ValueOf("ack")
+	env["calls"] = reflect.ValueOf(func() int { panic("evaluated") })
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{`switch st { case 0: "idle"; case 1, 2: "open"; case Closed: "closed" }`, "open"},
+		{`switch st + 1 { case 1, 2: "open"; case Closed: "closed" }`, "closed"},
+		{`switch name { default: 0; case "syn": 1; case "ack": 2 }`, 2},
+		{`switch name { case "syn": 1; default: 0 }`, 0},
+		{`switch { case st > 2: "high"; case st > 1: "mid"; default: "low" }`, "mid"},
+		{`switch st { case 2: 1; case calls(): 2 }`, 1},
+		{"n := 0; switch st { case 2: n = 1; break; n = 2 }; n", 1},
+		{"n := 0; for i := range 4 { switch i { case 1, 3: continue }; n = n + 1 }; n", 2},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if rv.Interface() != test.expected {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+
+	results, err := Eval("switch st { case 0: 1 }", env)
+	if err != nil || len(results) != 0 {
+		t.Fatalf("expected no results, got %v, %v", results, err)
+	}
+
+	for script, expected := range map[string]string{
+		`switch st { case "a": 1 }`:            "cannot use \"a\"",
+		"switch { case 1: 1 }":                 "non-bool case",
+		"switch st { default: 1; default: 2 }": "multiple defaults",
+		"switch st { case : 1 }":               "expected expression",
+		"switch st { case 1 1 }":               "expected :",
+		"switch st { default: continue }":      "continue is not in a loop",
+		"switch st { case 2: x }":              "unbound variable",
+	} {
+		_, err := Eval(script, env)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%q: expected error containing %q, got %v", script, expected, err)
+		}
+	}
+}
+
+func TestFuncLit(t *testing.T) {
+	xs := []int{3, 1, 2}
+	env := NewStandardEnvironment()
+	env["a"] = reflect.ValueOf("outer")
+	env["xs"] = reflect.ValueOf(xs)
+	env["sortSlice"] = reflect.ValueOf(sort.Slice)
+	env["apply"] = reflect.ValueOf(func(f func(string) (int, error), s string) (int, error) {
+		return f(s)
+	})
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"add := func(a, b) { return a + b }; add(1, 2)", 3},
+		{"a", "outer"},
+		{"func(x) { return x * 2 }(21)", 42},
+		{"fact := func(n) { for n > 1 { return n * fact(n - 1) }; return 1 }; fact(5)", 120},
+		{"count := 0; inc := func() { count = count + 1 }; inc(); inc(); count", 2},
+		{"first := func() { for _, x := range xs { return x } }; first()", 3},
+		{"apply(func(s) { return 7, nil }, \"abc\")", 7},
+		{"sortSlice(xs, func(i, j) { return xs[i] < xs[j] }); xs[0]", 1},
+	} {
+		rv, err := Eval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if len(rv) == 0 || rv[0].Interface() != test.expected {
+			t.Fatalf("%q: got %v, expected %#v", test.script, rv, test.expected)
+		}
+	}
+	rv, err := Eval("nothing := func() { return }; nothing()", env)
+	if err != nil || len(rv) != 0 {
+		t.Fatalf("unexpected results %v, %v", rv, err)
+	}
+
+	for script, expected := range map[string]string{
+		"return 1":                         "return is not in a function",
+		"for { func() { break } }":         "break is not in a loop",
+		"func(1) {}":                       "expected parameter name",
+		"func(a b) {}":                     "expected , or )",
+		"func(a) {}()":                     "called with 0 arguments",
+		`apply(func(s) { return 1 }, "x")`: "returned 1 values",
+		`apply(func(s) { return "a", nil }, "x")`: "cannot use",
+		`apply(func() { return 1, nil }, "x")`:    "wrong number of parameters",
+	} {
+		_, err := Eval(script, env)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%q: expected error containing %q, got %v", script, expected, err)
+		}
+	}
+}
+
+func TestGo(t *testing.T) {
+	values := make(chan int, 1)
+	errs := make(chan error, 1)
+	env := NewStandardEnvironment()
+	env["record"] = reflect.ValueOf(func(x int) { values <- x })
+	env["$goerror"] = reflect.ValueOf(func(err error) { errs <- err })
+
+	if _, err := Eval("go record(1)", env); err != nil {
+		t.Fatal(err)
+	}
+	if v := <-values; v != 1 {
+		t.Fatalf("unexpected value %d", v)
+	}
+
+	if _, err := Eval("y := 2; go (func(x) { z := x; record(z + y) })(3)", env); err != nil {
+		t.Fatal(err)
+	}
+	if v := <-values; v != 5 {
+		t.Fatalf("unexpected value %d", v)
+	}
+	if _, found := env["z"]; found {
+		t.Fatal("goroutine binding leaked into the environment")
+	}
+
+	if _, err := Eval("go (func() { missing() })()", env); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; !errors.Is(err, ErrUnboundVar) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for script, expected := range map[string]error{
+		"go missing()": ErrUnboundVar,
+		"go 1":         ErrParser,
+		"go record":    ErrParser,
+	} {
+		if _, err := Eval(script, env); !errors.Is(err, expected) {
+			t.Fatalf("%q: expected %v, got %v", script, expected, err)
+		}
+	}
+}
+
+type testID string
+
+func TestConditional(t *testing.T) {
+	calls := 0
+	env := NewStandardEnvironment()
+	env["count"] = reflect.ValueOf(func() int64 { calls++; return 1 })
+	env["x"] = reflect.ValueOf(int64(5))
+	env["pair"] = reflect.ValueOf(func() (int64, string) { return 1, "a" })
+	var i32 int32
+	env["i32"] = reflect.ValueOf(&i32).Elem()
+
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"if x > 3 then 1 else 2", 1},
+		{`if x > 10 then "big" else if x > 3 then "medium" else "small"`, "medium"},
+		{"if true then count() else count() + 1", int64(1)},
+		{"(if false then 1 else 2) * 3", 6},
+		{"i32 = if x == 5 then 7 else 8; i32", int32(7)},
+		{"if false then 1 else x", int64(5)},
+	} {
+		val, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if val.Interface() != test.expected {
+			t.Fatalf("%q: unexpected value %#v", test.script, val)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected one branch to be evaluated, got %d calls", calls)
+	}
+	rv, err := Eval("if true then pair() else pair()", env)
+	if err != nil || len(rv) != 2 {
+		t.Fatalf("unexpected results %v, %v", rv, err)
+	}
+
+	if _, err := Eval("if 1 then 2 else 3", env); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected type mismatch, got %v", err)
+	}
+	for _, script := range []string{"if true then 1", "if true 1 else 2", "if then 1 else 2",
+		"if true then else 2"} {
+		if _, err := Eval(script, env); !errors.Is(err, ErrParser) {
+			t.Fatalf("%q: expected parser error, got %v", script, err)
+		}
+	}
+}
+
+func TestConversion(t *testing.T) {
+	env := NewStandardEnvironment()
+	for name, v := range map[string]interface{}{
+		"int64":   int64(0),
+		"uint8":   uint8(0),
+		"uint64":  uint64(0),
+		"float64": float64(0),
+		"string":  "",
+		"uintptr": uintptr(0),
+		"ID":      testID(""),
+		"Ptr":     unsafe.Pointer(nil),
+		"Bytes":   []byte(nil),
+		"Any":     (*interface{})(nil),
+	} {
+		typ := reflect.TypeOf(v)
+		if name == "Any" {
+			typ = typ.Elem()
+		}
+		env[name] = reflect.ValueOf(typ)
+	}
+	x := 7
+	env["i32"] = reflect.ValueOf(int32(-1))
+	env["boxed"] = reflect.ValueOf([]interface{}{int64(5), "s"})
+	env["ptr"] = reflect.ValueOf(unsafe.Pointer(&x))
+
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"uint64(i32)", uint64(math.MaxUint64)},
+		{"uint8(255)", uint8(255)},
+		{"float64(3)", float64(3)},
+		{"int64(2.0)", int64(2)},
+		{"int64(boxed[0])", int64(5)},
+		{"ID(boxed[1])", testID("s")},
+		{`string(Bytes("hi"))`, "hi"},
+		{"uintptr(ptr) == uintptr(Ptr(uintptr(ptr)))", true},
+	} {
+		val, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if val.Interface() != test.expected {
+			t.Fatalf("%q: unexpected value %#v", test.script, val)
+		}
+	}
+
+	val, err := singleEval("Any(i32)", env)
+	if err != nil || val.Type() != reflect.TypeOf((*interface{})(nil)).Elem() {
+		t.Fatalf("unexpected value %v, %v", val, err)
+	}
+	val, err = singleEval("Bytes(nil)", env)
+	if err != nil || !val.IsNil() {
+		t.Fatalf("unexpected value %v, %v", val, err)
+	}
+
+	for _, script := range []string{
+		"uint8(256)",
+		"uint64(-1)",
+		"int64(1.5)",
+		`int64("1")`,
+		"int64(boxed[1])",
+		"int64(nil)",
+		"int64(1, 2)",
+	} {
+		if _, err := Eval(script, env); !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("%q: expected type mismatch, got %v", script, err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["s"] = reflect.ValueOf(&TestStruct{})
+	env["Node"] = reflect.ValueOf(reflect.TypeOf(ListNode{}))
+	env["nodes"] = reflect.ValueOf([]ListNode{{X: 1}})
+	env["string"] = reflect.ValueOf(reflect.TypeOf(""))
+	env["ns"] = reflect.ValueOf(NamespaceOf("ns", Environment{"a": reflect.ValueOf(1)}))
+
+	for script, expected := range map[string][]string{
+		"s.GetField1() + s.Field1": nil,
+		"x := 1; y := x + 2; y":    nil,
+		"f := func(n) { return if n > 0 then f(n - 1) else g() }; g := func() { return 1 }": nil,
+		"for i, n := range nodes { n.Next.Tags[i] }":                                        nil,
+		"switch v := s.Field2.(type) { case string: len(v) }":                               nil,
+		"p := Node{X: 1, Next: &nodes[0]}; p.Next.Y":                                        nil,
+		"v, err := s.TestCall(); v; err.Error()":                                            nil,
+		"ns.a; std.len; s = 1; s.Anything":                                                  nil,
+		`import "strings"; strings.ToUpper(q)`:                                              nil,
+		`import str "strings"; str.ToUpper("a")`:                                            nil,
+
+		"s.GetFeild1()": {`TestStruct has no field or method GetFeild1; did you mean GetField1?`},
+		"x := 1; x.Y":   {"int has no field or method Y"},
+		"y = 1":         {`"y" (use := to define it)`},
+		"counter + 1":   {`"counter"`},
+		"val := 1; vla": {`"vla"; did you mean val?`},
+		"for _, n := range nodes { n.Nxt }; Node{W: 1}": {
+			"ListNode has no field or method Nxt; did you mean Next?",
+			"unknown field W in reflectlang.ListNode literal; did you mean X?"},
+		"func() { return undefined }; for range 1 { total := 1 }; total": {`"undefined"`, `"total"`},
+		"s.TestCall()?.Field1": {"int has no field or method Field1"},
+		"ns.bogus":             {`"bogus" not found in namespace ns`},
+	} {
+		val, err := Parse(script)
+		if err != nil {
+			t.Fatalf("%q: %v", script, err)
+		}
+		diags := Check(val, env)
+		if len(diags) != len(expected) {
+			t.Fatalf("%q: expected %d diagnostics, got %v", script, len(expected), diags)
+		}
+		for i, diag := range diags {
+			if !strings.HasSuffix(diag.Err.Error(), expected[i]) || diag.Line != 1 || diag.Column == 0 {
+				t.Fatalf("%q: expected %q, got %v", script, expected[i], diag)
+			}
+		}
+	}
+
+	val, err := Parse("s.Nope; missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	diags := Check(val, env)
+	if len(diags) != 2 || !errors.Is(diags[0].Err, ErrTypeMismatch) ||
+		!errors.Is(diags[1].Err, ErrUnboundVar) || diags[1].Column != 9 {
+		t.Fatalf("unexpected diagnostics %v", diags)
+	}
+	if s := env["s"].Interface().(*TestStruct); s.calls != 0 {
+		t.Fatal("checking ran the script")
+	}
+}
+
+type ListNode struct {
+	X, Y   int
+	Tags   []string
+	Next   *ListNode
+	hidden int
+}
+
+type Embedded struct {
+	ListNode
+	Z int
+}
+
+func TestCompositeLit(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["Node"] = reflect.ValueOf(reflect.TypeOf(ListNode{}))
+	env["Nodes"] = reflect.ValueOf(reflect.TypeOf([]ListNode{}))
+	env["NodePtrs"] = reflect.ValueOf(reflect.TypeOf([]*ListNode{}))
+	env["Embedded"] = reflect.ValueOf(reflect.TypeOf(Embedded{}))
+	env["Ints"] = reflect.ValueOf(reflect.TypeOf([]int{}))
+	env["Triple"] = reflect.ValueOf(reflect.TypeOf([3]int8{}))
+	env["Counts"] = reflect.ValueOf(reflect.TypeOf(map[string]int{}))
+	env["Duration"] = reflect.ValueOf(reflect.TypeOf(time.Duration(0)))
+	env["Any"] = reflect.ValueOf(reflect.TypeOf([]interface{}{}))
+	env["pkg"] = reflect.ValueOf(NamespaceOf("pkg", Environment{
+		"Node": reflect.ValueOf(reflect.TypeOf(ListNode{})),
+	}))
+	env["xs"] = reflect.ValueOf([]int{5, 6})
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"Node{}", ListNode{}},
+		{"Node()", ListNode{}},
+		{"Duration()", time.Duration(0)},
+		{"Node{X: 1, Y: 2}", ListNode{X: 1, Y: 2}},
+		{"Node{Y: 2,}", ListNode{Y: 2}},
+		{"pkg.Node{X: 3}", ListNode{X: 3}},
+		{`Node{X: 1, Next: &Node{X: 2}}.Next.X`, 2},
+		{"p := Node{X: 1}; p.Y = 4; p", ListNode{X: 1, Y: 4}},
+		{"(&Node{X: 5}).X", 5},
+		{"Nodes{{X: 1}, {Y: 2}}", []ListNode{{X: 1}, {Y: 2}}},
+		{"len(NodePtrs{{X: 1}, nil})", 2},
+		{"NodePtrs{{X: 1}}[0].X", 1},
+		{"Embedded{ListNode: Node{X: 1}, Z: 2}.X", 1},
+		{"Ints{1, 2, 3}", []int{1, 2, 3}},
+		{"Ints{4: 1, 2}", []int{0, 0, 0, 0, 1, 2}},
+		{"Ints{xs[0], len(xs)}", []int{5, 2}},
+		{"Triple{1, 2}", [3]int8{1, 2, 0}},
+		{`Counts{"a": 1, "b": if true then 2 else 3}`, map[string]int{"a": 1, "b": 2}},
+		{`Any{1, "a", nil}`, []interface{}{1, "a", nil}},
+		{"s := Ints{}; for _, x := range (Ints{1, 2}) { s = Ints{x, len(s)} }; s", []int{2, 2}},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if !reflect.DeepEqual(rv.Interface(), test.expected) {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+
+	for script, expected := range map[string]error{
+		"Node{1}":                  ErrTypeMismatch,
+		"Node{X: 1, 2}":            ErrTypeMismatch,
+		"Node{Z: 1}":               ErrTypeMismatch,
+		"Node{X: 1, X: 2}":         ErrTypeMismatch,
+		"Node{hidden: 1}":          ErrTypeMismatch,
+		`Node{X: "a"}`:             ErrTypeMismatch,
+		"Embedded{X: 1}":           ErrTypeMismatch,
+		"Triple{300}":              ErrTypeMismatch,
+		"Triple{3: 1}":             ErrRuntime,
+		"Ints{0: 1, 0: 2}":         ErrTypeMismatch,
+		"Counts{1}":                ErrTypeMismatch,
+		"Duration{}":               ErrTypeMismatch,
+		"xs{1}":                    ErrTypeMismatch,
+		"Node{X: 1":                ErrParser,
+		"for x := range Ints{} {}": ErrParser,
+	} {
+		if _, err := Eval(script, env); !errors.Is(err, expected) {
+			t.Fatalf("%q: expected %v, got %v", script, expected, err)
+		}
+	}
+
+	MarkImmutable(env, "xs")
+	if _, err := Eval("Any{xs}", env); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected read-only error, got %v", err)
+	}
+
+	for script, expected := range map[string]string{
+		"Node{Tgas: nil}":  "; did you mean Tags?",
+		"Node{tags: nil}":  "; did you mean Tags?",
+		"Node{Nxet: nil}":  "; did you mean Next?",
+		"Node{Z: 1}":       "; did you mean X?",
+		"Node{Label: nil}": " literal",
+	} {
+		_, err := Eval(script, env)
+		if err == nil || !strings.HasSuffix(err.Error(), expected) {
+			t.Fatalf("%q: expected error ending with %q, got %v", script, expected, err)
+		}
+	}
+}
+
+func TestAutoRef(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["Node"] = reflect.ValueOf(reflect.TypeOf(ListNode{}))
+	env["bump"] = reflect.ValueOf(func(n *ListNode) { n.X++ })
+	env["getX"] = reflect.ValueOf(func(n ListNode) int { return n.X })
+	env["sumX"] = reflect.ValueOf(func(ns ...*ListNode) (sum int) {
+		for _, n := range ns {
+			sum += n.X
+		}
+		return sum
+	})
+	env["frozen"] = reflect.ValueOf(&ListNode{X: 7}).Elem()
+	env["plain"] = reflect.ValueOf(ListNode{})
+	for _, test := range []struct {
+		script   string
+		expected int
+	}{
+		{"n := Node{X: 1}; bump(n); n.X", 2},
+		{"n := Node{X: 1}; bump(&n); n.X", 2},
+		{"p := &Node{X: 3}; getX(p)", 3},
+		{"getX(Node{X: 4})", 4},
+		{"a := Node{X: 1}; b := Node{X: 2}; sumX(a, &b)", 3},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if int(rv.Int()) != test.expected {
+			t.Fatalf("%q: got %v, expected %d", test.script, rv, test.expected)
+		}
+	}
+
+	// nil pointers and unaddressable values aren't adapted.
+	for _, script := range []string{"p := &Node{}; p = nil; getX(p)", "bump(plain)"} {
+		if _, err := Eval(script, env); err == nil {
+			t.Fatalf("%q: expected an error", script)
+		}
+	}
+
+	MarkImmutable(env, "frozen")
+	if _, err := Eval("bump(frozen)", env); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected read-only error, got %v", err)
+	}
+
+	SetAutoRef(env, false)
+	if AutoRef(env) {
+		t.Fatal("auto ref still enabled")
+	}
+	if _, err := Eval("n := Node{X: 1}; bump(n)", env); err == nil {
+		t.Fatal("expected an error with auto ref disabled")
+	}
+}
+
+func TestSpread(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["sum"] = reflect.ValueOf(func(base int64, xs ...int64) int64 {
+		for _, x := range xs {
+			base += x
+		}
+		return base
+	})
+	env["join"] = reflect.ValueOf(strings.Join)
+	env["xs"] = reflect.ValueOf([]int64{1, 2, 3})
+	env["ys"] = reflect.ValueOf([]int{1, 2, 3})
+	env["words"] = reflect.ValueOf([]string{"a", "b"})
+	env["arr"] = reflect.ValueOf([2]int64{4, 5})
+	env["int64"] = reflect.ValueOf(reflect.TypeOf(int64(0)))
+
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"sum(10, xs...)", int64(16)},
+		{"sum(10, nil...)", int64(10)},
+		{"sum(10, 1, 2.0)", int64(13)},
+		{"(func(a, b, c) { return a + b + c })(xs...)", int64(6)},
+		{"(func(a, b, c) { return a + b + c })(int64(0), arr...)", int64(9)},
+		{"(func(a, b) { return b })(words...)", "b"},
+	} {
+		val, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if val.Interface() != test.expected {
+			t.Fatalf("%q: unexpected value %#v", test.script, val)
+		}
+	}
+
+	for _, script := range []string{
+		"sum(10, ys...)",
+		"sum(xs...)",
+		"join(words...)",
+		"len(sum...)",
+		"int64(xs...)",
+	} {
+		if _, err := Eval(script, env); !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("%q: expected type mismatch, got %v", script, err)
+		}
+	}
+	for _, script := range []string{"sum(xs..., 1)", "sum(...)"} {
+		if _, err := Eval(script, env); !errors.Is(err, ErrParser) {
+			t.Fatalf("%q: expected parser error, got %v", script, err)
+		}
+	}
+}
+
+func TestDefer(t *testing.T) {
+	var calls []string
+	env := NewStandardEnvironment()
+	env["record"] = reflect.ValueOf(func(s string) { calls = append(calls, s) })
+	env["fail"] = reflect.ValueOf(func() error { return errors.New("failed") })
+	env["boom"] = reflect.ValueOf(func() { panic("boom") })
+
+	for _, test := range []struct {
+		script   string
+		expected string
+	}{
+		{`record("a"); defer record("b"); record("c")`, "a c b"},
+		{`defer record("a"); defer record("b")`, "b a"},
+		{`x := "a"; defer record(x); x = "b"; record(x)`, "b a"},
+		{`(func() { defer record("a"); record("b"); return 1; record("c") })()`, "b a"},
+		{`for i := range 2 { defer record("a"); record("b") }`, "b a b a"},
+		{`for { defer record("a"); break }`, "a"},
+		{`defer record("a")`, "a"},
+	} {
+		calls = nil
+		if _, err := Eval(test.script, env); err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if got := strings.Join(calls, " "); got != test.expected {
+			t.Fatalf("%q: expected calls %q, got %q", test.script, test.expected, got)
+		}
+	}
+
+	rv, err := Eval(`(func() { defer record("a"); return "b" })()`, env)
+	if err != nil || len(rv) != 1 || rv[0].Interface() != "b" {
+		t.Fatalf("unexpected result %v, %v", rv, err)
+	}
+
+	// deferred calls run despite errors and panics, and report their own.
+	for _, test := range []struct {
+		script   string
+		expected string
+		err      string
+	}{
+		{`defer record("a"); missing()`, "a", "missing"},
+		{`defer record("a"); defer record("b"); boom()`, "b a", "boom"},
+		{`defer record("a"); defer boom(); record("b")`, "b a", "boom"},
+		{`(func() { defer record("a"); fail()?; record("b") })()`, "a", "failed"},
+		{`defer (func() { fail()? })(); record("a")`, "a", "failed"},
+	} {
+		calls = nil
+		if _, err := Eval(test.script, env); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("%q: expected error containing %q, got %v", test.script, test.err, err)
+		}
+		if got := strings.Join(calls, " "); got != test.expected {
+			t.Fatalf("%q: expected calls %q, got %q", test.script, test.expected, got)
+		}
+	}
+
+	for _, script := range []string{"defer 1", "defer record"} {
+		if _, err := Eval(script, env); !errors.Is(err, ErrParser) {
+			t.Fatalf("%q: expected parser error, got %v", script, err)
+		}
+	}
+}
+
+func TestEach(t *testing.T) {
+	failing := errors.New("failing")
+	structs := []*TestStruct{{Field1: 1}, {Field1: 2, err: failing}, {Field1: 3}}
+	env := NewStandardEnvironment()
+	env["xs"] = reflect.ValueOf(structs)
+	env["it"] = reflect.ValueOf("outer")
+
+	rv, err := singleEval(`each(xs, "it.SetField1(it.Field1 * 10)")`, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range rv.Interface().([]EachResult) {
+		if result.Index != i || result.Value != nil || result.Err != nil {
+			t.Fatalf("unexpected result %#v", result)
+		}
+		if structs[i].Field1 != (i+1)*10 {
+			t.Fatalf("unexpected value %#v", structs[i])
+		}
+	}
+
+	rv, err = singleEval(`each(xs, "it.TestCall()")`, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := rv.Interface().([]EachResult)
+	if len(results) != 3 || results[0].Value != 1 || results[0].Err != nil ||
+		results[1].Err != failing {
+		t.Fatalf("unexpected results %#v", results)
+	}
+
+	rv, err = singleEval(`each(xs, "it.Field1 + \"a\"")`, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range rv.Interface().([]EachResult) {
+		if !errors.Is(result.Err, ErrTypeMismatch) {
+			t.Fatalf("unexpected result %#v", result)
+		}
+	}
+
+	if env["it"].Interface() != "outer" {
+		t.Fatalf("it was not restored: %#v", env["it"])
+	}
+	if _, err := Eval(`each(1, "it")`, env); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	failing := errors.New("failing")
+	s := &TestStruct{err: failing}
+	calls := 0
+	env := NewStandardEnvironment()
+	env["s"] = reflect.ValueOf(s)
+	env["flaky"] = reflect.ValueOf(func() (string, error) {
+		calls++
+		if calls < 3 {
+			return "", failing
+		}
+		return "done", nil
+	})
+	env["panics"] = reflect.ValueOf(func() { panic("boom") })
+
+	for _, test := range []struct {
+		script   string
+		attempts int
+		value    interface{}
+		err      error
+	}{
+		{"retry(5, 1ms, flaky)", 3, "done", nil},
+		{"retry(3, 1ms, s.TestCall)", 3, 3, failing},
+		{`retry(2, 0, "s.TestCall()")`, 2, 5, failing},
+		{`retry(2, 0, "s.GetField1()")`, 1, 0, nil},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		result := rv.Interface().(RetryResult)
+		if result.Attempts != test.attempts || result.Value != test.value || result.Err != test.err {
+			t.Fatalf("%q: unexpected result %#v", test.script, result)
+		}
+	}
+
+	rv, err := singleEval("retry(2, 0, panics)", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := rv.Interface().(RetryResult); result.Attempts != 2 || result.Err == nil {
+		t.Fatalf("unexpected result %#v", result)
+	}
+
+	for _, script := range []string{"retry(0, 0, flaky)", `retry(1, "a", flaky)`, "retry(1, 0, 1)"} {
+		if _, err := Eval(script, env); err == nil {
+			t.Fatalf("%q: expected error", script)
+		}
+	}
+}
+
+func TestCatch(t *testing.T) {
+	failing := errors.New("failing")
+	env := NewStandardEnvironment()
+	env["flaky"] = reflect.ValueOf(func() (string, error) { return "", failing })
+	env["panics"] = reflect.ValueOf(func() { panic("boom") })
+
+	for _, test := range []struct {
+		script string
+		value  interface{}
+		err    string
+	}{
+		{`catch("1 + 2")`, 3, ""},
+		{"catch(func() { return 7 })", 7, ""},
+		{"catch(flaky)", "", "failing"},
+		{"catch(panics)", nil, "panic: boom"},
+		{`catch("panic(42)")`, nil, "panic: 42"},
+		{`catch(func() { panic("stop"); return 1 })`, nil, "panic: stop"},
+		{`catch("missing.Field")`, nil, "unbound variable"},
+	} {
+		rv, err := Eval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if len(rv) != 2 {
+			t.Fatalf("%q: expected 2 results, got %d", test.script, len(rv))
+		}
+		if value := rv[0].Interface(); value != test.value {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, value, test.value)
+		}
+		switch err, _ := rv[1].Interface().(error); {
+		case test.err == "" && err != nil:
+			t.Fatalf("%q: unexpected error %v", test.script, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Fatalf("%q: got error %v, expected %q", test.script, err, test.err)
+		}
+	}
+
+	rv, err := singleEval(`v, err := catch("panic(1)"); err != nil && v == nil`, env)
+	if err != nil || !rv.Bool() {
+		t.Fatalf("unexpected result %v, %v", rv, err)
+	}
+
+	_, err = Eval(`panic("stop")`, env)
+	var perr *PanicError
+	if !errors.As(err, &perr) || perr.Value != "stop" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for _, script := range []string{"catch()", "catch(1)", "panic()"} {
+		if _, err := Eval(script, env); err == nil {
+			t.Fatalf("%q: expected error", script)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	m := map[int32]string{1: "a", 2: "b"}
+	env := NewStandardEnvironment()
+	env["m"] = reflect.ValueOf(m)
+	env["frozen"] = reflect.ValueOf(map[string]int{"a": 1})
+	env["nilmap"] = reflect.ValueOf(map[string]int(nil))
+	MarkImmutable(env, "frozen")
+	for _, script := range []string{
+		"delete(m, 1)",
+		"delete(m, 3)",
+		`delete(nilmap, "a")`,
+		`std.delete(m, 2)`,
+	} {
+		if _, err := Eval(script, env); err != nil {
+			t.Fatalf("%q: %v", script, err)
+		}
+	}
+	if len(m) != 0 {
+		t.Fatalf("unexpected map %v", m)
+	}
+
+	for script, expected := range map[string]error{
+		`delete(m, "a")`:      ErrTypeMismatch,
+		`delete("m", 1)`:      ErrTypeMismatch,
+		`delete(frozen, "a")`: ErrReadOnly,
+	} {
+		if _, err := Eval(script, env); !errors.Is(err, expected) {
+			t.Fatalf("%q: expected %v, got %v", script, expected, err)
+		}
+	}
+}
+
+func TestKeysValues(t *testing.T) {
+	type key struct {
+		A string
+		B int
+	}
+	env := NewStandardEnvironment()
+	env["m"] = reflect.ValueOf(map[string]int{"b": 2, "c": 3, "a": 1})
+	env["floats"] = reflect.ValueOf(map[float64]bool{2: true, math.NaN(): false, -1: true})
+	env["structs"] = reflect.ValueOf(map[key]int{{"b", 1}: 3, {"a", 2}: 2, {"a", 1}: 1})
+	env["mixed"] = reflect.ValueOf(map[interface{}]int{"x": 1, 2: 2, nil: 0, 1: 3})
+	env["nilmap"] = reflect.ValueOf(map[string]int(nil))
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"keys(m)", []string{"a", "b", "c"}},
+		{"values(m)", []int{1, 2, 3}},
+		{"values(structs)", []int{1, 2, 3}},
+		{"values(mixed)", []int{0, 3, 2, 1}},
+		{"keys(floats)[1:]", []float64{-1, 2}},
+		{"keys(nilmap)", []string{}},
+		{`s := ""; for _, k := range keys(m) { s = s + k }; s`, "abc"},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if !reflect.DeepEqual(rv.Interface(), test.expected) {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+	if rv, err := singleEval("keys(floats)[0]", env); err != nil || !math.IsNaN(rv.Float()) {
+		t.Fatalf("expected NaN first, got %v, %v", rv, err)
+	}
+
+	for _, script := range []string{`keys("m")`, "values(1)", "keys(m, m)"} {
+		if _, err := Eval(script, env); err == nil {
+			t.Fatalf("%q: expected an error", script)
+		}
+	}
+}
+
+func TestSelectRecv(t *testing.T) {
+	a, b := make(chan int, 1), make(chan string, 1)
+	env := NewStandardEnvironment()
+	env["a"] = reflect.ValueOf(a)
+	env["b"] = reflect.ValueOf(b)
+	env["recvOnly"] = reflect.ValueOf((<-chan int)(a))
+
+	b <- "hi"
+	rv, err := Eval("selectrecv(a, b, 1s)", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rv) != 3 || rv[0].Interface() != 1 || rv[1].Interface() != "hi" || rv[2].Interface() != true {
+		t.Fatalf("unexpected results %v", rv)
+	}
+
+	a <- 3
+	rv, err = Eval("selectrecv(recvOnly)", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rv[0].Interface() != 0 || rv[1].Interface() != 3 {
+		t.Fatalf("unexpected results %v", rv)
+	}
+
+	rv, err = Eval("selectrecv(a, b, 1ms)", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rv[0].Interface() != -1 || rv[2].Interface() != false {
+		t.Fatalf("unexpected results %v", rv)
+	}
+
+	close(b)
+	rv, err = Eval("selectrecv(a, b)", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rv[0].Interface() != 1 || rv[1].Interface() != "" || rv[2].Interface() != false {
+		t.Fatalf("unexpected results %v", rv)
+	}
+
+	for _, script := range []string{"selectrecv(1ms)", "selectrecv(a, 1)", "selectrecv(1ms, a)"} {
+		if _, err := Eval(script, env); !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("%q: expected type mismatch, got %v", script, err)
+		}
+	}
+	if _, err := Eval("selectrecv()", env); err == nil {
+		t.Fatal("expected error")
+	}
+	SetReadOnly(env, true)
+	if _, err := Eval("selectrecv(b)", env); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected read-only error, got %v", err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	buf := make([]byte, 4)
+	xs := []int{0, 0}
+	env := NewStandardEnvironment()
+	env["buf"] = reflect.ValueOf(buf)
+	env["xs"] = reflect.ValueOf(xs)
+	env["src"] = reflect.ValueOf([]int{1, 2, 3})
+	env["arr"] = reflect.ValueOf([1]int{9})
+
+	for _, test := range []struct {
+		script   string
+		expected int
+	}{
+		{`copy(buf, "hello")`, 4},
+		{"copy(xs, src)", 2},
+		{"copy(xs, arr)", 1},
+		{"copy(buf[0:0], buf)", 0},
+	} {
+		val, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if val.Interface() != test.expected {
+			t.Fatalf("%q: unexpected value %#v", test.script, val)
+		}
+	}
+	if string(buf) != "hell" || xs[0] != 9 || xs[1] != 2 {
+		t.Fatalf("unexpected values %q, %v", buf, xs)
+	}
+
+	for _, script := range []string{
+		"copy(xs, buf)",
+		`copy(xs, "hi")`,
+		"copy(arr, src)",
+		"copy(xs, 1)",
+	} {
+		if _, err := Eval(script, env); !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("%q: expected type mismatch, got %v", script, err)
+		}
+	}
+}
+
+func TestLayer(t *testing.T) {
+	parent := NewStandardEnvironment()
+	parent["x"] = reflect.ValueOf(1)
+	parent["y"] = reflect.ValueOf(2)
+
+	child := Environment{}
+	child["y"] = reflect.ValueOf(3)
+	child["double"] = LowerFunc(func(args []reflect.Value) ([]reflect.Value, error) {
+		return []reflect.Value{reflect.ValueOf(args[0].Int() * 2)}, nil
+	})
+	DefineBuiltin(child, "triple", LowerFunc(func(args []reflect.Value) ([]reflect.Value, error) {
+		return []reflect.Value{reflect.ValueOf(args[0].Int() * 3)}, nil
+	}))
+
+	env := Layer(parent, child)
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"x", 1},
+		{"y", 3},
+		{"double(5)", int64(10)},
+		{"std.triple(5)", int64(15)},
+		{"std.len(\"abc\")", 3},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if rv.Interface() != test.expected {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+}
+
+func TestLoweredValuesInCopiedEnvironment(t *testing.T) {
+	env := NewStandardEnvironment()
+	copied := Environment{}
+	for name, v := range env {
+		copied[name] = v
+	}
+	for _, script := range []string{`len("ab")`, `std.len("ab")`} {
+		rv, err := singleEval(script, copied)
+		if err != nil {
+			t.Fatalf("%q: %v", script, err)
+		}
+		if rv.Interface() != 2 {
+			t.Fatalf("%q: unexpected %#v", script, rv.Interface())
+		}
+	}
+	if _, err := Eval("x := 3", copied); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := env["x"]; ok {
+		t.Fatal("definition leaked into the original environment")
+	}
+	if rv, err := singleEval("x", copied); err != nil || rv.Interface() != 3 {
+		t.Fatalf("unexpected %v, %v", rv, err)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	resolved := 0
+	pkg := NewNamespace("example.com/pkg", "")
+	pkg.SetLazy(func() []string { return []string{"Lazy"} },
+		func(name string) (reflect.Value, bool, error) {
+			if name != "Lazy" {
+				return reflect.Value{}, false, nil
+			}
+			resolved++
+			return reflect.ValueOf(42), true, nil
+		})
+	pkg.Set("Eager", reflect.ValueOf("eager"))
+	pkg.Nested("sub").Set("Deep", reflect.ValueOf(true))
+	if fmt.Sprint(pkg.Dir()) != "[Eager Lazy sub]" {
+		t.Fatalf("unexpected dir %v", pkg.Dir())
+	}
+
+	env := NewStandardEnvironment()
+	env["pkg"] = reflect.ValueOf(pkg)
+
+	for _, test := range []struct {
+		script   string
+		expected interface{}
+	}{
+		{"pkg.Eager", "eager"},
+		{"pkg.Lazy", 42},
+		{"pkg.Lazy", 42},
+		{"pkg.sub.Deep", true},
+	} {
+		rv, err := singleEval(test.script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", test.script, err)
+		}
+		if rv.Interface() != test.expected {
+			t.Fatalf("%q: got %#v, expected %#v", test.script, rv.Interface(), test.expected)
+		}
+	}
+	if resolved != 1 {
+		t.Fatalf("lazy member resolved %d times", resolved)
+	}
+	if _, err := Eval("pkg.Missing", env); err == nil {
+		t.Fatal("expected error")
+	}
+	if fmt.Sprint(pkg.Dir()) != "[Eager Lazy sub]" {
+		t.Fatalf("unexpected dir %v", pkg.Dir())
+	}
+	if Repr(env["pkg"]) != "{Eager, Lazy, sub}" {
+		t.Fatalf("unexpected repr %q", Repr(env["pkg"]))
+	}
+	if Std(env).MemberDoc("len") == "" {
+		t.Fatal("expected len documentation")
+	}
+}
+
+func TestNames(t *testing.T) {
+	env := Environment{"b": reflect.ValueOf(1), "$hidden": reflect.ValueOf(2)}
+	if names := Names(env); fmt.Sprint(names) != "[b]" {
+		t.Fatalf("unexpected names %v", names)
+	}
+	if _, err := Eval("a := 1; c := 2", env); err != nil {
+		t.Fatal(err)
+	}
+	delete(env, "b")
+	for i := 0; i < 100; i++ {
+		env[fmt.Sprintf("x%03d", i)] = reflect.ValueOf(i)
+	}
+	names := Names(env)
+	if len(names) != 102 || names[0] != "a" || names[1] != "c" || names[2] != "x000" ||
+		!sort.StringsAreSorted(names) {
+		t.Fatalf("unexpected names %v", names)
+	}
+	names[0] = "modified"
+	if Names(env)[0] != "a" {
+		t.Fatal("names were shared with the caller")
+	}
+
+	copied := copyEnv(env)
+	copied["b"] = reflect.ValueOf(3)
+	if Names(copied)[1] != "b" || Names(env)[1] != "c" {
+		t.Fatal("copies share a name index")
+	}
+}
+
+func TestSprintf(t *testing.T) {
+	type secret struct{ n int }
+	env := NewStandardEnvironment()
+	env["d"] = reflect.ValueOf(1500 * time.Millisecond)
+	env["hidden"] = reflect.ValueOf(struct{ s secret }{secret{7}}).Field(0)
+	for script, expected := range map[string]string{
+		`sprintf("%d items", 3)`:             "3 items",
+		`sprintf("%s/%q", "a", "b")`:         `a/"b"`,
+		`sprintf("%v took %T", d, d)`:        "1.5s took time.Duration",
+		`sprintf("%v", nil)`:                 "<nil>",
+		`sprintf("%+v", hidden)`:             "{n:7}",
+		`sprintf("plain")`:                   "plain",
+		`sprintf("%s!", sprintf("%x", 255))`: "ff!",
+	} {
+		rv, err := singleEval(script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", script, err)
+		}
+		if rv.Interface() != expected {
+			t.Fatalf("%q: got %#v, expected %#v", script, rv.Interface(), expected)
+		}
+	}
+	for _, script := range []string{"sprintf()", "sprintf(1)"} {
+		if _, err := Eval(script, env); err == nil {
+			t.Fatalf("%q: expected an error", script)
+		}
+	}
+}
+
+func TestRegex(t *testing.T) {
+	type level string
+	env := NewStandardEnvironment()
+	env["lines"] = reflect.ValueOf([]string{"GET /a 200", "POST /b 500", "GET /c 503"})
+	env["levels"] = reflect.ValueOf([2]level{"warn", "error"})
+	env["status"] = reflect.ValueOf(level("error: timeout"))
+	for script, expected := range map[string]string{
+		`regex("a+b").String()`:                                     "a+b",
+		`match("^err", status)`:                                     "true",
+		`match(regex("5\\d\\d"), "code 200")`:                       "false",
+		`find("[0-9]+", "a1 b22 c333")`:                             "[1 22 333]",
+		`find("x", "abc")`:                                          "[]",
+		`grep(" 5", lines)`:                                         "[POST /b 500 GET /c 503]",
+		`grep(regex("^e"), levels)`:                                 "[error]",
+		`re := regex("/(\\w)"); re.FindStringSubmatch(lines[1])[1]`: "b",
+	} {
+		rv, err := singleEval(script, env)
+		if err != nil {
+			t.Fatalf("%q: %v", script, err)
+		}
+		if got := fmt.Sprint(rv.Interface()); got != expected {
+			t.Fatalf("%q: got %q, expected %q", script, got, expected)
+		}
+	}
+	rv, err := singleEval(`grep("e", levels)`, env)
+	if err != nil || rv.Type() != reflect.TypeOf([]level{}) {
+		t.Fatalf("expected a []level, got %v, %v", rv, err)
+	}
+
+	for script, expected := range map[string]string{
+		`regex("(")`:       "missing closing )",
+		`regex(1)`:         "regex expected a pattern string or regex",
+		`match("a", 1)`:    "match expected a string",
+		`find("a")`:        "usage: find(pattern, s)",
+		`grep("a", "abc")`: "grep expected a slice of strings",
+	} {
+		_, err := Eval(script, env)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%q: expected error containing %q, got %v", script, expected, err)
+		}
+	}
+}
+
+func TestLimit(t *testing.T) {
+	flushes := 0
+	flushCache := reflect.ValueOf(func() { flushes++ })
+	global := NewLimiter(1, time.Hour)
+	newEnv := func() Environment {
+		env := NewStandardEnvironment()
+		env["flushCache"] = Limit(flushCache, global)
+		env["reset"] = Limit(LowerFunc(func(args []reflect.Value) ([]reflect.Value, error) {
+			return nil, nil
+		}), NewLimiter(2, 0))
+		return env
+	}
+	env1, env2 := newEnv(), newEnv()
+	if _, err := Eval("f := flushCache; f()", env1); err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range []Environment{env1, env2} {
+		_, err := Eval("flushCache()", env)
+		if !errors.Is(err, ErrRateLimited) ||
+			!strings.Contains(err.Error(), "flushCache is limited to 1 calls per 1h0m0s, try again in") {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if flushes != 1 {
+		t.Fatalf("expected 1 flush, got %d", flushes)
+	}
+
+	if _, err := Eval("reset(); reset()", env1); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Eval("reset()", env1)
+	if !errors.Is(err, ErrRateLimited) ||
+		!strings.Contains(err.Error(), "reset is limited to 2 calls, which were used up") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := Eval("reset()", env2); err != nil {
+		t.Fatal(err)
+	}
+
+	window := NewLimiter(2, 50*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if ok, _ := window.Allow(); !ok {
+			t.Fatal("expected the limiter to allow the call")
+		}
+	}
+	ok, retryAfter := window.Allow()
+	if ok || retryAfter <= 0 || retryAfter > 50*time.Millisecond {
+		t.Fatalf("unexpected %v, %v", ok, retryAfter)
+	}
+	time.Sleep(retryAfter)
+	if ok, _ := window.Allow(); !ok {
+		t.Fatal("expected the limiter to allow the call after the window")
+	}
+}
+
+func TestBudget(t *testing.T) {
+	env := NewStandardEnvironment()
+	SetBudget(env, 100)
+	if _, err := Eval("n := 0; for i := range 10 { n = n + i }; n", env); err != nil {
+		t.Fatal(err)
+	}
+	if remaining, limited := BudgetRemaining(env); !limited || remaining != 90 {
+		t.Fatalf("unexpected remaining budget %d, %v", remaining, limited)
+	}
+
+	for _, script := range []string{
+		"for { }",
+		"f := func() { return f() }; f()",
+		"for i := range 1000 { len(\"x\") }",
+	} {
+		SetBudget(env, 100)
+		_, err := Eval(script, env)
+		if !errors.Is(err, ErrBudgetExceeded) ||
+			!strings.Contains(err.Error(), "line 1, column ") ||
+			!strings.Contains(err.Error(), "more than its budget of 100 steps") {
+			t.Fatalf("%q: unexpected error %v", script, err)
+		}
+		if remaining, _ := BudgetRemaining(env); remaining != 0 {
+			t.Fatalf("%q: expected no remaining budget, got %d", script, remaining)
+		}
+	}
+
+	scope := NewScope(env)
+	SetBudget(scope, 0)
+	if _, limited := BudgetRemaining(scope); limited {
+		t.Fatal("expected the scope to be unlimited")
+	}
+	if _, err := Eval("for i := range 1000 { }", scope); err != nil {
+		t.Fatal(err)
+	}
+	SetBudget(env, 0)
+	if _, err := Eval("for i := range 1000 { }", env); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocBudget(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["Ints"] = reflect.ValueOf(reflect.TypeOf([]int64{}))
+	env["Counts"] = reflect.ValueOf(reflect.TypeOf(map[string]int64{}))
+	env["bytes"] = reflect.ValueOf(reflect.TypeOf([]byte{}))
+	env["Big"] = reflect.ValueOf(reflect.TypeOf([1 << 20]byte{}))
+	SetAllocBudget(env, 1000)
+	if _, err := Eval(`xs := Ints{1, 2, 3}; s := "ab" + "cd"`, env); err != nil {
+		t.Fatal(err)
+	}
+	if remaining, limited := AllocBudgetRemaining(env); !limited || remaining != 1000-24-24-4 {
+		t.Fatalf("unexpected remaining budget %d, %v", remaining, limited)
+	}
+
+	for script, expected := range map[string]string{
+		"Ints{1000000000: 1}":         "a []int64 of 1000000001 elements needs 8000000008 bytes",
+		`s := "x"; for { s = s + s }`: "a string of 512 bytes needs 512 bytes, but only 490 of",
+		"Big()":                       "a [1048576]uint8 needs 1048576 bytes",
+		`bytes(sprintf("%0600d", 1))`: "converting to []uint8 needs 600 bytes",
+	} {
+		SetAllocBudget(env, 1000)
+		_, err := Eval(script, env)
+		if !errors.Is(err, ErrAllocBudgetExceeded) || !strings.Contains(err.Error(), expected) ||
+			!strings.Contains(err.Error(), "line 1, column ") {
+			t.Fatalf("%q: unexpected error %v", script, err)
+		}
+	}
+
+	SetAllocBudget(env, 50)
+	_, err := Eval(`Counts{"a": 1, "b": 2}`, env)
+	if !errors.Is(err, ErrAllocBudgetExceeded) || !strings.Contains(err.Error(),
+		"a map[string]int64 of 2 entries needs 48 bytes, but only 42 of the budget of 50 remain") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	SetAllocBudget(env, 10)
+	_, err = Eval(`sprintf("%020d", 1)`, env)
+	if !errors.Is(err, ErrAllocBudgetExceeded) || !strings.Contains(err.Error(),
+		"a string of 20 bytes needs 20 bytes, but only 10 of the budget of 10 remain") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	SetAllocBudget(env, 0)
+	if _, limited := AllocBudgetRemaining(env); limited {
+		t.Fatal("expected allocation to be unlimited")
+	}
+	if _, err := Eval("Big()", env); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	imported := ""
+	env := NewStandardEnvironment()
+	env["s"] = reflect.ValueOf(&TestStruct{Field1: 1})
+	env["sprint"] = reflect.ValueOf(fmt.Sprint)
+	env["join"] = reflect.ValueOf(strings.Join)
+	env["now"] = reflect.ValueOf(time.Now)
+	env["$import"] = LowerFunc(func(args []reflect.Value) ([]reflect.Value, error) {
+		imported = args[1].String()
+		return nil, nil
+	})
+	SetPolicy(env, Rules{
+		Allow: []string{"github.com/jtolio/crawlspace/reflectlang.TestStruct", "fmt", "strings", "std"},
+		Deny:  []string{"*.SetField*", "strings.Join", "crypto"},
+	})
+
+	for script, expected := range map[string]string{
+		"s.Field1":                  "1",
+		"s.GetField1()":             "1",
+		"sprint(1)":                 `"1"`,
+		"std.len":                   "",
+		`import "strings"`:          "",
+		"s.SetField1":               "github.com/jtolio/crawlspace/reflectlang.TestStruct.SetField1 is not permitted",
+		`join(nil, "")`:             "strings.Join is not permitted",
+		"now()":                     "time.Now is not permitted",
+		"catch(now)":                "time.Now is not permitted",
+		"retry(2, 0, now)":          "time.Now is not permitted",
+		`import "crypto/rsa"`:       "crypto/rsa is not permitted",
+		`import "os"`:               "os is not permitted",
+		"time(\"2024-01-01\").Unix": "time.Time.Unix is not permitted",
+	} {
+		rv, err := singleEval(script, env)
+		switch {
+		case strings.HasSuffix(expected, "is not permitted"):
+			if !errors.Is(err, ErrDenied) || !strings.HasSuffix(err.Error(), expected) {
+				t.Fatalf("%q: unexpected error %v", script, err)
+			}
+		case err != nil:
+			t.Fatalf("%q: %v", script, err)
+		case expected != "" && Repr(rv) != expected:
+			t.Fatalf("%q: got %s, expected %s", script, Repr(rv), expected)
+		}
+	}
+	if imported != "strings" {
+		t.Fatalf("unexpected import %q", imported)
+	}
+
+	scope := NewScope(env)
+	SetPolicy(scope, nil)
+	if _, err := Eval(`s.SetField2("x")`, scope); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Eval(`s.SetField2("y")`, env); !errors.Is(err, ErrDenied) {
+		t.Fatalf("expected access to be denied, got %v", err)
+	}
+
+	for _, test := range []struct {
+		fn       interface{}
+		expected string
+	}{
+		{strings.Join, "strings.Join"},
+		{(&strings.Builder{}).Len, "strings.Builder.Len"},
+		{time.Time{}.Unix, "time.Time.Unix"},
+	} {
+		if access, ok := funcAccess(reflect.ValueOf(test.fn)); !ok || access.String() != test.expected {
+			t.Fatalf("got %q, expected %q", access, test.expected)
+		}
+	}
+}
+
+func TestPure(t *testing.T) {
+	s := &TestStruct{Field1: 1, Field2: "a"}
+	env := NewStandardEnvironment()
+	env["s"] = reflect.ValueOf(s)
+	env["m"] = reflect.ValueOf(map[string]int{"a": 1})
+	env["sprint"] = reflect.ValueOf(fmt.Sprint)
+	env["upper"] = reflect.ValueOf(strings.ToUpper)
+	env["TestStruct"] = reflect.ValueOf(reflect.TypeOf(TestStruct{}))
+	SetReadOnly(env, true)
+	SetPure(env, Rules{Allow: []string{"*.Get*", "strings"}})
+
+	for script, expected := range map[string]string{
+		"s.GetField1()":           "1",
+		"s?.GetField2()":          `"a"`,
+		`upper(s.GetField2())`:    `"A"`,
+		"x := 1; x = x + 1; x":    "2",
+		"p := &TestStruct{}; p":   "",
+		"p := &(TestStruct{}); p": "",
+		"s.SetField1(2)":          "cannot call",
+		`sprint(1)`:               "cannot call",
+		"f := s.GetField1; f()":   "cannot call",
+		"s.Field1 = 2":            "cannot assign",
+		`m["a"] = 2`:              "cannot assign",
+		`delete(m, "a")`:          "read-only",
+		"x := s.Field1; &x":       "cannot take the address of x",
+		"&s.Field1":               "cannot take the address of s.Field1",
+	} {
+		rv, err := singleEval(script, env)
+		switch {
+		case strings.HasPrefix(expected, "cannot") || expected == "read-only":
+			if !errors.Is(err, ErrReadOnly) || !strings.Contains(err.Error(), expected) {
+				t.Fatalf("%q: unexpected error %v", script, err)
+			}
+		case err != nil:
+			t.Fatalf("%q: %v", script, err)
+		case expected != "" && Repr(rv) != expected:
+			t.Fatalf("%q: got %s, expected %s", script, Repr(rv), expected)
+		}
+	}
+	if s.Field1 != 1 {
+		t.Fatalf("read-only evaluation changed s: %+v", s)
+	}
+
+	scope := NewScope(env)
+	SetPure(scope, nil)
+	if _, err := Eval("s.GetField1()", scope); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected read-only error, got %v", err)
+	}
+}
+
+func TestStack(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["s"] = reflect.ValueOf(&TestStruct{Field1: 1})
+	env["sprint"] = reflect.ValueOf(fmt.Sprint)
+	env["boom"] = reflect.ValueOf(func() int { panic("boom") })
+	env["apply"] = reflect.ValueOf(func(f func(int) int) int { return f(1) })
+
+	for _, test := range []struct {
+		script   string
+		expected []string
+	}{
+		{"get := func(x) { return x.Missing }; sprint(get(1))",
+			[]string{"line 1, column 26: x.Missing", "line 1, column 48: get(1)",
+				"line 1, column 44: sprint(get(1))"}},
+		{"1 + sprint(boom())", []string{"line 1, column 16: boom()", "line 1, column 11: sprint(boom())"}},
+		{"apply(func(x) { return x.Bad })",
+			[]string{"line 1, column 25: x.Bad", "line 1, column 6: apply(func(x) { return x.Bad })"}},
+		{"sprint(s.GetField1(), missing)", []string{"line 1, column 7: sprint(s.GetField1(), missing)"}},
+		{"s.Field1.Deeper", []string{"line 1, column 9: s.Field1.Deeper"}},
+	} {
+		_, err := Eval(test.script, env)
+		if err == nil {
+			t.Fatalf("%q: expected error", test.script)
+		}
+		var frames []string
+		for _, frame := range Stack(err) {
+			frames = append(frames, frame.String())
+		}
+		if !reflect.DeepEqual(frames, test.expected) {
+			t.Fatalf("%q: unexpected stack %q", test.script, frames)
+		}
+	}
+
+	_, err := Eval("sprint(boom())", env)
+	var perr *PanicError
+	if !errors.As(err, &perr) || perr.Value != "boom" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := "panic: boom\n\tat line 1, column 12: boom()\n\tat line 1, column 7: sprint(boom())"
+	if got := fmt.Sprintf("%+v", err); got != expected {
+		t.Fatalf("got %q, expected %q", got, expected)
+	}
+	if got := fmt.Sprint(err); got != "panic: boom" {
+		t.Fatalf("unexpected message %q", got)
+	}
+
+	rv, err := singleEval("f := func(n) { return if n == 0 then 0 else f(n - 1) }; f(3)", env)
+	if err != nil || rv.Interface() != 0 {
+		t.Fatalf("unexpected result %v, %v", rv, err)
+	}
+	long := "sprint(" + strings.Repeat("1, ", 30) + "missing)"
+	if frames := Stack(func() error { _, err := Eval(long, env); return err }()); len(frames) != 1 ||
+		len(frames[0].Expr) != maxFrameExpr || !strings.HasSuffix(frames[0].Expr, "...") {
+		t.Fatalf("unexpected stack %v", frames)
+	}
+}
+
+func TestLangError(t *testing.T) {
+	errBoom := errors.New("boom")
+	env := NewStandardEnvironment()
+	env["fail"] = reflect.ValueOf(func() (int, error) { return 0, errBoom })
+	env["x"] = reflect.ValueOf(int32(1))
+
+	for _, test := range []struct {
+		script    string
+		kind      error
+		line, col int
+		msg       string
+	}{
+		{"1 +", ErrParser, 1, 3, `unparsed input: "+"`},
+		{"y := \"a\";\n  y.Len", ErrTypeMismatch, 2, 4, `tried to access field "Len" on value "a", string`},
+		{`1 + (x + "a")`, ErrTypeMismatch, 1, 8, `cannot use "a" (untyped constant) as int32`},
+		{"fail()?", nil, 1, 7, "boom"},
+	} {
+		_, err := Eval(test.script, env)
+		var lerr *LangError
+		if !errors.As(err, &lerr) {
+			t.Fatalf("%q: unexpected error %v", test.script, err)
+		}
+		if lerr.Kind != test.kind || lerr.Line != test.line || lerr.Col != test.col || lerr.Msg != test.msg {
+			t.Fatalf("%q: unexpected error %#v", test.script, lerr)
+		}
+		if test.kind != nil && !errors.Is(err, test.kind) {
+			t.Fatalf("%q: error doesn't match %v", test.script, test.kind)
+		}
+	}
+
+	for script, expected := range map[string]string{
+		"fail()?": "line 1, column 7: boom",
+		// errors about other errors are laid out like the rest.
+		"1 / 0":      "runtime error: line 1, column 3: integer divide by zero",
+		`"ab"[1:10]`: "runtime error: line 1, column 5: slice bounds out of range [1:10] with length 2",
+		`x + "a"`:    `type mismatch: line 1, column 3: cannot use "a" (untyped constant) as int32`,
+		"1 +":        `parser error: line 1, column 3: unparsed input: "+"`,
+	} {
+		_, err := Eval(script, env)
+		if err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Fatalf("%q: unexpected error %v", script, err)
+		}
+	}
+	if _, err := Eval("fail()?", env); !errors.Is(err, errBoom) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestCompleteAt(t *testing.T) {
+	env := NewStandardEnvironment()
+	env["s"] = reflect.ValueOf(&TestStruct{})
+	env["structs"] = reflect.ValueOf([]TestStruct{})
+	env["sprint"] = reflect.ValueOf(fmt.Sprint)
+	env["if"] = reflect.ValueOf(1)
+	ns := NewNamespace("tools", "")
+	ns.Set("Stat", reflect.ValueOf(1))
+	ns.Set("Stop", reflect.ValueOf(2))
+	env["tools"] = reflect.ValueOf(ns)
+
+	for _, test := range []struct {
+		source     string
+		candidates []string
+		start      int
+	}{
+		{"s.Get", []string{"GetField1", "GetField2"}, 2},
+		{"s.", []string{"Field1", "Field2", "GetField1", "GetField2", "SetField1", "SetField2", "TestCall"}, 2},
+		{"sprint(s.Field", []string{"Field1", "Field2"}, 9},
+		{"for _, x := range structs { x.Te", []string{"TestCall"}, 30},
+		{"tools.St", []string{"Stat", "Stop"}, 6},
+		{"tools?.Sto", []string{"Stop"}, 7},
+		{"total := 1; to", []string{"tools", "total"}, 12},
+		{"f := func(param) { return par", []string{"param"}, 26},
+		{"spr", []string{"sprint", "sprintf"}, 0},
+		{"@i", []string{"@if"}, 0},
+		{"s.Field1.", nil, 9},
+		{"missing.F", nil, 8},
+		{`sprint("s`, nil, 9},
+		{"x // s", nil, 6},
+		{"if x then s.GetField1", []string{"GetField1"}, 12},
+	} {
+		candidates, start := CompleteAt(test.source, len([]rune(test.source)), env)
+		if !reflect.DeepEqual(candidates, test.candidates) || start != test.start {
+			t.Fatalf("%q: got %q at %d, expected %q at %d", test.source, candidates, start,
+				test.candidates, test.start)
+		}
+	}
+
+	if candidates, start := CompleteAt("s.GetF + 1", 6, env); len(candidates) != 2 || start != 2 {
+		t.Fatalf("unexpected completion %q at %d", candidates, start)
+	}
+}
+
+func TestIncomplete(t *testing.T) {
+	for _, script := range []string{
+		"f(1, 2",
+		"xs[1",
+		"for x := range xs { x",
+		"p := Point{X: 1,",
+		"f(func(x) { return x",
+		`x := "abc`,
+		`"abc\`,
+		"f(1, // more",
+	} {
+		_, err := Parse(script)
+		if !errors.Is(err, ErrIncomplete) || !errors.Is(err, ErrParser) {
+			t.Fatalf("%q: expected incomplete input, got %v", script, err)
+		}
+	}
+	for _, script := range []string{
+		"f(1 2",
+		"1 +",
+		"f(1))",
+		"f(1))(",
+		"\"abc\n\"",
+		"x $ (",
+	} {
+		_, err := Parse(script)
+		if errors.Is(err, ErrIncomplete) || !errors.Is(err, ErrParser) {
+			t.Fatalf("%q: expected a parser error, got %v", script, err)
+		}
+	}
+}
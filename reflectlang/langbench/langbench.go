@@ -0,0 +1,106 @@
+// Package langbench benchmarks parsing and evaluating reflectlang
+// expressions. It has a standard set of representative cases, and can run
+// embedders' own cases against their own environments.
+package langbench
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+// Case is an expression to benchmark.
+type Case struct {
+	Name       string
+	Expression string
+}
+
+// ChainDepth is how many links the chain bound by Env has.
+const ChainDepth = 32
+
+// Link is a link in the chain bound by Env.
+type Link struct {
+	Next  *Link
+	Value int
+}
+
+// Get returns the link's value.
+func (l *Link) Get() int { return l.Value }
+
+// Env returns a standard environment extended with the values the standard
+// cases use.
+func Env() reflectlang.Environment {
+	env := reflectlang.NewStandardEnvironment()
+	var chain *Link
+	for i := ChainDepth; i > 0; i-- {
+		chain = &Link{Next: chain, Value: i}
+	}
+	xs := make([]int, 100)
+	for i := range xs {
+		xs[i] = i
+	}
+	env["chain"] = reflect.ValueOf(chain)
+	env["xs"] = reflect.ValueOf(xs)
+	env["m"] = reflect.ValueOf(map[string]int{"key": 1})
+	env["x"] = reflect.ValueOf(42)
+	env["sum16"] = reflect.ValueOf(func(a, b, c, d, e, f, g, h,
+		i, j, k, l, m, n, o, p int) int {
+		return a + b + c + d + e + f + g + h + i + j + k + l + m + n + o + p
+	})
+	return env
+}
+
+// Cases are the standard cases, which run against Env.
+var Cases = []Case{
+	{"literal", "1"},
+	{"arithmetic", "1 + 2*3 - x/4 + (x&^3)<<1"},
+	{"comparison", "x > 10 and x < 100 or not (x == 0)"},
+	{"string", `"hello, " + "world"`},
+	{"index", `xs[50] + m["key"]`},
+	{"slice", "xs[10:20]"},
+	{"method", "chain.Get()"},
+	{"selectors", "chain" + strings.Repeat(".Next", ChainDepth-1) + ".Value"},
+	{"call16", "sum16(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16)"},
+	{"assignment", "y := x; y = y + 1"},
+	{"loop", "n := 0; for _, v := range xs { n = n + v }"},
+	{"long", strings.TrimSuffix(strings.Repeat("x + 1 - ", 100), " - ")},
+}
+
+// Run benchmarks each case against env as sub-benchmarks. For each case,
+// parse/<name> measures parsing, and eval/<name> measures parsing and
+// evaluating, as sessions do. It fails if a case doesn't evaluate.
+func Run(b *testing.B, env reflectlang.Environment, cases []Case) {
+	for _, c := range cases {
+		if _, err := reflectlang.Eval(c.Expression, env); err != nil {
+			b.Fatalf("%s: %v", c.Name, err)
+		}
+	}
+	b.Run("parse", func(b *testing.B) {
+		for _, c := range cases {
+			c := c
+			b.Run(c.Name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := reflectlang.Parse(c.Expression); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	})
+	b.Run("eval", func(b *testing.B) {
+		for _, c := range cases {
+			c := c
+			b.Run(c.Name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := reflectlang.Eval(c.Expression, env); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	})
+}
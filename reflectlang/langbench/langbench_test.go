@@ -0,0 +1,20 @@
+package langbench
+
+import (
+	"testing"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+func TestCases(t *testing.T) {
+	env := Env()
+	for _, c := range Cases {
+		if _, err := reflectlang.Eval(c.Expression, env); err != nil {
+			t.Fatalf("%s: %v", c.Name, err)
+		}
+	}
+}
+
+func BenchmarkStandard(b *testing.B) {
+	Run(b, Env(), Cases)
+}
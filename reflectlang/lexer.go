@@ -0,0 +1,455 @@
+package reflectlang
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// tokenKind classifies tokens.
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenKeyword
+	tokenNumber
+	tokenDuration
+	tokenString
+	tokenOperator
+	// tokenComment and tokenInvalid, comments and text that can't be
+	// tokenized, are only tokens for Tokenize.
+	tokenComment
+	tokenInvalid
+)
+
+// token is a lexical token of the source.
+type token struct {
+	kind tokenKind
+	// text is the token's source text, except for identifiers quoted with @,
+	// where it is the name without the @, and strings, where it is the
+	// string's decoded value.
+	text string
+	// pos is where the token starts, and end is just past where it ends.
+	pos, end position
+	// comments are the comments between the previous token and this one.
+	comments []string
+}
+
+// is returns true if the token is an operator or keyword with the given
+// text.
+func (t token) is(text string) bool {
+	return (t.kind == tokenOperator || t.kind == tokenKeyword) && t.text == text
+}
+
+func (t token) span() span {
+	return span{pos: t.pos, start: t.pos, end: t.end}
+}
+
+// String describes the token for error messages.
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "eof"
+	case tokenString:
+		return fmt.Sprintf("string %q", t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// operators are all the operator and punctuation tokens, longest first, so
+// that the token at a position is the longest that matches. This way, e.g.,
+// & does not match the start of && or &^.
+var operators = []string{
+	"...",
+	"&&", "||", "&^", "<<", ">>", "<=", ">=", "==", "!=", "~=", "<>", ":=", "?.",
+	"*", "/", "&", "+", "-", "|", "^", "<", ">", "!",
+	"(", ")", "[", "]", "{", "}", ",", ".", ":", ";", "=", "?",
+}
+
+func charRepr(c rune) string {
+	if c == -1 {
+		return "eof"
+	}
+	return fmt.Sprintf("%q", string(c))
+}
+
+// Identifiers follow Go's rules: a letter or underscore followed by letters,
+// underscores, and digits, where letters and digits are as defined by
+// unicode.IsLetter and unicode.IsDigit.
+func isIdentifierChar(c rune) bool {
+	return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+// IsIdentifier returns true if v is lexically an identifier. Keywords are
+// identifiers, though they must be quoted with @ to be used as names.
+func IsIdentifier(v string) bool {
+	chars := []rune(v)
+	if len(chars) == 0 {
+		return false
+	}
+	if unicode.IsDigit(chars[0]) {
+		return false
+	}
+	for _, c := range chars {
+		if !isIdentifierChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// keywords are reserved for current and future syntax. Go's keywords are all
+// reserved, along with a few of the language's own.
+var keywords = map[string]bool{
+	"break": true, "case": true, "chan": true, "const": true,
+	"continue": true, "default": true, "defer": true, "else": true,
+	"fallthrough": true, "for": true, "func": true, "go": true, "goto": true,
+	"if": true, "import": true, "interface": true, "map": true,
+	"package": true, "range": true, "return": true, "select": true,
+	"struct": true, "switch": true, "type": true, "var": true,
+
+	"and": true, "not": true, "or": true, "then": true,
+}
+
+// IsKeyword returns true if v is a reserved keyword. A variable or field
+// named after a keyword can be referred to by quoting it with @, as in @if.
+func IsKeyword(v string) bool {
+	return keywords[v]
+}
+
+func isUniquelyFloatingPointChar(c rune) bool {
+	switch c {
+	case '.', '+', '-', 'p', 'P': // floating point
+		return true
+	}
+	return false
+}
+
+func isNumberChar(c rune) bool {
+	if unicode.IsDigit(c) {
+		return true
+	}
+	if isUniquelyFloatingPointChar(c) {
+		return true
+	}
+	switch c {
+	case 'b', 'B': // binary
+		return true
+	case 'o', 'O': // octal
+		return true
+	case 'x', 'X', 'a', 'A', 'c', 'C', 'd', 'D', 'e', 'E', 'f', 'F': // hex
+		return true
+	case '_': // separators
+		return true
+	}
+	return false
+}
+
+// signAllowed returns true if a sign may follow the number literal prefix
+// num, which is only the case directly after an exponent marker.
+func signAllowed(num string) bool {
+	if num == "" {
+		return false
+	}
+	hex := strings.HasPrefix(strings.ToLower(num), "0x")
+	switch num[len(num)-1] {
+	case 'p', 'P':
+		return hex
+	case 'e', 'E':
+		return !hex
+	}
+	return false
+}
+
+func stringContains(val string, matcher func(rune) bool) bool {
+	for _, c := range val {
+		if matcher(c) {
+			return true
+		}
+	}
+	return false
+}
+
+type lexer struct {
+	source []rune
+	position
+}
+
+func newLexer(source string) *lexer {
+	return &lexer{
+		source:   []rune(source),
+		position: position{offset: 0, line: 1, col: 1},
+	}
+}
+
+// tokenize splits source into tokens, ending with a tokenEOF token. Text
+// that can't be tokenized is skipped, and the errors are returned along
+// with the tokens.
+func tokenize(source string) (tokens []token, errs []error) {
+	return newLexer(source).tokens(false)
+}
+
+// tokens lexes the rest of the source into tokens, ending with a tokenEOF
+// token, and returns them along with the errors. Normally, comments are
+// attached to the following token, and text that can't be tokenized is
+// skipped. If all is true, they are instead tokens of their own, of kinds
+// tokenComment and tokenInvalid.
+func (l *lexer) tokens(all bool) (tokens []token, errs []error) {
+	for {
+		comments := l.skipWhitespace()
+		if all {
+			tokens = append(tokens, comments...)
+		}
+		start := l.position
+		tok, err := l.next()
+		if err != nil {
+			errs = append(errs, err)
+			if tok.kind != tokenString {
+				if l.offset == start.offset {
+					l.advance(1)
+				}
+				if all {
+					tokens = append(tokens, token{kind: tokenInvalid,
+						text: string(l.source[start.offset:l.offset]), pos: start, end: l.position})
+				}
+				continue
+			}
+		}
+		if !all {
+			for _, comment := range comments {
+				tok.comments = append(tok.comments, comment.text)
+			}
+		}
+		tokens = append(tokens, tok)
+		if tok.kind == tokenEOF {
+			return tokens, errs
+		}
+	}
+}
+
+func (l *lexer) char(lookahead int) rune {
+	if l.offset+lookahead >= len(l.source) || l.offset+lookahead < 0 {
+		return -1
+	}
+	return l.source[l.offset+lookahead]
+}
+
+func (l *lexer) string(width int) string {
+	remaining := l.source[l.offset:]
+	if len(remaining) < width {
+		width = len(remaining)
+	}
+	return string(remaining[:width])
+}
+
+func (l *lexer) advance(distance int) {
+	for i := 0; i < distance && l.offset < len(l.source); i++ {
+		if l.source[l.offset] == '\n' {
+			l.line++
+			l.col = 1
+		} else {
+			l.col++
+		}
+		l.offset++
+	}
+}
+
+func (l *lexer) sourceError(messagef string, args ...interface{}) error {
+	return l.position.Err(ErrParser, messagef, args...)
+}
+
+// skipWhitespace skips whitespace and comments, returning the comments, as
+// tokens of kind tokenComment.
+func (l *lexer) skipWhitespace() (comments []token) {
+	for {
+		switch l.char(0) {
+		case ' ', '\t', '\r', '\n':
+			l.advance(1)
+			continue
+		}
+		commentEnd := ""
+		switch l.string(2) {
+		case "//":
+			commentEnd = "\n"
+		case "/*":
+			commentEnd = "*/"
+		default:
+			return comments
+		}
+		start := l.position
+		l.advance(2)
+		for l.offset < len(l.source) && l.string(len(commentEnd)) != commentEnd {
+			l.advance(1)
+		}
+		if commentEnd == "*/" {
+			l.advance(len(commentEnd))
+		}
+		comments = append(comments, token{kind: tokenComment,
+			text: string(l.source[start.offset:l.offset]), pos: start, end: l.position})
+	}
+}
+
+func (l *lexer) next() (token, error) {
+	tok := token{pos: l.position}
+	c := l.char(0)
+	switch {
+	case c == -1:
+		tok.kind = tokenEOF
+	case c == '"':
+		// strings with errors are still tokens, for error recovery.
+		text, err := l.lexString()
+		tok.kind, tok.text, tok.end = tokenString, text, l.position
+		if err != nil {
+			return tok, err
+		}
+	case unicode.IsDigit(c):
+		tok.kind, tok.text = l.lexNumber()
+	case c == '@':
+		l.advance(1)
+		if unicode.IsDigit(l.char(0)) || !isIdentifierChar(l.char(0)) {
+			return tok, l.sourceError("expected a name after @")
+		}
+		tok.kind, tok.text = tokenIdent, l.lexIdentifier()
+	case isIdentifierChar(c):
+		tok.kind, tok.text = tokenIdent, l.lexIdentifier()
+		if keywords[tok.text] {
+			tok.kind = tokenKeyword
+		}
+	default:
+		for _, op := range operators {
+			if op == "?." && l.string(4) == "?..." {
+				// f()?... spreads the results of f()?.
+				continue
+			}
+			if l.string(len(op)) == op {
+				tok.kind, tok.text = tokenOperator, op
+				l.advance(len(op))
+				break
+			}
+		}
+		if tok.kind != tokenOperator {
+			return tok, l.sourceError("unexpected character %s", charRepr(c))
+		}
+	}
+	tok.end = l.position
+	return tok, nil
+}
+
+func (l *lexer) lexIdentifier() string {
+	start := l.offset
+	for isIdentifierChar(l.char(0)) {
+		l.advance(1)
+	}
+	return string(l.source[start:l.offset])
+}
+
+func (l *lexer) lexNumber() (tokenKind, string) {
+	var num strings.Builder
+	for isNumberChar(l.char(0)) &&
+		(l.char(0) != '+' && l.char(0) != '-' || signAllowed(num.String())) {
+		num.WriteRune(l.char(0))
+		l.advance(1)
+	}
+	for _, suffix := range durationSuffixes {
+		if l.string(len([]rune(suffix))) == suffix {
+			l.advance(len([]rune(suffix)))
+			return tokenDuration, num.String() + suffix
+		}
+	}
+	if l.char(0) == 'u' {
+		l.advance(1)
+		num.WriteRune('u')
+	}
+	return tokenNumber, num.String()
+}
+
+// simpleEscapes maps single character escape codes in strings to what they
+// stand for.
+var simpleEscapes = map[rune]rune{
+	'\\': '\\', '"': '"', 'n': '\n', 't': '\t', 'r': '\r',
+	'a': '\a', 'b': '\b', 'f': '\f', 'v': '\v',
+}
+
+// lexString lexes a double quoted string. Escapes are as in Go, except
+// that octal escapes may have one to three digits, so \0 is a NUL byte.
+// \xNN and octal escapes are bytes, and \uNNNN and \UNNNNNNNN are code
+// points, encoded as UTF-8.
+func (l *lexer) lexString() (_ string, err error) {
+	l.advance(1)
+	var val []byte
+	// fail records the first error, but keeps going to the end of the
+	// string, so that tokenizing can continue after it.
+	fail := func(messagef string, args ...interface{}) {
+		if err == nil {
+			err = l.sourceError(messagef, args...)
+		}
+	}
+	for {
+		r := l.char(0)
+		switch r {
+		case -1:
+			return string(val), l.position.Err(ErrIncomplete, "unterminated string")
+		case '\n':
+			return string(val), l.sourceError("unterminated string")
+		case '"':
+			l.advance(1)
+			return string(val), err
+		case '\\':
+			l.advance(1)
+			r = l.char(0)
+			if escaped, ok := simpleEscapes[r]; ok {
+				val = append(val, string(escaped)...)
+				break
+			}
+			switch r {
+			case 'x', 'u', 'U':
+				digits := map[rune]int{'x': 2, 'u': 4, 'U': 8}[r]
+				l.advance(1)
+				code, ok := l.escapeDigits(digits, 16)
+				switch {
+				case !ok:
+					fail("\\%c escape expects %d hex digits", r, digits)
+				case r == 'x':
+					val = append(val, byte(code))
+				case code > unicode.MaxRune || code >= 0xd800 && code < 0xe000:
+					fail("escape is an invalid code point: %#x", code)
+				default:
+					val = append(val, string(rune(code))...)
+				}
+				continue
+			case '0', '1', '2', '3', '4', '5', '6', '7':
+				code, _ := l.escapeDigits(3, 8)
+				if code > 0xff {
+					fail("octal escape is more than a byte: %#o", code)
+				}
+				val = append(val, byte(code))
+				continue
+			case -1:
+				return string(val), l.position.Err(ErrIncomplete, "unterminated string")
+			case '\n':
+				return string(val), l.sourceError("unterminated string")
+			default:
+				fail("unexpected escape code: %s", charRepr(r))
+			}
+		default:
+			val = append(val, string(r)...)
+		}
+		l.advance(1)
+	}
+}
+
+// escapeDigits consumes up to max digits in base of a numeric escape's
+// code. ok is false if there were fewer.
+func (l *lexer) escapeDigits(max int, base int) (code int, ok bool) {
+	n := 0
+	for ; n < max; n++ {
+		digit := strings.IndexRune("0123456789abcdef"[:base], unicode.ToLower(l.char(0)))
+		if digit < 0 {
+			break
+		}
+		code = code*base + digit
+		l.advance(1)
+	}
+	return code, n == max
+}
@@ -0,0 +1,210 @@
+package reflectlang
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limiter limits how many times something may happen in a sliding window of
+// time, or at all. It is safe for concurrent use, so one Limiter can be
+// shared by the environments of every session, for a global limit, or made
+// for each environment, for a per-session limit.
+type Limiter struct {
+	n   int
+	per time.Duration
+
+	mtx sync.Mutex
+	// times are when the most recent events happened, oldest first, and
+	// count is how many happened at all.
+	times []time.Time
+	count int
+}
+
+// NewLimiter returns a Limiter that allows n events per the given duration.
+// If per is zero, it allows n events at all, as a quota.
+func NewLimiter(n int, per time.Duration) *Limiter {
+	return &Limiter{n: n, per: per}
+}
+
+// Allow records an event and returns true if the limit allows it. If it
+// doesn't, the event isn't recorded, and retryAfter is how long until the
+// limit would allow it, or zero if it never will.
+func (l *Limiter) Allow() (ok bool, retryAfter time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.per <= 0 {
+		if l.count >= l.n {
+			return false, 0
+		}
+		l.count++
+		return true, 0
+	}
+	now := time.Now()
+	for len(l.times) > 0 && now.Sub(l.times[0]) >= l.per {
+		l.times = l.times[1:]
+	}
+	if len(l.times) >= l.n {
+		if l.n <= 0 {
+			return false, 0
+		}
+		return false, l.times[0].Add(l.per).Sub(now)
+	}
+	l.times = append(l.times, now)
+	return true, 0
+}
+
+func (l *Limiter) String() string {
+	if l.per <= 0 {
+		return fmt.Sprintf("%d calls", l.n)
+	}
+	return fmt.Sprintf("%d calls per %v", l.n, l.per)
+}
+
+// limitedFunc is a function whose calls are limited, as returned by Limit.
+type limitedFunc struct {
+	fn      reflect.Value
+	limiter *Limiter
+}
+
+// Limit returns fn, a function or Callable, limited by l, for binding in an
+// environment. Calls the limit doesn't allow fail with ErrRateLimited,
+// without calling fn. Since only calls made by the evaluator are limited,
+// the result can't be passed to Go code as a function.
+func Limit(fn reflect.Value, l *Limiter) reflect.Value {
+	return reflect.ValueOf(&limitedFunc{fn: fn, limiter: l})
+}
+
+func (f *limitedFunc) GoString() string {
+	return fmt.Sprintf("%s (limited to %s)", Repr(f.fn), f.limiter)
+}
+
+func asLimitedFunc(v reflect.Value) (*limitedFunc, bool) {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil, false
+	}
+	f, ok := v.Interface().(*limitedFunc)
+	return f, ok
+}
+
+// budget is how much of something evaluation may use, as set by SetBudget
+// or SetAllocBudget.
+type budget struct {
+	total int64
+	// remaining is updated atomically, since goroutines started with go
+	// share their environment's budgets.
+	remaining int64
+}
+
+// take uses up n of the budget, if that much remains.
+func (b *budget) take(n int64) bool {
+	if atomic.AddInt64(&b.remaining, -n) >= 0 {
+		return true
+	}
+	atomic.AddInt64(&b.remaining, n)
+	return false
+}
+
+// setBudget binds a budget of total to key in env, or, if total isn't
+// positive, makes env unlimited.
+func setBudget(env Environment, key string, total int64) {
+	if total > 0 {
+		env[key] = reflect.ValueOf(&budget{total: total, remaining: total})
+		return
+	}
+	delete(env, key)
+	if budgetOf(env, key) != nil {
+		env[key] = reflect.ValueOf((*budget)(nil))
+	}
+}
+
+// budgetOf returns the budget bound to key in env, or nil if it is
+// unlimited.
+func budgetOf(env Environment, key string) *budget {
+	v, ok := Lookup(env, key)
+	if !ok || !v.IsValid() || !v.CanInterface() {
+		return nil
+	}
+	b, _ := v.Interface().(*budget)
+	return b
+}
+
+// remainingOf returns what remains of the budget bound to key in env, and
+// whether it is limited at all.
+func remainingOf(env Environment, key string) (remaining int64, limited bool) {
+	b := budgetOf(env, key)
+	if b == nil {
+		return 0, false
+	}
+	return atomic.LoadInt64(&b.remaining), true
+}
+
+// SetBudget limits evaluation in env, and in the scopes in it, to steps
+// steps, where each iteration of a loop and each call is a step. Once the
+// steps are used up, evaluation fails with ErrBudgetExceeded at the loop or
+// call that would have taken another, so that a command can't run forever.
+// Setting a budget again replaces the old one, such as for each command. If
+// steps isn't positive, evaluation in env is unlimited.
+func SetBudget(env Environment, steps int64) {
+	setBudget(env, "$budget", steps)
+}
+
+// BudgetRemaining returns how many more steps evaluation in env may take,
+// and whether it is limited at all. Scopes share the budget of their
+// parents, unless set otherwise.
+func BudgetRemaining(env Environment) (steps int64, limited bool) {
+	return remainingOf(env, "$budget")
+}
+
+// step takes a step of env's budget, if it has one, failing at s if there
+// are none left.
+func (s span) step(env Environment) error {
+	b := budgetOf(env, "$budget")
+	if b == nil || b.take(1) {
+		return nil
+	}
+	return s.Err(ErrBudgetExceeded, "evaluation took more than its budget of %d steps", b.total)
+}
+
+// SetAllocBudget limits how many bytes evaluation in env, and in the scopes
+// in it, may allocate for the values it builds: composite literals, zero
+// values, strings built by concatenation, conversions between strings and
+// slices, and the results of builtins such as keys and sprintf. An
+// allocation that would exceed what remains fails with
+// ErrAllocBudgetExceeded before it is made, so that a careless command
+// can't balloon the process's heap. Memory allocated by Go functions that
+// are called isn't counted. Setting a budget again replaces the old one,
+// such as for each command. If bytes isn't positive, allocation in env is
+// unlimited.
+func SetAllocBudget(env Environment, bytes int64) {
+	setBudget(env, "$allocbudget", bytes)
+}
+
+// AllocBudgetRemaining returns how many more bytes evaluation in env may
+// allocate, and whether it is limited at all. Scopes share the budget of
+// their parents, unless set otherwise.
+func AllocBudgetRemaining(env Environment) (bytes int64, limited bool) {
+	return remainingOf(env, "$allocbudget")
+}
+
+// allocate takes bytes for allocating what, such as "a []int of 10
+// elements", from env's allocation budget, if it has one.
+func allocate(env Environment, bytes int64, what string, args ...interface{}) error {
+	b := budgetOf(env, "$allocbudget")
+	if b == nil || b.take(bytes) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s needs %d bytes, but only %d of the budget of %d remain",
+		ErrAllocBudgetExceeded, fmt.Sprintf(what, args...), bytes,
+		atomic.LoadInt64(&b.remaining), b.total)
+}
+
+// alloc is like allocate, but fails at s.
+func (s span) alloc(env Environment, bytes int64, what string, args ...interface{}) error {
+	if err := allocate(env, bytes, what, args...); err != nil {
+		return s.wrap(err)
+	}
+	return nil
+}
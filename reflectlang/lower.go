@@ -0,0 +1,65 @@
+package reflectlang
+
+import (
+	"reflect"
+)
+
+// Callable is implemented by values that handle being called by the
+// evaluator themselves, instead of being called with reflect.Value.Call.
+// CallLowered receives the environment the call is evaluated in, and the
+// arguments as reflect.Values, which may have any type or be invalid (nil).
+type Callable interface {
+	CallLowered(env Environment, args []reflect.Value) ([]reflect.Value, error)
+}
+
+// FieldResolver is implemented by values that handle field access by the
+// evaluator themselves.
+type FieldResolver interface {
+	LowerField(env Environment, name string) ([]reflect.Value, error)
+}
+
+func asCallable(v reflect.Value) (Callable, bool) {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil, false
+	}
+	c, ok := v.Interface().(Callable)
+	return c, ok
+}
+
+func asFieldResolver(v reflect.Value) (FieldResolver, bool) {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil, false
+	}
+	r, ok := v.Interface().(FieldResolver)
+	return r, ok
+}
+
+type lowerFunc struct {
+	fn func(env Environment, args []reflect.Value) ([]reflect.Value, error)
+}
+
+func (lf lowerFunc) CallLowered(env Environment, args []reflect.Value) ([]reflect.Value, error) {
+	return lf.fn(env, args)
+}
+
+// LowerFunc returns a Callable value wrapping fn, which will be called with
+// the unconverted arguments of the call.
+func LowerFunc(fn func([]reflect.Value) ([]reflect.Value, error)) reflect.Value {
+	return reflect.ValueOf(lowerFunc{
+		fn: func(_ Environment, args []reflect.Value) ([]reflect.Value, error) {
+			return fn(args)
+		},
+	})
+}
+
+// LowerEnvFunc is like LowerFunc, but fn is also given the environment the
+// call is evaluated in.
+func LowerEnvFunc(fn func(env Environment, args []reflect.Value) ([]reflect.Value, error)) reflect.Value {
+	return reflect.ValueOf(lowerFunc{fn: fn})
+}
+
+// IsLowerFunc returns true if v is a Callable.
+func IsLowerFunc(v interface{}) bool {
+	_, ok := v.(Callable)
+	return ok
+}
@@ -0,0 +1,105 @@
+package reflectlang
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// nameIndex is the sorted names of an environment, kept in the environment
+// under $names so that listing a large environment doesn't sort all of its
+// names every time.
+type nameIndex struct {
+	mtx    sync.Mutex
+	sorted []string
+	known  map[string]bool
+}
+
+// Names returns the sorted names bound in env, or the environments it is
+// scoped over, leaving out hidden names, which start with $. The names are
+// indexed in each environment and the index is brought up to date on each
+// call, so only names bound or unbound since the last call are sorted or
+// removed. The result may be modified by the caller.
+func Names(env Environment) []string {
+	idx := nameIndexOf(env)
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	var added []string
+	present := 0
+	for name := range env {
+		switch {
+		case strings.HasPrefix(name, "$"):
+		case idx.known[name]:
+			present++
+		default:
+			added = append(added, name)
+		}
+	}
+	if present < len(idx.sorted) {
+		kept := make([]string, 0, present)
+		for _, name := range idx.sorted {
+			if _, ok := env[name]; ok {
+				kept = append(kept, name)
+			} else {
+				delete(idx.known, name)
+			}
+		}
+		idx.sorted = kept
+	}
+	if len(added) > 0 {
+		sort.Strings(added)
+		for _, name := range added {
+			idx.known[name] = true
+		}
+		idx.sorted = mergeSorted(idx.sorted, added)
+	}
+	names := append([]string(nil), idx.sorted...)
+	if parent := Parent(env); parent != nil {
+		var inherited []string
+		for _, name := range Names(parent) {
+			if _, ok := env[name]; !ok {
+				inherited = append(inherited, name)
+			}
+		}
+		names = mergeSorted(names, inherited)
+	}
+	return names
+}
+
+// nameIndexOf returns env's name index, adding an empty one if it has none.
+func nameIndexOf(env Environment) *nameIndex {
+	if v, ok := env["$names"]; ok && v.IsValid() && v.CanInterface() {
+		if idx, ok := v.Interface().(*nameIndex); ok {
+			return idx
+		}
+	}
+	idx := &nameIndex{known: map[string]bool{}}
+	env["$names"] = reflect.ValueOf(idx)
+	return idx
+}
+
+// mergeSorted returns a new slice of the sorted names a and b, which have
+// no names in common.
+func mergeSorted(a, b []string) []string {
+	merged := make([]string, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if a[0] < b[0] {
+			merged, a = append(merged, a[0]), a[1:]
+		} else {
+			merged, b = append(merged, b[0]), b[1:]
+		}
+	}
+	merged = append(merged, a...)
+	return append(merged, b...)
+}
+
+// insertSorted returns the sorted names with name, which isn't one of
+// them, inserted in order.
+func insertSorted(names []string, name string) []string {
+	i := sort.SearchStrings(names, name)
+	names = append(names, "")
+	copy(names[i+1:], names[i:])
+	names[i] = name
+	return names
+}
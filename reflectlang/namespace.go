@@ -0,0 +1,179 @@
+package reflectlang
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Namespace is a named collection of values accessed with field syntax,
+// such as std.len or an imported package's members. Members can be set
+// directly or resolved lazily on first access, and can be namespaces
+// themselves. A Namespace is safe for concurrent use.
+type Namespace struct {
+	name string
+	doc  string
+
+	mtx     sync.Mutex
+	members map[string]reflect.Value
+	// sorted is the names of members, kept sorted as they are added.
+	sorted  []string
+	docs    map[string]string
+	list    func() []string
+	resolve func(name string) (v reflect.Value, found bool, err error)
+}
+
+// NewNamespace returns an empty namespace.
+func NewNamespace(name, doc string) *Namespace {
+	return &Namespace{
+		name:    name,
+		doc:     doc,
+		members: map[string]reflect.Value{},
+		docs:    map[string]string{},
+	}
+}
+
+// NamespaceOf returns a namespace whose members are the values in env.
+func NamespaceOf(name string, env Environment) *Namespace {
+	ns := NewNamespace(name, "")
+	for k, v := range env {
+		ns.members[k] = v
+		ns.sorted = append(ns.sorted, k)
+	}
+	sort.Strings(ns.sorted)
+	return ns
+}
+
+// Name returns the namespace's name.
+func (ns *Namespace) Name() string { return ns.name }
+
+// Doc returns the namespace's documentation.
+func (ns *Namespace) Doc() string { return ns.doc }
+
+// Set binds v to name in the namespace.
+func (ns *Namespace) Set(name string, v reflect.Value) {
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	ns.setLocked(name, v)
+}
+
+// setLocked binds v to name, with ns.mtx held.
+func (ns *Namespace) setLocked(name string, v reflect.Value) {
+	if _, ok := ns.members[name]; !ok {
+		ns.sorted = insertSorted(ns.sorted, name)
+	}
+	ns.members[name] = v
+}
+
+// SetDoc sets the documentation for the member name.
+func (ns *Namespace) SetDoc(name, doc string) {
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	ns.docs[name] = doc
+}
+
+// MemberDoc returns the documentation for the member name, if any.
+func (ns *Namespace) MemberDoc(name string) string {
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	return ns.docs[name]
+}
+
+// SetLazy configures the namespace to resolve members that haven't been set
+// by calling resolve on first access. list, if not nil, returns the names
+// resolve can find, for Dir. Resolved members are cached.
+func (ns *Namespace) SetLazy(list func() []string,
+	resolve func(name string) (v reflect.Value, found bool, err error)) {
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	ns.list, ns.resolve = list, resolve
+}
+
+// Get returns the member name, resolving it if needed.
+func (ns *Namespace) Get(name string) (reflect.Value, bool, error) {
+	ns.mtx.Lock()
+	v, ok := ns.members[name]
+	resolve := ns.resolve
+	ns.mtx.Unlock()
+	if ok || resolve == nil {
+		return v, ok, nil
+	}
+	v, found, err := resolve(name)
+	if err != nil || !found {
+		return reflect.Value{}, false, err
+	}
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	if existing, ok := ns.members[name]; ok {
+		return existing, true, nil
+	}
+	ns.setLocked(name, v)
+	return v, true, nil
+}
+
+// Nested returns the namespace bound to name, creating and binding a new
+// one if name is unbound. It returns nil if name is bound to something else.
+func (ns *Namespace) Nested(name string) *Namespace {
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	if v, ok := ns.members[name]; ok {
+		return AsNamespace(v)
+	}
+	sub := NewNamespace(name, "")
+	ns.setLocked(name, reflect.ValueOf(sub))
+	return sub
+}
+
+// Dir returns the sorted names of the namespace's members, including ones
+// that can be lazily resolved.
+func (ns *Namespace) Dir() []string {
+	ns.mtx.Lock()
+	names := append([]string(nil), ns.sorted...)
+	list := ns.list
+	ns.mtx.Unlock()
+	if list == nil {
+		return names
+	}
+	// only the names that are yet to be resolved need sorting.
+	var unresolved []string
+	seen := map[string]bool{}
+	for _, name := range list() {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if i := sort.SearchStrings(names, name); i == len(names) || names[i] != name {
+			unresolved = append(unresolved, name)
+		}
+	}
+	sort.Strings(unresolved)
+	return mergeSorted(names, unresolved)
+}
+
+// LowerField implements FieldResolver.
+func (ns *Namespace) LowerField(env Environment, name string) ([]reflect.Value, error) {
+	v, found, err := ns.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %q not found in namespace %s",
+			ErrTypeMismatch, name, ns.name)
+	}
+	return []reflect.Value{v}, nil
+}
+
+func (ns *Namespace) String() string {
+	return "{" + strings.Join(ns.Dir(), ", ") + "}"
+}
+
+// AsNamespace returns the namespace v holds, or nil.
+func AsNamespace(v reflect.Value) *Namespace {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil
+	}
+	ns, _ := v.Interface().(*Namespace)
+	return ns
+}
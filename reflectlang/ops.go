@@ -0,0 +1,560 @@
+package reflectlang
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+type numericClass int
+
+const (
+	notNumeric numericClass = iota
+	signedClass
+	unsignedClass
+	floatClass
+	stringClass
+)
+
+func classify(v reflect.Value) numericClass {
+	if !v.IsValid() {
+		return notNumeric
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return signedClass
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return unsignedClass
+	case reflect.Float32, reflect.Float64:
+		return floatClass
+	case reflect.String:
+		return stringClass
+	}
+	return notNumeric
+}
+
+// arithmetic performs op on left and right, which must be of the same class
+// of numeric kinds (or both strings for addition). The result has left's
+// type.
+func arithmetic(op OpType, left, right reflect.Value) (reflect.Value, error) {
+	class := classify(left)
+	if class == notNumeric || class != classify(right) {
+		return reflect.Value{}, fmt.Errorf("%w: invalid operation %s %s %s",
+			ErrTypeMismatch, typeName(left), op, typeName(right))
+	}
+	var result reflect.Value
+	switch class {
+	case signedClass:
+		l, r := left.Int(), right.Int()
+		var v int64
+		switch op {
+		case OpAdd:
+			v = l + r
+		case OpSub:
+			v = l - r
+		case OpMul:
+			v = l * r
+		case OpDiv:
+			if r == 0 {
+				return reflect.Value{}, fmt.Errorf("%w: integer divide by zero", ErrRuntime)
+			}
+			v = l / r
+		}
+		result = reflect.ValueOf(v)
+	case unsignedClass:
+		l, r := left.Uint(), right.Uint()
+		var v uint64
+		switch op {
+		case OpAdd:
+			v = l + r
+		case OpSub:
+			v = l - r
+		case OpMul:
+			v = l * r
+		case OpDiv:
+			if r == 0 {
+				return reflect.Value{}, fmt.Errorf("%w: integer divide by zero", ErrRuntime)
+			}
+			v = l / r
+		}
+		result = reflect.ValueOf(v)
+	case floatClass:
+		l, r := left.Float(), right.Float()
+		var v float64
+		switch op {
+		case OpAdd:
+			v = l + r
+		case OpSub:
+			v = l - r
+		case OpMul:
+			v = l * r
+		case OpDiv:
+			v = l / r
+		}
+		result = reflect.ValueOf(v)
+	case stringClass:
+		if op != OpAdd {
+			return reflect.Value{}, fmt.Errorf("%w: operator %s not defined on strings",
+				ErrTypeMismatch, op)
+		}
+		result = reflect.ValueOf(left.String() + right.String())
+	}
+	return result.Convert(left.Type()), nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// durationArithmetic scales a time.Duration by a number, as in d * 3, 3 * d,
+// d / 2, or d * 1.5, where the number may be of any integer or float type,
+// typed or not. The result is a time.Duration, with fractional nanoseconds
+// truncated. ok is false if op and its operands aren't such a scaling, in
+// which case the usual rules apply, so that d + 1 and d / d behave as in Go.
+func durationArithmetic(op OpType, left, right reflect.Value) (
+	rv reflect.Value, ok bool, err error) {
+	isDuration := func(v reflect.Value) bool {
+		return v.IsValid() && v.Type() == durationType
+	}
+	var d, n reflect.Value
+	switch {
+	case op == OpMul && isDuration(left) && !isDuration(right):
+		d, n = left, right
+	case op == OpMul && isDuration(right) && !isDuration(left):
+		d, n = right, left
+	case op == OpDiv && isDuration(left) && !isDuration(right):
+		d, n = left, right
+	default:
+		return reflect.Value{}, false, nil
+	}
+	dur := time.Duration(d.Int())
+	var scaled float64
+	switch classify(n) {
+	case signedClass:
+		return scaleDuration(op, dur, n.Int())
+	case unsignedClass:
+		if n.Uint() > math.MaxInt64 {
+			return reflect.Value{}, true, fmt.Errorf("%w: %d overflows time.Duration",
+				ErrRuntime, n.Uint())
+		}
+		return scaleDuration(op, dur, int64(n.Uint()))
+	case floatClass:
+		if op == OpMul {
+			scaled = float64(dur) * n.Float()
+		} else if n.Float() == 0 {
+			return reflect.Value{}, true, fmt.Errorf("%w: division by zero", ErrRuntime)
+		} else {
+			scaled = float64(dur) / n.Float()
+		}
+	default:
+		return reflect.Value{}, false, nil
+	}
+	if math.IsNaN(scaled) || scaled < math.MinInt64 || scaled >= math.MaxInt64 {
+		return reflect.Value{}, true, fmt.Errorf("%w: %v %s %v overflows time.Duration",
+			ErrRuntime, dur, op, n.Float())
+	}
+	return reflect.ValueOf(time.Duration(scaled)), true, nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// timeArithmetic adds durations to and subtracts them from a time.Time, and
+// subtracts one time.Time from another, giving a time.Duration. ok is false
+// if op and its operands aren't one of these.
+func timeArithmetic(op OpType, left, right reflect.Value) (rv reflect.Value, ok bool) {
+	isType := func(v reflect.Value, typ reflect.Type) bool {
+		return v.IsValid() && v.Type() == typ
+	}
+	switch {
+	case op == OpSub && isType(left, timeType) && isType(right, timeType):
+		return reflect.ValueOf(left.Interface().(time.Time).Sub(right.Interface().(time.Time))), true
+	case op == OpAdd && isType(left, timeType) && isType(right, durationType):
+		return reflect.ValueOf(left.Interface().(time.Time).Add(time.Duration(right.Int()))), true
+	case op == OpAdd && isType(left, durationType) && isType(right, timeType):
+		return reflect.ValueOf(right.Interface().(time.Time).Add(time.Duration(left.Int()))), true
+	case op == OpSub && isType(left, timeType) && isType(right, durationType):
+		return reflect.ValueOf(left.Interface().(time.Time).Add(-time.Duration(right.Int()))), true
+	}
+	return reflect.Value{}, false
+}
+
+// scaleDuration multiplies or divides dur by the integer n, failing rather
+// than wrapping around if the result doesn't fit in a time.Duration.
+func scaleDuration(op OpType, dur time.Duration, n int64) (reflect.Value, bool, error) {
+	if op == OpDiv && n == 0 {
+		return reflect.Value{}, true, fmt.Errorf("%w: integer divide by zero", ErrRuntime)
+	}
+	// -MinInt64 is the only quotient that overflows, and it's also the only
+	// product the division check below can't catch.
+	overflows := n == -1 && dur == math.MinInt64
+	if op == OpMul && n != 0 && dur*time.Duration(n)/time.Duration(n) != dur {
+		overflows = true
+	}
+	if overflows {
+		return reflect.Value{}, true, fmt.Errorf("%w: %v %s %v overflows time.Duration",
+			ErrRuntime, dur, op, n)
+	}
+	if op == OpMul {
+		return reflect.ValueOf(dur * time.Duration(n)), true, nil
+	}
+	return reflect.ValueOf(dur / time.Duration(n)), true, nil
+}
+
+func typeName(v reflect.Value) string {
+	if !v.IsValid() {
+		return "nil"
+	}
+	return v.Type().String()
+}
+
+// bitwise performs the bitwise or shift operation op on left and right,
+// which must be integers. The result has left's type.
+func bitwise(op OpType, left, right reflect.Value) (reflect.Value, error) {
+	class := classify(left)
+	if op == OpShl || op == OpShr {
+		var shift uint64
+		switch classify(right) {
+		case signedClass:
+			if right.Int() < 0 {
+				return reflect.Value{}, fmt.Errorf("%w: negative shift amount %d",
+					ErrRuntime, right.Int())
+			}
+			shift = uint64(right.Int())
+		case unsignedClass:
+			shift = right.Uint()
+		default:
+			class = notNumeric
+		}
+		switch class {
+		case signedClass:
+			if op == OpShl {
+				return reflect.ValueOf(left.Int() << shift).Convert(left.Type()), nil
+			}
+			return reflect.ValueOf(left.Int() >> shift).Convert(left.Type()), nil
+		case unsignedClass:
+			if op == OpShl {
+				return reflect.ValueOf(left.Uint() << shift).Convert(left.Type()), nil
+			}
+			return reflect.ValueOf(left.Uint() >> shift).Convert(left.Type()), nil
+		}
+		return reflect.Value{}, fmt.Errorf("%w: invalid shift %s %s %s",
+			ErrTypeMismatch, typeName(left), op, typeName(right))
+	}
+
+	if (class != signedClass && class != unsignedClass) || class != classify(right) {
+		return reflect.Value{}, fmt.Errorf("%w: invalid operation %s %s %s",
+			ErrTypeMismatch, typeName(left), op, typeName(right))
+	}
+	var l, r uint64
+	if class == signedClass {
+		l, r = uint64(left.Int()), uint64(right.Int())
+	} else {
+		l, r = left.Uint(), right.Uint()
+	}
+	var v uint64
+	switch op {
+	case OpBitAnd:
+		v = l & r
+	case OpBitOr:
+		v = l | r
+	case OpBitXor:
+		v = l ^ r
+	case OpAndNot:
+		v = l &^ r
+	}
+	if class == signedClass {
+		return reflect.ValueOf(int64(v)).Convert(left.Type()), nil
+	}
+	return reflect.ValueOf(v).Convert(left.Type()), nil
+}
+
+// coerce applies untyped constant conversion to the operands of a binary
+// operation: an untyped operand takes the type of a typed operand, and two
+// untyped numbers become floats if either is a float. Otherwise, numeric
+// operands must have identical types.
+func coerce(op OpType, left, right reflect.Value, leftUntyped, rightUntyped bool) (
+	_, _ reflect.Value, err error) {
+	if !left.IsValid() || !right.IsValid() {
+		return left, right, nil
+	}
+	switch {
+	case leftUntyped && rightUntyped:
+		if classify(left) == signedClass && classify(right) == floatClass {
+			left = reflect.ValueOf(float64(left.Int()))
+		} else if classify(left) == floatClass && classify(right) == signedClass {
+			right = reflect.ValueOf(float64(right.Int()))
+		}
+	case leftUntyped:
+		left, err = convertUntyped(left, right.Type())
+	case rightUntyped:
+		right, err = convertUntyped(right, left.Type())
+	case left.Type() != right.Type() &&
+		classify(left) != notNumeric && classify(right) != notNumeric:
+		err = fmt.Errorf("%w: invalid operation %s %s %s (mismatched types)",
+			ErrTypeMismatch, typeName(left), op, typeName(right))
+	}
+	return left, right, err
+}
+
+// convertUntyped converts the untyped constant v to typ, if it can be
+// represented by typ.
+func convertUntyped(v reflect.Value, typ reflect.Type) (reflect.Value, error) {
+	if typ.Kind() == reflect.Interface {
+		return v, nil
+	}
+	target := reflect.New(typ).Elem()
+	fail := func() (reflect.Value, error) {
+		return reflect.Value{}, fmt.Errorf("%w: cannot use %s (untyped constant) as %s",
+			ErrTypeMismatch, Repr(v), typ)
+	}
+	switch classify(target) {
+	case signedClass:
+		var x int64
+		switch classify(v) {
+		case signedClass:
+			x = v.Int()
+		case floatClass:
+			if f := v.Float(); f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+				return fail()
+			} else {
+				x = int64(f)
+			}
+		default:
+			return fail()
+		}
+		if target.OverflowInt(x) {
+			return fail()
+		}
+		target.SetInt(x)
+	case unsignedClass:
+		var x uint64
+		switch classify(v) {
+		case signedClass:
+			if v.Int() < 0 {
+				return fail()
+			}
+			x = uint64(v.Int())
+		case floatClass:
+			if f := v.Float(); f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 {
+				return fail()
+			} else {
+				x = uint64(f)
+			}
+		default:
+			return fail()
+		}
+		if target.OverflowUint(x) {
+			return fail()
+		}
+		target.SetUint(x)
+	case floatClass:
+		var x float64
+		switch classify(v) {
+		case signedClass:
+			x = float64(v.Int())
+		case floatClass:
+			x = v.Float()
+		default:
+			return fail()
+		}
+		if target.OverflowFloat(x) {
+			return fail()
+		}
+		target.SetFloat(x)
+	case stringClass:
+		if classify(v) != stringClass {
+			return fail()
+		}
+		target.SetString(v.String())
+	default:
+		return fail()
+	}
+	return target, nil
+}
+
+// equal compares left and right. A nil pointer, map, slice, func, channel,
+// or interface is equal to nil. Otherwise, like in Go, slices, maps, and
+// funcs, and values holding them, can't be compared.
+func equal(left, right reflect.Value) (bool, error) {
+	if !left.IsValid() || !right.IsValid() {
+		isNil := func(v reflect.Value) bool {
+			if !v.IsValid() {
+				return true
+			}
+			switch v.Kind() {
+			case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Func,
+				reflect.Chan, reflect.Interface, reflect.UnsafePointer:
+				return v.IsNil()
+			}
+			return false
+		}
+		return isNil(left) && isNil(right), nil
+	}
+	if left.Type() == timeType && right.Type() == timeType {
+		return left.Interface().(time.Time).Equal(right.Interface().(time.Time)), nil
+	}
+	for _, v := range []reflect.Value{left, right} {
+		if !canCompare(v) {
+			return false, fmt.Errorf("%w: cannot compare %s", ErrTypeMismatch, typeName(v))
+		}
+	}
+	return valuesEqual(left, right), nil
+}
+
+// canCompare returns whether v can be compared with ==. Like in Go, for
+// interfaces that depends on their dynamic values, and for structs and
+// arrays, on their fields and elements.
+func canCompare(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.Interface:
+		return canCompare(v.Elem())
+	case reflect.Struct:
+		if !v.Type().Comparable() {
+			return false
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if !canCompare(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Array:
+		if !v.Type().Comparable() {
+			return false
+		}
+		for i := 0; i < v.Len(); i++ {
+			if !canCompare(v.Index(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return v.Type().Comparable()
+}
+
+// valuesEqual compares left and right, which must both canCompare, like
+// Go's ==. Unlike comparing their Interface() values, it works for values
+// obtained through unexported fields.
+func valuesEqual(left, right reflect.Value) bool {
+	if left.Kind() == reflect.Interface {
+		left = left.Elem()
+	}
+	if right.Kind() == reflect.Interface {
+		right = right.Elem()
+	}
+	if !left.IsValid() || !right.IsValid() {
+		return left.IsValid() == right.IsValid()
+	}
+	if left.Type() != right.Type() {
+		return false
+	}
+	switch left.Kind() {
+	case reflect.Bool:
+		return left.Bool() == right.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return left.Int() == right.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return left.Uint() == right.Uint()
+	case reflect.Float32, reflect.Float64:
+		return left.Float() == right.Float()
+	case reflect.Complex64, reflect.Complex128:
+		return left.Complex() == right.Complex()
+	case reflect.String:
+		return left.String() == right.String()
+	case reflect.Pointer, reflect.Chan, reflect.UnsafePointer:
+		return left.Pointer() == right.Pointer()
+	case reflect.Struct:
+		for i := 0; i < left.NumField(); i++ {
+			if !valuesEqual(left.Field(i), right.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Array:
+		for i := 0; i < left.Len(); i++ {
+			if !valuesEqual(left.Index(i), right.Index(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compare performs the ordered comparison op on left and right, which must
+// be of the same class of numeric kinds, both strings, or both times.
+func compare(op OpType, left, right reflect.Value) (reflect.Value, error) {
+	if left.IsValid() && right.IsValid() && left.Type() == timeType && right.Type() == timeType {
+		l, r := left.Interface().(time.Time), right.Interface().(time.Time)
+		return compareResult(op, l.Before(r), l.After(r), l.Equal(r)), nil
+	}
+	class := classify(left)
+	if class == notNumeric || class != classify(right) {
+		return reflect.Value{}, fmt.Errorf("%w: invalid operation %s %s %s",
+			ErrTypeMismatch, typeName(left), op, typeName(right))
+	}
+	var less, greater bool
+	switch class {
+	case signedClass:
+		less, greater = left.Int() < right.Int(), left.Int() > right.Int()
+	case unsignedClass:
+		less, greater = left.Uint() < right.Uint(), left.Uint() > right.Uint()
+	case floatClass:
+		less, greater = left.Float() < right.Float(), left.Float() > right.Float()
+	case stringClass:
+		less, greater = left.String() < right.String(), left.String() > right.String()
+	}
+	eq, err := equal(left, right)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	return compareResult(op, less, greater, eq), nil
+}
+
+// compareResult returns the result of the ordered comparison op, given
+// whether its left operand is less than, greater than, or equal to its
+// right.
+func compareResult(op OpType, less, greater, eq bool) reflect.Value {
+	var rv bool
+	switch op {
+	case OpLess:
+		rv = less
+	case OpLessEqual:
+		rv = !greater && (less || eq)
+	case OpGreater:
+		rv = greater
+	case OpGreaterEqual:
+		rv = !less && (greater || eq)
+	}
+	return reflect.ValueOf(rv)
+}
+
+// assignable returns v converted for assignment to a variable of type typ.
+func assignable(v reflect.Value, typ reflect.Type, untyped bool) (reflect.Value, error) {
+	if !v.IsValid() {
+		switch typ.Kind() {
+		case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Func,
+			reflect.Chan, reflect.Interface, reflect.UnsafePointer:
+			return reflect.Zero(typ), nil
+		}
+		return reflect.Value{}, fmt.Errorf("%w: cannot use nil as %s", ErrTypeMismatch, typ)
+	}
+	if f, ok := asFunc(v); ok && typ.Kind() == reflect.Func {
+		return f.MakeFunc(typ)
+	}
+	if untyped {
+		var err error
+		v, err = convertUntyped(v, typ)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+	}
+	if !v.Type().AssignableTo(typ) {
+		return reflect.Value{}, fmt.Errorf("%w: cannot use %s as %s",
+			ErrTypeMismatch, typeName(v), typ)
+	}
+	return v, nil
+}
@@ -0,0 +1,251 @@
+package reflectlang
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// AccessKind is the kind of an Access.
+type AccessKind int
+
+const (
+	// AccessMember is access to a field or method of a value, or a member of
+	// a namespace, as in x.Name.
+	AccessMember AccessKind = iota
+	// AccessCall is a call of a Go function, other than lowered functions.
+	AccessCall
+	// AccessImport is an import of a package.
+	AccessImport
+)
+
+// Access is something evaluation is about to access, for a Policy to
+// permit or deny.
+type Access struct {
+	Kind AccessKind
+	// Package is the import path of the package of the type or function
+	// accessed, or of the package imported. For namespace members, it is
+	// the namespace's name, which for imported packages is their path.
+	Package string
+	// Type is the name of the type whose field or method is accessed, if
+	// any, without its package. Pointers are left out, so methods with
+	// pointer receivers have the name of the type pointed to.
+	Type string
+	// Member is the name of the field, method, or function accessed, or
+	// empty for imports.
+	Member string
+}
+
+// String returns the access's package, type, and member, joined by dots,
+// such as net/http.Server.Shutdown or os.Exit.
+func (a Access) String() string {
+	var parts []string
+	for _, part := range []string{a.Package, a.Type, a.Member} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// Policy decides what evaluation may access, such as to let a session read
+// a process's metrics without letting it shut the process down or reach
+// its keys.
+type Policy interface {
+	Permit(a Access) bool
+}
+
+// SetPolicy makes evaluation in env, and in the scopes in it, consult p
+// before accessing fields, methods, and namespace members, calling Go
+// functions, and importing packages. Accesses p doesn't permit fail with
+// ErrDenied. If p is nil, everything is permitted.
+func SetPolicy(env Environment, p Policy) {
+	setPolicy(env, "$policy", p)
+}
+
+// SetPure marks the Go functions and methods that p permits as pure, free
+// of side effects, so that read-only environments may call them, such as
+// to let viewers call String methods. Calls of functions are permitted as
+// for SetPolicy, and method calls as accesses to their methods. If p is
+// nil, no functions are pure.
+func SetPure(env Environment, p Policy) {
+	setPolicy(env, "$pure", p)
+}
+
+// setPolicy binds p to key in env, or, if p is nil, makes env have none.
+func setPolicy(env Environment, key string, p Policy) {
+	if p != nil {
+		env[key] = reflect.ValueOf(&p)
+		return
+	}
+	delete(env, key)
+	if policyOf(env, key) != nil {
+		env[key] = reflect.ValueOf((*Policy)(nil))
+	}
+}
+
+// policyOf returns the policy bound to key in env, or nil if it has none.
+func policyOf(env Environment, key string) Policy {
+	v, ok := Lookup(env, key)
+	if !ok || !v.IsValid() || !v.CanInterface() {
+		return nil
+	}
+	if p, _ := v.Interface().(*Policy); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// permit returns an error at s if env's policy doesn't permit a.
+func (s span) permit(env Environment, a Access) error {
+	if p := policyOf(env, "$policy"); p != nil && !p.Permit(a) {
+		return s.Err(ErrDenied, "%s is not permitted", a)
+	}
+	return nil
+}
+
+// isPure returns true if env's pure policy permits a.
+func isPure(env Environment, a Access) bool {
+	p := policyOf(env, "$pure")
+	return p != nil && p.Permit(a)
+}
+
+// pureFunc is a method value of a pure method, for calling it in read-only
+// environments, which don't allow calling other Go functions.
+type pureFunc struct {
+	fn reflect.Value
+}
+
+func asPureFunc(v reflect.Value) (*pureFunc, bool) {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil, false
+	}
+	f, ok := v.Interface().(*pureFunc)
+	return f, ok
+}
+
+// pureCall returns true if fn, a Go function, may be called in read-only
+// environments.
+func pureCall(env Environment, fn reflect.Value) bool {
+	if _, ok := asPureFunc(fn); ok {
+		return true
+	}
+	a, ok := funcAccess(fn)
+	return ok && isPure(env, a)
+}
+
+// memberAccess returns the access of the field, method, or member name of
+// v.
+func memberAccess(v reflect.Value, name string) Access {
+	if ns := AsNamespace(v); ns != nil {
+		return Access{Kind: AccessMember, Package: ns.Name(), Member: name}
+	}
+	a := Access{Kind: AccessMember, Member: name}
+	if v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return a
+	}
+	t := v.Type()
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	a.Package, a.Type = t.PkgPath(), t.Name()
+	if a.Type == "" {
+		a.Type = t.String()
+	}
+	return a
+}
+
+// funcAccess returns the access of a call of fn, a Go function, from the
+// name the runtime knows it by, such as net/http.(*Server).Shutdown-fm for
+// a method value. It returns false for method values made by reflect, as
+// for x.Method, which don't know their method, and were permitted when it
+// was accessed.
+func funcAccess(fn reflect.Value) (Access, bool) {
+	a := Access{Kind: AccessCall}
+	f := runtime.FuncForPC(fn.Pointer())
+	if f == nil || f.Name() == "reflect.methodValueCall" {
+		return a, false
+	}
+	name := strings.TrimSuffix(f.Name(), "-fm")
+	slash := strings.LastIndex(name, "/") + 1
+	dot := strings.Index(name[slash:], ".")
+	if dot < 0 {
+		a.Member = name
+		return a, true
+	}
+	dot += slash
+	a.Package, a.Member = name[:dot], name[dot+1:]
+	if i := strings.LastIndex(a.Member, "."); i >= 0 {
+		a.Type = strings.TrimSuffix(strings.TrimPrefix(a.Member[:i], "(*"), ")")
+		a.Member = a.Member[i+1:]
+	}
+	return a, true
+}
+
+// Rules is a Policy of patterns of the names of accesses, as returned by
+// Access.String. A pattern matches a name if it matches all of it, or
+// everything before a dot or slash in it, so net/http.Server matches all of
+// the fields and methods of http.Server, and crypto matches the crypto
+// package and every package under it. In patterns, * matches any run of
+// characters, so *.Shutdown matches any method named Shutdown.
+type Rules struct {
+	// Allow, if not empty, are the patterns of what is permitted. Anything
+	// none of them match is denied.
+	Allow []string
+	// Deny are the patterns of what is denied, even if Allow matches it.
+	Deny []string
+}
+
+// Permit implements Policy.
+func (r Rules) Permit(a Access) bool {
+	name := a.String()
+	for _, pattern := range r.Deny {
+		if matchName(pattern, name) {
+			return false
+		}
+	}
+	if len(r.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range r.Allow {
+		if matchName(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchName returns true if pattern matches name, or a prefix of name that
+// ends before a dot or slash.
+func matchName(pattern, name string) bool {
+	if glob(pattern, name) {
+		return true
+	}
+	for i := 0; i < len(name); i++ {
+		if (name[i] == '.' || name[i] == '/') && glob(pattern, name[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// glob returns true if pattern matches all of name, where * in pattern
+// matches any run of characters.
+func glob(pattern, name string) bool {
+	star := strings.IndexByte(pattern, '*')
+	if star < 0 {
+		return pattern == name
+	}
+	if !strings.HasPrefix(name, pattern[:star]) {
+		return false
+	}
+	for i := star; i <= len(name); i++ {
+		if glob(pattern[star+1:], name[i:]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package reflectlang
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Frame is an expression evaluation was in when it failed, such as a call
+// the failure happened in, or a call of the function literal it happened in.
+type Frame struct {
+	// Expr is the expression, as formatted by Format, shortened if it is
+	// long.
+	Expr string
+	// Pos is where the expression is: the ( of a call, or the . of a
+	// selector.
+	Pos Position
+}
+
+func (f Frame) String() string {
+	return fmt.Sprintf("line %d, column %d: %s", f.Pos.Line, f.Pos.Column, f.Expr)
+}
+
+// maxFrameExpr is how many runes of an expression a Frame keeps.
+const maxFrameExpr = 60
+
+// StackError is an error from evaluation, along with its script stack: the
+// calls and selectors evaluation was in when it failed, innermost first.
+// Eval returns errors from calls and selectors as StackErrors, which format
+// with their stack under %+v.
+type StackError struct {
+	Err   error
+	Stack []Frame
+}
+
+func (e *StackError) Error() string { return e.Err.Error() }
+func (e *StackError) Unwrap() error { return e.Err }
+
+// Format implements fmt.Formatter, writing the stack after the message for
+// %+v.
+func (e *StackError) Format(s fmt.State, verb rune) {
+	switch {
+	case verb == 'v' && s.Flag('+'):
+		var b strings.Builder
+		b.WriteString(e.Error())
+		for _, frame := range e.Stack {
+			b.WriteString("\n\tat " + frame.String())
+		}
+		fmt.Fprint(s, b.String())
+	case verb == 'q':
+		fmt.Fprintf(s, "%q", e.Error())
+	default:
+		fmt.Fprint(s, e.Error())
+	}
+}
+
+// Stack returns the script stack err happened in, innermost first, or nil
+// if it has none.
+func Stack(err error) []Frame {
+	var serr *StackError
+	if errors.As(err, &serr) {
+		return serr.Stack
+	}
+	return nil
+}
+
+// trace returns err with expr, which is at s, pushed onto its script stack.
+// Errors that unwind statements for break, continue, and return are
+// returned as they are.
+func (s span) trace(err error, expr Evaluable) error {
+	if err == nil || isControlFlow(err) {
+		return err
+	}
+	text := []rune(Format(expr))
+	if len(text) > maxFrameExpr {
+		text = append(text[:maxFrameExpr-3], []rune("...")...)
+	}
+	frame := Frame{Expr: string(text), Pos: s.pos.export()}
+
+	var stack []Frame
+	if serr, ok := err.(*StackError); ok {
+		err, stack = serr.Err, serr.Stack
+	} else {
+		// such as errors from function literals called by Go functions,
+		// which come back as panics.
+		stack = Stack(err)
+	}
+	return &StackError{Err: err, Stack: append(stack[:len(stack):len(stack)], frame)}
+}
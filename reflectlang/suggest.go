@@ -0,0 +1,71 @@
+package reflectlang
+
+import "strings"
+
+// didYouMean returns a suggestion of which of candidates was meant instead
+// of name, to append to an error message, or "".
+func didYouMean(name string, candidates []string) string {
+	if s := suggestion(name, candidates); s != "" {
+		return "; did you mean " + s + "?"
+	}
+	return ""
+}
+
+// suggestion returns the candidate closest to name, if it is close enough
+// to be a likely typo, or "". Names are compared ignoring case, and ties go
+// to the earliest candidate.
+func suggestion(name string, candidates []string) string {
+	best, bestDistance := "", -1
+	for _, candidate := range candidates {
+		distance := editDistance(strings.ToLower(name), strings.ToLower(candidate))
+		limit := len([]rune(candidate)) / 3
+		if limit < 1 {
+			limit = 1
+		}
+		if distance <= limit && (bestDistance < 0 || distance < bestDistance) {
+			best, bestDistance = candidate, distance
+		}
+	}
+	return best
+}
+
+// editDistance returns how many insertions, deletions, substitutions, and
+// transpositions of adjacent runes it takes to turn a into b, without
+// editing any substring twice.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	// rows are the distances from prefixes of a two, one, and zero runes
+	// shorter than the current one, to each prefix of b.
+	older := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] &&
+				older[j-2]+1 < cur[j] {
+				cur[j] = older[j-2] + 1
+			}
+		}
+		older, prev, cur = prev, cur, older
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
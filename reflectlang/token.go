@@ -0,0 +1,89 @@
+package reflectlang
+
+// TokenKind is the kind of a Token.
+type TokenKind int
+
+const (
+	// TokenIdent is a name, including names quoted with @, as in @if.
+	TokenIdent TokenKind = iota
+	// TokenKeyword is a reserved keyword, such as for or then.
+	TokenKeyword
+	// TokenNumber is a number literal, such as 1, 0x1p-2, or 5u.
+	TokenNumber
+	// TokenDuration is a duration literal, such as 5ms.
+	TokenDuration
+	// TokenString is a string literal, including unterminated ones.
+	TokenString
+	// TokenOperator is an operator or punctuation, such as &&, := or (.
+	TokenOperator
+	// TokenComment is a // or /* */ comment.
+	TokenComment
+	// TokenInvalid is text that can't be tokenized, such as $.
+	TokenInvalid
+)
+
+var tokenKindNames = map[TokenKind]string{
+	TokenIdent:    "ident",
+	TokenKeyword:  "keyword",
+	TokenNumber:   "number",
+	TokenDuration: "duration",
+	TokenString:   "string",
+	TokenOperator: "operator",
+	TokenComment:  "comment",
+	TokenInvalid:  "invalid",
+}
+
+func (k TokenKind) String() string {
+	if name, ok := tokenKindNames[k]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// tokenKinds maps the lexer's token kinds to TokenKinds.
+var tokenKinds = map[tokenKind]TokenKind{
+	tokenIdent:    TokenIdent,
+	tokenKeyword:  TokenKeyword,
+	tokenNumber:   TokenNumber,
+	tokenDuration: TokenDuration,
+	tokenString:   TokenString,
+	tokenOperator: TokenOperator,
+	tokenComment:  TokenComment,
+	tokenInvalid:  TokenInvalid,
+}
+
+// Token is a lexical token of source, as returned by Tokenize.
+type Token struct {
+	Kind TokenKind
+	// Text is the token's text as it is in the source, quotes, escapes,
+	// and @ included.
+	Text string
+	// Start is where the token starts, and End is just past where it ends.
+	Start, End Position
+}
+
+// Tokenize splits source into tokens, the way Parse does, such as for
+// highlighting it. Unlike for Parse, comments are tokens, and text that
+// can't be tokenized is a TokenInvalid, so that the tokens cover all of
+// the source but whitespace. The tokens are returned even if some of the
+// source can't be tokenized, along with the first error, an ErrParser.
+func Tokenize(source string) ([]Token, error) {
+	l := newLexer(source)
+	tokens, errs := l.tokens(true)
+	exported := make([]Token, 0, len(tokens))
+	for _, tok := range tokens {
+		if tok.kind == tokenEOF {
+			continue
+		}
+		exported = append(exported, Token{
+			Kind:  tokenKinds[tok.kind],
+			Text:  string(l.source[tok.pos.offset:tok.end.offset]),
+			Start: tok.pos.export(),
+			End:   tok.end.export(),
+		})
+	}
+	if len(errs) > 0 {
+		return exported, errs[0]
+	}
+	return exported, nil
+}
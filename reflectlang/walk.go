@@ -0,0 +1,179 @@
+package reflectlang
+
+// Position is a place in parsed source. Offset counts runes from the start
+// of the source, and Line and Column count from 1, with columns in runes.
+type Position struct {
+	Offset, Line, Column int
+}
+
+// Span is the range of source a node was parsed from, from Start up to but
+// not including End. Pos is where errors about the node are reported: its
+// operator, such as the + of an addition or the ( of a call, or else its
+// start. Nodes made other than by parsing have a zero Span.
+type Span struct {
+	Pos, Start, End Position
+}
+
+func (p position) export() Position {
+	return Position{Offset: p.offset, Line: p.line, Column: p.col}
+}
+
+func (s span) export() Span {
+	return Span{Pos: s.pos.export(), Start: s.start.export(), End: s.end.export()}
+}
+
+// Node is a node of the syntax trees returned by Parse: one of the
+// Evaluables defined in this package, or a clause of a switch.
+type Node interface {
+	Span() Span
+}
+
+func (s *Sequence) Span() Span      { return s.span.export() }
+func (b *Break) Span() Span         { return b.span.export() }
+func (c *Continue) Span() Span      { return c.span.export() }
+func (f *For) Span() Span           { return f.span.export() }
+func (f *FuncLit) Span() Span       { return f.span.export() }
+func (r *Return) Span() Span        { return r.span.export() }
+func (f *ForRange) Span() Span      { return f.span.export() }
+func (s *TypeSwitch) Span() Span    { return s.span.export() }
+func (c *TypeClause) Span() Span    { return c.span.export() }
+func (s *ValueSwitch) Span() Span   { return s.span.export() }
+func (c *CaseClause) Span() Span    { return c.span.export() }
+func (b *BadStatement) Span() Span  { return b.span.export() }
+func (s *Subexpression) Span() Span { return s.span.export() }
+func (c *Call) Span() Span          { return c.span.export() }
+func (c *Conditional) Span() Span   { return c.span.export() }
+func (p *Propagate) Span() Span     { return p.span.export() }
+func (g *Go) Span() Span            { return g.span.export() }
+func (d *Defer) Span() Span         { return d.span.export() }
+func (f *FieldAccess) Span() Span   { return f.span.export() }
+func (s *SafeChain) Span() Span     { return s.span.export() }
+func (a *ArrayAccess) Span() Span   { return a.span.export() }
+func (s *SliceAccess) Span() Span   { return s.span.export() }
+func (c *CompositeLit) Span() Span  { return c.span.export() }
+func (o *Operation) Span() Span     { return o.span.export() }
+func (m *Modifier) Span() Span      { return m.span.export() }
+func (a *Assignment) Span() Span    { return a.span.export() }
+func (c *Const) Span() Span         { return c.span.export() }
+func (i *Ident) Span() Span         { return i.span.export() }
+func (v *Value) Span() Span         { return v.span.export() }
+
+// Walk traverses the syntax tree rooted at expr, as returned by Parse,
+// depth first: it calls fn(node), and then, if fn returns true, walks each
+// of node's children in source order. The keys and values of a
+// CompositeLit's elements are its children, as are the clauses of switches.
+// Evaluables that aren't Nodes, such as those defined elsewhere, are
+// skipped.
+func Walk(expr Evaluable, fn func(Node) bool) {
+	if node, ok := expr.(Node); ok {
+		walk(node, fn)
+	}
+}
+
+func walk(node Node, fn func(Node) bool) {
+	if !fn(node) {
+		return
+	}
+	for _, child := range children(node) {
+		walk(child, fn)
+	}
+}
+
+// children returns the children of node in source order.
+func children(node Node) []Node {
+	var nodes []Node
+	add := func(exprs ...Evaluable) {
+		for _, expr := range exprs {
+			if child, ok := expr.(Node); ok {
+				nodes = append(nodes, child)
+			}
+		}
+	}
+	addIdents := func(idents ...*Ident) {
+		for _, ident := range idents {
+			if ident != nil {
+				nodes = append(nodes, ident)
+			}
+		}
+	}
+	addBody := func(body *Sequence) {
+		if body != nil {
+			nodes = append(nodes, body)
+		}
+	}
+
+	switch n := node.(type) {
+	case *Sequence:
+		add(n.Statements...)
+	case *For:
+		add(n.Cond)
+		addBody(n.Body)
+	case *FuncLit:
+		addIdents(n.Params...)
+		addBody(n.Body)
+	case *Return:
+		add(n.Values...)
+	case *ForRange:
+		add(n.Key, n.Value, n.Over)
+		addBody(n.Body)
+	case *TypeSwitch:
+		addIdents(n.Bind)
+		add(n.Subject)
+		for i := range n.Clauses {
+			nodes = append(nodes, &n.Clauses[i])
+		}
+	case *TypeClause:
+		add(n.Types...)
+		addBody(n.Body)
+	case *ValueSwitch:
+		add(n.Tag)
+		for i := range n.Clauses {
+			nodes = append(nodes, &n.Clauses[i])
+		}
+	case *CaseClause:
+		add(n.Values...)
+		addBody(n.Body)
+	case *Subexpression:
+		add(n.Expr)
+	case *Call:
+		add(n.Func)
+		add(n.Args...)
+	case *Conditional:
+		add(n.Cond, n.Then, n.Else)
+	case *Propagate:
+		add(n.Expr)
+	case *Go:
+		if n.Call != nil {
+			nodes = append(nodes, n.Call)
+		}
+	case *Defer:
+		if n.Call != nil {
+			nodes = append(nodes, n.Call)
+		}
+	case *FieldAccess:
+		add(n.Val)
+		addIdents(n.Field)
+	case *SafeChain:
+		add(n.Expr)
+	case *ArrayAccess:
+		add(n.Array, n.Index)
+	case *SliceAccess:
+		add(n.Array, n.Low, n.High)
+	case *CompositeLit:
+		add(n.Type)
+		for _, elem := range n.Elements {
+			add(elem.Key, elem.Value)
+		}
+	case *Operation:
+		add(n.Left, n.Right)
+	case *Modifier:
+		add(n.Val)
+	case *Assignment:
+		add(n.Targets...)
+		add(n.Values...)
+	case *Const:
+		addIdents(n.Names...)
+		add(n.Values...)
+	}
+	return nodes
+}
@@ -0,0 +1,132 @@
+package crawlspace
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+// Remote is a session with another process' crawlspace, for evaluating
+// commands there programmatically, over the same text protocol people use.
+// Telnet listeners are not supported. A Remote is not safe for concurrent
+// use.
+type Remote struct {
+	conn     net.Conn
+	in       *bufio.Reader
+	banner   []string
+	sentinel string
+}
+
+// DialRemote connects to the crawlspace at ep and waits for its first
+// prompt. ctx limits how long that may take.
+func DialRemote(ctx context.Context, ep Endpoint) (*Remote, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, ep.Network, ep.Address)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewRemote(ctx, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// NewRemote starts a Remote on conn, which must already be connected (and,
+// for example, authenticated) to a crawlspace listener, and waits for the
+// first prompt. The Remote closes conn when it is closed.
+func NewRemote(ctx context.Context, conn net.Conn) (*Remote, error) {
+	r := &Remote{
+		conn:     conn,
+		in:       bufio.NewReader(conn),
+		sentinel: fmt.Sprintf("crawlspace-remote-%016x", rand.Uint64()),
+	}
+	r.setDeadline(ctx)
+	banner, err := r.readUntil("> ")
+	if err != nil {
+		return nil, err
+	}
+	r.banner = strings.Split(strings.TrimSuffix(banner, "\n"), "\n")
+	return r, nil
+}
+
+// Process returns the remote process' main module and version, as shown at
+// the start of its sessions.
+func (r *Remote) Process() string {
+	if len(r.banner) < 2 {
+		return ""
+	}
+	return r.banner[1]
+}
+
+// Eval evaluates command, which must be a single line, in the remote
+// session, and returns its output as the session shows it, such as rendered
+// results or an error message. ctx limits how long it may take, after which
+// the Remote is unusable.
+func (r *Remote) Eval(ctx context.Context, command string) (string, error) {
+	if strings.ContainsAny(command, "\r\n") || strings.TrimSpace(command) == "" {
+		return "", errors.New("remote commands must be a single, non-empty line")
+	}
+	if _, err := reflectlang.Parse(command); errors.Is(err, reflectlang.ErrIncomplete) {
+		// the session would wait for the rest of the command.
+		return "", fmt.Errorf("remote commands must be complete: %w", err)
+	}
+	r.setDeadline(ctx)
+	// the sentinel's output marks the end of command's output, whatever it
+	// contains.
+	quoted := strconv.Quote(r.sentinel)
+	_, err := fmt.Fprintf(r.conn, "%s\n%s\n", command, quoted)
+	if err != nil {
+		return "", err
+	}
+	output, err := r.readUntil("> " + quoted + "\n> ")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(output, "\n"), nil
+}
+
+// Close ends the remote session.
+func (r *Remote) Close() error {
+	_, _ = fmt.Fprintf(r.conn, "quit()\n")
+	return r.conn.Close()
+}
+
+func (r *Remote) setDeadline(ctx context.Context) {
+	deadline, _ := ctx.Deadline()
+	_ = r.conn.SetDeadline(deadline)
+}
+
+// readUntil reads until suffix, returning what was read before it.
+func (r *Remote) readUntil(suffix string) (string, error) {
+	var buf strings.Builder
+	for !strings.HasSuffix(buf.String(), suffix) {
+		c, err := r.in.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("remote session ended: %w", err)
+		}
+		if c == '\r' && r.peekByte() == '\n' {
+			// for listeners writing CRLF line endings.
+			continue
+		}
+		buf.WriteByte(c)
+	}
+	output := buf.String()
+	return output[:len(output)-len(suffix)], nil
+}
+
+func (r *Remote) peekByte() byte {
+	next, err := r.in.Peek(1)
+	if err != nil {
+		return 0
+	}
+	return next[0]
+}
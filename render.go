@@ -0,0 +1,289 @@
+package crawlspace
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+const defaultMaxElements = 1000
+
+func (m *Crawlspace) maxElements() int {
+	if n := m.limits().MaxElements; n != 0 {
+		return n
+	}
+	return defaultMaxElements
+}
+
+// render returns the representation of v, and the number of elements it was
+// truncated to, or -1 if it was not truncated. If raw is true, values are
+// rendered without special casing, and control characters aren't escaped.
+func (m *Crawlspace) render(v reflect.Value, raw bool, symbolize func(uintptr) string) (
+	repr string, truncatedTo int) {
+	var b strings.Builder
+	truncatedTo, _ = m.renderTo(&b, v, raw, symbolize)
+	return b.String(), truncatedTo
+}
+
+// renderTo is like render, but writes the representation to w.
+func (m *Crawlspace) renderTo(w io.Writer, v reflect.Value, raw bool,
+	symbolize func(uintptr) string) (truncatedTo int, err error) {
+	if raw {
+		return m.renderValue(w, v, raw, symbolize)
+	}
+	sw := &sanitizer{w: w}
+	truncatedTo, err = m.renderValue(sw, v, raw, symbolize)
+	if flushErr := sw.Flush(); err == nil {
+		err = flushErr
+	}
+	return truncatedTo, err
+}
+
+func (m *Crawlspace) renderValue(w io.Writer, v reflect.Value, raw bool,
+	symbolize func(uintptr) string) (truncatedTo int, err error) {
+	if !raw {
+		if valueErr, ok := asError(v); ok {
+			_, err = io.WriteString(w, renderError(valueErr))
+			return -1, err
+		}
+		if addr, ok := asAddress(v); ok {
+			repr := reflectlang.Repr(v)
+			if sym := symbolize(addr); sym != "" {
+				repr += " <" + sym + ">"
+			}
+			_, err = io.WriteString(w, repr)
+			return -1, err
+		}
+	}
+	max := m.maxElements()
+	if max > 0 && v.IsValid() {
+		switch v.Kind() {
+		case reflect.Array, reflect.Slice:
+			if v.Len() > max {
+				if v.Kind() == reflect.Array && !v.CanAddr() {
+					c := reflect.New(v.Type()).Elem()
+					c.Set(v)
+					v = c
+				}
+				if err := reflectlang.WriteRepr(w, v.Slice(0, max)); err != nil {
+					return max, err
+				}
+				_, err = io.WriteString(w, " ...")
+				return max, err
+			}
+		}
+	}
+	return -1, reflectlang.WriteRepr(w, v)
+}
+
+// sanitize escapes control characters other than newlines and tabs, and
+// invalid UTF-8, so that rendered values can't send escape sequences to the
+// client's terminal.
+func sanitize(s string) string {
+	if utf8.ValidString(s) && strings.IndexFunc(s, isUnsafeControl) < 0 {
+		return s
+	}
+	var b strings.Builder
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&b, "\\x%02x", s[0])
+		case isUnsafeControl(r) && r < 0x100:
+			fmt.Fprintf(&b, "\\x%02x", r)
+		case isUnsafeControl(r):
+			fmt.Fprintf(&b, "\\u%04x", r)
+		default:
+			b.WriteString(s[:size])
+		}
+		s = s[size:]
+	}
+	return b.String()
+}
+
+// sanitizer is a writer that writes what is written to it to w, sanitized.
+// A character split across writes is held back until the next write, or
+// Flush.
+type sanitizer struct {
+	w       io.Writer
+	partial []byte
+}
+
+func (s *sanitizer) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(s.partial) > 0 {
+		p = append(s.partial, p...)
+		s.partial = nil
+	}
+	end := len(p)
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	s.partial = append(s.partial, p[end:]...)
+	_, err := io.WriteString(s.w, sanitize(string(p[:end])))
+	return n, err
+}
+
+// Flush writes any character held back, which is incomplete.
+func (s *sanitizer) Flush() error {
+	partial := s.partial
+	s.partial = nil
+	_, err := io.WriteString(s.w, sanitize(string(partial)))
+	return err
+}
+
+func isUnsafeControl(r rune) bool {
+	return r != '\n' && r != '\t' && unicode.IsControl(r)
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// isNilError returns true if v is a nil error interface value, such as the
+// last result of a successful call to a function returning an error. These
+// are elided when rendering results.
+func isNilError(v reflect.Value) bool {
+	return v.IsValid() && v.Type() == errorType && v.IsNil()
+}
+
+var unsafePointerType = reflect.TypeOf(unsafe.Pointer(nil))
+
+func asAddress(v reflect.Value) (uintptr, bool) {
+	if !v.IsValid() {
+		return 0, false
+	}
+	switch {
+	case v.Kind() == reflect.Uintptr:
+		return uintptr(v.Uint()), true
+	case v.Type() == unsafePointerType:
+		return uintptr(v.Pointer()), true
+	}
+	return 0, false
+}
+
+// symbolizer returns the function used to annotate addresses. If env binds
+// $symbolize to a func(uintptr) string, it is used, otherwise addresses are
+// only resolved if they are in a function.
+func symbolizer(env reflectlang.Environment) func(uintptr) string {
+	if v, ok := reflectlang.Lookup(env, "$symbolize"); ok && v.IsValid() && v.CanInterface() {
+		if fn, ok := v.Interface().(func(uintptr) string); ok {
+			return fn
+		}
+	}
+	return FuncSymbol
+}
+
+// FuncSymbol returns the name and offset of the function containing addr,
+// or the empty string if addr is not in a function.
+func FuncSymbol(addr uintptr) string {
+	fn := runtime.FuncForPC(addr)
+	if fn == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s+%#x", fn.Name(), addr-fn.Entry())
+}
+
+func asError(v reflect.Value) (error, bool) {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil, false
+	}
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer, reflect.Map, reflect.Slice,
+		reflect.Func, reflect.Chan:
+		if v.IsNil() {
+			return nil, false
+		}
+	}
+	err, ok := v.Interface().(error)
+	return err, ok
+}
+
+// renderError renders an error's message followed by its chain of wrapped
+// errors. If the error formats differently with %+v, such as errors that
+// carry a stack trace, that form is used instead of the chain.
+func renderError(err error) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "error(%T): %v", err, err)
+	if plus := fmt.Sprintf("%+v", err); plus != err.Error() {
+		b.WriteString("\n  " + strings.ReplaceAll(plus, "\n", "\n  "))
+		return b.String()
+	}
+	var walk func(err error, depth int)
+	walk = func(err error, depth int) {
+		var wrapped []error
+		switch err := err.(type) {
+		case interface{ Unwrap() error }:
+			if next := err.Unwrap(); next != nil {
+				wrapped = append(wrapped, next)
+			}
+		case interface{ Unwrap() []error }:
+			wrapped = err.Unwrap()
+		}
+		for _, next := range wrapped {
+			fmt.Fprintf(&b, "\n%scaused by (%T): %v", strings.Repeat("  ", depth), next, next)
+			walk(next, depth+1)
+		}
+	}
+	walk(err, 1)
+	return b.String()
+}
+
+func describe(v reflect.Value, truncatedTo int) string {
+	if !v.IsValid() {
+		return "nil"
+	}
+	desc := v.Type().String()
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer, reflect.Map, reflect.Slice,
+		reflect.Func, reflect.Chan:
+		if v.IsNil() {
+			return desc + "(nil)"
+		}
+	}
+	switch v.Kind() {
+	case reflect.Array, reflect.Slice, reflect.Map, reflect.Chan, reflect.String:
+		desc += fmt.Sprintf(" len=%d", v.Len())
+	}
+	if truncatedTo >= 0 {
+		desc += fmt.Sprintf(" (truncated to %d)", truncatedTo)
+	}
+	return desc
+}
+
+// summary returns a line describing rv, or the empty string if the rendered
+// values speak for themselves.
+func summary(rv []reflect.Value, truncatedTo []int) string {
+	interesting := len(rv) > 1
+	descs := make([]string, 0, len(rv))
+	for i, v := range rv {
+		descs = append(descs, describe(v, truncatedTo[i]))
+		if truncatedTo[i] >= 0 {
+			interesting = true
+		}
+		if v.IsValid() {
+			switch v.Kind() {
+			case reflect.Array, reflect.Slice, reflect.Map:
+				interesting = true
+			}
+		}
+	}
+	if !interesting {
+		return ""
+	}
+	noun := "values"
+	if len(rv) == 1 {
+		noun = "value"
+	}
+	return fmt.Sprintf("%d %s: %s", len(rv), noun, strings.Join(descs, ", "))
+}
@@ -0,0 +1,81 @@
+package crawlspace
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy configures how accept errors are retried.
+type RetryPolicy struct {
+	// MinDelay is the first delay. If zero, 5ms is used.
+	MinDelay time.Duration
+	// MaxDelay is the largest delay. If zero, 1s is used.
+	MaxDelay time.Duration
+	// MaxRetries is the number of consecutive retries allowed before giving
+	// up. If zero, retries are unlimited.
+	MaxRetries int
+	// Jitter randomizes each delay by up to this fraction of the delay in
+	// either direction. It should be between 0 and 1.
+	Jitter float64
+	// Retryable decides whether an error should be retried. If nil,
+	// IsTemporaryAcceptError is used.
+	Retryable func(err error) bool
+}
+
+func (p RetryPolicy) retryable(err error, retries int) bool {
+	if p.MaxRetries > 0 && retries >= p.MaxRetries {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsTemporaryAcceptError(err)
+}
+
+func (p RetryPolicy) next(delay time.Duration) time.Duration {
+	min, max := p.MinDelay, p.MaxDelay
+	if min <= 0 {
+		min = 5 * time.Millisecond
+	}
+	if max <= 0 {
+		max = time.Second
+	}
+	if delay == 0 {
+		delay = min
+	} else {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+func (p RetryPolicy) jitter(delay time.Duration) time.Duration {
+	if p.Jitter <= 0 {
+		return delay
+	}
+	return delay + time.Duration(p.Jitter*(2*rand.Float64()-1)*float64(delay))
+}
+
+// IsTemporaryAcceptError returns true if err, returned from a listener's
+// Accept, is likely to go away on its own, such as running out of file
+// descriptors or a connection aborted before it was accepted.
+func IsTemporaryAcceptError(err error) bool {
+	if err == nil || errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	for _, errno := range []syscall.Errno{
+		syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+		syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EINTR,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
@@ -0,0 +1,503 @@
+package crawlspace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+// ErrSessionEnded is returned by EvalOnce for sessions that have ended, by
+// quit() or Close.
+var ErrSessionEnded = errors.New("session ended")
+
+// Session is the state of an interactive session: its environment, with the
+// session builtins bound, and what earlier commands left behind, such as
+// previous results, tags, and watches. Interact runs a session for a text
+// client. Other frontends can use NewSession and EvalOnce to get the same
+// semantics. A session's commands run one at a time, so frontends may submit
+// them from several goroutines: overlapping calls to EvalOnce wait for each
+// other.
+//
+// Sessions are available to environment constructors passed to
+// NewWithSession, and in the shell as `session`, so that bindings can behave
+// differently per user or per session.
+type Session struct {
+	id     uint64
+	user   string
+	remote net.Addr
+	start  time.Time
+	ctx    context.Context
+	cancel func()
+
+	// listener and disconnect are from SessionOptions.
+	listener   string
+	disconnect func()
+
+	storeMtx sync.Mutex
+	store    map[string]interface{}
+
+	env        reflectlang.Environment
+	out        io.Writer
+	setBuiltin func(name string, v reflect.Value)
+	symbolize  func(uintptr) string
+	watches    *watchSet
+	notebook   *Notebook
+	onClose    func()
+
+	// mtx serializes commands with each other and with background work,
+	// such as watches, that uses the environment or output.
+	mtx         sync.Mutex
+	ended       bool
+	raw         bool
+	lastResults []reflect.Value
+	// previous is the result of the previous command, for notebook.keep().
+	previous Result
+	failures int
+	// pinnedReadOnly is set by readonly(), after which unlock() refuses to
+	// make the session writable.
+	pinnedReadOnly bool
+}
+
+// Result is the outcome of evaluating a command with EvalOnce.
+type Result struct {
+	Command string
+
+	// Values are the command's results. If the command called a function
+	// whose last result is an error, and the call succeeded, the last value
+	// is the nil error, which Interact elides.
+	Values []reflect.Value
+	// Reprs are how Values render, and TruncatedTo is, for each value, how
+	// many elements its repr was truncated to, or -1 if it wasn't. Spills
+	// describe, for each value, whether its repr was larger than SpillSize
+	// and spilled, in which case Reprs only has its first page.
+	Reprs       []string
+	TruncatedTo []int
+	Spills      []Spill
+	// Raw is true if the command called raw(...), in which case Reprs and
+	// ErrMessage are rendered without special casing or escaping.
+	Raw bool
+	// Summary describes the types and lengths of Values, if there are
+	// several or they are containers, unless NoSummary is set.
+	Summary string
+
+	// Elapsed is how long evaluation took, and Slow is true if it took at
+	// least SlowCommand.
+	Elapsed time.Duration
+	Slow    bool
+
+	// Err is why the command failed, if it did, and ErrMessage is how it
+	// renders. ReadOnly is true if this failure tripped SafeMode, making the
+	// session read-only.
+	Err        error
+	ErrMessage string
+	ReadOnly   bool
+}
+
+// SessionOptions describes who a session is for.
+type SessionOptions struct {
+	// User is who the session is for, if known.
+	User string
+	// RemoteAddr is where the session's client connected from, if anywhere.
+	RemoteAddr net.Addr
+	// Profile is the session's policy.
+	Profile Profile
+
+	// listener is the name of the config listener the session is from, if
+	// any, and disconnect disconnects its client, for Reload.
+	listener   string
+	disconnect func()
+}
+
+// NewSession starts a session using the crawlspace's environment
+// constructor, and evaluates the startup commands. The environment, startup
+// command errors, and background work such as onchange(...) watches, write
+// output to out. The session's context is derived from ctx.
+// The session should be closed when it is no longer needed.
+func (m *Crawlspace) NewSession(ctx context.Context, out io.Writer, opts SessionOptions) (
+	*Session, error) {
+	return m.newSession(ctx, out, m.env, opts)
+}
+
+func (m *Crawlspace) newSession(ctx context.Context, out io.Writer,
+	envFn func(s *Session) reflectlang.Environment, opts SessionOptions) (*Session, error) {
+	m.mtx.Lock()
+	m.lastSessionID++
+	id := m.lastSessionID
+	m.mtx.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Session{
+		id:     id,
+		user:   opts.User,
+		remote: opts.RemoteAddr,
+		start:  time.Now(),
+		ctx:    ctx,
+		cancel: cancel,
+		store:  map[string]interface{}{},
+		out:    out,
+
+		listener:   opts.listener,
+		disconnect: opts.disconnect,
+	}
+	env := envFn(s)
+	setBuiltin, err := m.builtinBinder(env, out)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	s.env, s.setBuiltin, s.symbolize = env, setBuiltin, symbolizer(env)
+
+	setBuiltin("session", reflect.ValueOf(s))
+	// errors from go statements are reported whenever they happen.
+	env["$goerror"] = reflect.ValueOf(func(err error) {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		if !s.ended {
+			_, _ = fmt.Fprintf(out, "\n%s%s\n", m.messages().GoErrorPrefix, sanitize(err.Error()))
+		}
+	})
+
+	// quit is lowered so that it works in read-only sessions.
+	setBuiltin("quit", reflectlang.LowerFunc(func(args []reflect.Value) ([]reflect.Value, error) {
+		s.ended = true
+		return nil, nil
+	}))
+	setBuiltin("raw", reflectlang.LowerFunc(func(args []reflect.Value) ([]reflect.Value, error) {
+		s.raw = true
+		if len(args) == 0 {
+			return s.lastResults, nil
+		}
+		return args, nil
+	}))
+	tagSet{}.bind(setBuiltin)
+
+	s.watches = &watchSet{
+		mtx: &s.mtx,
+		env: env,
+		out: out,
+		render: func(v reflect.Value) string {
+			repr, _ := m.render(v, false, s.symbolize)
+			return repr
+		},
+	}
+	setBuiltin("onchange", reflectlang.LowerFunc(s.watches.onchange))
+
+	setBuiltin("freeze", reflectlang.LowerEnvFunc(m.freeze))
+	m.bindNotebook(s)
+	if m.Internals != HideInternals {
+		m.bindInternals(env, setBuiltin)
+	}
+
+	if m.Exec.enabled() {
+		setBuiltin("exec", reflect.ValueOf(func(command string, args ...string) (ExecResult, error) {
+			return m.exec(s, command, args...)
+		}))
+	}
+
+	setBuiltin("unlock", reflectlang.LowerFunc(func(args []reflect.Value) ([]reflect.Value, error) {
+		if s.pinnedReadOnly {
+			return nil, fmt.Errorf("%w: the session was made read-only with readonly()",
+				reflectlang.ErrReadOnly)
+		}
+		s.failures = 0
+		reflectlang.SetReadOnly(env, false)
+		return nil, nil
+	}))
+	setBuiltin("readonly", reflectlang.LowerFunc(func(args []reflect.Value) ([]reflect.Value, error) {
+		s.pinnedReadOnly = true
+		reflectlang.SetReadOnly(env, true)
+		return nil, nil
+	}))
+
+	if opts.Profile.ReadOnly {
+		s.pinnedReadOnly = true
+		reflectlang.SetReadOnly(env, true)
+	}
+	reflectlang.SetPolicy(env, opts.Profile.policy())
+	reflectlang.SetPure(env, opts.Profile.pure())
+	m.mtx.Lock()
+	if m.live == nil {
+		m.live = map[*Session]struct{}{}
+	}
+	m.live[s] = struct{}{}
+	m.mtx.Unlock()
+	prevOnClose := s.onClose
+	s.onClose = func() {
+		m.mtx.Lock()
+		delete(m.live, s)
+		m.mtx.Unlock()
+		prevOnClose()
+	}
+
+	if err := m.runStartup(s, opts.Profile); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// runStartup evaluates the startup commands of the crawlspace, its config,
+// and the session's profile, in that order. Their results aren't shown, but
+// their errors are.
+func (m *Crawlspace) runStartup(s *Session, profile Profile) error {
+	var commands []string
+	commands = append(commands, m.Startup...)
+	commands = append(commands, m.currentConfig().Startup...)
+	commands = append(commands, profile.Startup...)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, command := range commands {
+		if _, err := reflectlang.Eval(command, s.env); err != nil {
+			_, err = fmt.Fprintf(s.out, "%sstartup %q: %s\n", m.messages().ErrorPrefix, command,
+				sanitize(err.Error()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ID identifies the session among the sessions of the process.
+func (s *Session) ID() uint64 { return s.id }
+
+// User returns who the session is for, if known.
+func (s *Session) User() string { return s.user }
+
+// RemoteAddr returns where the session's client connected from, or nil.
+func (s *Session) RemoteAddr() net.Addr { return s.remote }
+
+// Start returns when the session started.
+func (s *Session) Start() time.Time { return s.start }
+
+// Out returns the session's output.
+func (s *Session) Out() io.Writer { return s.out }
+
+// Context returns a context that is canceled when the session ends.
+func (s *Session) Context() context.Context { return s.ctx }
+
+// Get returns the value stored in the session under key, or nil.
+func (s *Session) Get(key string) interface{} {
+	s.storeMtx.Lock()
+	defer s.storeMtx.Unlock()
+	return s.store[key]
+}
+
+// Set stores value in the session under key, for the rest of the session.
+func (s *Session) Set(key string, value interface{}) {
+	s.storeMtx.Lock()
+	defer s.storeMtx.Unlock()
+	s.store[key] = value
+}
+
+func (s *Session) String() string {
+	if s.user != "" {
+		return fmt.Sprintf("<session %d for %s>", s.id, s.user)
+	}
+	return fmt.Sprintf("<session %d>", s.id)
+}
+
+// GoString is the same as String, for rendering in sessions.
+func (s *Session) GoString() string { return s.String() }
+
+// Notebook returns the session's notebook, of the commands and notes added
+// with notebook.keep() and notebook.note(...).
+func (s *Session) Notebook() *Notebook { return s.notebook }
+
+// Watches returns the session's running onchange(...) watches.
+func (s *Session) Watches() []*Watch {
+	s.watches.watchesMtx.Lock()
+	defer s.watches.watchesMtx.Unlock()
+	var running []*Watch
+	for _, w := range s.watches.watches {
+		if !w.stopped() {
+			running = append(running, w)
+		}
+	}
+	return running
+}
+
+// Ended returns true if the session has ended, by quit() or Close.
+func (s *Session) Ended() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.ended
+}
+
+// revoke ends the session and disconnects its client, after telling it
+// why.
+func (s *Session) revoke(message string) {
+	s.mtx.Lock()
+	if !s.ended {
+		_, _ = fmt.Fprintf(s.out, "\n%s\n", message)
+	}
+	s.mtx.Unlock()
+	_ = s.Close()
+	if s.disconnect != nil {
+		s.disconnect()
+	}
+}
+
+// Close ends the session, stopping its watches and canceling its context.
+// If anything new was added to the notebook, it is saved to NotebookFS.
+func (s *Session) Close() error {
+	s.mtx.Lock()
+	s.ended = true
+	s.mtx.Unlock()
+	s.watches.stopAll()
+	s.cancel()
+	s.onClose()
+	return nil
+}
+
+// Complete returns the completions of the name that ends at offset, in
+// runes, in line, a command being typed in the session, along with the
+// offset the name starts at, as reflectlang.CompleteAt finds them in the
+// session's environment. Nothing is evaluated. Complete only returns an
+// error if the session has ended.
+func (m *Crawlspace) Complete(s *Session, line string, offset int) (
+	candidates []string, start int, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.ended {
+		return nil, 0, ErrSessionEnded
+	}
+	candidates, start = reflectlang.CompleteAt(line, offset, s.env)
+	return candidates, start, nil
+}
+
+// EvalOnce evaluates a command in the session. A failing command is
+// described by the Result's Err. EvalOnce only returns an error if the
+// session has ended. It is safe for concurrent use, but waits for any
+// command already running in the session, and for background work such as
+// watches, to finish first.
+func (m *Crawlspace) EvalOnce(s *Session, line string) (Result, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.ended {
+		return Result{}, ErrSessionEnded
+	}
+
+	s.raw = false
+	res := Result{Command: line}
+	start := time.Now()
+	rv, err := reflectlang.Eval(line, s.env)
+	res.Elapsed = time.Since(start)
+	res.Raw = s.raw
+	m.count(func(counts *Metrics) {
+		counts.Commands++
+		if err != nil {
+			counts.FailedCommands++
+		}
+	})
+	if m.OnCommand != nil {
+		m.OnCommand(line, res.Elapsed, err)
+	}
+	limits := m.limits()
+	slow := time.Duration(limits.SlowCommand)
+	res.Slow = slow > 0 && res.Elapsed >= slow
+	if res.Slow && m.Logf != nil {
+		m.Logf("crawlspace: slow command (%v): %q", res.Elapsed, line)
+	}
+
+	if err != nil {
+		res.Err, res.ErrMessage = err, err.Error()
+		if len(reflectlang.Stack(err)) > 1 {
+			// the script stack shows which part of a nested command failed.
+			res.ErrMessage = fmt.Sprintf("%+v", err)
+		}
+		if !res.Raw {
+			res.ErrMessage = sanitize(res.ErrMessage)
+		}
+		if limits.SafeMode > 0 && isFlailing(err) {
+			s.failures++
+			if s.failures >= limits.SafeMode && !reflectlang.IsReadOnly(s.env) {
+				reflectlang.SetReadOnly(s.env, true)
+				res.ReadOnly = true
+			}
+		}
+		s.previous = res
+		return res, nil
+	}
+
+	s.failures = 0
+	s.lastResults = rv
+	s.setBuiltin("_", reflectlang.LowerFunc(func(args []reflect.Value) ([]reflect.Value, error) {
+		if len(args) != 0 {
+			return nil, fmt.Errorf("unexpected argument")
+		}
+		return rv, nil
+	}))
+	res.Values = rv
+	res.Reprs = make([]string, 0, len(rv))
+	res.TruncatedTo = make([]int, 0, len(rv))
+	res.Spills = make([]Spill, 0, len(rv))
+	for _, val := range rv {
+		w := &spillWriter{m: m, max: limits.SpillSize}
+		// the spill writer doesn't fail, and how spilling failed is part of
+		// the result.
+		truncated, _ := m.renderTo(w, val, res.Raw, s.symbolize)
+		repr, spill := w.finish()
+		res.Reprs = append(res.Reprs, repr)
+		res.TruncatedTo = append(res.TruncatedTo, truncated)
+		res.Spills = append(res.Spills, spill)
+	}
+	if !m.NoSummary {
+		res.Summary = summary(rv, res.TruncatedTo)
+	}
+	s.previous = res
+	return res, nil
+}
+
+// writeCommandResult writes res to the session's output the way Interact
+// shows it.
+func (m *Crawlspace) writeCommandResult(s *Session, res Result) (err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	out, msgs := s.out, m.messages()
+	if res.Err != nil {
+		_, err = fmt.Fprintf(out, "%s%s\n", msgs.ErrorPrefix, res.ErrMessage)
+		if err == nil && res.Slow {
+			_, err = fmt.Fprintf(out, msgs.Elapsed+"\n", res.Elapsed.Round(time.Microsecond))
+		}
+		if err == nil && res.ReadOnly {
+			_, err = fmt.Fprintf(out, msgs.SafeMode+"\n", m.limits().SafeMode)
+		}
+		return err
+	}
+	for i, repr := range res.Reprs {
+		if i == len(res.Values)-1 && isNilError(res.Values[i]) {
+			continue
+		}
+		_, err = fmt.Fprintf(out, "%s\n", resultText(repr, res.spill(i), msgs))
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case len(res.Values) == 0:
+		_, err = fmt.Fprintf(out, "%s\n", msgs.NoResults)
+	case len(res.Values) == 1 && isNilError(res.Values[0]):
+		_, err = fmt.Fprintf(out, "%s\n", msgs.OK)
+	}
+	if err != nil {
+		return err
+	}
+	if res.Summary != "" {
+		_, err = fmt.Fprintf(out, "(%s)\n", res.Summary)
+		if err != nil {
+			return err
+		}
+	}
+	if res.Slow {
+		_, err = fmt.Fprintf(out, msgs.Elapsed+"\n", res.Elapsed.Round(time.Microsecond))
+	}
+	return err
+}
@@ -0,0 +1,237 @@
+package crawlspace
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// spillPageSize is how much of a spilled result is shown in the session.
+const spillPageSize = 2048
+
+// SpillFS is a file system that results larger than SpillSize are written
+// to. It is an fs.FS, so spilled results can be read back, that can also
+// create files.
+type SpillFS interface {
+	fs.FS
+	// Create creates the named file. It may fail if the file exists.
+	Create(name string) (io.WriteCloser, error)
+}
+
+// SpillDir is a SpillFS that stores files in a directory on disk.
+type SpillDir string
+
+// Open implements fs.FS.
+func (d SpillDir) Open(name string) (fs.File, error) {
+	return os.DirFS(string(d)).Open(name)
+}
+
+// Create implements SpillFS. The file is only readable by the current
+// user, and it is an error if it exists, so that a file or symlink planted
+// in a shared directory can't be written through.
+func (d SpillDir) Create(name string) (io.WriteCloser, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.OpenFile(filepath.Join(string(d), filepath.FromSlash(name)),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+// defaultSpillDir returns the SpillDir used when SpillFS is nil, a
+// directory in os.TempDir() that only the current user can access,
+// creating it if needed.
+func defaultSpillDir() (SpillDir, error) {
+	dir := userTempDir("crawlspace-output")
+	return SpillDir(dir), privateDir(dir)
+}
+
+// userTempDir returns the path of a directory in os.TempDir() for the
+// current user, named after name and their uid.
+func userTempDir(name string) string {
+	if uid := os.Getuid(); uid >= 0 {
+		name = fmt.Sprintf("%s-%d", name, uid)
+	}
+	return filepath.Join(os.TempDir(), name)
+}
+
+// privateDir creates dir if it doesn't exist, and returns an error unless
+// it is a directory, and not a symlink to one, that is owned by the current
+// user and that no one else can access.
+func privateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if uid, ok := fileOwner(fi); ok && (uid != os.Getuid() || fi.Mode().Perm() != 0700) {
+		return fmt.Errorf("%s is not private: owned by uid %d, with mode %v", dir, uid,
+			fi.Mode().Perm())
+	}
+	return nil
+}
+
+var spillCount int64
+
+// Spill describes a rendered result larger than SpillSize, which was written
+// to SpillFS rather than kept in Result.Reprs.
+type Spill struct {
+	// Size is the rendered result's size in bytes, or 0 if it wasn't
+	// spilled.
+	Size int64
+	// Name is the spilled file's name in SpillFS, or its path if SpillFS is
+	// a SpillDir.
+	Name string
+	// Err is why spilling failed, if it did, in which case only the
+	// result's first page was kept.
+	Err error
+}
+
+// spillWriter is what results are rendered into. It keeps what is written
+// to it in memory until that is larger than max, if max is positive, and
+// then writes it to a new file in SpillFS instead, keeping only the first
+// page in memory.
+type spillWriter struct {
+	m   *Crawlspace
+	max int
+	// buf has what was written, or once spilling, enough of it to cut the
+	// first page at a character boundary.
+	buf      bytes.Buffer
+	spilling bool
+	file     io.WriteCloser
+	spill    Spill
+}
+
+func (w *spillWriter) Write(p []byte) (int, error) {
+	if !w.spilling {
+		if w.max <= 0 || w.buf.Len()+len(p) <= w.max {
+			return w.buf.Write(p)
+		}
+		w.startSpilling()
+	}
+	w.spill.Size += int64(len(p))
+	if room := spillPageSize + 1 - w.buf.Len(); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		w.buf.Write(p[:room])
+	}
+	if w.file != nil {
+		if _, err := w.file.Write(p); err != nil {
+			w.fail(err)
+		}
+	}
+	return len(p), nil
+}
+
+// startSpilling creates the spill file and moves what was kept in memory to
+// it.
+func (w *spillWriter) startSpilling() {
+	w.spilling = true
+	w.spill.Size = int64(w.buf.Len())
+	name := fmt.Sprintf("crawlspace-%d-%s-%d.txt", os.Getpid(),
+		time.Now().UTC().Format("20060102T150405"), atomic.AddInt64(&spillCount, 1))
+	fsys, err := w.m.spillFS()
+	if err == nil {
+		w.file, err = fsys.Create(name)
+	}
+	if err == nil {
+		_, err = w.file.Write(w.buf.Bytes())
+	}
+	if err != nil {
+		w.fail(err)
+	} else {
+		w.spill.Name = name
+		if dir, ok := fsys.(SpillDir); ok {
+			w.spill.Name = filepath.Join(string(dir), name)
+		}
+	}
+	if w.buf.Len() > spillPageSize+1 {
+		w.buf.Truncate(spillPageSize + 1)
+	}
+}
+
+func (w *spillWriter) fail(err error) {
+	if w.file != nil {
+		_ = w.file.Close()
+		w.file = nil
+	}
+	w.spill.Name, w.spill.Err = "", err
+}
+
+// finish closes the spill file, if there is one, and returns what was
+// written, or its first page if it was spilled, and where it was spilled.
+func (w *spillWriter) finish() (repr string, spill Spill) {
+	if !w.spilling {
+		return w.buf.String(), Spill{}
+	}
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			w.fail(err)
+		}
+		w.file = nil
+	}
+	return firstPage(w.buf.String()), w.spill
+}
+
+// spill returns how the ith of res's values was spilled.
+func (res Result) spill(i int) Spill {
+	if i < len(res.Spills) {
+		return res.Spills[i]
+	}
+	return Spill{}
+}
+
+// resultText returns how Interact shows a result that rendered as repr,
+// with a notice if it was spilled.
+func resultText(repr string, spill Spill, msgs Messages) string {
+	switch {
+	case spill.Size == 0:
+		return repr
+	case spill.Err != nil:
+		return fmt.Sprintf("%s ...\n"+msgs.SpillFailed, repr, spill.Size, spill.Err)
+	}
+	return fmt.Sprintf("%s ...\n"+msgs.Spilled, repr, spill.Size, spill.Name)
+}
+
+// spillFS returns where results are spilled.
+func (m *Crawlspace) spillFS() (SpillFS, error) {
+	if m.SpillFS != nil {
+		return m.SpillFS, nil
+	}
+	return defaultSpillDir()
+}
+
+func spill(fsys SpillFS, name, repr string) error {
+	fh, err := fsys.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(fh, repr)
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// firstPage returns the start of repr, cut at a character boundary.
+func firstPage(repr string) string {
+	if len(repr) <= spillPageSize {
+		return repr
+	}
+	end := spillPageSize
+	for end > 0 && !utf8.RuneStart(repr[end]) {
+		end--
+	}
+	return repr[:end]
+}
@@ -0,0 +1,71 @@
+package crawlspace
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+// tagSet holds the values a session has bookmarked with tag(value, label).
+type tagSet map[string]reflect.Value
+
+// tag implements tag(value, label), which bookmarks value under label,
+// replacing any value previously tagged with the same label. It returns
+// value.
+func (ts tagSet) tag(args []reflect.Value) ([]reflect.Value, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("usage: tag(value, label)")
+	}
+	label := indirectInterface(args[1])
+	if label.Kind() != reflect.String {
+		return nil, fmt.Errorf("tag label must be a string")
+	}
+	ts[label.String()] = args[0]
+	return args[:1], nil
+}
+
+// tags implements tags() and tags(label). With no arguments, it returns all
+// tagged values keyed by label. With a label, it returns the value tagged
+// with that label, with its original type.
+func (ts tagSet) tags(args []reflect.Value) ([]reflect.Value, error) {
+	switch len(args) {
+	case 0:
+		all := make(map[string]interface{}, len(ts))
+		for label, v := range ts {
+			if v.IsValid() && v.CanInterface() {
+				all[label] = v.Interface()
+			} else {
+				all[label] = nil
+			}
+		}
+		return []reflect.Value{reflect.ValueOf(all)}, nil
+	case 1:
+		label := indirectInterface(args[0])
+		if label.Kind() != reflect.String {
+			return nil, fmt.Errorf("tag label must be a string")
+		}
+		v, ok := ts[label.String()]
+		if !ok {
+			return nil, fmt.Errorf("no value tagged %q (tags: %v)", label.String(), ts.labels())
+		}
+		return []reflect.Value{v}, nil
+	}
+	return nil, fmt.Errorf("usage: tags() or tags(label)")
+}
+
+func (ts tagSet) labels() []string {
+	labels := make([]string, 0, len(ts))
+	for label := range ts {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// bind binds tag and tags with setBuiltin.
+func (ts tagSet) bind(setBuiltin func(name string, v reflect.Value)) {
+	setBuiltin("tag", reflectlang.LowerFunc(ts.tag))
+	setBuiltin("tags", reflectlang.LowerFunc(ts.tags))
+}
@@ -0,0 +1,132 @@
+package crawlspace
+
+import (
+	"io"
+)
+
+// telnet protocol bytes, from RFC 854 and RFC 857.
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWill = 251
+	telnetWont = 252
+	telnetDo   = 253
+	telnetDont = 254
+	telnetIAC  = 255
+
+	telnetOptEcho = 1
+	telnetOptSGA  = 3
+)
+
+// telnetNegotiation asks the client to echo input locally, as the server
+// doesn't echo, and to not wait for go aheads.
+var telnetNegotiation = []byte{
+	telnetIAC, telnetWont, telnetOptEcho,
+	telnetIAC, telnetWill, telnetOptSGA,
+	telnetIAC, telnetDo, telnetOptSGA,
+}
+
+// telnetReader strips telnet commands from input and normalizes line
+// endings, CRLF and CR NUL, to LF.
+type telnetReader struct {
+	in    io.Reader
+	state int
+}
+
+const (
+	telnetData = iota
+	telnetCR
+	telnetCommand
+	telnetOption
+	telnetSubnegotiation
+	telnetSubnegotiationIAC
+)
+
+func (r *telnetReader) Read(p []byte) (n int, err error) {
+	for n == 0 && err == nil {
+		var m int
+		m, err = r.in.Read(p)
+		n = r.decode(p[:m])
+	}
+	return n, err
+}
+
+// decode decodes p in place, returning the length of the decoded data.
+func (r *telnetReader) decode(p []byte) (n int) {
+	for _, b := range p {
+		switch r.state {
+		case telnetData, telnetCR:
+			cr := r.state == telnetCR
+			r.state = telnetData
+			switch {
+			case b == telnetIAC:
+				r.state = telnetCommand
+			case b == '\r':
+				r.state = telnetCR
+			case cr && (b == '\n' || b == 0):
+				p[n] = '\n'
+				n++
+			default:
+				if cr {
+					// a bare CR is followed by NUL, so this isn't
+					// expected, but keep the CR rather than losing it.
+					p[n] = '\r'
+					n++
+				}
+				p[n] = b
+				n++
+			}
+		case telnetCommand:
+			switch b {
+			case telnetIAC:
+				p[n] = telnetIAC
+				n++
+				r.state = telnetData
+			case telnetWill, telnetWont, telnetDo, telnetDont:
+				r.state = telnetOption
+			case telnetSB:
+				r.state = telnetSubnegotiation
+			default:
+				r.state = telnetData
+			}
+		case telnetOption:
+			r.state = telnetData
+		case telnetSubnegotiation:
+			if b == telnetIAC {
+				r.state = telnetSubnegotiationIAC
+			}
+		case telnetSubnegotiationIAC:
+			if b == telnetSE {
+				r.state = telnetData
+			} else {
+				r.state = telnetSubnegotiation
+			}
+		}
+	}
+	return n
+}
+
+// telnetWriter writes output with CRLF line endings, escaping IAC bytes.
+type telnetWriter struct {
+	out io.Writer
+	cr  bool
+}
+
+func (w *telnetWriter) Write(p []byte) (n int, err error) {
+	buf := make([]byte, 0, len(p)+len(p)/8)
+	for _, b := range p {
+		switch {
+		case b == '\n' && !w.cr:
+			buf = append(buf, '\r', '\n')
+		case b == telnetIAC:
+			buf = append(buf, telnetIAC, telnetIAC)
+		default:
+			buf = append(buf, b)
+		}
+		w.cr = b == '\r'
+	}
+	if _, err := w.out.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,106 @@
+package tools
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+// InterfaceDir is what dir(v) returns for a value of a non-empty interface
+// type, such as an io.Reader field. Methods are the interface's methods,
+// which any value of the interface has. Members are the methods and fields
+// of the value's dynamic type, which only this value is known to have.
+// Dynamic is empty if the value is nil.
+type InterfaceDir struct {
+	Interface string
+	Methods   []string
+	Dynamic   string
+	Members   []string
+}
+
+// GoString renders the methods and members on labeled lines.
+func (d InterfaceDir) GoString() string {
+	methods := fmt.Sprintf("%s (interface): %s", d.Interface, strings.Join(d.Methods, ", "))
+	if d.Dynamic == "" {
+		return methods + "\nnil (no dynamic type)"
+	}
+	return fmt.Sprintf("%s\n%s (dynamic type): %s", methods, d.Dynamic,
+		strings.Join(d.Members, ", "))
+}
+
+// dir implements dir(...), which lists env's names without arguments, and
+// otherwise the members of a namespace or value. suppressed are the names
+// of builtins that are left out of the list of env's names, unless they
+// were rebound.
+func dir(env reflectlang.Environment, suppressed map[string]reflect.Value,
+	args []reflect.Value) ([]reflect.Value, error) {
+	if len(args) == 0 {
+		names := []string{}
+		for _, name := range reflectlang.Names(env) {
+			if v, _ := reflectlang.Lookup(env, name); v != suppressed[name] {
+				names = append(names, name)
+			}
+		}
+		return []reflect.Value{reflect.ValueOf(names)}, nil
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("usage: dir() or dir(v)")
+	}
+	arg := args[0]
+	if arg.Kind() == reflect.Interface && arg.NumMethod() > 0 {
+		d := InterfaceDir{Interface: arg.Type().String(), Methods: members(arg.Type())}
+		if !arg.IsNil() {
+			d.Dynamic, d.Members = arg.Elem().Type().String(), members(arg.Elem().Type())
+		}
+		return []reflect.Value{reflect.ValueOf(d)}, nil
+	}
+	if arg.Kind() == reflect.Interface {
+		arg = arg.Elem()
+	}
+	if !arg.IsValid() {
+		return []reflect.Value{reflect.ValueOf([]string{})}, nil
+	}
+	if ns := reflectlang.AsNamespace(arg); ns != nil {
+		return []reflect.Value{reflect.ValueOf(ns.Dir())}, nil
+	}
+	if arg.CanInterface() && reflectlang.IsLowerFunc(arg.Interface()) {
+		return []reflect.Value{reflect.ValueOf([]string{})}, nil
+	}
+	return []reflect.Value{reflect.ValueOf(members(arg.Type()))}, nil
+}
+
+// members returns the sorted names of typ's methods and fields, and if typ
+// is a pointer, those of its element type.
+func members(typ reflect.Type) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, typ := range []reflect.Type{typ, derefType(typ)} {
+		for i := 0; i < typ.NumMethod(); i++ {
+			add(typ.Method(i).Name)
+		}
+		if typ.Kind() == reflect.Struct {
+			for i := 0; i < typ.NumField(); i++ {
+				add(typ.Field(i).Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// derefType returns the element type of typ if it is a pointer, or typ.
+func derefType(typ reflect.Type) reflect.Type {
+	if typ.Kind() == reflect.Pointer {
+		return typ.Elem()
+	}
+	return typ
+}
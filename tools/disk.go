@@ -0,0 +1,182 @@
+package tools
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DiskUsage describes the files under a path and the filesystem it is on.
+type DiskUsage struct {
+	Path string
+	// Bytes is the total apparent size of the regular files under Path.
+	// Symlinks are not followed.
+	Bytes int64
+	Files int
+	Dirs  int
+	// Errors is how many entries couldn't be read, and so aren't counted.
+	Errors int
+
+	// The FS fields describe Path's filesystem. Available is what
+	// unprivileged users can use.
+	FSTotal, FSFree, FSAvailable uint64
+	FSInodes, FSInodesFree       uint64
+}
+
+// diskUsage implements du(path).
+func diskUsage(path string) (DiskUsage, error) {
+	usage := DiskUsage{Path: path}
+	err := statfs(path, &usage)
+	if err != nil {
+		return usage, err
+	}
+	err = filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			usage.Errors++
+			return nil
+		}
+		switch {
+		case d.IsDir():
+			usage.Dirs++
+		case d.Type().IsRegular():
+			info, err := d.Info()
+			if err != nil {
+				usage.Errors++
+				return nil
+			}
+			usage.Files++
+			usage.Bytes += info.Size()
+		}
+		return nil
+	})
+	return usage, err
+}
+
+// IOStats describes the process' I/O, from /proc/self/io.
+type IOStats struct {
+	// Window is how long the stats were collected for, or zero if they are
+	// totals since the process started.
+	Window time.Duration
+	// ReadBytes and WriteBytes are what the process caused to be fetched
+	// from or sent to storage.
+	ReadBytes, WriteBytes int64
+	// ReadChars and WriteChars are what the process read and wrote with
+	// system calls, including from the page cache, pipes, and sockets.
+	ReadChars, WriteChars             int64
+	ReadSyscalls, WriteSyscalls       int64
+	ReadBytesPerSec, WriteBytesPerSec float64
+}
+
+// ioStats implements iostat(duration). With a positive duration, it
+// reports the I/O during the next duration. Otherwise, it reports totals.
+func ioStats(window time.Duration) (IOStats, error) {
+	before, err := readProcIO()
+	if err != nil || window <= 0 {
+		return before, err
+	}
+	time.Sleep(window)
+	after, err := readProcIO()
+	if err != nil {
+		return after, err
+	}
+	stats := IOStats{
+		Window:        window,
+		ReadBytes:     after.ReadBytes - before.ReadBytes,
+		WriteBytes:    after.WriteBytes - before.WriteBytes,
+		ReadChars:     after.ReadChars - before.ReadChars,
+		WriteChars:    after.WriteChars - before.WriteChars,
+		ReadSyscalls:  after.ReadSyscalls - before.ReadSyscalls,
+		WriteSyscalls: after.WriteSyscalls - before.WriteSyscalls,
+	}
+	stats.ReadBytesPerSec = float64(stats.ReadBytes) / window.Seconds()
+	stats.WriteBytesPerSec = float64(stats.WriteBytes) / window.Seconds()
+	return stats, nil
+}
+
+func readProcIO() (IOStats, error) {
+	f, err := os.Open("/proc/self/io")
+	if err != nil {
+		return IOStats{}, err
+	}
+	defer func() { _ = f.Close() }()
+	return parseProcIO(f)
+}
+
+// parseProcIO parses the contents of /proc/self/io.
+func parseProcIO(r io.Reader) (IOStats, error) {
+	var stats IOStats
+	fields := map[string]*int64{
+		"rchar":       &stats.ReadChars,
+		"wchar":       &stats.WriteChars,
+		"syscr":       &stats.ReadSyscalls,
+		"syscw":       &stats.WriteSyscalls,
+		"read_bytes":  &stats.ReadBytes,
+		"write_bytes": &stats.WriteBytes,
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		name, value, found := strings.Cut(scanner.Text(), ":")
+		field := fields[name]
+		if !found || field == nil {
+			continue
+		}
+		var err error
+		*field, err = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return IOStats{}, fmt.Errorf("unexpected /proc/self/io line %q", scanner.Text())
+		}
+	}
+	return stats, scanner.Err()
+}
+
+// FDStats describes the process' open file descriptors.
+type FDStats struct {
+	Open int
+	// Limit and MaxLimit are the soft and hard limits on open descriptors.
+	Limit, MaxLimit uint64
+	// ByKind counts the open descriptors by what they refer to: "file",
+	// "socket", "pipe", "anon_inode", or "unknown".
+	ByKind map[string]int
+}
+
+// fdStats implements fds().
+func fdStats() (FDStats, error) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return FDStats{}, err
+	}
+	stats := FDStats{ByKind: map[string]int{}}
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", entry.Name()))
+		if err != nil {
+			// the descriptor was closed, possibly the directory's own.
+			continue
+		}
+		stats.Open++
+		stats.ByKind[fdKind(target)]++
+	}
+	stats.Limit, stats.MaxLimit, err = fdLimits()
+	return stats, err
+}
+
+// fdKind returns the FDStats.ByKind kind of a descriptor, given the target
+// of its /proc/self/fd link.
+func fdKind(target string) string {
+	switch {
+	case strings.HasPrefix(target, "/"):
+		return "file"
+	case strings.HasPrefix(target, "socket:"):
+		return "socket"
+	case strings.HasPrefix(target, "pipe:"):
+		return "pipe"
+	case strings.HasPrefix(target, "anon_inode:"):
+		return "anon_inode"
+	}
+	return "unknown"
+}
@@ -0,0 +1,25 @@
+package tools
+
+import (
+	"syscall"
+)
+
+func statfs(path string, usage *DiskUsage) error {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return err
+	}
+	bsize := uint64(st.Bsize)
+	usage.FSTotal = st.Blocks * bsize
+	usage.FSFree = st.Bfree * bsize
+	usage.FSAvailable = st.Bavail * bsize
+	usage.FSInodes, usage.FSInodesFree = st.Files, st.Ffree
+	return nil
+}
+
+func fdLimits() (limit, max uint64, err error) {
+	var rlimit syscall.Rlimit
+	err = syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit)
+	return rlimit.Cur, rlimit.Max, err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package tools
+
+import (
+	"errors"
+)
+
+var errNotLinux = errors.New("only supported on linux")
+
+func statfs(path string, usage *DiskUsage) error { return errNotLinux }
+
+func fdLimits() (limit, max uint64, err error) { return 0, 0, errNotLinux }
@@ -1,6 +1,6 @@
 module github.com/jtolio/crawlspace/tools
 
-go 1.16
+go 1.18
 
 require (
 	github.com/jtolio/crawlspace v0.0.0-20231116162947-3ec5cc6b36c5
@@ -8,3 +8,11 @@ require (
 	github.com/zeebo/goof v0.0.0-20230907150950-e9457bc94477
 	github.com/zeebo/sudo v1.0.2
 )
+
+require (
+	github.com/kr/text v0.2.0 // indirect
+	github.com/rogpeppe/go-internal v1.9.0 // indirect
+	github.com/zeebo/errs v1.3.0 // indirect
+)
+
+replace github.com/jtolio/crawlspace => ../
@@ -0,0 +1,111 @@
+package tools
+
+import (
+	"fmt"
+	"runtime/metrics"
+	"sort"
+	"time"
+)
+
+// schedlatInterval is how long the probe sleeps between samples.
+const schedlatInterval = time.Millisecond
+
+// SchedLatency describes goroutine scheduling latency and GC assist pressure
+// during a window, for confirming or ruling out runtime starvation.
+type SchedLatency struct {
+	Window time.Duration
+	// Samples is how many times the probe slept. Each sample's latency is how
+	// much later than requested the probe goroutine woke up and ran.
+	Samples                 int
+	Min, P50, P90, P99, Max time.Duration
+
+	// GCCycles is how many GC cycles completed during the window.
+	GCCycles uint64
+	// GCAssistCPU is the CPU time goroutines spent assisting the GC during
+	// the window, and GCAssistFraction is its fraction of all CPU time used.
+	// They are -1 if unknown. The runtime only updates CPU time estimates
+	// during GC, so they may lag, and the fraction is unknown if no GC cycle
+	// completed.
+	GCAssistCPU      time.Duration
+	GCAssistFraction float64
+}
+
+// schedLatency implements schedlat(duration). It samples by sleeping
+// repeatedly in a goroutine, so a starved scheduler shows up as late
+// wakeups.
+func schedLatency(window time.Duration) (SchedLatency, error) {
+	if window <= 0 {
+		return SchedLatency{}, fmt.Errorf("window must be positive, got %v", window)
+	}
+	before := readSchedMetrics()
+
+	done := make(chan []time.Duration)
+	go func() {
+		var latencies []time.Duration
+		deadline := time.Now().Add(window)
+		for time.Now().Before(deadline) {
+			start := time.Now()
+			time.Sleep(schedlatInterval)
+			latency := time.Since(start) - schedlatInterval
+			if latency < 0 {
+				latency = 0
+			}
+			latencies = append(latencies, latency)
+		}
+		done <- latencies
+	}()
+	latencies := <-done
+
+	return summarizeSchedLatency(window, latencies, before, readSchedMetrics()), nil
+}
+
+// summarizeSchedLatency computes a window's SchedLatency from its sampled
+// latencies, which it sorts, and the runtime metrics before and after it.
+func summarizeSchedLatency(window time.Duration, latencies []time.Duration,
+	before, after schedMetrics) SchedLatency {
+	stats := SchedLatency{
+		Window:           window,
+		Samples:          len(latencies),
+		GCCycles:         after.gcCycles - before.gcCycles,
+		GCAssistCPU:      -1,
+		GCAssistFraction: -1,
+	}
+	if before.assist >= 0 && after.assist >= 0 {
+		assist := after.assist - before.assist
+		stats.GCAssistCPU = time.Duration(assist * float64(time.Second))
+		if total := after.total - before.total; total > 0 {
+			stats.GCAssistFraction = assist / total
+		}
+	}
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		percentile := func(p int) time.Duration { return latencies[(len(latencies)-1)*p/100] }
+		stats.Min, stats.P50, stats.P90 = latencies[0], percentile(50), percentile(90)
+		stats.P99, stats.Max = percentile(99), latencies[len(latencies)-1]
+	}
+	return stats
+}
+
+type schedMetrics struct {
+	gcCycles uint64
+	// assist and total are CPU seconds, or -1 if unsupported.
+	assist, total float64
+}
+
+func readSchedMetrics() schedMetrics {
+	samples := []metrics.Sample{
+		{Name: "/gc/cycles/total:gc-cycles"},
+		{Name: "/cpu/classes/gc/mark/assist:cpu-seconds"},
+		{Name: "/cpu/classes/total:cpu-seconds"},
+	}
+	metrics.Read(samples)
+	m := schedMetrics{assist: -1, total: -1}
+	if samples[0].Value.Kind() == metrics.KindUint64 {
+		m.gcCycles = samples[0].Value.Uint64()
+	}
+	if samples[1].Value.Kind() == metrics.KindFloat64 &&
+		samples[2].Value.Kind() == metrics.KindFloat64 {
+		m.assist, m.total = samples[1].Value.Float64(), samples[2].Value.Float64()
+	}
+	return m
+}
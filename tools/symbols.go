@@ -0,0 +1,62 @@
+//go:build !crawlspace_pure
+// +build !crawlspace_pure
+
+package tools
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/jtolio/crawlspace"
+)
+
+type globalSymbol struct {
+	name       string
+	start, end uintptr
+}
+
+var (
+	globalSymbolsOnce sync.Once
+	globalSymbols     []globalSymbol
+)
+
+// loadGlobalSymbols builds a table of the address ranges of all globals the
+// troop can find.
+func loadGlobalSymbols() {
+	names, err := troop.Globals()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		v, err := troop.Global(name)
+		if err != nil || !v.IsValid() || !v.CanAddr() {
+			continue
+		}
+		start := v.UnsafeAddr()
+		globalSymbols = append(globalSymbols, globalSymbol{
+			name:  name,
+			start: start,
+			end:   start + v.Type().Size(),
+		})
+	}
+	sort.Slice(globalSymbols, func(i, j int) bool {
+		return globalSymbols[i].start < globalSymbols[j].start
+	})
+}
+
+// symbolize returns the function or global variable addr points into, with
+// an offset, or the empty string if unknown.
+func symbolize(addr uintptr) string {
+	if sym := crawlspace.FuncSymbol(addr); sym != "" {
+		return sym
+	}
+	globalSymbolsOnce.Do(loadGlobalSymbols)
+	i := sort.Search(len(globalSymbols), func(i int) bool {
+		return globalSymbols[i].end > addr
+	})
+	if i < len(globalSymbols) && globalSymbols[i].start <= addr {
+		return fmt.Sprintf("%s+%#x", globalSymbols[i].name, addr-globalSymbols[i].start)
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+package tools
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+)
+
+// ThreadStats describes the process' OS threads and cgo use, for debugging
+// thread exhaustion and cgo leaks.
+type ThreadStats struct {
+	// OSThreads is how many threads the process has, according to /proc, or
+	// -1 if unknown.
+	OSThreads int
+	// ThreadsCreated is how many threads the runtime has created.
+	ThreadsCreated int
+	// LockedGoroutines is how many goroutines are locked to their thread,
+	// by runtime.LockOSThread or by running a cgo callback.
+	LockedGoroutines int
+	Goroutines       int
+	CgoCalls         int64
+	GOMAXPROCS       int
+}
+
+// threadStats implements threads().
+func threadStats() ThreadStats {
+	return ThreadStats{
+		OSThreads:        osThreads(),
+		ThreadsCreated:   pprof.Lookup("threadcreate").Count(),
+		LockedGoroutines: lockedGoroutines(),
+		Goroutines:       runtime.NumGoroutine(),
+		CgoCalls:         runtime.NumCgoCall(),
+		GOMAXPROCS:       runtime.GOMAXPROCS(0),
+	}
+}
+
+// osThreads returns the Threads line of /proc/self/status, or -1.
+func osThreads() int {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return -1
+	}
+	return parseThreads(string(status))
+}
+
+// parseThreads returns the Threads line of the contents of /proc/self/status,
+// or -1.
+func parseThreads(status string) int {
+	for _, line := range strings.Split(status, "\n") {
+		if strings.HasPrefix(line, "Threads:") {
+			n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Threads:")))
+			if err != nil {
+				return -1
+			}
+			return n
+		}
+	}
+	return -1
+}
+
+// lockedGoroutines counts the goroutines whose traceback header says they
+// are locked to their thread. The runtime doesn't expose this otherwise.
+func lockedGoroutines() int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	return countLocked(buf)
+}
+
+// countLocked counts the goroutines of a runtime.Stack traceback that are
+// locked to their thread.
+func countLocked(stack []byte) int {
+	count := 0
+	for _, line := range bytes.Split(stack, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("goroutine ")) &&
+			bytes.Contains(line, []byte("locked to thread")) {
+			count++
+		}
+	}
+	return count
+}
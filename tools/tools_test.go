@@ -0,0 +1,224 @@
+package tools
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+func TestParseProcIO(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected IOStats
+		err      bool
+	}{
+		{
+			input: "rchar: 100\nwchar: 200\nsyscr: 3\nsyscw: 4\nread_bytes: 4096\n" +
+				"write_bytes: 8192\ncancelled_write_bytes: 0\n",
+			expected: IOStats{ReadChars: 100, WriteChars: 200, ReadSyscalls: 3,
+				WriteSyscalls: 4, ReadBytes: 4096, WriteBytes: 8192},
+		},
+		{input: "", expected: IOStats{}},
+		{input: "rchar 100\nunknown: 5\n", expected: IOStats{}},
+		{input: "rchar: many\n", err: true},
+	} {
+		stats, err := parseProcIO(strings.NewReader(tc.input))
+		if (err != nil) != tc.err {
+			t.Fatalf("%q: unexpected error %v", tc.input, err)
+		}
+		if err == nil && stats != tc.expected {
+			t.Fatalf("%q: expected %+v, got %+v", tc.input, tc.expected, stats)
+		}
+	}
+}
+
+func TestFDKind(t *testing.T) {
+	for target, expected := range map[string]string{
+		"/dev/null":              "file",
+		"/tmp/x (deleted)":       "file",
+		"socket:[12345]":         "socket",
+		"pipe:[678]":             "pipe",
+		"anon_inode:[eventpoll]": "anon_inode",
+		"net:[4026531992]":       "unknown",
+		"":                       "unknown",
+	} {
+		if kind := fdKind(target); kind != expected {
+			t.Fatalf("%q: expected %q, got %q", target, expected, kind)
+		}
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("du is only supported on linux")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a"), []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "b"), []byte("defgh"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := diskUsage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Bytes != 8 || usage.Files != 2 || usage.Dirs != 2 || usage.Errors != 0 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+	if usage.FSTotal == 0 || usage.FSAvailable > usage.FSTotal {
+		t.Fatalf("unexpected filesystem usage %+v", usage)
+	}
+}
+
+func TestParseThreads(t *testing.T) {
+	for status, expected := range map[string]int{
+		"Name:\tx\nThreads:\t12\nSigQ:\t0/1\n": 12,
+		"Threads: 3":                           3,
+		"Name:\tx\n":                           -1,
+		"Threads:\tmany\n":                     -1,
+		"":                                     -1,
+	} {
+		if n := parseThreads(status); n != expected {
+			t.Fatalf("%q: expected %d, got %d", status, expected, n)
+		}
+	}
+}
+
+func TestCountLocked(t *testing.T) {
+	stack := "goroutine 1 [running, locked to thread]:\nmain.main()\n\n" +
+		"goroutine 2 [chan receive]:\nmain.f()\n\tlocked to thread\n\n" +
+		"goroutine 3 [syscall, locked to thread]:\nmain.g()\n"
+	if n := countLocked([]byte(stack)); n != 2 {
+		t.Fatalf("expected 2 locked goroutines, got %d", n)
+	}
+	if n := countLocked(nil); n != 0 {
+		t.Fatalf("expected no locked goroutines, got %d", n)
+	}
+}
+
+func TestSummarizeSchedLatency(t *testing.T) {
+	var latencies []time.Duration
+	for i := 100; i > 0; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	stats := summarizeSchedLatency(time.Second, latencies,
+		schedMetrics{gcCycles: 1, assist: 1, total: 10},
+		schedMetrics{gcCycles: 3, assist: 2, total: 20})
+	expected := SchedLatency{
+		Window:           time.Second,
+		Samples:          100,
+		Min:              time.Millisecond,
+		P50:              50 * time.Millisecond,
+		P90:              90 * time.Millisecond,
+		P99:              99 * time.Millisecond,
+		Max:              100 * time.Millisecond,
+		GCCycles:         2,
+		GCAssistCPU:      time.Second,
+		GCAssistFraction: 0.1,
+	}
+	if stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+
+	// unsupported metrics and no samples
+	stats = summarizeSchedLatency(time.Second, nil,
+		schedMetrics{assist: -1, total: -1}, schedMetrics{assist: -1, total: -1})
+	expected = SchedLatency{Window: time.Second, GCAssistCPU: -1, GCAssistFraction: -1}
+	if stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+
+	// no CPU time used, so the fraction is unknown
+	stats = summarizeSchedLatency(time.Second, nil,
+		schedMetrics{assist: 1, total: 10}, schedMetrics{assist: 1, total: 10})
+	if stats.GCAssistCPU != 0 || stats.GCAssistFraction != -1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+type dirTest struct {
+	A int
+	b int
+}
+
+func (d *dirTest) String() string { return fmt.Sprint(d.A, d.b) }
+
+func TestDir(t *testing.T) {
+	hidden := reflect.ValueOf(1)
+	env := reflectlang.Environment{
+		"x":      reflect.ValueOf(2),
+		"hidden": hidden,
+		"shown":  reflect.ValueOf(3),
+	}
+	// builtins are left out, unless they were rebound.
+	suppressed := map[string]reflect.Value{"hidden": hidden, "shown": reflect.ValueOf(4)}
+	results, err := dir(env, suppressed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := results[0].Interface(); !reflect.DeepEqual(names, []string{"shown", "x"}) {
+		t.Fatalf("unexpected names %v", names)
+	}
+
+	var nilStringer fmt.Stringer
+	var stringer fmt.Stringer = &dirTest{}
+	for _, tc := range []struct {
+		arg      reflect.Value
+		expected interface{}
+	}{
+		{reflect.ValueOf(&dirTest{}), []string{"A", "String", "b"}},
+		{reflect.ValueOf(dirTest{}), []string{"A", "b"}},
+		{reflect.ValueOf(&nilStringer).Elem(),
+			InterfaceDir{Interface: "fmt.Stringer", Methods: []string{"String"}}},
+		{reflect.ValueOf(&stringer).Elem(),
+			InterfaceDir{Interface: "fmt.Stringer", Methods: []string{"String"},
+				Dynamic: "*tools.dirTest", Members: []string{"A", "String", "b"}}},
+		{reflect.Value{}, []string{}},
+		{reflectlang.LowerFunc(
+			func(args []reflect.Value) ([]reflect.Value, error) { return nil, nil }),
+			[]string{}},
+	} {
+		results, err := dir(env, nil, []reflect.Value{tc.arg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || !reflect.DeepEqual(results[0].Interface(), tc.expected) {
+			t.Fatalf("%v: expected %#v, got %#v", tc.arg, tc.expected, results)
+		}
+	}
+
+	if _, err := dir(env, nil, []reflect.Value{hidden, hidden}); err == nil {
+		t.Fatal("expected usage error")
+	}
+}
+
+func TestImportPathToNameBasic(t *testing.T) {
+	for path, expected := range map[string]string{
+		"fmt":                             "fmt",
+		"net/http":                        "http",
+		"github.com/jtolio/crawlspace":    "crawlspace",
+		"github.com/jtolio/crawlspace/v2": "crawlspace",
+		"gopkg.in/yaml.v2":                "yaml",
+		"github.com/google/go-cmp":        "cmp",
+		"github.com/mattn/sqlite-go":      "sqlite",
+		"v2":                              "v2",
+	} {
+		if name := importPathToNameBasic(path); name != expected {
+			t.Fatalf("%q: expected %q, got %q", path, expected, name)
+		}
+	}
+}
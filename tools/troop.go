@@ -0,0 +1,296 @@
+//go:build !crawlspace_pure
+// +build !crawlspace_pure
+
+package tools
+
+import (
+	"debug/dwarf"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unsafe"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+	"github.com/kr/pretty"
+	"github.com/zeebo/goof"
+	"github.com/zeebo/sudo"
+)
+
+var troop goof.Troop
+
+// addTroop adds the builtins that use the troop to env.
+func addTroop(env reflectlang.Environment) {
+	env["$forcedImports"] = reflect.ValueOf(func() []interface{} {
+		return []interface{}{
+			reflect.NewAt,
+			reflect.TypeOf(unsafe.Pointer(nil)),
+			pretty.Sprint,
+		}
+	})
+
+	env["$symbolize"] = reflect.ValueOf(symbolize)
+
+	reflectlang.DefineBuiltin(env, "packages", reflect.ValueOf(func(contains ...string) []string {
+		pkgs := map[string]bool{}
+		process := func(names []string) {
+			for _, name := range names {
+				if strings.HasPrefix(name, "go:") ||
+					strings.HasPrefix(name, "struct {") {
+					continue
+				}
+				name = strings.TrimPrefix(name, "type:.eq.")
+				name = strings.TrimPrefix(name, "type:.hash.")
+				lastSlash := strings.LastIndex(name, "/")
+				pkgPrefix := ""
+				if lastSlash >= 0 {
+					pkgPrefix = name[:lastSlash]
+					name = name[lastSlash:]
+				}
+
+				pos := strings.Index(name, ".")
+				if pos < 0 {
+					pkgs[pkgPrefix] = true
+					continue
+				}
+				pkgs[pkgPrefix+name[:pos]] = true
+			}
+		}
+
+		names, err := troop.Globals()
+		assert(err)
+		process(names)
+
+		names, err = troop.Functions()
+		assert(err)
+		process(names)
+
+		types, err := troop.Types()
+		assert(err)
+		for _, typ := range types {
+			pkgs[typ.PkgPath()] = true
+		}
+
+		names = make([]string, 0, len(pkgs))
+		for pkg := range pkgs {
+			okayToAdd := true
+			for _, needle := range contains {
+				if !strings.Contains(pkg, needle) {
+					okayToAdd = false
+					break
+				}
+			}
+			if okayToAdd {
+				names = append(names, pkg)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}))
+
+	reflectlang.DefineBuiltin(env, "sudo", reflectlang.LowerFunc(func(args []reflect.Value) ([]reflect.Value, error) {
+		result := make([]reflect.Value, 0, len(args))
+		for _, arg := range args {
+			result = append(result, sudo.Sudo(arg))
+		}
+		return result, nil
+	}))
+
+	env["$import"] = reflectlang.LowerEnvFunc(func(env reflectlang.Environment, args []reflect.Value) ([]reflect.Value, error) {
+
+		if len(args) != 2 {
+			return nil, fmt.Errorf("import expected 2 arguments")
+		}
+		if args[0].Kind() != reflect.String {
+			return nil, fmt.Errorf("import expected a target name argument")
+		}
+		if args[1].Kind() != reflect.String {
+			return nil, fmt.Errorf("import expected a package name")
+		}
+
+		target := args[0].String()
+		pkgName := args[1].String()
+
+		if target == "_" {
+			return nil, nil
+		}
+		members := map[string]func() (reflect.Value, error){}
+
+		types, err := troop.Types()
+		if err != nil {
+			return nil, err
+		}
+		for _, typ := range types {
+			if typ.PkgPath() == pkgName {
+				typ := typ
+				members[typ.Name()] = func() (reflect.Value, error) {
+					return reflect.ValueOf(typ), nil
+				}
+			}
+		}
+
+		scanList := func(names []string, loader func(name string) (reflect.Value, error)) {
+			for _, name := range names {
+				if !strings.HasPrefix(name, pkgName+".") {
+					continue
+				}
+				localName := strings.TrimPrefix(name, pkgName+".")
+				if !reflectlang.IsIdentifier(localName) {
+					continue
+				}
+				name := name
+				members[localName] = func() (reflect.Value, error) { return loader(name) }
+			}
+		}
+
+		globals, err := troop.Globals()
+		if err != nil {
+			return nil, err
+		}
+		scanList(globals, troop.Global)
+
+		functions, err := troop.Functions()
+		if err != nil {
+			return nil, err
+		}
+		scanList(functions, func(name string) (reflect.Value, error) {
+			return troopFunc(name), nil
+		})
+
+		if target == "." {
+			for localName, load := range members {
+				v, err := load()
+				if err != nil {
+					return nil, err
+				}
+				env[localName] = v
+			}
+			return nil, nil
+		}
+
+		if target == "" {
+			target = importPathToNameBasic(pkgName)
+		}
+		if len(members) == 0 {
+			return nil, fmt.Errorf("package %q not found", pkgName)
+		}
+		names := make([]string, 0, len(members))
+		for localName := range members {
+			names = append(names, localName)
+		}
+		sort.Strings(names)
+
+		// globals are loaded on first access, since loading every global in a
+		// large package is slow.
+		ns := reflectlang.NewNamespace(pkgName, "")
+		ns.SetLazy(func() []string { return names },
+			func(name string) (reflect.Value, bool, error) {
+				load, ok := members[name]
+				if !ok {
+					return reflect.Value{}, false, nil
+				}
+				v, err := load()
+				return v, err == nil, err
+			})
+		env[target] = reflect.ValueOf(ns)
+
+		return nil, nil
+	})
+}
+
+// troopFunc returns a callable value that calls the function name via the
+// troop.
+func troopFunc(name string) reflect.Value {
+	return reflectlang.LowerEnvFunc(func(env reflectlang.Environment, args []reflect.Value) (
+		_ []reflect.Value, err error) {
+		if reflectlang.IsReadOnly(env) {
+			return nil, fmt.Errorf("%w: cannot call %s", reflectlang.ErrReadOnly, name)
+		}
+		iargs, err := troopArgs(name, args)
+		if err != nil {
+			return nil, err
+		}
+
+		results, err := troop.Call(name, iargs...)
+		if err != nil {
+			return nil, err
+		}
+
+		// the troop returns results as interface{}, losing their types, so
+		// error results are restored from its metadata. This way they can be
+		// checked with ? and the try helpers like native functions' errors.
+		resultTypes := troopResultTypes(name, len(args))
+		if len(resultTypes) != len(results) {
+			resultTypes = nil
+		}
+		var iresults []reflect.Value
+		for i, res := range results {
+			v := reflect.ValueOf(res)
+			if resultTypes != nil && resultTypes[i] == "error" {
+				err, _ := res.(error)
+				v = reflect.ValueOf(&err).Elem()
+			}
+			iresults = append(iresults, v)
+		}
+
+		return iresults, nil
+	})
+}
+
+// troopResultTypes returns the names of the result types of the function
+// name, when called with nargs arguments. The troop doesn't expose function
+// signatures, so they are read from its function metadata, and nil is
+// returned if that fails.
+func troopResultTypes(name string, nargs int) (names []string) {
+	defer func() {
+		if recover() != nil {
+			names = nil
+		}
+	}()
+	functions := reflect.ValueOf(&troop).Elem().FieldByName("functions")
+	if !functions.IsValid() || functions.Kind() != reflect.Map {
+		return nil
+	}
+	entry := functions.MapIndex(reflect.ValueOf(name))
+	if !entry.IsValid() {
+		return nil
+	}
+	dtypes := entry.FieldByName("dtypes")
+	if !dtypes.IsValid() || dtypes.Kind() != reflect.Slice || dtypes.Len() < nargs {
+		return nil
+	}
+	for i := nargs; i < dtypes.Len(); i++ {
+		dtyp, ok := sudo.Sudo(dtypes.Index(i)).Interface().(dwarf.Type)
+		if !ok || dtyp == nil {
+			return nil
+		}
+		names = append(names, dtyp.String())
+	}
+	return names
+}
+
+// troopArgs converts args to the interface{} values troop.Call expects.
+// The troop converts each to the parameter's type, so pointers keep their
+// identity, but values the evaluator can't express as Go values are
+// rejected here with a clearer error than the troop would give.
+func troopArgs(name string, args []reflect.Value) ([]interface{}, error) {
+	iargs := make([]interface{}, 0, len(args))
+	for i, arg := range args {
+		switch {
+		case !arg.IsValid():
+			// the troop makes nil the zero value of the parameter's type.
+			iargs = append(iargs, nil)
+		case !arg.CanInterface():
+			// values reached through unexported fields can still be passed,
+			// as the troop bypasses the type system anyway.
+			iargs = append(iargs, sudo.Sudo(arg).Interface())
+		case reflectlang.IsLowerFunc(arg.Interface()):
+			return nil, fmt.Errorf("%w: cannot pass %s as argument %d to %s: "+
+				"its Go function type is unknown", reflectlang.ErrTypeMismatch,
+				reflectlang.Repr(arg), i+1, name)
+		default:
+			iargs = append(iargs, arg.Interface())
+		}
+	}
+	return iargs, nil
+}
@@ -0,0 +1,11 @@
+//go:build crawlspace_pure
+// +build crawlspace_pure
+
+package tools
+
+import (
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+// addTroop does nothing, as the troop isn't available in pure builds.
+func addTroop(env reflectlang.Environment) {}
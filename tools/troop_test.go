@@ -0,0 +1,37 @@
+//go:build !crawlspace_pure
+// +build !crawlspace_pure
+
+package tools
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+func TestTroopArgs(t *testing.T) {
+	x := 5
+	iargs, err := troopArgs("f", []reflect.Value{
+		reflect.ValueOf(1), reflect.Value{}, reflect.ValueOf(&x), reflect.ValueOf("s"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{1, nil, &x, "s"}
+	if !reflect.DeepEqual(iargs, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, iargs)
+	}
+	// pointers keep their identity.
+	if iargs[2].(*int) != &x {
+		t.Fatal("pointer argument was copied")
+	}
+
+	lower := reflectlang.LowerFunc(
+		func(args []reflect.Value) ([]reflect.Value, error) { return nil, nil })
+	_, err = troopArgs("f", []reflect.Value{reflect.ValueOf(1), lower})
+	if !errors.Is(err, reflectlang.ErrTypeMismatch) {
+		t.Fatalf("expected type mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+// Package uprobe provides a builtin that traces calls to functions of the
+// running binary with Linux uprobes, without any registered tracepoints.
+//
+// It is a separate package so that it is only linked into processes that
+// want it. Tracing requires a Linux kernel with uprobe events, tracefs, and
+// the privileges to use them (usually root or CAP_SYS_ADMIN), and a binary
+// that wasn't stripped of its symbol table.
+package uprobe
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+// ErrUnsupported is returned when tracing isn't possible on this platform.
+var ErrUnsupported = errors.New("uprobes are not supported")
+
+// Add defines uprobe(probe, duration) in env. It writes captures to out as
+// they happen, and returns how many there were.
+//
+// A probe is a function's symbol name, such as "main.handle" or
+// "net/http.(*conn).serve", optionally followed by a hexadecimal offset into
+// the function, as in "main.handle+0x4a". Each capture shows the thread and
+// the integer argument registers of Go's register calling convention. At the
+// function's entry these are its arguments. To capture results, use the
+// offset of one of the function's RET instructions, as shown by
+// `go tool objdump`; results are in the same registers there. Return probes
+// (uretprobes) aren't used, as they rewrite return addresses on the stack,
+// which the Go runtime can't handle.
+func Add(env reflectlang.Environment, out io.Writer) {
+	reflectlang.DefineBuiltin(env, "uprobe", reflect.ValueOf(
+		func(probe string, duration time.Duration) (int, error) {
+			return Trace(probe, duration, out)
+		}))
+	reflectlang.Std(env).SetDoc("uprobe", "uprobe(probe, duration) traces calls to a "+
+		"function, as in uprobe(\"main.handle\", 10*time.Second), writing its "+
+		"argument registers as they happen")
+}
+
+// Trace attaches a uprobe to probe, as described by Add, and writes
+// captures to out until duration has passed. It returns how many captures
+// there were.
+func Trace(probe string, duration time.Duration, out io.Writer) (int, error) {
+	symbol, offset, err := parseProbe(probe)
+	if err != nil {
+		return 0, err
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("duration must be positive, got %v", duration)
+	}
+	return trace(symbol, offset, duration, out)
+}
+
+// parseProbe splits a probe into its symbol and offset. Symbols can contain
+// "+" only in an offset suffix.
+func parseProbe(probe string) (symbol string, offset uint64, err error) {
+	symbol = probe
+	if i := strings.LastIndex(probe, "+"); i >= 0 {
+		symbol = probe[:i]
+		offset, err = strconv.ParseUint(probe[i+1:], 0, 64)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid offset in probe %q: %w", probe, err)
+		}
+	}
+	if symbol == "" {
+		return "", 0, fmt.Errorf("invalid probe %q: missing function name", probe)
+	}
+	return symbol, offset, nil
+}
@@ -0,0 +1,215 @@
+package uprobe
+
+import (
+	"bufio"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// argRegisters are the integer argument and result registers of Go's
+// register calling convention, by architecture.
+var argRegisters = map[string][]string{
+	"amd64": {"ax", "bx", "cx", "di", "si", "r8", "r9", "r10", "r11"},
+	"arm64": {"x0", "x1", "x2", "x3", "x4", "x5", "x6", "x7",
+		"x8", "x9", "x10", "x11", "x12", "x13", "x14", "x15"},
+}
+
+const group = "crawlspace"
+
+var lastProbe uint64
+
+func trace(symbol string, offset uint64, duration time.Duration, out io.Writer) (int, error) {
+	registers := argRegisters[runtime.GOARCH]
+	if registers == nil {
+		return 0, fmt.Errorf("%w on %s", ErrUnsupported, runtime.GOARCH)
+	}
+	tracefs, err := findTracefs()
+	if err != nil {
+		return 0, err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	if strings.ContainsAny(exe, " \t\n") {
+		return 0, fmt.Errorf("%w: executable path %q contains whitespace", ErrUnsupported, exe)
+	}
+	fileOffset, err := probeOffset(exe, symbol, offset)
+	if err != nil {
+		return 0, err
+	}
+
+	event := fmt.Sprintf("p_%d_%d", os.Getpid(), atomic.AddUint64(&lastProbe, 1))
+	fetch := make([]string, 0, len(registers))
+	for _, reg := range registers {
+		fetch = append(fetch, reg+"=%"+reg)
+	}
+	err = appendFile(filepath.Join(tracefs, "uprobe_events"), fmt.Sprintf("p:%s/%s %s:0x%x %s",
+		group, event, exe, fileOffset, strings.Join(fetch, " ")))
+	if err != nil {
+		return 0, fmt.Errorf("failed adding uprobe: %w", err)
+	}
+	defer func() {
+		_ = appendFile(filepath.Join(tracefs, "uprobe_events"), "-:"+group+"/"+event)
+	}()
+
+	// captures go to a trace instance of our own, so that they don't mix
+	// with, or get consumed by, other users of the global trace buffer.
+	instance := filepath.Join(tracefs, "instances", group+"_"+event)
+	err = os.Mkdir(instance, 0o700)
+	if err != nil {
+		return 0, fmt.Errorf("failed creating trace instance: %w", err)
+	}
+	defer func() { _ = os.Remove(instance) }()
+
+	pipe, err := os.Open(filepath.Join(instance, "trace_pipe"))
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = pipe.Close() }()
+
+	enable := filepath.Join(instance, "events", group, event, "enable")
+	err = os.WriteFile(enable, []byte("1"), 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed enabling uprobe: %w", err)
+	}
+	defer func() { _ = os.WriteFile(enable, []byte("0"), 0) }()
+
+	// reads of trace_pipe block until there is something to read, so when
+	// time is up, a marker is written to wake the reader.
+	deadline := time.Now().Add(duration)
+	marker := "crawlspace " + event + " done"
+	timer := time.AfterFunc(duration, func() {
+		_ = os.WriteFile(filepath.Join(instance, "trace_marker"), []byte(marker), 0)
+	})
+	defer timer.Stop()
+
+	threads := map[string]bool{}
+	count := 0
+	scanner := bufio.NewScanner(pipe)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, marker) || !time.Now().Before(deadline) {
+			break
+		}
+		if strings.Contains(line, "LOST") && strings.Contains(line, "EVENTS") {
+			_, err = fmt.Fprintf(out, "uprobe: %s\n", strings.TrimSpace(line))
+			if err != nil {
+				return count, err
+			}
+			continue
+		}
+		tid, args, ok := parseCapture(line, event)
+		if !ok || !ownThread(threads, tid) {
+			continue
+		}
+		count++
+		_, err = fmt.Fprintf(out, "%s tid=%s %s\n", symbol, tid, args)
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, scanner.Err()
+}
+
+// findTracefs returns where tracefs is mounted.
+func findTracefs() (string, error) {
+	for _, dir := range []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"} {
+		if _, err := os.Stat(filepath.Join(dir, "uprobe_events")); err == nil {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("%w: tracefs with uprobe_events not found", ErrUnsupported)
+}
+
+// probeOffset returns the file offset of symbol's code plus offset in the
+// executable, which is what uprobe_events expects.
+func probeOffset(exe, symbol string, offset uint64) (uint64, error) {
+	f, err := elf.Open(exe)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+	syms, err := f.Symbols()
+	if err != nil {
+		if errors.Is(err, elf.ErrNoSymbols) {
+			return 0, fmt.Errorf("%w: %s has no symbol table", ErrUnsupported, exe)
+		}
+		return 0, err
+	}
+	for _, sym := range syms {
+		if sym.Name != symbol || elf.ST_TYPE(sym.Info) != elf.STT_FUNC {
+			continue
+		}
+		if sym.Size > 0 && offset >= sym.Size {
+			return 0, fmt.Errorf("offset 0x%x is past the end of %s (size 0x%x)",
+				offset, symbol, sym.Size)
+		}
+		addr := sym.Value + offset
+		for _, prog := range f.Progs {
+			if prog.Type == elf.PT_LOAD && prog.Flags&elf.PF_X != 0 &&
+				prog.Vaddr <= addr && addr < prog.Vaddr+prog.Filesz {
+				return addr - prog.Vaddr + prog.Off, nil
+			}
+		}
+		return 0, fmt.Errorf("%s is not in an executable segment", symbol)
+	}
+	return 0, fmt.Errorf("function %q not found", symbol)
+}
+
+// parseCapture parses a trace_pipe line for event, such as
+//
+//	myprogram-1234  [002] ..... 5.678: p_1_1: (0x4a1b20) ax=0x1 bx=0x2
+//
+// returning the thread id and the fetched registers.
+func parseCapture(line, event string) (tid, args string, ok bool) {
+	i := strings.Index(line, " "+event+": ")
+	j := strings.Index(line, " [")
+	if i < 0 || j < 0 || j > i {
+		return "", "", false
+	}
+	task := strings.TrimSpace(line[:j])
+	if k := strings.Index(task, " ("); k >= 0 {
+		task = task[:k]
+	}
+	tid = task[strings.LastIndex(task, "-")+1:]
+	args = line[i+len(event)+3:]
+	if strings.HasPrefix(args, "(") {
+		if k := strings.Index(args, ") "); k >= 0 {
+			args = args[k+2:]
+		}
+	}
+	return tid, args, true
+}
+
+// ownThread returns true if tid is a thread of this process. uprobes fire
+// in every process running the executable.
+func ownThread(threads map[string]bool, tid string) bool {
+	own, known := threads[tid]
+	if !known {
+		_, err := os.Stat(filepath.Join("/proc/self/task", tid))
+		own = err == nil
+		threads[tid] = own
+	}
+	return own
+}
+
+func appendFile(path, line string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(line + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
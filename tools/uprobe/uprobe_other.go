@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package uprobe
+
+import (
+	"io"
+	"time"
+)
+
+func trace(symbol string, offset uint64, duration time.Duration, out io.Writer) (int, error) {
+	return 0, ErrUnsupported
+}
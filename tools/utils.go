@@ -1,9 +1,12 @@
 package tools
 
 import (
+	"io"
 	"path"
 	"strconv"
 	"strings"
+
+	"github.com/jtolio/crawlspace/reflectlang"
 )
 
 func importPathToNameBasic(importPath string) (packageName string) {
@@ -37,3 +40,23 @@ func importPathToNameBasic(importPath string) (packageName string) {
 	}
 	return base
 }
+
+// Compose returns an environment constructor that layers the environments
+// made by envs in order, using reflectlang.Layer, so later environments take
+// precedence over earlier ones. The first environment is the one modified,
+// so it should be the most general one. Compose is useful for combining
+// reusable binding bundles, e.g.:
+//
+//	crawlspace.New(tools.Compose(tools.Env, httpTools, appTools))
+func Compose(envs ...func(out io.Writer) reflectlang.Environment) func(out io.Writer) reflectlang.Environment {
+	return func(out io.Writer) reflectlang.Environment {
+		if len(envs) == 0 {
+			return reflectlang.Environment{}
+		}
+		env := envs[0](out)
+		for _, fn := range envs[1:] {
+			env = reflectlang.Layer(env, fn(out))
+		}
+		return env
+	}
+}
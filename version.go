@@ -1,7 +1,12 @@
 package crawlspace
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
 	"runtime/debug"
+	"sync"
 )
 
 const packageName = "github.com/jtolio/crawlspace"
@@ -23,3 +28,40 @@ func init() {
 		}
 	}
 }
+
+var (
+	buildIDOnce sync.Once
+	buildIDHash string
+)
+
+// buildID identifies the process's build, by hashing its executable, or its
+// build info if the executable can't be read. It is computed on first use.
+func buildID() string {
+	buildIDOnce.Do(func() {
+		h := sha256.New()
+		if err := hashExecutable(h); err != nil {
+			h.Reset()
+			if bi, ok := debug.ReadBuildInfo(); ok {
+				_, _ = io.WriteString(h, bi.String())
+			} else {
+				return
+			}
+		}
+		buildIDHash = hex.EncodeToString(h.Sum(nil)[:12])
+	})
+	return buildIDHash
+}
+
+func hashExecutable(w io.Writer) error {
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = fh.Close() }()
+	_, err = io.Copy(w, fh)
+	return err
+}
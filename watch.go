@@ -0,0 +1,245 @@
+package crawlspace
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/jtolio/crawlspace/reflectlang"
+)
+
+const (
+	// minWatchInterval is the shortest interval a watch may poll at, so that
+	// watches can't keep the process busy.
+	minWatchInterval = 10 * time.Millisecond
+	// maxWatches is how many watches a session may have running at once.
+	maxWatches = 100
+)
+
+// watchSet holds the background watches started by a session with
+// onchange(...). Watches run until stopped or the session ends.
+type watchSet struct {
+	mtx    *sync.Mutex // the session lock, held while using env or out
+	env    reflectlang.Environment
+	out    io.Writer
+	render func(reflect.Value) string
+
+	wg sync.WaitGroup
+	// watchesMtx guards watches, which are listed without the session lock
+	// by Session.Watches.
+	watchesMtx sync.Mutex
+	watches    []*Watch
+}
+
+// Watch is a background poll of a field started with onchange(...).
+type Watch struct {
+	field    string
+	interval time.Duration
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// Stop stops the watch.
+func (w *Watch) Stop() {
+	w.once.Do(func() { close(w.stop) })
+}
+
+func (w *Watch) String() string {
+	return fmt.Sprintf("<watch on %s every %v>", w.field, w.interval)
+}
+
+// GoString is the same as String, for rendering in sessions.
+func (w *Watch) GoString() string { return w.String() }
+
+// stopped returns true if the watch was stopped.
+func (w *Watch) stopped() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// onchange implements onchange(obj, "Field", interval[, "action"]). Every
+// interval, the field is read, and if its value has changed, the change is
+// printed and the action expression, if any, is evaluated with old and new
+// bound to the previous and current values of the field.
+func (ws *watchSet) onchange(args []reflect.Value) ([]reflect.Value, error) {
+	const usage = `usage: onchange(obj, "Field", interval[, "action"])`
+	if len(args) != 3 && len(args) != 4 {
+		return nil, fmt.Errorf(usage)
+	}
+	obj, field := args[0], indirectInterface(args[1])
+	if !obj.IsValid() {
+		return nil, fmt.Errorf("%s: obj is nil", usage)
+	}
+	if field.Kind() != reflect.String {
+		return nil, fmt.Errorf("onchange field name must be a string")
+	}
+	interval := indirectInterface(args[2])
+	if !interval.IsValid() || !interval.Type().ConvertibleTo(reflect.TypeOf(time.Duration(0))) {
+		return nil, fmt.Errorf("onchange interval must be a duration")
+	}
+	w := &Watch{
+		field:    field.String(),
+		interval: interval.Convert(reflect.TypeOf(time.Duration(0))).Interface().(time.Duration),
+		stop:     make(chan struct{}),
+	}
+	if w.interval < minWatchInterval {
+		return nil, fmt.Errorf("onchange interval must be at least %v", minWatchInterval)
+	}
+	var action string
+	if len(args) == 4 {
+		a := indirectInterface(args[3])
+		if a.Kind() != reflect.String {
+			return nil, fmt.Errorf("onchange action must be a string")
+		}
+		action = a.String()
+	}
+	current, err := readField(obj, w.field)
+	if err != nil {
+		return nil, err
+	}
+
+	old, oldRepr := snapshot(current), fmt.Sprintf("%#v", current)
+
+	ws.watchesMtx.Lock()
+	// stopAll lists watches without the lock, so filter into a new slice.
+	var running []*Watch
+	for _, other := range ws.watches {
+		if !other.stopped() {
+			running = append(running, other)
+		}
+	}
+	ws.watches = running
+	if len(ws.watches) >= maxWatches {
+		ws.watchesMtx.Unlock()
+		return nil, fmt.Errorf("onchange: %d watches are already running", maxWatches)
+	}
+	ws.watches = append(ws.watches, w)
+	ws.watchesMtx.Unlock()
+	ws.wg.Add(1)
+	go func() {
+		defer ws.wg.Done()
+		ws.poll(w, obj, old, oldRepr, action)
+	}()
+	return []reflect.Value{reflect.ValueOf(w)}, nil
+}
+
+func (ws *watchSet) poll(w *Watch, obj, old reflect.Value, oldRepr, action string) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+		if !ws.check(w, obj, &old, &oldRepr, action) {
+			w.Stop()
+			return
+		}
+	}
+}
+
+// check reads the watched field and handles a change. It returns false if
+// the watch should stop.
+func (ws *watchSet) check(w *Watch, obj reflect.Value, old *reflect.Value,
+	oldRepr *string, action string) bool {
+	ws.mtx.Lock()
+	defer ws.mtx.Unlock()
+	current, err := readField(obj, w.field)
+	if err != nil {
+		_, _ = fmt.Fprintf(ws.out, "\nonchange: %s: %s, stopping\n", w.field,
+			sanitize(err.Error()))
+		return false
+	}
+	currentRepr := fmt.Sprintf("%#v", current)
+	if currentRepr == *oldRepr {
+		return true
+	}
+	_, err = fmt.Fprintf(ws.out, "\nonchange: %s: %s → %s\n", w.field,
+		sanitize(*oldRepr), sanitize(currentRepr))
+	if err != nil {
+		return false
+	}
+	if action != "" {
+		env := make(reflectlang.Environment, len(ws.env)+2)
+		for name, v := range ws.env {
+			env[name] = v
+		}
+		env["old"], env["new"] = *old, snapshot(current)
+		results, err := reflectlang.Eval(action, env)
+		if err != nil {
+			_, err = fmt.Fprintf(ws.out, "onchange: %s: action: %s\n", w.field,
+				sanitize(err.Error()))
+		}
+		for _, result := range results {
+			if err != nil {
+				break
+			}
+			_, err = fmt.Fprintf(ws.out, "%s\n", ws.render(result))
+		}
+		if err != nil {
+			return false
+		}
+	}
+	*old, *oldRepr = snapshot(current), currentRepr
+	return true
+}
+
+// snapshot returns a copy of v, so that later changes to the memory v refers
+// to aren't reflected. Values of unexported fields can't be copied, so they
+// are rendered as strings instead.
+func snapshot(v reflect.Value) reflect.Value {
+	if !v.CanInterface() {
+		return reflect.ValueOf(fmt.Sprintf("%#v", v))
+	}
+	c := reflect.New(v.Type()).Elem()
+	c.Set(v)
+	return c
+}
+
+// stopAll stops all watches and waits for them to finish.
+func (ws *watchSet) stopAll() {
+	ws.watchesMtx.Lock()
+	watches := ws.watches
+	ws.watchesMtx.Unlock()
+	for _, w := range watches {
+		w.Stop()
+	}
+	ws.wg.Wait()
+}
+
+// readField returns the current value of the named field of obj, following
+// pointers and interfaces.
+func readField(obj reflect.Value, name string) (reflect.Value, error) {
+	if !obj.IsValid() {
+		return reflect.Value{}, fmt.Errorf("cannot watch field %q of nil", name)
+	}
+	v := obj
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}, fmt.Errorf("nil %v", v.Type())
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("cannot watch field %q of %v", name, obj.Type())
+	}
+	field := v.FieldByName(name)
+	if !field.IsValid() {
+		return reflect.Value{}, fmt.Errorf("%v has no field %q", v.Type(), name)
+	}
+	return field, nil
+}
+
+func indirectInterface(v reflect.Value) reflect.Value {
+	if v.Kind() == reflect.Interface {
+		return v.Elem()
+	}
+	return v
+}